@@ -2,12 +2,22 @@ package main
 
 import "os"
 import "log"
+import "embed"
+import "io/fs"
 
 import "github.com/maklesoft/padlock-cloud/padlockcloud"
 
+//go:embed assets
+var assets embed.FS
+
 func main() {
+	if sub, err := fs.Sub(assets, "assets"); err == nil {
+		padlockcloud.EmbeddedAssets = sub
+	}
+
 	err := padlockcloud.NewCliApp().Run(os.Args)
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		os.Exit(padlockcloud.ExitCode(err))
 	}
 }
@@ -0,0 +1,463 @@
+package padlockcloud
+
+import "errors"
+import "fmt"
+import "math"
+import "sort"
+import "strings"
+
+// Fetches all accounts from `storage`, sorted by email
+func ListAccounts(storage Storage) ([]*Account, error) {
+	iter, err := storage.Iterator(&Account{})
+	if err == ErrUnregisteredStorable {
+		// The memory storage returns this error if no accounts have been stored yet
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	var accounts []*Account
+	for iter.Next() {
+		acc := &Account{}
+		if err := iter.Get(acc); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, acc)
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Email < accounts[j].Email
+	})
+
+	return accounts, nil
+}
+
+// Settings applied to newly created accounts
+type DefaultAccountConfig struct {
+	// Number of email-sending requests per minute allowed for new accounts. Uses the default
+	// per-email quota if zero
+	RateLimit int `yaml:"rate_limit"`
+	// Number of bytes new accounts may store. Unlimited if zero
+	DataQuota int64 `yaml:"data_quota"`
+	// Tags added to new accounts
+	Tags map[string]string `yaml:"tags,omitempty"`
+}
+
+// Applies the defaults to `acc`, leaving any settings that have already been specified intact.
+// Does nothing if `c` is nil
+func (c *DefaultAccountConfig) Apply(acc *Account) {
+	if c == nil {
+		return
+	}
+	if acc.RateLimit == 0 {
+		acc.RateLimit = c.RateLimit
+	}
+	if acc.DataQuota == 0 {
+		acc.DataQuota = c.DataQuota
+	}
+	for k, v := range c.Tags {
+		if _, ok := acc.Tags[k]; ok {
+			continue
+		}
+		if acc.Tags == nil {
+			acc.Tags = make(map[string]string)
+		}
+		acc.Tags[k] = v
+	}
+}
+
+// Creates a new account with the given email
+func CreateAccount(storage Storage, email string) (*Account, error) {
+	return CreateAccountWithDefaults(storage, email, nil)
+}
+
+// Creates a new account with the given email, applying `defaults`. Returns `ErrAccountExists` if
+// an account with that email already exists
+func CreateAccountWithDefaults(storage Storage, email string, defaults *DefaultAccountConfig) (*Account, error) {
+	if _, err := GetAccount(storage, email); err == nil {
+		return nil, ErrAccountExists
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+	return UpsertAccountWithDefaults(storage, email, defaults)
+}
+
+// Like `CreateAccountWithDefaults`, but replaces an existing account with the same email instead
+// of failing. The replaced account loses its auth tokens and settings; its data is kept
+func UpsertAccountWithDefaults(storage Storage, email string, defaults *DefaultAccountConfig) (*Account, error) {
+	acc := &Account{Email: email}
+	defaults.Apply(acc)
+	if err := storage.Put(acc); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// Fetches the account with the given email. Returns `ErrNotFound` if no such account exists
+func GetAccount(storage Storage, email string) (*Account, error) {
+	acc := &Account{Email: email}
+	if err := storage.Get(acc); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// Removes the data associated with the account with the given email while leaving the account itself
+// intact. Returns `ErrNotFound` if no such account exists
+func ResetAccountData(storage Storage, email string) error {
+	acc, err := GetAccount(storage, email)
+	if err != nil {
+		return err
+	}
+	ops, err := resetAccountDataOps(storage, acc)
+	if err != nil {
+		return err
+	}
+	return storage.Batch(ops)
+}
+
+// Writes for removing the data store, vaults and stored versions of `acc`
+func resetAccountDataOps(storage Storage, acc *Account) ([]BatchOp, error) {
+	ops, err := deleteVaultOps(storage, acc.Email)
+	if err != nil {
+		return nil, err
+	}
+	return append(ops, DeleteOp(&DataStore{Account: acc}), DeleteOp(&DataHistory{Email: acc.Email})), nil
+}
+
+// Number of bytes stored for an account
+type StorageUsage struct {
+	// Combined size of the data store and all named vaults
+	Bytes int64 `json:"bytes"`
+	// Size of each named vault
+	Vaults map[string]int64 `json:"vaults,omitempty"`
+	// The account's data quota, if it has one
+	Quota *StorageQuota `json:"quota,omitempty"`
+}
+
+// Data quota of an account along with how much of it is used
+type StorageQuota struct {
+	// Maximum number of bytes, as set in `Account.DataQuota`
+	Limit int64 `json:"limit"`
+	// Percentage of the limit used, which may exceed 100 if the quota was lowered after storing data
+	PercentUsed float64 `json:"percentUsed"`
+}
+
+// Sets `Quota` to the given limit. Does nothing if `limit` is not positive
+func (u *StorageUsage) setQuota(limit int64) {
+	if limit <= 0 {
+		return
+	}
+	u.Quota = &StorageQuota{
+		Limit:       limit,
+		PercentUsed: math.Round(float64(u.Bytes)/float64(limit)*10000) / 100,
+	}
+}
+
+// Computes the number of bytes currently stored for the account with the given email. Sizes are
+// taken from the stored values without loading their contents, so they may include the storage's
+// compression and encryption overhead. Previous versions kept for rolling back are not included
+func GetStorageUsage(storage Storage, email string) (*StorageUsage, error) {
+	usage := &StorageUsage{}
+
+	// Other accounts' emails may start with this one, so only the exact key is counted
+	if err := storage.ListPrefixFunc(&DataStore{}, email, func(key string, size int) error {
+		if key == email {
+			usage.Bytes += int64(size)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	prefix := email + "/"
+	if err := storage.ListPrefixFunc(&Vault{}, prefix, func(key string, size int) error {
+		name := strings.TrimPrefix(key, prefix)
+		if !ValidVaultName(name) {
+			return nil
+		}
+		if usage.Vaults == nil {
+			usage.Vaults = make(map[string]int64)
+		}
+		usage.Vaults[name] = int64(size)
+		usage.Bytes += int64(size)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// Computes the number of bytes stored for each account in a single pass over all data stores and
+// vaults, measured like `GetStorageUsage`. Accounts without any data are omitted
+func StorageUsageByAccount(storage Storage) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+
+	if err := storage.ListPrefixFunc(&DataStore{}, "", func(key string, size int) error {
+		sizes[key] += int64(size)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := storage.ListPrefixFunc(&Vault{}, "", func(key string, size int) error {
+		if v := vaultFromKey(key); ValidVaultName(v.Name) {
+			sizes[v.Email] += int64(size)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return sizes, nil
+}
+
+// Sets the number of email-sending requests per minute allowed for the account with the given
+// email, replacing the default per-email quota. A value of 0 restores the default. Returns
+// `ErrNotFound` if no such account exists
+func SetAccountRateLimit(storage Storage, email string, perMin int) error {
+	acc, err := GetAccount(storage, email)
+	if err != nil {
+		return err
+	}
+	acc.RateLimit = perMin
+	return storage.Put(acc)
+}
+
+// Suspends or reinstates the account with the given email. `reason` is shown to the user and
+// cleared when reinstating. Returns `ErrNotFound` if no such account exists
+func SetAccountSuspended(storage Storage, email string, suspended bool, reason string) error {
+	acc, err := GetAccount(storage, email)
+	if err != nil {
+		return err
+	}
+	acc.Suspended = suspended
+	acc.SuspendedReason = ""
+	if suspended {
+		acc.SuspendedReason = reason
+	}
+	return storage.Put(acc)
+}
+
+// Removes all auth tokens from the account with the given email, forcing every device to
+// authenticate again. Returns the number of revoked tokens or `ErrNotFound` if no such account exists
+func RevokeAuthTokens(storage Storage, email string) (int, error) {
+	acc, err := GetAccount(storage, email)
+	if err != nil {
+		return 0, err
+	}
+	n := len(acc.AuthTokens)
+	acc.AuthTokens = nil
+	return n, storage.Put(acc)
+}
+
+// Adds the given tags to the account with the given email, replacing existing values for the
+// same keys. Returns `ErrNotFound` if no such account exists
+func TagAccount(storage Storage, email string, tags map[string]string) error {
+	acc, err := GetAccount(storage, email)
+	if err != nil {
+		return err
+	}
+	if acc.Tags == nil {
+		acc.Tags = make(map[string]string)
+	}
+	for k, v := range tags {
+		acc.Tags[k] = v
+	}
+	return storage.Put(acc)
+}
+
+// Removes the tags with the given keys from the account with the given email. Returns
+// `ErrNotFound` if no such account exists
+func UntagAccount(storage Storage, email string, keys []string) error {
+	acc, err := GetAccount(storage, email)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		delete(acc.Tags, k)
+	}
+	return storage.Put(acc)
+}
+
+// Deletes the account with the given email along with its data, named vaults and any stored
+// versions of its data
+func DeleteAccount(storage Storage, email string) error {
+	ops, err := deleteAccountOps(storage, email)
+	if err != nil {
+		return err
+	}
+	return storage.Batch(ops)
+}
+
+// Writes for removing the account with the given email, as described in `DeleteAccount`
+func deleteAccountOps(storage Storage, email string) ([]BatchOp, error) {
+	ops, err := deleteVaultOps(storage, email)
+	if err != nil {
+		return nil, err
+	}
+	return append(ops,
+		DeleteOp(&DataStore{Account: &Account{Email: email}}),
+		DeleteOp(&DataHistory{Email: email}),
+		DeleteOp(&Account{Email: email}),
+	), nil
+}
+
+// Returned by `EraseAccount` if records of the account are still present after erasing it
+var ErrEraseIncomplete = errors.New("padlock: account records still present after erasing")
+
+// Permanently removes everything stored for the account with the given email: the account along
+// with its auth tokens, its data, named vaults and stored versions, pending auth requests and any
+// copy kept in the trash. Unlike `DeleteAccount`, this also covers accounts that only exist in the
+// trash. Returns `ErrNotFound` if there is neither, and an error wrapping `ErrEraseIncomplete` if
+// any records are still found afterwards
+func EraseAccount(storage Storage, email string) error {
+	_, accErr := GetAccount(storage, email)
+	if accErr != nil && accErr != ErrNotFound {
+		return accErr
+	}
+	trashed := &TrashedAccount{Account: &Account{Email: email}}
+	trashErr := storage.Get(trashed)
+	if trashErr != nil && trashErr != ErrNotFound {
+		return trashErr
+	}
+	if accErr == ErrNotFound && trashErr == ErrNotFound {
+		return ErrNotFound
+	}
+
+	ops, err := deleteAccountOps(storage, email)
+	if err != nil {
+		return err
+	}
+	ops = append(ops, DeleteOp(trashed))
+
+	requests, err := authRequestsFor(storage, email)
+	if err != nil {
+		return err
+	}
+	for _, ar := range requests {
+		ops = append(ops, deleteAuthRequestOps(ar)...)
+	}
+
+	if err := storage.Batch(ops); err != nil {
+		return err
+	}
+
+	return verifyErased(storage, email)
+}
+
+// Checks that no records of the account with the given email are left
+func verifyErased(storage Storage, email string) error {
+	acc := &Account{Email: email}
+	for what, t := range map[string]Storable{
+		"account":  acc,
+		"data":     &DataStore{Account: acc},
+		"versions": &DataHistory{Email: email},
+		"trash":    &TrashedAccount{Account: acc},
+	} {
+		if err := storage.Get(t); err == nil {
+			return fmt.Errorf("%w: %s", ErrEraseIncomplete, what)
+		} else if err != ErrNotFound {
+			return err
+		}
+	}
+
+	if names, err := ListVaults(storage, email); err != nil {
+		return err
+	} else if len(names) != 0 {
+		return fmt.Errorf("%w: vaults", ErrEraseIncomplete)
+	}
+
+	if requests, err := authRequestsFor(storage, email); err != nil {
+		return err
+	} else if len(requests) != 0 {
+		return fmt.Errorf("%w: auth requests", ErrEraseIncomplete)
+	}
+
+	return nil
+}
+
+// Returns all auth requests made for the given email, including expired ones
+func authRequestsFor(storage Storage, email string) ([]*AuthRequest, error) {
+	iter, err := storage.Iterator(&AuthRequest{})
+	if err == ErrUnregisteredStorable {
+		// The memory storage returns this error if no auth requests have been stored yet
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	var requests []*AuthRequest
+	for iter.Next() {
+		ar := &AuthRequest{}
+		if err := iter.Get(ar); err != nil {
+			return nil, err
+		}
+		if ar.AuthToken != nil && ar.AuthToken.Email == email {
+			requests = append(requests, ar)
+		}
+	}
+
+	return requests, nil
+}
+
+// Changes the email of an account, moving the account record along with its auth tokens and
+// data to the new email. All changes are applied in a single batch, so an interrupted rename
+// never leaves the account split between both emails. Returns `ErrAccountExists` if an account
+// with the new email already exists
+func RenameAccount(storage Storage, oldEmail string, newEmail string) error {
+	acc, err := GetAccount(storage, oldEmail)
+	if err != nil {
+		return err
+	}
+
+	if _, err := GetAccount(storage, newEmail); err == nil {
+		return ErrAccountExists
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	data := &DataStore{Account: acc}
+	hasData := true
+	if err := storage.Get(data); err == ErrNotFound {
+		hasData = false
+	} else if err != nil {
+		return err
+	}
+
+	renamed := *acc
+	renamed.Email = newEmail
+	renamed.AuthTokens = make([]*AuthToken, len(acc.AuthTokens))
+	for i, t := range acc.AuthTokens {
+		token := *t
+		token.Email = newEmail
+		renamed.AuthTokens[i] = &token
+	}
+
+	var ops []BatchOp
+	if hasData {
+		ops = append(ops, PutOp(&DataStore{Account: &renamed, Content: data.Content}))
+	}
+
+	vaults, err := GetVaults(storage, oldEmail)
+	if err != nil {
+		return err
+	}
+	ops = append(ops, putVaultOps(newEmail, vaults)...)
+
+	if versions, err := ListDataVersions(storage, oldEmail); err != nil {
+		return err
+	} else if versions != nil {
+		ops = append(ops, PutOp(&DataHistory{Email: newEmail, Versions: versions}))
+	}
+
+	deleteOps, err := deleteAccountOps(storage, oldEmail)
+	if err != nil {
+		return err
+	}
+
+	return storage.Batch(append(append(ops, deleteOps...), PutOp(&renamed)))
+}
@@ -0,0 +1,387 @@
+package padlockcloud
+
+import "errors"
+import "net/http"
+import "reflect"
+import "testing"
+import "time"
+
+func TestRenameAccount(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	newEmail := "new@padlock.io"
+
+	acc, err := CreateAccount(storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewAuthToken(testEmail, "api", DefaultTokenBytes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.Expires = token.Created.AddDate(1, 0, 0)
+	acc.AddAuthToken(token)
+	if err := storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&DataStore{Account: acc, Content: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		if err := RenameAccount(storage, testEmail, newEmail); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := GetAccount(storage, testEmail); err != ErrNotFound {
+			t.Fatalf("Expected old account to be removed, got %v", err)
+		}
+		if err := storage.Get(&DataStore{Account: &Account{Email: testEmail}}); err != ErrNotFound {
+			t.Fatalf("Expected old data to be removed, got %v", err)
+		}
+
+		renamed, err := GetAccount(storage, newEmail)
+		if err != nil {
+			t.Fatalf("Expected renamed account to exist, got %v", err)
+		}
+		if len(renamed.AuthTokens) != 1 || renamed.AuthTokens[0].Token != token.Token || renamed.AuthTokens[0].Email != newEmail {
+			t.Fatalf("Expected auth tokens to be moved to new email, got %+v", renamed.AuthTokens)
+		}
+
+		data := &DataStore{Account: renamed}
+		if err := storage.Get(data); err != nil || string(data.Content) != "data" {
+			t.Fatalf("Expected data to be moved to new email, got %v", err)
+		}
+	})
+
+	t.Run("target exists", func(t *testing.T) {
+		if _, err := CreateAccount(storage, testEmail); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := RenameAccount(storage, newEmail, testEmail); err != ErrAccountExists {
+			t.Fatalf("Expected account exists error, got %v", err)
+		}
+
+		// Neither account should have been modified
+		if acc, err := GetAccount(storage, newEmail); err != nil || len(acc.AuthTokens) != 1 {
+			t.Fatalf("Expected source account to be untouched, got %v", err)
+		}
+		if acc, err := GetAccount(storage, testEmail); err != nil || len(acc.AuthTokens) != 0 {
+			t.Fatalf("Expected target account to be untouched, got %v", err)
+		}
+	})
+
+	t.Run("source missing", func(t *testing.T) {
+		if err := RenameAccount(storage, "unknown@padlock.io", "other@padlock.io"); err != ErrNotFound {
+			t.Fatalf("Expected not found error, got %v", err)
+		}
+	})
+}
+
+func TestSetAccountRateLimit(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if err := SetAccountRateLimit(storage, testEmail, 10); err == nil {
+		t.Fatal("Expected error for non-existing account")
+	}
+
+	if _, err := CreateAccount(storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetAccountRateLimit(storage, testEmail, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err := GetAccount(storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.RateLimit != 10 {
+		t.Errorf("Expected rate limit to be 10, is %d", acc.RateLimit)
+	}
+
+	rl, _ := NewEmailRateLimiter(nil, RateQuota{PerMin(1), 0}, RateQuota{PerMin(1), 0})
+	rl.Storage = storage
+	if perMin := rl.accountRateLimit(testEmail); perMin != 10 {
+		t.Errorf("Expected rate limiter to pick up override of 10, got %d", perMin)
+	}
+	if perMin := rl.accountRateLimit("unknown@padlock.io"); perMin != 0 {
+		t.Errorf("Expected no override for unknown account, got %d", perMin)
+	}
+}
+
+func TestAccountTags(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if err := TagAccount(storage, testEmail, map[string]string{"plan": "pro"}); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for non-existing account, got %v", err)
+	}
+
+	if _, err := CreateAccount(storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := TagAccount(storage, testEmail, map[string]string{"plan": "free", "region": "eu"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := TagAccount(storage, testEmail, map[string]string{"plan": "pro"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tags should be preserved across other updates
+	if err := SetAccountRateLimit(storage, testEmail, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err := GetAccount(storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.Tags) != 2 || acc.Tags["plan"] != "pro" || acc.Tags["region"] != "eu" {
+		t.Errorf("Unexpected tags: %v", acc.Tags)
+	}
+
+	for _, c := range []struct {
+		filter  map[string]string
+		matches bool
+	}{
+		{nil, true},
+		{map[string]string{"plan": "pro"}, true},
+		{map[string]string{"plan": ""}, true},
+		{map[string]string{"plan": "pro", "region": "eu"}, true},
+		{map[string]string{"plan": "free"}, false},
+		{map[string]string{"plan": "pro", "team": ""}, false},
+	} {
+		if acc.HasTags(c.filter) != c.matches {
+			t.Errorf("%v: Expected match to be %v", c.filter, c.matches)
+		}
+	}
+
+	if err := UntagAccount(storage, testEmail, []string{"plan", "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+	if acc, err = GetAccount(storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.Tags) != 1 || acc.Tags["region"] != "eu" {
+		t.Errorf("Expected only the region tag to remain, got %v", acc.Tags)
+	}
+}
+
+func TestRevokeAuthTokens(t *testing.T) {
+	ctx := newServerTestContext()
+
+	if _, err := RevokeAuthTokens(ctx.storage, testEmail); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for non-existing account, got %v", err)
+	}
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ctx.request("GET", ctx.host+"/authtestapi/", "", ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "")
+
+	acc, err := GetAccount(ctx.storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := len(acc.AuthTokens)
+
+	n, err := RevokeAuthTokens(ctx.storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != count {
+		t.Errorf("Expected %d revoked tokens, got %d", count, n)
+	}
+
+	if acc, err = GetAccount(ctx.storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.AuthTokens) != 0 {
+		t.Errorf("Expected account to have no auth tokens, has %d", len(acc.AuthTokens))
+	}
+
+	// Previously valid token should now be rejected
+	res, err = ctx.request("GET", ctx.host+"/authtestapi/", "", ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &InvalidAuthToken{})
+}
+
+func TestCreateAccountWithDefaults(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	defaults := &DefaultAccountConfig{RateLimit: 30, DataQuota: 1000, Tags: map[string]string{"plan": "free"}}
+	if _, err := CreateAccountWithDefaults(storage, testEmail, defaults); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err := GetAccount(storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.RateLimit != 30 || acc.DataQuota != 1000 || !reflect.DeepEqual(acc.Tags, map[string]string{"plan": "free"}) {
+		t.Errorf("Expected account to inherit defaults, got rate limit %d, data quota %d and tags %v", acc.RateLimit, acc.DataQuota, acc.Tags)
+	}
+
+	// Changing the defaults shouldn't affect existing accounts
+	defaults.Tags["plan"] = "pro"
+	if acc, err = GetAccount(storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if acc.Tags["plan"] != "free" {
+		t.Errorf("Expected existing account to keep its tags, got %v", acc.Tags)
+	}
+
+	// Creating the same account again should fail rather than replace it
+	if _, err := CreateAccountWithDefaults(storage, testEmail, defaults); err != ErrAccountExists {
+		t.Errorf("Expected account exists error, got %v", err)
+	}
+
+	// Explicitly specified settings take precedence
+	acc = &Account{RateLimit: 100, DataQuota: 5000, Tags: map[string]string{"plan": "team"}}
+	defaults.Tags["region"] = "eu"
+	defaults.Apply(acc)
+	if acc.RateLimit != 100 || acc.DataQuota != 5000 || !reflect.DeepEqual(acc.Tags, map[string]string{"plan": "team", "region": "eu"}) {
+		t.Errorf("Expected explicit settings to be kept, got rate limit %d and tags %v", acc.RateLimit, acc.Tags)
+	}
+}
+
+func TestEraseAccount(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	for _, email := range []string{testEmail, "other@padlock.io"} {
+		acc := &Account{Email: email, AuthTokens: []*AuthToken{{Token: "token-" + email, Id: "id-" + email, Email: email}}}
+		if err := storage.Put(acc); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(&DataStore{Account: acc, Content: []byte(testData)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := PutVaults(storage, email, map[string][]byte{"work": []byte("work data")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := RecordDataVersion(storage, email, []byte("old data"), 5, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(&AuthRequest{Token: "request-" + email, AuthToken: &AuthToken{Email: email}, Created: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := EraseAccount(storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing should be left of the erased account
+	if err := verifyErased(storage, testEmail); err != nil {
+		t.Errorf("Expected all records to be removed, got %v", err)
+	}
+
+	// Other accounts should be untouched
+	if _, err := GetAccount(storage, "other@padlock.io"); err != nil {
+		t.Errorf("Expected other account to be kept, got %v", err)
+	}
+	if requests, err := authRequestsFor(storage, "other@padlock.io"); err != nil || len(requests) != 1 {
+		t.Errorf("Expected auth request of other account to be kept, got %d, %v", len(requests), err)
+	}
+
+	if err := EraseAccount(storage, testEmail); err != ErrNotFound {
+		t.Errorf("Expected not found error for erased account, got %v", err)
+	}
+
+	// Accounts that are only in the trash should be erased as well
+	if err := TrashAccount(storage, "other@padlock.io", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := EraseAccount(storage, "other@padlock.io"); err != nil {
+		t.Fatal(err)
+	}
+	if trashed, _ := ListTrash(storage); len(trashed) != 0 {
+		t.Errorf("Expected trash to be empty, got %d", len(trashed))
+	}
+	if err := verifyErased(storage, "other@padlock.io"); err != nil {
+		t.Errorf("Expected all records to be removed, got %v", err)
+	}
+}
+
+func TestVerifyErased(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if err := storage.Put(&DataStore{Account: &Account{Email: testEmail}, Content: []byte(testData)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyErased(storage, testEmail); !errors.Is(err, ErrEraseIncomplete) {
+		t.Errorf("Expected remaining data to be detected, got %v", err)
+	}
+}
+
+func TestGetStorageUsage(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	// Data of an account whose email starts with the same characters shouldn't be counted
+	for _, s := range []Storable{
+		&DataStore{Account: &Account{Email: testEmail}, Content: []byte("data")},
+		&DataStore{Account: &Account{Email: testEmail + "m"}, Content: []byte("other data")},
+		&Vault{Email: testEmail, Name: "work", Content: []byte("work data")},
+		&Vault{Email: testEmail + "m", Name: "work", Content: []byte("other work data")},
+	} {
+		if err := storage.Put(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := GetStorageUsage(storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &StorageUsage{Bytes: 13, Vaults: map[string]int64{"work": 9}}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, usage)
+	}
+
+	// Usage of all accounts should match that of each account
+	sizes, err := StorageUsageByAccount(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]int64{testEmail: 13, testEmail + "m": 25}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Expected %v, got %v", expected, sizes)
+	}
+}
@@ -0,0 +1,389 @@
+package padlockcloud
+
+import "net/http"
+import "encoding/json"
+import "strconv"
+import "strings"
+import "time"
+import "crypto/subtle"
+
+// Admin api configuration
+type AdminConfig struct {
+	// Address the admin api should listen on, e.g. "localhost:3001". The admin api is disabled if empty
+	Addr string `yaml:"addr"`
+	// Key used for authenticating requests to the admin api via the `Authorization: Bearer <key>` header
+	Key string `yaml:"key"`
+	// File to read `Key` from instead
+	KeyFile string `yaml:"key_file"`
+}
+
+// Default number of accounts returned by the admin account list endpoint
+const adminDefaultPageSize = 50
+
+// Representation of an auth token in admin api responses. Omits the actual token value
+type adminAuthToken struct {
+	Id             string    `json:"id"`
+	Type           string    `json:"type"`
+	Created        time.Time `json:"created"`
+	LastUsed       time.Time `json:"lastUsed"`
+	Expires        time.Time `json:"expires"`
+	ClientVersion  string    `json:"clientVersion"`
+	ClientPlatform string    `json:"clientPlatform"`
+	DeviceName     string    `json:"deviceName"`
+	IP             string    `json:"ip"`
+	UserAgent      string    `json:"userAgent"`
+	Location       string    `json:"location"`
+	LastIP         string    `json:"lastIp"`
+}
+
+// Representation of an account in admin api responses
+type adminAccount struct {
+	Email      string            `json:"email"`
+	Created    time.Time         `json:"created"`
+	Updated    time.Time         `json:"updated"`
+	AuthTokens []*adminAuthToken `json:"authTokens"`
+}
+
+func newAdminAccount(acc *Account) *adminAccount {
+	a := &adminAccount{
+		Email:      acc.Email,
+		Created:    acc.Created,
+		Updated:    acc.Updated,
+		AuthTokens: []*adminAuthToken{},
+	}
+	for _, t := range acc.AuthTokens {
+		a.AuthTokens = append(a.AuthTokens, &adminAuthToken{
+			Id:             t.Id,
+			Type:           t.Type,
+			Created:        t.Created,
+			LastUsed:       t.LastUsed,
+			Expires:        t.Expires,
+			ClientVersion:  t.ClientVersion,
+			ClientPlatform: t.ClientPlatform,
+			DeviceName:     t.DeviceName,
+			IP:             t.IP,
+			UserAgent:      t.UserAgent,
+			Location:       t.Location,
+			LastIP:         t.LastIP,
+		})
+	}
+	return a
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+
+	return nil
+}
+
+// Checks the `Authorization` header for the configured admin key
+type AdminAuthenticate struct {
+	*Server
+}
+
+func (m *AdminAuthenticate) Wrap(h Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+		key := m.Config.Admin.Key
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if key == "" || subtle.ConstantTimeCompare([]byte(given), []byte(key)) != 1 {
+			return &InvalidAuthToken{}
+		}
+
+		return h.Handle(w, r, auth)
+	})
+}
+
+type AdminListAccounts struct {
+	*Server
+}
+
+// Lists accounts. Supports paging via the `offset` and `limit` query parameters
+func (h *AdminListAccounts) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	offset, limit := 0, adminDefaultPageSize
+	var err error
+
+	if o := r.URL.Query().Get("offset"); o != "" {
+		if offset, err = strconv.Atoi(o); err != nil || offset < 0 {
+			return &BadRequest{"invalid offset"}
+		}
+	}
+
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			return &BadRequest{"invalid limit"}
+		}
+	}
+
+	accounts, err := ListAccounts(h.Storage)
+	if err != nil {
+		return err
+	}
+
+	total := len(accounts)
+	page := []*adminAccount{}
+	for i := offset; i < total && i < offset+limit; i++ {
+		page = append(page, newAdminAccount(accounts[i]))
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"accounts": page,
+		"total":    total,
+		"offset":   offset,
+		"limit":    limit,
+	})
+}
+
+type AdminCreateAccount struct {
+	*Server
+}
+
+// Creates a new account. Expects an `email` parameter
+func (h *AdminCreateAccount) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	email := r.PostFormValue("email")
+	if email == "" {
+		return &BadRequest{"no email provided"}
+	}
+
+	acc, err := CreateAccountWithDefaults(h.Storage, email, &h.Config.DefaultAccount)
+	if err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - admin:account:create - %s\n", FormatRequest(r), email)
+	h.audit(r, "account:create", email, "admin")
+
+	return writeJSON(w, http.StatusCreated, newAdminAccount(acc))
+}
+
+// Extracts the account email from urls of the form /admin/accounts/{email}
+func adminEmailFromPath(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, "/admin/accounts/")
+}
+
+type AdminGetAccount struct {
+	*Server
+}
+
+func (h *AdminGetAccount) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	email := adminEmailFromPath(r)
+
+	acc, err := GetAccount(h.Storage, email)
+	if err == ErrNotFound {
+		return &AccountNotFound{email}
+	} else if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, newAdminAccount(acc))
+}
+
+type AdminDeleteAccount struct {
+	*Server
+}
+
+func (h *AdminDeleteAccount) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	email := adminEmailFromPath(r)
+
+	if _, err := GetAccount(h.Storage, email); err == ErrNotFound {
+		return &AccountNotFound{email}
+	} else if err != nil {
+		return err
+	}
+
+	if err := h.Server.DeleteAccount(email); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - admin:account:delete - %s\n", FormatRequest(r), email)
+	h.audit(r, "account:delete", email, "admin")
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+type AdminResetRateLimit struct {
+	*Server
+}
+
+// Clears the rate limits of the ip address or email given in urls of the form
+// /admin/ratelimits/{key}
+func (h *AdminResetRateLimit) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	key := strings.TrimPrefix(r.URL.Path, "/admin/ratelimits/")
+	if key == "" {
+		return &BadRequest{"no key provided"}
+	}
+
+	if err := h.emailRateLimiter.Reset(key); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - admin:ratelimit:reset - %s\n", FormatRequest(r), key)
+	h.audit(r, "ratelimit:reset", key, "admin")
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+type AdminMetrics struct {
+	*Server
+}
+
+// Returns the current values of operational gauges like open connections and goroutines
+func (h *AdminMetrics) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	return writeJSON(w, http.StatusOK, h.MetricsSnapshot())
+}
+
+type AdminBackup struct {
+	*Server
+}
+
+// Creates a backup at the configured destination and returns its details
+func (h *AdminBackup) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	if h.Backuper == nil {
+		return &FeatureDisabled{"Backup"}
+	}
+
+	info, err := h.Backuper.Create()
+	if err == ErrBackupInProgress {
+		return &BackupInProgress{}
+	} else if err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - admin:backup - %s\n", FormatRequest(r), info.Name)
+
+	return writeJSON(w, http.StatusOK, struct {
+		*BackupInfo
+		Status string `json:"status"`
+	}{info, "completed"})
+}
+
+type AdminDownloadBackup struct {
+	*Server
+}
+
+// Streams a backup of the current database contents in the response body. Used by the cli for
+// backing up a running server, which holds the lock on the database
+func (h *AdminDownloadBackup) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	storage, ok := unwrapStorage(h.Storage).(Backupable)
+	if !ok {
+		return &FeatureDisabled{"Backup"}
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.WriteHeader(http.StatusOK)
+
+	// The status has already been sent, so errors can only be logged. The client notices the
+	// truncated archive
+	if err := storage.Backup(w); err != nil {
+		h.LogError(err, r)
+		return nil
+	}
+
+	h.Info.Printf("%s - admin:backup:download\n", FormatRequest(r))
+	return nil
+}
+
+// Wraps an admin endpoint in the appropriate middleware
+func (server *Server) WrapAdminEndpoint(endpoint *Endpoint) Handler {
+	var h Handler = endpoint
+
+	h = (&AdminAuthenticate{server}).Wrap(h)
+
+	h = (&CheckStarting{server}).Wrap(h)
+
+	h = (&CheckMethod{endpoint.Handlers}).Wrap(h)
+
+	h = (&HandlePanic{}).Wrap(h)
+
+	h = (&HandleError{server}).Wrap(h)
+
+	return h
+}
+
+// Creates the handler for the admin api
+func (server *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	endpoints := map[string]*Endpoint{
+		"/admin/accounts": &Endpoint{
+			Handlers: map[string]Handler{
+				"GET":  &AdminListAccounts{server},
+				"POST": &AdminCreateAccount{server},
+			},
+		},
+		"/admin/accounts/": &Endpoint{
+			Handlers: map[string]Handler{
+				"GET":    &AdminGetAccount{server},
+				"DELETE": &AdminDeleteAccount{server},
+			},
+		},
+		"/admin/ratelimits/": &Endpoint{
+			Handlers: map[string]Handler{
+				"DELETE": &AdminResetRateLimit{server},
+			},
+		},
+		"/admin/metrics": &Endpoint{
+			Handlers: map[string]Handler{
+				"GET": &AdminMetrics{server},
+			},
+		},
+		"/admin/backup": &Endpoint{
+			Handlers: map[string]Handler{
+				"GET":  &AdminDownloadBackup{server},
+				"POST": &AdminBackup{server},
+			},
+		},
+	}
+
+	for key, endpoint := range endpoints {
+		mux.Handle(key, HttpHandler(server.WrapAdminEndpoint(endpoint)))
+	}
+	mux.Handle("/", server.NotFoundHandler())
+
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The admin api always responds with JSON, including errors
+		r.Header.Set("Accept", "application/json")
+		mux.ServeHTTP(w, r)
+	})
+
+	// Cross-origin requests are rejected unless a policy for the admin paths allows them
+	if server.Config.Cors {
+		h = server.Cors(h)
+	}
+
+	return h
+}
+
+// Starts the admin api in the background if an address is configured
+func (server *Server) StartAdmin() error {
+	if server.Config.Admin.Addr == "" {
+		return nil
+	}
+
+	server.admin = &http.Server{
+		Addr:     server.Config.Admin.Addr,
+		Handler:  server.AdminHandler(),
+		ErrorLog: server.Error,
+	}
+
+	server.Info.Printf("Starting admin api on %s", server.Config.Admin.Addr)
+
+	go func() {
+		if err := server.admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			server.Error.Println("Admin api stopped unexpectedly:", err)
+		}
+	}()
+
+	return nil
+}
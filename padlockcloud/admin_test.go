@@ -0,0 +1,122 @@
+package padlockcloud
+
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "strings"
+import "encoding/json"
+
+const testAdminKey = "adminkey"
+
+func adminRequest(host string, method string, path string, body string, key string) (*http.Response, error) {
+	req, err := http.NewRequest(method, host+path, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestAdminApi(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.Admin.Key = testAdminKey
+	admin := httptest.NewServer(ctx.server.AdminHandler())
+	defer admin.Close()
+
+	var res *http.Response
+	var err error
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		for _, key := range []string{"", "wrongkey"} {
+			if res, err = adminRequest(admin.URL, "GET", "/admin/accounts", "", key); err != nil {
+				t.Fatal(err)
+			}
+			testError(t, res, &InvalidAuthToken{})
+
+			if res, err = adminRequest(admin.URL, "DELETE", "/admin/accounts/"+testEmail, "", key); err != nil {
+				t.Fatal(err)
+			}
+			testError(t, res, &InvalidAuthToken{})
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		for _, email := range []string{testEmail, "a@padlock.io", "b@padlock.io"} {
+			if res, err = adminRequest(admin.URL, "POST", "/admin/accounts", url.Values{
+				"email": {email},
+			}.Encode(), testAdminKey); err != nil {
+				t.Fatal(err)
+			}
+			testResponse(t, res, http.StatusCreated, email)
+		}
+
+		if _, err := GetAccount(ctx.storage, testEmail); err != nil {
+			t.Fatalf("Expected account to be created, got %v", err)
+		}
+
+		// Existing accounts must not be overwritten
+		if res, err = adminRequest(admin.URL, "POST", "/admin/accounts", url.Values{
+			"email": {testEmail},
+		}.Encode(), testAdminKey); err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &Conflict{})
+	})
+
+	t.Run("list", func(t *testing.T) {
+		if res, err = adminRequest(admin.URL, "GET", "/admin/accounts?offset=1&limit=1", "", testAdminKey); err != nil {
+			t.Fatal(err)
+		}
+		body, err := validateResponse(res, http.StatusOK, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var page struct {
+			Accounts []*adminAccount
+			Total    int
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatal(err)
+		}
+
+		if page.Total != 3 || len(page.Accounts) != 1 || page.Accounts[0].Email != "b@padlock.io" {
+			t.Fatalf("Unexpected page: %s", body)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		if res, err = adminRequest(admin.URL, "GET", "/admin/accounts/"+testEmail, "", testAdminKey); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusOK, "\"email\":\""+testEmail+"\"")
+
+		if res, err = adminRequest(admin.URL, "GET", "/admin/accounts/unknown@padlock.io", "", testAdminKey); err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &AccountNotFound{})
+
+		// Unknown routes should be answered with a json error as well
+		if res, err = adminRequest(admin.URL, "GET", "/admin/unknown", "", testAdminKey); err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &UnsupportedEndpoint{})
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if res, err = adminRequest(admin.URL, "DELETE", "/admin/accounts/"+testEmail, "", testAdminKey); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusNoContent, "")
+
+		if _, err := GetAccount(ctx.storage, testEmail); err != ErrNotFound {
+			t.Fatalf("Expected account to be deleted, got %v", err)
+		}
+	})
+}
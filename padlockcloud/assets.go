@@ -0,0 +1,61 @@
+package padlockcloud
+
+import "os"
+import "fmt"
+import "io/fs"
+import "errors"
+
+// Assets embedded into the binary. Set by the main package; nil if no assets have been embedded
+var EmbeddedAssets fs.FS
+
+// Files that have to be present in an assets directory
+var requiredAssets = []string{
+	"templates/email/base.txt",
+	"templates/email/activate-auth-token.txt",
+	"templates/email/deprecated-version.txt",
+	"templates/email/account-suspended.txt",
+	"templates/page/base.html",
+	"templates/page/error.html",
+	"templates/page/login.html",
+	"templates/page/dashboard.html",
+	"static",
+}
+
+// Checks if all required files are present in `assets`
+func ValidateAssets(assets fs.FS) error {
+	for _, name := range requiredAssets {
+		if _, err := fs.Stat(assets, name); err != nil {
+			return fmt.Errorf("missing %s", name)
+		}
+	}
+	return nil
+}
+
+// Returns the assets to use for a given configuration. If `fromEmbed` is true, the embedded assets
+// are used. Otherwise the assets are loaded from `path`. If `path` is empty, the embedded assets are
+// used if available, falling back to `DefaultAssetsPath`
+func OpenAssets(path string, fromEmbed bool) (fs.FS, error) {
+	if fromEmbed || path == "" && EmbeddedAssets != nil {
+		if EmbeddedAssets == nil {
+			return nil, errors.New("padlock: no embedded assets available in this build")
+		}
+		return EmbeddedAssets, nil
+	}
+
+	if path == "" {
+		path = DefaultAssetsPath
+	}
+
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("padlock: assets directory %s does not exist. Use the --assets-path option "+
+			"to point to the assets directory or --assets-from-embed to use the built-in assets", path)
+	}
+
+	assets := os.DirFS(path)
+	if err := ValidateAssets(assets); err != nil {
+		return nil, fmt.Errorf("padlock: invalid assets directory %s: %v. Use the --assets-path option "+
+			"to point to the assets directory or --assets-from-embed to use the built-in assets", path, err)
+	}
+
+	return assets, nil
+}
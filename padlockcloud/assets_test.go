@@ -0,0 +1,63 @@
+package padlockcloud
+
+import "os"
+import "io/ioutil"
+import "path/filepath"
+import "testing"
+
+func TestOpenAssets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	prevEmbedded := EmbeddedAssets
+	defer func() {
+		EmbeddedAssets = prevEmbedded
+	}()
+	EmbeddedAssets = nil
+
+	// Non-existing directory should fail
+	if _, err := OpenAssets(filepath.Join(dir, "nonexistent"), false); err == nil {
+		t.Fatal("Opening non-existing assets directory should fail")
+	}
+
+	// Directory missing required files should fail
+	if _, err := OpenAssets(dir, false); err == nil {
+		t.Fatal("Opening empty assets directory should fail")
+	}
+
+	// Forcing embedded assets without any available should fail
+	if _, err := OpenAssets("", true); err == nil {
+		t.Fatal("Using embedded assets should fail if none are available")
+	}
+
+	assets, err := OpenAssets("../assets", false)
+	if err != nil {
+		t.Fatalf("Opening valid assets directory should work, got %v", err)
+	}
+
+	// If no path is provided, embedded assets should be used if available
+	EmbeddedAssets = assets
+	if a, err := OpenAssets("", false); err != nil || a != assets {
+		t.Fatalf("Expected embedded assets to be used, got %v", err)
+	}
+
+	// Embedded assets should be used if forced even if a path is provided
+	if a, err := OpenAssets(dir, true); err != nil || a != assets {
+		t.Fatalf("Expected embedded assets to be used, got %v", err)
+	}
+
+	// Templates should load fine from embedded assets
+	ctx := newServerTestContext()
+	ctx.server.Templates = nil
+	ctx.server.Assets = nil
+	ctx.server.Config.AssetsPath = ""
+	if err := ctx.server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.server.Assets != assets || ctx.server.Templates.Dashboard == nil {
+		t.Fatal("Expected server to be initialized with embedded assets")
+	}
+}
@@ -0,0 +1,160 @@
+package padlockcloud
+
+import "bufio"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "io"
+import "net/http"
+import "os"
+import "sync"
+import "time"
+
+// Single entry in the audit log
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Email     string    `json:"email,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	// Additional information, e.g. the id of a revoked auth token
+	Details string `json:"details,omitempty"`
+	// Hash over the hash of the previous entry and the contents of this entry
+	Hash string `json:"hash"`
+}
+
+// Computes the hash of the entry, chained to the hash of the previous entry
+func (e *AuditEntry) computeHash(prev string) string {
+	c := *e
+	c.Hash = ""
+	data, _ := json.Marshal(&c)
+
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Append-only log of security-relevant events like account creation or failed authentication
+// attempts. Each entry includes a hash over its contents and the previous entry's hash, so any
+// modification or removal of entries (except for at the end of the log) can be detected via
+// `VerifyAuditLog`
+type AuditLog struct {
+	// Path to the log file
+	Path string
+	// Source for the time of entries that don't specify one. Defaults to the system clock
+	Clock Clock
+
+	mutex sync.Mutex
+	file  *os.File
+	last  string
+}
+
+// Opens the log file, creating it if it doesn't exist yet. New entries are chained to the last
+// existing entry
+func (l *AuditLog) Open() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	l.last = ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err == nil {
+			l.last = entry.Hash
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	return nil
+}
+
+func (l *AuditLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Appends an entry to the log. Does nothing if `l` is nil
+func (l *AuditLog) Log(entry *AuditEntry) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return ErrStorageClosed
+	}
+
+	if entry.Time.IsZero() {
+		entry.Time = clockNow(l.Clock)
+	}
+	// Normalize time so the hash can be recomputed from the serialized entry
+	entry.Time = entry.Time.UTC().Round(0)
+	entry.Hash = entry.computeHash(l.last)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	l.last = entry.Hash
+	return nil
+}
+
+// Records an event triggered by a request
+func (l *AuditLog) LogRequest(r *http.Request, event string, email string, details string) error {
+	return l.Log(&AuditEntry{
+		Event:     event,
+		Email:     email,
+		IP:        getIp(r),
+		RequestID: r.Header.Get("X-Request-ID"),
+		Details:   details,
+	})
+}
+
+// Validates the hash chain of an audit log. Returns the number of valid entries and an error
+// pointing to the first entry that has been modified, inserted or removed
+func VerifyAuditLog(r io.Reader) (int, error) {
+	var prev string
+	n := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return n, fmt.Errorf("padlock: audit log entry %d is malformed: %v", n+1, err)
+		}
+
+		if entry.Hash != entry.computeHash(prev) {
+			return n, fmt.Errorf("padlock: audit log entry %d has been tampered with", n+1)
+		}
+
+		prev = entry.Hash
+		n++
+	}
+
+	return n, scanner.Err()
+}
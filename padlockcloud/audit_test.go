@@ -0,0 +1,119 @@
+package padlockcloud
+
+import "testing"
+import "bufio"
+import "bytes"
+import "encoding/json"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+
+func readAuditLog(t *testing.T, path string) []*AuditEntry {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []*AuditEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "padlock-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l := &AuditLog{Path: path}
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	l.Log(&AuditEntry{Event: "account:create", Email: testEmail})
+	l.Log(&AuditEntry{Event: "auth_token:create", Email: testEmail})
+	l.Close()
+
+	// Reopening the log should continue the existing hash chain
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	l.Log(&AuditEntry{Event: "account:delete", Email: testEmail})
+	l.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := VerifyAuditLog(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 verified entries, got %d", n)
+	}
+
+	// Modifying an entry should break the chain
+	data, _ := ioutil.ReadFile(path)
+	tampered := strings.Replace(string(data), "account:delete", "account:rename", 1)
+	if n, err := VerifyAuditLog(strings.NewReader(tampered)); err == nil || n != 2 {
+		t.Errorf("Expected verification to fail at entry 3, got %d verified entries and error %v", n, err)
+	}
+
+	// ...and so should removing one
+	lines := strings.SplitAfter(string(data), "\n")
+	removed := lines[0] + lines[2]
+	if n, err := VerifyAuditLog(strings.NewReader(removed)); err == nil || n != 1 {
+		t.Errorf("Expected verification to fail at entry 2, got %d verified entries and error %v", n, err)
+	}
+}
+
+func TestAuditLogServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "padlock-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	ctx := newServerTestContext()
+	ctx.server.Audit = &AuditLog{Path: path}
+	if err := ctx.server.Audit.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.server.Audit.Close()
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.authToken.Token = "invalid"
+	if _, err := ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	for _, entry := range readAuditLog(t, path) {
+		if entry.Email != testEmail {
+			t.Errorf("Expected entry for %s, got %+v", testEmail, entry)
+		}
+		events = append(events, entry.Event)
+	}
+
+	// The test client already sends the api token along with the activation request, before it
+	// has been activated. Activating an api token also creates a web session
+	expected := "auth:failed,account:create,auth_token:create,auth_token:create,auth:failed"
+	if strings.Join(events, ",") != expected {
+		t.Errorf("Expected events %s, got %s", expected, strings.Join(events, ","))
+	}
+}
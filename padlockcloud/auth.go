@@ -7,6 +7,7 @@ import "net/http"
 import "regexp"
 import "fmt"
 import "errors"
+import "strings"
 
 var authStringPattern = regexp.MustCompile("^(?:AuthToken|ApiKey) (.+):(.+)$")
 var authMaxAge = func(authType string) time.Duration {
@@ -18,6 +19,17 @@ var authMaxAge = func(authType string) time.Duration {
 	}
 }
 
+type contextKey string
+
+const clientCertContextKey contextKey = "clientCert"
+
+// Returns the subject of the verified client certificate used for the request or an
+// empty string if none was provided
+func ClientCertSubject(r *http.Request) string {
+	subject, _ := r.Context().Value(clientCertContextKey).(string)
+	return subject
+}
+
 // A wrapper for an api key containing some meta info like the user and device name
 type AuthToken struct {
 	Email          string
@@ -29,7 +41,17 @@ type AuthToken struct {
 	Expires        time.Time
 	ClientVersion  string
 	ClientPlatform string
-	account        *Account
+	// Name of the device the token was requested from, either supplied by the user or derived
+	// from the user agent
+	DeviceName string
+	// Address, user agent and (if available) location of the client that requested the token,
+	// helping users tell their devices apart
+	IP        string
+	UserAgent string
+	Location  string
+	// Address of the client that last used the token
+	LastIP  string
+	account *Account
 }
 
 // Returns the account associated with this auth token
@@ -60,9 +82,9 @@ func (t *AuthToken) String() string {
 	)
 }
 
-// Returns true if `t` is expires, false otherwise
-func (t *AuthToken) Expired() bool {
-	return !t.Expires.IsZero() && t.Expires.Before(time.Now())
+// Returns true if `t` is expired at the given time
+func (t *AuthToken) ExpiredAt(at time.Time) bool {
+	return !t.Expires.IsZero() && t.Expires.Before(at)
 }
 
 // Creates an auth token from it's string representation of the form "AuthToken base64(t.Email):t.Token"
@@ -100,9 +122,10 @@ func AuthTokenFromRequest(r *http.Request) (*AuthToken, error) {
 	return AuthTokenFromString(authString)
 }
 
-// Creates a new auth token for a given `email`
-func NewAuthToken(email string, t string) (*AuthToken, error) {
-	authT, err := token()
+// Creates a new auth token for a given `email`, generated from `size` random bytes. Timestamps
+// are taken from `clock`, or the system clock if nil
+func NewAuthToken(email string, t string, size int, clock Clock) (*AuthToken, error) {
+	authT, err := token(size)
 	if err != nil {
 		return nil, err
 	}
@@ -115,10 +138,11 @@ func NewAuthToken(email string, t string) (*AuthToken, error) {
 		t = "api"
 	}
 
+	now := clockNow(clock)
 	var expires time.Time
 
 	if maxAge := authMaxAge(t); maxAge != 0 {
-		expires = time.Now().Add(maxAge)
+		expires = now.Add(maxAge)
 	}
 
 	return &AuthToken{
@@ -126,8 +150,8 @@ func NewAuthToken(email string, t string) (*AuthToken, error) {
 		Token:    authT,
 		Type:     t,
 		Id:       id,
-		Created:  time.Now(),
-		LastUsed: time.Now(),
+		Created:  now,
+		LastUsed: now,
 		Expires:  expires,
 	}, nil
 }
@@ -139,9 +163,34 @@ type Account struct {
 	Email string
 	// Time the account was created
 	Created time.Time
+	// Time the account was last modified
+	Updated time.Time
 	// A set of api keys that can be used to access the data associated with this
 	// account
 	AuthTokens []*AuthToken
+	// Number of email-sending requests per minute allowed for this account. Replaces the default
+	// per-email quota of the `EmailRateLimiter` if not zero. Other requests aren't affected
+	RateLimit int `json:",omitempty"`
+	// Maximum number of bytes the data store and all vaults of this account may take up combined.
+	// Unlimited if zero
+	DataQuota int64 `json:",omitempty"`
+	// Suspended accounts can't access their data or request new auth tokens. Their data is kept
+	// intact so the account can be reinstated later
+	Suspended bool `json:",omitempty"`
+	// Reason for the suspension, shown to the user
+	SuspendedReason string `json:",omitempty"`
+	// Arbitrary labels for grouping accounts, e.g. "plan": "pro". Not used for authorization
+	Tags map[string]string `json:",omitempty"`
+}
+
+// Returns true if the account has all of the given tags. Tags with an empty value match any value
+func (acc *Account) HasTags(tags map[string]string) bool {
+	for k, v := range tags {
+		if value, ok := acc.Tags[k]; !ok || (v != "" && value != v) {
+			return false
+		}
+	}
+	return true
 }
 
 // Implements the `Key` method of the `Storable` interface
@@ -156,11 +205,17 @@ func (acc *Account) Deserialize(data []byte) error {
 
 // Implementation of the `Storable.Serialize` method
 func (acc *Account) Serialize() ([]byte, error) {
+	return json.Marshal(acc)
+}
+
+// Implementation of the `Timestamped.Touch` method. Sets the `Created` field if it hasn't
+// been set yet, updates the `Updated` field and removes old auth tokens
+func (acc *Account) Touch(t time.Time) {
 	if acc.Created.IsZero() {
-		acc.Created = time.Now()
+		acc.Created = t
 	}
-	acc.RemoveOldAuthTokens()
-	return json.Marshal(acc)
+	acc.Updated = t
+	acc.RemoveOldAuthTokens(t)
 }
 
 // Adds an api key to this account. If an api key for the given device
@@ -205,8 +260,8 @@ func (a *Account) RemoveAuthToken(t *AuthToken) {
 	}
 }
 
-// Filters out auth tokens that have been expired for 7 days or more
-func (a *Account) RemoveOldAuthTokens() {
+// Filters out auth tokens that have been expired for 7 days or more at the time `now`
+func (a *Account) RemoveOldAuthTokens(now time.Time) {
 	s := a.AuthTokens[:0]
 
 	for _, t := range a.AuthTokens {
@@ -215,7 +270,7 @@ func (a *Account) RemoveOldAuthTokens() {
 		if t.Type == "api" {
 			maxAge = 7 * 24 * time.Hour
 		}
-		if t.Expires.IsZero() || t.Expires.After(time.Now().Add(-maxAge)) {
+		if t.Expires.IsZero() || t.Expires.After(now.Add(-maxAge)) {
 			s = append(s, t)
 		}
 	}
@@ -223,6 +278,17 @@ func (a *Account) RemoveOldAuthTokens() {
 	a.AuthTokens = s
 }
 
+// Returns the auth token that hasn't been used for the longest time or nil if the account has none
+func (a *Account) LeastRecentlyUsedAuthToken() *AuthToken {
+	var lru *AuthToken
+	for _, t := range a.AuthTokens {
+		if t != nil && (lru == nil || t.LastUsed.Before(lru.LastUsed)) {
+			lru = t
+		}
+	}
+	return lru
+}
+
 func (a *Account) AuthTokensByType(typ string) []*AuthToken {
 	var tokens []*AuthToken
 	for _, t := range a.AuthTokens {
@@ -240,6 +306,16 @@ type AuthRequest struct {
 	AuthToken *AuthToken
 	Created   time.Time
 	Redirect  string
+	// When the activation email was last resent. Zero if it was only sent once
+	Resent time.Time
+}
+
+// Returns when the activation email for `ar` was last sent
+func (ar *AuthRequest) LastSent() time.Time {
+	if ar.Resent.After(ar.Created) {
+		return ar.Resent
+	}
+	return ar.Created
 }
 
 // Implementation of the `Storable.Key` interface method
@@ -257,24 +333,117 @@ func (ar *AuthRequest) Serialize() ([]byte, error) {
 	return json.Marshal(ar)
 }
 
-// Creates a new `AuthRequest` with a given `email`
-func NewAuthRequest(email string, tType string) (*AuthRequest, error) {
+// Creates a new `AuthRequest` with a given `email`. Both tokens are generated from `size` random
+// bytes. Timestamps are taken from `clock`, or the system clock if nil
+func NewAuthRequest(email string, tType string, size int, clock Clock) (*AuthRequest, error) {
 	// Create new auth token
-	authToken, err := NewAuthToken(email, tType)
+	authToken, err := NewAuthToken(email, tType, size, clock)
 	if err != nil {
 		return nil, err
 	}
 
 	// Create activation token
-	actToken, err := token()
+	actToken, err := token(size)
 	if err != nil {
 		return nil, err
 	}
 
-	return &AuthRequest{actToken, authToken, time.Now(), ""}, nil
+	return &AuthRequest{Token: actToken, AuthToken: authToken, Created: authToken.Created}, nil
+}
+
+// Entry in the index of auth requests by email. Keys have the form `email/token`, so the requests
+// made for an email can be found with a prefix scan
+type authRequestRef struct {
+	Email string
+	Token string
+}
+
+// Implementation of the `Storable.Key` interface method. Tokens can't contain slashes, so keys can
+// always be split into the email and the token at the last slash
+func (ref *authRequestRef) Key() []byte {
+	return []byte(ref.Email + "/" + ref.Token)
+}
+
+// Implementation of the `Storable.Deserialize` method. All information is contained in the key
+func (ref *authRequestRef) Deserialize(data []byte) error {
+	return nil
+}
+
+// Implementation of the `Storable.Serialize` method
+func (ref *authRequestRef) Serialize() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Creates an index entry with the given key, as returned by `authRequestRef.Key`
+func authRequestRefFromKey(key string) *authRequestRef {
+	i := strings.LastIndex(key, "/")
+	if i == -1 {
+		return &authRequestRef{Token: key}
+	}
+	return &authRequestRef{Email: key[:i], Token: key[i+1:]}
+}
+
+// Writes for storing `ar` along with its index entry
+func putAuthRequestOps(ar *AuthRequest) []BatchOp {
+	ops := []BatchOp{PutOp(ar)}
+	if ar.AuthToken != nil {
+		ops = append(ops, PutOp(&authRequestRef{ar.AuthToken.Email, ar.Token}))
+	}
+	return ops
+}
+
+// Writes for removing `ar` along with its index entry
+func deleteAuthRequestOps(ar *AuthRequest) []BatchOp {
+	ops := []BatchOp{DeleteOp(&AuthRequest{Token: ar.Token})}
+	if ar.AuthToken != nil {
+		ops = append(ops, DeleteOp(&authRequestRef{ar.AuthToken.Email, ar.Token}))
+	}
+	return ops
+}
+
+// Time after which unactivated auth requests expire
+const authRequestMaxAge = 24 * time.Hour
+
+// Returns the most recently created auth request for `email` that is unexpired according to
+// `clock`. Returns `ErrNotFound` if there is none. Requests are looked up via the index by email,
+// so requests stored without an index entry are ignored
+func LatestAuthRequest(storage Storage, email string, clock Clock) (*AuthRequest, error) {
+	minCreated := clockNow(clock).Add(-authRequestMaxAge)
+	var latest *AuthRequest
+	prefix := email + "/"
+	err := storage.ListPrefixFunc(&authRequestRef{}, prefix, func(key string, size int) error {
+		ref := authRequestRefFromKey(key)
+		if ref.Email != email {
+			// Belongs to an email starting with `prefix`
+			return nil
+		}
+		ar := &AuthRequest{Token: ref.Token}
+		if err := storage.Get(ar); err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if ar.AuthToken == nil || ar.AuthToken.Email != email || ar.Created.Before(minCreated) {
+			return nil
+		}
+		if latest == nil || ar.Created.After(latest.Created) {
+			latest = ar
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if latest == nil {
+		return nil, ErrNotFound
+	}
+
+	return latest, nil
 }
 
 func init() {
 	RegisterStorable(&Account{}, "auth-accounts")
 	RegisterStorable(&AuthRequest{}, "auth-requests")
+	RegisterStorable(&authRequestRef{}, "auth-request-index")
 }
@@ -2,9 +2,12 @@ package padlockcloud
 
 import "testing"
 import "fmt"
+import "time"
+import "io/ioutil"
+import "os"
 
 func TestAuthTokenFromString(t *testing.T) {
-	token, err := NewAuthToken("martin@padlock.io", "api")
+	token, err := NewAuthToken("martin@padlock.io", "api", DefaultTokenBytes, nil)
 	str := token.String()
 	token2, err := AuthTokenFromString(str)
 	if err != nil || token.Email != token2.Email || token.Token != token2.Token {
@@ -24,7 +27,7 @@ func TestAuthTokenFromString(t *testing.T) {
 
 func TestManageAuthTokens(t *testing.T) {
 	acc := &Account{}
-	t1, _ := NewAuthToken("martin@padlock.io", "api")
+	t1, _ := NewAuthToken("martin@padlock.io", "api", DefaultTokenBytes, nil)
 
 	if acc.AddAuthToken(t1); len(acc.AuthTokens) != 1 || acc.AuthTokens[0] != t1 {
 		t.Fatal("Add auth token")
@@ -60,8 +63,8 @@ func TestManageAuthTokens(t *testing.T) {
 
 func TestValidateAuthToken(t *testing.T) {
 	acc := &Account{}
-	t1, _ := NewAuthToken("asdf", "api")
-	t2, _ := NewAuthToken("fsda", "api")
+	t1, _ := NewAuthToken("asdf", "api", DefaultTokenBytes, nil)
+	t2, _ := NewAuthToken("fsda", "api", DefaultTokenBytes, nil)
 	acc.AddAuthToken(t1)
 
 	if t2.Validate(acc) {
@@ -86,3 +89,55 @@ func TestValidateAuthToken(t *testing.T) {
 		t.Fatal("account field should be set after validation")
 	}
 }
+
+func TestAccountTimestamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t1 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	clock := NewFakeClock(t1)
+
+	for _, storage := range []Storage{
+		&MemoryStorage{Clock: clock},
+		&LevelDBStorage{Config: &LevelDBConfig{Path: dir}, Clock: clock},
+	} {
+		if err := storage.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		clock.Set(t1)
+		if err := storage.Put(&Account{Email: testEmail}); err != nil {
+			t.Fatal(err)
+		}
+
+		acc := &Account{Email: testEmail}
+		if err := storage.Get(acc); err != nil {
+			t.Fatal(err)
+		}
+		if !acc.Created.Equal(t1) || !acc.Updated.Equal(t1) {
+			t.Fatalf("Expected created and updated to be %v, got %v and %v", t1, acc.Created, acc.Updated)
+		}
+
+		clock.Set(t2)
+		if err := storage.Put(acc); err != nil {
+			t.Fatal(err)
+		}
+
+		acc = &Account{Email: testEmail}
+		if err := storage.Get(acc); err != nil {
+			t.Fatal(err)
+		}
+		if !acc.Created.Equal(t1) {
+			t.Fatalf("Created should stay at %v, got %v", t1, acc.Created)
+		}
+		if !acc.Updated.Equal(t2) {
+			t.Fatalf("Updated should be bumped to %v, got %v", t2, acc.Updated)
+		}
+
+		storage.Close()
+	}
+}
@@ -0,0 +1,113 @@
+package padlockcloud
+
+import "errors"
+import "fmt"
+import "strings"
+
+// Restrictions on the email addresses auth tokens can be requested for and on the shared secret
+// integrators pass along with them. The zero value accepts any address and secret. Tokens are only ever activated through the link sent to the address, so requiring a
+// verified email doesn't need any configuration
+type AuthPolicyConfig struct {
+	// Minimum length of email addresses. Not enforced if zero
+	MinEmailLength int `yaml:"min_email_length"`
+	// Maximum length of email addresses. Not enforced if zero
+	MaxEmailLength int `yaml:"max_email_length"`
+	// Only accept addresses from these domains, including their subdomains. All domains are
+	// accepted if empty
+	AllowedEmailDomains []string `yaml:"allowed_email_domains,omitempty"`
+	// Reject addresses from these domains, including their subdomains. Takes precedence over
+	// `AllowedEmailDomains`
+	DeniedEmailDomains []string `yaml:"denied_email_domains,omitempty"`
+	// Minimum length of the `secret` parameter. A secret is required if set. Not enforced if zero
+	MinSecretLength int `yaml:"min_secret_length"`
+	// Maximum length of the `secret` parameter. Not enforced if zero
+	MaxSecretLength int `yaml:"max_secret_length"`
+}
+
+// Validates the config, returning an error describing the first invalid setting
+func (c *AuthPolicyConfig) Validate() error {
+	if c.MinEmailLength < 0 || c.MaxEmailLength < 0 {
+		return errors.New("padlock: email length limits must not be negative")
+	}
+	if c.MaxEmailLength != 0 && c.MinEmailLength > c.MaxEmailLength {
+		return fmt.Errorf("padlock: minimum email length %d exceeds maximum of %d", c.MinEmailLength, c.MaxEmailLength)
+	}
+	if c.MinSecretLength < 0 || c.MaxSecretLength < 0 {
+		return errors.New("padlock: secret length limits must not be negative")
+	}
+	if c.MaxSecretLength != 0 && c.MinSecretLength > c.MaxSecretLength {
+		return fmt.Errorf("padlock: minimum secret length %d exceeds maximum of %d", c.MinSecretLength, c.MaxSecretLength)
+	}
+	for _, d := range append(append([]string{}, c.AllowedEmailDomains...), c.DeniedEmailDomains...) {
+		if d == "" || strings.ContainsAny(d, "@ ") {
+			return fmt.Errorf("padlock: invalid email domain '%s'", d)
+		}
+	}
+	return nil
+}
+
+// Checks `email` against the policy, returning a `BadRequest` error describing the violation if
+// it isn't accepted. Does nothing if `c` is nil
+func (c *AuthPolicyConfig) Check(email string) error {
+	if c == nil {
+		return nil
+	}
+
+	if c.MinEmailLength != 0 && len(email) < c.MinEmailLength {
+		return &BadRequest{fmt.Sprintf("email must be at least %d characters long", c.MinEmailLength)}
+	}
+	if c.MaxEmailLength != 0 && len(email) > c.MaxEmailLength {
+		return &BadRequest{fmt.Sprintf("email must be at most %d characters long", c.MaxEmailLength)}
+	}
+
+	if len(c.AllowedEmailDomains) == 0 && len(c.DeniedEmailDomains) == 0 {
+		return nil
+	}
+
+	i := strings.LastIndex(email, "@")
+	if i == -1 {
+		return &BadRequest{"invalid email address"}
+	}
+	domain := email[i+1:]
+
+	if matchEmailDomain(domain, c.DeniedEmailDomains) {
+		return &BadRequest{fmt.Sprintf("email domain '%s' is not allowed", domain)}
+	}
+	if len(c.AllowedEmailDomains) != 0 && !matchEmailDomain(domain, c.AllowedEmailDomains) {
+		return &BadRequest{fmt.Sprintf("email domain '%s' is not allowed", domain)}
+	}
+
+	return nil
+}
+
+// Checks the shared secret passed with an auth token request against the policy, returning a
+// `BadRequest` error describing the violation if it isn't accepted. Does nothing if `c` is nil
+func (c *AuthPolicyConfig) CheckSecret(secret string) error {
+	if c == nil {
+		return nil
+	}
+
+	if c.MinSecretLength != 0 && secret == "" {
+		return &BadRequest{"no secret provided"}
+	}
+	if c.MinSecretLength != 0 && len(secret) < c.MinSecretLength {
+		return &BadRequest{fmt.Sprintf("secret must be at least %d characters long", c.MinSecretLength)}
+	}
+	if c.MaxSecretLength != 0 && len(secret) > c.MaxSecretLength {
+		return &BadRequest{fmt.Sprintf("secret must be at most %d characters long", c.MaxSecretLength)}
+	}
+
+	return nil
+}
+
+// Reports whether `domain` equals or is a subdomain of any of `domains`, ignoring case
+func matchEmailDomain(domain string, domains []string) bool {
+	domain = strings.ToLower(domain)
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
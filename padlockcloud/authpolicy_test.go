@@ -0,0 +1,138 @@
+package padlockcloud
+
+import "fmt"
+import "net/http"
+import "net/url"
+import "strings"
+import "testing"
+
+func TestAuthPolicyCheck(t *testing.T) {
+	policy := &AuthPolicyConfig{
+		MinEmailLength:      10,
+		MaxEmailLength:      30,
+		AllowedEmailDomains: []string{"padlock.io"},
+		DeniedEmailDomains:  []string{"guests.padlock.io"},
+	}
+
+	for _, email := range []string{"martin@padlock.io", "martin@PADLOCK.io", "martin@eu.padlock.io"} {
+		if err := policy.Check(email); err != nil {
+			t.Errorf("Expected %s to be accepted, got %v", email, err)
+		}
+	}
+
+	for email, msg := range map[string]string{
+		"m@pad.io":                           "email must be at least 10 characters long",
+		"martin.with.a.long.name@padlock.io": "email must be at most 30 characters long",
+		"martin@example.com":                 "email domain 'example.com' is not allowed",
+		"martin@notpadlock.io":               "email domain 'notpadlock.io' is not allowed",
+		"martin@guests.padlock.io":           "email domain 'guests.padlock.io' is not allowed",
+	} {
+		if err, ok := policy.Check(email).(*BadRequest); !ok || err.Msg != msg {
+			t.Errorf("Expected '%s' for %s, got %v", msg, email, err)
+		}
+	}
+
+	// The zero value should accept anything
+	if err := (&AuthPolicyConfig{}).Check("a"); err != nil {
+		t.Error(err)
+	}
+	if err := (&AuthPolicyConfig{}).CheckSecret(""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthPolicyCheckSecret(t *testing.T) {
+	policy := &AuthPolicyConfig{MinSecretLength: 8, MaxSecretLength: 16}
+
+	if err := policy.CheckSecret("0123456789"); err != nil {
+		t.Errorf("Expected secret to be accepted, got %v", err)
+	}
+
+	for secret, msg := range map[string]string{
+		"":                  "no secret provided",
+		"0123":              "secret must be at least 8 characters long",
+		"0123456789abcdefg": "secret must be at most 16 characters long",
+	} {
+		if err, ok := policy.CheckSecret(secret).(*BadRequest); !ok || err.Msg != msg {
+			t.Errorf("Expected '%s' for '%s', got %v", msg, secret, err)
+		}
+	}
+
+	// Without a minimum length, a secret is optional
+	if err := (&AuthPolicyConfig{MaxSecretLength: 16}).CheckSecret(""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthPolicyConfigValidate(t *testing.T) {
+	for _, c := range []*AuthPolicyConfig{
+		{MinEmailLength: -1},
+		{MinEmailLength: 20, MaxEmailLength: 10},
+		{AllowedEmailDomains: []string{"user@padlock.io"}},
+		{DeniedEmailDomains: []string{""}},
+		{MinSecretLength: -1},
+		{MinSecretLength: 20, MaxSecretLength: 10},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", c)
+		}
+	}
+
+	c := &AuthPolicyConfig{MinEmailLength: 5, AllowedEmailDomains: []string{"padlock.io"}}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthPolicy(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.AuthPolicy.AllowedEmailDomains = []string{"padlock.io"}
+
+	requestToken := func(email string) *http.Response {
+		res, err := ctx.request("POST", ctx.host+"/auth/", url.Values{
+			"email": {email},
+		}.Encode(), ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Emails from other domains should be rejected without creating an auth request
+	testError(t, requestToken("martin@example.com"), &BadRequest{"email domain 'example.com' is not allowed"})
+	if _, err := LatestAuthRequest(ctx.storage, "martin@example.com", nil); err != ErrNotFound {
+		t.Errorf("Expected no auth request to be stored, got %v", err)
+	}
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.server.Config.AuthPolicy.MinEmailLength = 20
+	testError(t, requestToken(testEmail), &BadRequest{"email must be at least 20 characters long"})
+	ctx.server.Config.AuthPolicy.MinEmailLength = 0
+
+	// Secrets can be passed as form values or in json bodies
+	ctx.server.Config.AuthPolicy.MinSecretLength = 8
+	testError(t, requestToken(testEmail), &BadRequest{"no secret provided"})
+
+	res, err := ctx.request("POST", ctx.host+"/auth/", url.Values{
+		"email":  {testEmail},
+		"secret": {"0123"},
+	}.Encode(), ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &BadRequest{"secret must be at least 8 characters long"})
+
+	req, err := http.NewRequest("POST", ctx.host+"/auth/", strings.NewReader(`{"email":"`+testEmail+`","secret":"0123456789"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", fmt.Sprintf("application/vnd.padlock;version=%d", ApiVersion))
+	if res, err = ctx.client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusAccepted, "")
+}
@@ -0,0 +1,319 @@
+package padlockcloud
+
+import "context"
+import "io"
+import "os"
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+import "strings"
+import "errors"
+import "io/ioutil"
+import "path/filepath"
+
+const (
+	backupPrefix     = "backup-"
+	backupSuffix     = ".tar.gz"
+	backupTimeFormat = "20060102T150405.000000000Z"
+)
+
+// Returned when trying to create a backup while another one is still in progress
+var ErrBackupInProgress = errors.New("padlock: a backup is already in progress")
+
+type BackupConfig struct {
+	// Interval in which to perform backups. Backups are disabled if zero
+	Interval time.Duration `yaml:"interval"`
+	// Destination for backups. Currently only paths to local directories are supported
+	Destination string `yaml:"destination"`
+	// Number of backups to keep. Older backups are deleted. If zero, all backups are kept
+	Retention int `yaml:"retention"`
+	// How failed backups are retried. Backups are only attempted once by default
+	Retry BackoffPolicy `yaml:"retry"`
+}
+
+// Common interface for storage implementations that support creating backups
+type Backupable interface {
+	// Writes a consistent backup of the storage contents to the given writer
+	Backup(io.Writer) error
+}
+
+// Common interface for places backups can be stored at
+type BackupDestination interface {
+	// Returns a writer for storing a new backup with the given name. The backup
+	// is only considered complete once the writer has been closed
+	Create(name string) (io.WriteCloser, error)
+	// Lists the names of all existing backups
+	List() ([]string, error)
+	// Removes the backup with the given name
+	Remove(name string) error
+}
+
+// Returns an appropriate `BackupDestination` implementation for a given destination string
+func NewBackupDestination(dest string) (BackupDestination, error) {
+	if dest == "" {
+		return nil, errors.New("padlock: no backup destination provided")
+	}
+
+	if strings.HasPrefix(dest, "s3://") {
+		return nil, fmt.Errorf("padlock: unsupported backup destination: %s", dest)
+	}
+
+	return &LocalBackupDestination{dest}, nil
+}
+
+// Writes to a temporary file and moves it to its final location once closed
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+func (f *atomicFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	return os.Rename(f.File.Name(), f.path)
+}
+
+// `BackupDestination` implementation for storing backups in a local directory
+type LocalBackupDestination struct {
+	// Path to the directory backups should be stored in
+	Dir string
+}
+
+func (d *LocalBackupDestination) Create(name string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(d.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(d.Dir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &atomicFile{f, filepath.Join(d.Dir, name)}, nil
+}
+
+func (d *LocalBackupDestination) List() ([]string, error) {
+	files, err := ioutil.ReadDir(d.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *LocalBackupDestination) Remove(name string) error {
+	return os.Remove(filepath.Join(d.Dir, name))
+}
+
+// Returns the path of the backup with the given name
+func (d *LocalBackupDestination) Path(name string) string {
+	return filepath.Join(d.Dir, name)
+}
+
+// Details about a created backup
+type BackupInfo struct {
+	Name string `json:"name"`
+	// Location of the backup, if the destination provides one
+	Path    string    `json:"path,omitempty"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// Outcome of the most recent backups as reported by the metrics endpoints
+type BackupStats struct {
+	// Time of the last successful backup
+	LastBackup *time.Time `json:"lastBackup,omitempty"`
+	// Either "success" or "failure". Empty until the first backup has been attempted
+	Result string `json:"result,omitempty"`
+	// Error of the last attempt, if it failed
+	Error string `json:"error,omitempty"`
+}
+
+// Creates backups of a storage and prunes old backups according to the retention setting
+type Backuper struct {
+	Storage     Backupable
+	Destination BackupDestination
+	// Number of backups to keep. If zero, all backups are kept
+	Retention int
+	// How failed backups are retried. A single attempt is made if nil
+	Retry *BackoffPolicy
+	// Source for the creation times of backups. Defaults to the system clock
+	Clock Clock
+
+	mutex      sync.Mutex
+	running    bool
+	attempted  bool
+	lastBackup time.Time
+	lastError  error
+
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Context for retrying failed backups, cancelled by `Close`
+func (b *Backuper) context() context.Context {
+	b.once.Do(func() {
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+	})
+	return b.ctx
+}
+
+// Stops retrying failed backups, e.g. when shutting down. Backups can still be created afterwards,
+// but only a single attempt is made
+func (b *Backuper) Close() error {
+	b.context()
+	b.cancel()
+	return nil
+}
+
+// Returns the time of the last successful backup and the error of the last backup attempt, if any
+func (b *Backuper) Status() (time.Time, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.lastBackup, b.lastError
+}
+
+// Same as `Status` but in the form reported by the metrics endpoints. Returns nil if `b` is nil
+func (b *Backuper) Stats() *BackupStats {
+	if b == nil {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stats := &BackupStats{}
+	if !b.lastBackup.IsZero() {
+		last := b.lastBackup
+		stats.LastBackup = &last
+	}
+	if b.attempted {
+		stats.Result = "success"
+		if b.lastError != nil {
+			stats.Result = "failure"
+			stats.Error = b.lastError.Error()
+		}
+	}
+	return stats
+}
+
+// Creates a new backup and removes old backups exceeding the retention count. Returns the name
+// of the created backup
+func (b *Backuper) Run() (string, error) {
+	info, err := b.Create()
+	if info == nil {
+		return "", err
+	}
+	return info.Name, err
+}
+
+// Same as `Run` but returns details about the created backup. Returns `ErrBackupInProgress` if
+// another backup is still being created
+func (b *Backuper) Create() (*BackupInfo, error) {
+	b.mutex.Lock()
+	if b.running {
+		b.mutex.Unlock()
+		return nil, ErrBackupInProgress
+	}
+	b.running = true
+	b.mutex.Unlock()
+
+	info, err := b.create()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.running = false
+	b.attempted = true
+	b.lastError = err
+	if err == nil {
+		b.lastBackup = info.Created
+	}
+
+	return info, err
+}
+
+func (b *Backuper) create() (*BackupInfo, error) {
+	var info *BackupInfo
+	if err := Retry(b.context(), b.Retry, func() error {
+		var err error
+		info, err = b.write()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return info, b.Prune()
+}
+
+// Writes a new backup to the destination
+func (b *Backuper) write() (*BackupInfo, error) {
+	info := &BackupInfo{Created: clockNow(b.Clock)}
+	info.Name = backupPrefix + info.Created.UTC().Format(backupTimeFormat) + backupSuffix
+
+	w, err := b.Destination.Create(info.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	cw := &countingWriter{Writer: w}
+	if err := b.Storage.Backup(cw); err != nil {
+		w.Close()
+		b.Destination.Remove(info.Name)
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	info.Size = cw.n
+	if d, ok := b.Destination.(interface{ Path(string) string }); ok {
+		info.Path = d.Path(info.Name)
+	}
+
+	return info, nil
+}
+
+// Removes the oldest backups exceeding the retention count
+func (b *Backuper) Prune() error {
+	if b.Retention <= 0 {
+		return nil
+	}
+
+	names, err := b.Destination.List()
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, name := range names {
+		if strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, name)
+		}
+	}
+
+	// Backup names contain a fixed-width timestamp so sorting them lexically puts them in chronological order
+	sort.Strings(backups)
+
+	for len(backups) > b.Retention {
+		if err := b.Destination.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
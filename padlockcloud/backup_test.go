@@ -0,0 +1,321 @@
+package padlockcloud
+
+import "testing"
+import "io"
+import "bytes"
+import "sort"
+import "time"
+import "errors"
+import "net/http"
+import "net/http/httptest"
+import "encoding/json"
+import "io/ioutil"
+
+type testBackupable struct {
+	err error
+}
+
+func (s *testBackupable) Backup(w io.Writer) error {
+	if s.err != nil {
+		return s.err
+	}
+	_, err := w.Write([]byte(testData))
+	return err
+}
+
+// Blocks backups until `release` is closed
+type blockingBackupable struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingBackupable) Backup(w io.Writer) error {
+	close(s.started)
+	<-s.release
+	_, err := w.Write([]byte(testData))
+	return err
+}
+
+type testBackupBuffer struct {
+	bytes.Buffer
+	dest *testBackupDestination
+	name string
+}
+
+func (b *testBackupBuffer) Close() error {
+	b.dest.backups[b.name] = b.Bytes()
+	return nil
+}
+
+// Fake `BackupDestination` implementation that keeps backups in memory
+type testBackupDestination struct {
+	backups map[string][]byte
+}
+
+func (d *testBackupDestination) Create(name string) (io.WriteCloser, error) {
+	return &testBackupBuffer{dest: d, name: name}, nil
+}
+
+func (d *testBackupDestination) List() ([]string, error) {
+	var names []string
+	for name := range d.backups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *testBackupDestination) Remove(name string) error {
+	delete(d.backups, name)
+	return nil
+}
+
+func TestBackuperRetention(t *testing.T) {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	dest := &testBackupDestination{make(map[string][]byte)}
+	storage := &testBackupable{}
+	b := &Backuper{
+		Storage:     storage,
+		Destination: dest,
+		Retention:   3,
+		Clock:       clock,
+	}
+
+	var created []string
+	for i := 0; i < 5; i++ {
+		clock.Set(start.Add(time.Duration(i) * time.Hour))
+		name, err := b.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, name)
+	}
+
+	names, _ := dest.List()
+	if len(names) != 3 {
+		t.Fatalf("Expected 3 backups to be kept, got %d", len(names))
+	}
+
+	// Only the 3 most recent backups should be kept
+	for i, name := range names {
+		if name != created[i+2] {
+			t.Errorf("Expected backup %s, got %s", created[i+2], name)
+		}
+		if string(dest.backups[name]) != testData {
+			t.Errorf("Expected backup content to be %s, got %s", testData, dest.backups[name])
+		}
+	}
+
+	if last, err := b.Status(); err != nil || !last.Equal(start.Add(4*time.Hour)) {
+		t.Errorf("Expected last backup at %v without error, got %v, %v", start.Add(4*time.Hour), last, err)
+	}
+
+	// Failed backups should be reported via Status and not leave any partial backups around
+	storage.err = errors.New("backup failed")
+	clock.Set(start.Add(5 * time.Hour))
+	if _, err := b.Run(); err != storage.err {
+		t.Fatalf("Expected error %v, got %v", storage.err, err)
+	}
+
+	if last, err := b.Status(); err != storage.err || !last.Equal(start.Add(4*time.Hour)) {
+		t.Errorf("Expected last backup at %v with error, got %v, %v", start.Add(4*time.Hour), last, err)
+	}
+
+	if names, _ := dest.List(); len(names) != 3 {
+		t.Errorf("Expected 3 backups after failed backup, got %d", len(names))
+	}
+}
+
+func TestBackuperClose(t *testing.T) {
+	b := &Backuper{
+		Storage:     &testBackupable{errors.New("disk full")},
+		Destination: &testBackupDestination{make(map[string][]byte)},
+		Retry:       &BackoffPolicy{MaxAttempts: 3, BaseDelay: time.Hour},
+	}
+
+	// Pending retries should be cancelled once the backuper is closed
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Close()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Run()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected backup to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected closing the backuper to cancel retries")
+	}
+}
+
+func TestScheduledBackups(t *testing.T) {
+	ctx := newServerTestContext()
+	dest := &testBackupDestination{make(map[string][]byte)}
+
+	ctx.server.Backuper = &Backuper{
+		Storage:     &testBackupable{},
+		Destination: dest,
+	}
+	ctx.server.backups = &Job{
+		Action: func() {
+			ctx.server.Backuper.Run()
+		},
+	}
+	ctx.server.backups.Start(time.Millisecond * 10)
+
+	time.Sleep(time.Millisecond * 50)
+	ctx.server.CleanUp()
+
+	names, _ := dest.List()
+	if len(names) == 0 {
+		t.Fatal("Expected backups to be created periodically")
+	}
+
+	// No more backups should be created after cleaning up
+	time.Sleep(time.Millisecond * 30)
+	if names2, _ := dest.List(); len(names2) != len(names) {
+		t.Fatalf("Expected no more backups after clean up, got %d instead of %d", len(names2), len(names))
+	}
+}
+
+func TestAdminBackup(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.Admin.Key = testAdminKey
+	admin := httptest.NewServer(ctx.server.AdminHandler())
+	defer admin.Close()
+
+	dest := &testBackupDestination{make(map[string][]byte)}
+	ctx.server.Backuper = &Backuper{
+		Storage:     &testBackupable{},
+		Destination: dest,
+	}
+
+	res, err := adminRequest(admin.URL, "POST", "/admin/backup", "", testAdminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, res.StatusCode, body)
+	}
+
+	var info struct {
+		BackupInfo
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dest.backups[info.Name]; !ok {
+		t.Errorf("Expected backup %s to be created, got %v", info.Name, dest.backups)
+	}
+	if info.Size != int64(len(testData)) || info.Status != "completed" {
+		t.Errorf("Expected completed backup of %d bytes, got %s", len(testData), body)
+	}
+
+	// Concurrent backups should be rejected
+	storage := &blockingBackupable{make(chan struct{}), make(chan struct{})}
+	ctx.server.Backuper.Storage = storage
+	done := make(chan error)
+	go func() {
+		_, err := ctx.server.Backuper.Run()
+		done <- err
+	}()
+	<-storage.started
+
+	if res, err = adminRequest(admin.URL, "POST", "/admin/backup", "", testAdminKey); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &BackupInProgress{})
+
+	close(storage.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminBackupDisabled(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.Admin.Key = testAdminKey
+	admin := httptest.NewServer(ctx.server.AdminHandler())
+	defer admin.Close()
+
+	res, err := adminRequest(admin.URL, "POST", "/admin/backup", "", testAdminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &FeatureDisabled{"Backup"})
+}
+
+func TestBackupMetrics(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.Admin.Key = testAdminKey
+	admin := httptest.NewServer(ctx.server.AdminHandler())
+	defer admin.Close()
+
+	metrics := func() *MetricsSnapshot {
+		res, err := adminRequest(admin.URL, "GET", "/admin/metrics", "", testAdminKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := validateResponse(res, http.StatusOK, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot := &MetricsSnapshot{}
+		if err := json.Unmarshal(body, snapshot); err != nil {
+			t.Fatal(err)
+		}
+		return snapshot
+	}
+
+	// Backups shouldn't be reported if they're disabled
+	if s := metrics(); s.Backup != nil {
+		t.Errorf("Expected no backup metrics, got %+v", s.Backup)
+	}
+
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	storage := &testBackupable{}
+	ctx.server.Backuper = &Backuper{
+		Storage:     storage,
+		Destination: &testBackupDestination{make(map[string][]byte)},
+		Clock:       clock,
+	}
+
+	if s := metrics(); s.Backup == nil || s.Backup.Result != "" || s.Backup.LastBackup != nil {
+		t.Errorf("Expected no backup to be reported before the first run, got %+v", s.Backup)
+	}
+
+	if _, err := ctx.server.Backuper.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := metrics()
+	if s.Backup == nil || s.Backup.Result != "success" || s.Backup.Error != "" ||
+		s.Backup.LastBackup == nil || !s.Backup.LastBackup.Equal(start) {
+		t.Errorf("Expected successful backup at %v, got %+v", start, s.Backup)
+	}
+
+	// Failed backups should be reported along with the time of the last successful one
+	storage.err = errors.New("backup failed")
+	clock.Set(start.Add(time.Hour))
+	if _, err := ctx.server.Backuper.Run(); err != storage.err {
+		t.Fatalf("Expected error %v, got %v", storage.err, err)
+	}
+
+	s = metrics()
+	if s.Backup == nil || s.Backup.Result != "failure" || s.Backup.Error != storage.err.Error() ||
+		s.Backup.LastBackup == nil || !s.Backup.LastBackup.Equal(start) {
+		t.Errorf("Expected failed backup after successful one at %v, got %+v", start, s.Backup)
+	}
+}
@@ -0,0 +1,243 @@
+package padlockcloud
+
+import "context"
+import "encoding/binary"
+import "encoding/json"
+import "reflect"
+import "sort"
+import "sync/atomic"
+import "github.com/syndtr/goleveldb/leveldb"
+import "github.com/syndtr/goleveldb/leveldb/opt"
+
+// Name of the directory holding batches that span multiple stores until they have been applied
+const journalLoc = "journal"
+
+// A single write performed as part of a `Storage.Batch`
+type BatchOp struct {
+	// Object to store or, if `Delete` is set, to remove
+	Storable Storable
+	Delete   bool
+}
+
+// Creates a `BatchOp` storing `t`
+func PutOp(t Storable) BatchOp {
+	return BatchOp{Storable: t}
+}
+
+// Creates a `BatchOp` removing `t`
+func DeleteOp(t Storable) BatchOp {
+	return BatchOp{Storable: t, Delete: true}
+}
+
+// A write as recorded in the journal, with the value already encoded for storing
+type journalOp struct {
+	Loc    string `json:"loc"`
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// Implementation of the `Storage.BatchCtx` interface method. Writes to a single store are
+// applied as one LevelDB batch. Since each store is a separate database, batches spanning multiple
+// stores are recorded in a journal first and only then applied to the stores. If the process dies
+// in between, the batch is completed the next time the storage is opened. The same goes for
+// errors occurring after the batch has been recorded
+func (s *LevelDBStorage) BatchCtx(ctx context.Context, ops []BatchOp) error {
+	if s.stores == nil {
+		return ErrStorageClosed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var jops []*journalOp
+	locs := make(map[string]bool)
+	for _, op := range ops {
+		if op.Storable == nil {
+			return ErrUnregisteredStorable
+		}
+		if _, err := s.getDB(op.Storable); err != nil {
+			return err
+		}
+
+		key := op.Storable.Key()
+		jop := &journalOp{
+			Loc:    StorableTypes[typeFromStorable(op.Storable)],
+			Key:    s.dbKey(key),
+			Delete: op.Delete,
+		}
+		if !op.Delete {
+			touch(ctx, op.Storable, s.Clock)
+			var err error
+			if jop.Value, err = s.encode(op.Storable, key); err != nil {
+				return err
+			}
+		}
+
+		jops = append(jops, jop)
+		locs[jop.Loc] = true
+	}
+
+	if len(locs) <= 1 {
+		return writeError(s.applyJournalOps(jops))
+	}
+
+	data, err := json.Marshal(jops)
+	if err != nil {
+		return err
+	}
+
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], atomic.AddUint64(&s.journalSeq, 1))
+	entry := s.dbKey(seq[:])
+
+	// The batch counts as committed once it has been synced to the journal
+	if err := s.journal.Put(entry, data, &opt.WriteOptions{Sync: true}); err != nil {
+		return writeError(err)
+	}
+
+	if err := s.applyJournalOps(jops); err != nil {
+		return writeError(err)
+	}
+
+	return writeError(s.journal.Delete(entry, nil))
+}
+
+// Implementation of the `Storage.Batch` interface method
+func (s *LevelDBStorage) Batch(ops []BatchOp) error {
+	return s.BatchCtx(context.Background(), ops)
+}
+
+// Writes `ops` to their stores, using a single LevelDB batch per store
+func (s *LevelDBStorage) applyJournalOps(ops []*journalOp) error {
+	dbs := make(map[string]*leveldb.DB)
+	for t, db := range s.stores {
+		dbs[StorableTypes[t]] = db
+	}
+
+	batches := make(map[string]*leveldb.Batch)
+	var locs []string
+	for _, op := range ops {
+		if dbs[op.Loc] == nil {
+			return ErrUnregisteredStorable
+		}
+		b := batches[op.Loc]
+		if b == nil {
+			b = new(leveldb.Batch)
+			batches[op.Loc] = b
+			locs = append(locs, op.Loc)
+		}
+		if op.Delete {
+			b.Delete(op.Key)
+		} else {
+			b.Put(op.Key, op.Value)
+		}
+	}
+
+	sort.Strings(locs)
+	for _, loc := range locs {
+		if err := dbs[loc].Write(batches[loc], nil); err != nil {
+			return err
+		}
+		if s.afterBatchWrite != nil {
+			if err := s.afterBatchWrite(loc); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Applies all batches left in the journal in the order they were recorded, removing them afterwards.
+// Applying a batch twice has no effect, so it doesn't matter how much of it had been applied before
+func (s *LevelDBStorage) replayJournal() error {
+	iter := s.newIterator(s.journal)
+	defer iter.Release()
+
+	replayed := 0
+	for iter.Next() {
+		var ops []*journalOp
+		if err := json.Unmarshal(iter.Value(), &ops); err != nil {
+			return err
+		}
+		if err := s.applyJournalOps(ops); err != nil {
+			return err
+		}
+		if err := s.journal.Delete(iter.Key(), nil); err != nil {
+			return err
+		}
+		replayed++
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if replayed != 0 && s.Log != nil {
+		s.Log.Info.Printf("Completed %d interrupted batch writes", replayed)
+	}
+
+	return nil
+}
+
+// Implementation of the `Storage.BatchCtx` interface method. All objects are serialized before the
+// first write, so errors leave the storage untouched
+func (s *MemoryStorage) BatchCtx(ctx context.Context, ops []BatchOp) error {
+	if s.store == nil {
+		return ErrStorageClosed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	values := make([][]byte, len(ops))
+	for i, op := range ops {
+		if op.Storable == nil {
+			return ErrUnregisteredStorable
+		}
+		if op.Delete {
+			continue
+		}
+		touch(ctx, op.Storable, s.Clock)
+		data, err := json.Marshal(op.Storable)
+		if err != nil {
+			return err
+		}
+		values[i] = data
+	}
+
+	for i, op := range ops {
+		typ := reflect.TypeOf(op.Storable)
+		key := string(op.Storable.Key())
+		if op.Delete {
+			if ts := s.store[typ]; ts != nil {
+				delete(ts, key)
+			}
+			continue
+		}
+		if s.store[typ] == nil {
+			s.store[typ] = make(map[string][]byte)
+		}
+		s.store[typ][key] = values[i]
+	}
+
+	return nil
+}
+
+// Implementation of the `Storage.Batch` interface method
+func (s *MemoryStorage) Batch(ops []BatchOp) error {
+	return s.BatchCtx(context.Background(), ops)
+}
+
+// Records a single span for a whole batch
+func (s *TracedStorage) BatchCtx(ctx context.Context, ops []BatchOp) error {
+	ctx, span := startSpan(ctx, "storage.batch")
+	defer span.End()
+
+	span.SetAttribute("padlock.storage.batch_size", len(ops))
+	err := s.Storage.BatchCtx(ctx, ops)
+	span.SetError(err)
+	return err
+}
@@ -0,0 +1,65 @@
+package padlockcloud
+
+import "fmt"
+
+// Outcome of a single check performed by `Server.Check`
+type CheckResult struct {
+	Name string
+	// Reason the check failed; nil if it passed or was skipped
+	Err error
+	// The check doesn't apply to the configuration or depends on a check that failed
+	Skipped bool
+}
+
+// Senders implementing this interface can verify their connection without sending anything
+type ConnectionChecker interface {
+	CheckConnection() error
+}
+
+// Performs the same initialization as `Start` without accepting any connections: Validates the
+// config, loads assets and templates, opens the storage and loads the TLS certificate. If `smtp` is
+// set, the connection to the mail server is tested as well. Everything is cleaned up afterwards
+func (server *Server) Check(smtp bool) []*CheckResult {
+	var results []*CheckResult
+	add := func(name string, err error) bool {
+		results = append(results, &CheckResult{Name: name, Err: err})
+		return err == nil
+	}
+	skip := func(name string) {
+		results = append(results, &CheckResult{Name: name, Skipped: true})
+	}
+
+	if add("config", wrapConfigError(server.initConfig())) {
+		defer server.CleanUp()
+		add("storage", server.initStorage())
+	} else {
+		skip("storage")
+	}
+
+	tls := false
+	for _, l := range server.listenerConfigs() {
+		tls = tls || l.TLS
+	}
+	if tls {
+		_, err := server.listenerTLSConfig()
+		add("tls", wrapConfigError(err))
+	} else {
+		skip("tls")
+	}
+
+	if c, ok := server.Sender.(ConnectionChecker); ok && smtp {
+		add("smtp", c.CheckConnection())
+	} else {
+		skip("smtp")
+	}
+
+	return results
+}
+
+// Marks `err` as a configuration error, recognized by `errors.Is(err, ErrInvalidConfig)`
+func wrapConfigError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+}
@@ -0,0 +1,50 @@
+package padlockcloud
+
+import "bytes"
+import "errors"
+import "hash/crc32"
+import "encoding/binary"
+
+// Prefix used for identifying values stored with a checksum. Values without this prefix were
+// stored before checksums were introduced and can not be verified
+var checksumMagic = []byte("\x00PCC")
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Number of bytes added to a value by `addChecksum`
+var checksumOverhead = len(checksumMagic) + 4
+
+// A stored value does not match its checksum
+var ErrChecksumMismatch = errors.New("padlock: checksum mismatch")
+
+// Returns true if `data` has been created by `addChecksum`
+func hasChecksum(data []byte) bool {
+	return bytes.HasPrefix(data, checksumMagic)
+}
+
+// Prepends a checksum of `data`. The result has the form `magic | crc32 | data`
+func addChecksum(data []byte) []byte {
+	out := make([]byte, checksumOverhead, checksumOverhead+len(data))
+	copy(out, checksumMagic)
+	binary.BigEndian.PutUint32(out[len(checksumMagic):], crc32.Checksum(data, checksumTable))
+	return append(out, data...)
+}
+
+// Verifies and strips the checksum from `data`. Values without a checksum are returned as is
+func verifyChecksum(data []byte) ([]byte, error) {
+	if !hasChecksum(data) {
+		return data, nil
+	}
+
+	if len(data) < checksumOverhead {
+		return nil, ErrChecksumMismatch
+	}
+
+	sum := binary.BigEndian.Uint32(data[len(checksumMagic):])
+	data = data[checksumOverhead:]
+	if crc32.Checksum(data, checksumTable) != sum {
+		return nil, ErrChecksumMismatch
+	}
+
+	return data, nil
+}
@@ -1,10 +1,26 @@
 package padlockcloud
 
+import "context"
 import "fmt"
+import "flag"
+import "bufio"
+import "strings"
+import "text/tabwriter"
+import "time"
+import "io"
+import "net/http"
+import "os"
+import "os/signal"
+import "syscall"
 import "path/filepath"
 import "io/ioutil"
 import "errors"
 import "encoding/base64"
+import "encoding/json"
+import "encoding/csv"
+import "reflect"
+import "sort"
+import "strconv"
 import "gopkg.in/yaml.v2"
 import "gopkg.in/urfave/cli.v1"
 
@@ -15,13 +31,91 @@ type CliConfig struct {
 	Email   EmailConfig   `yaml:"email"`
 }
 
+// Placeholder for secrets in printed configurations
+const redactedValue = "<redacted>"
+
+// Returns a copy of the config with passwords, keys and paths to key files masked
+func (c *CliConfig) Redacted() *CliConfig {
+	r := *c
+	for _, s := range []*string{
+		&r.Server.Secret,
+		&r.Server.SecretFile,
+		&r.Server.TLSKey,
+		&r.Server.Admin.Key,
+		&r.Server.Admin.KeyFile,
+		&r.Server.RateLimit.RedisPassword,
+		&r.Server.RateLimit.RedisPasswordFile,
+		&r.LevelDB.EncryptionKey,
+		&r.LevelDB.EncryptionKeyFile,
+		&r.Email.Password,
+		&r.Email.PasswordFile,
+	} {
+		if *s != "" {
+			*s = redactedValue
+		}
+	}
+	return &r
+}
+
+// Reads secrets from the files configured for them, e.g. `Email.PasswordFile`. Values read from
+// files take precedence over values provided directly. A single trailing newline is removed
+func (c *CliConfig) ReadSecretFiles() error {
+	for _, s := range []struct {
+		name  string
+		path  string
+		value *string
+	}{
+		{"server secret", c.Server.SecretFile, &c.Server.Secret},
+		{"admin key", c.Server.Admin.KeyFile, &c.Server.Admin.Key},
+		{"redis password", c.Server.RateLimit.RedisPasswordFile, &c.Server.RateLimit.RedisPassword},
+		{"email password", c.Email.PasswordFile, &c.Email.Password},
+	} {
+		if s.path == "" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			return fmt.Errorf("padlock: failed to read %s: %w", s.name, err)
+		}
+
+		value := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+		if value == "" {
+			return fmt.Errorf("padlock: %s file %s is empty", s.name, s.path)
+		}
+		*s.value = value
+	}
+
+	return nil
+}
+
 func (c *CliConfig) LoadFromFile(path string) error {
+	return c.loadFromFile(path, false)
+}
+
+// Same as `LoadFromFile` but fails if the file contains keys that don't correspond to any config
+// option, e.g. because of a typo
+func (c *CliConfig) LoadFromFileStrict(path string) error {
+	return c.loadFromFile(path, true)
+}
+
+func (c *CliConfig) loadFromFile(path string, strict bool) error {
 	// load config file
 	yamlData, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
 
+	if strict {
+		var doc yaml.MapSlice
+		if err := yaml.Unmarshal(yamlData, &doc); err != nil {
+			return err
+		}
+		if keys := unknownConfigKeys(doc, reflect.TypeOf(c).Elem(), ""); len(keys) != 0 {
+			return fmt.Errorf("Unknown config keys: %s", strings.Join(keys, ", "))
+		}
+	}
+
 	err = yaml.Unmarshal(yamlData, c)
 	if err != nil {
 		return err
@@ -30,6 +124,49 @@ func (c *CliConfig) LoadFromFile(path string) error {
 	return nil
 }
 
+// Returns the dotted paths of all keys in `doc` that don't correspond to a field of the struct
+// type `t`, matching keys against the yaml names of the fields
+func unknownConfigKeys(doc yaml.MapSlice, t reflect.Type, prefix string) []string {
+	var unknown []string
+	for _, item := range doc {
+		key := fmt.Sprint(item.Key)
+
+		var field *reflect.StructField
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); strings.Split(f.Tag.Get("yaml"), ",")[0] == key {
+				field = &f
+				break
+			}
+		}
+
+		if field == nil {
+			unknown = append(unknown, prefix+key)
+			continue
+		}
+
+		ft := field.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		switch value := item.Value.(type) {
+		case yaml.MapSlice:
+			if ft.Kind() == reflect.Struct {
+				unknown = append(unknown, unknownConfigKeys(value, ft, prefix+key+".")...)
+			}
+		case []interface{}:
+			if ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct {
+				for i, elem := range value {
+					if m, ok := elem.(yaml.MapSlice); ok {
+						unknown = append(unknown, unknownConfigKeys(m, ft.Elem(), fmt.Sprintf("%s%s.%d.", prefix, key, i))...)
+					}
+				}
+			}
+		}
+	}
+	return unknown
+}
+
 type CliApp struct {
 	*cli.App
 	*Log
@@ -38,6 +175,74 @@ type CliApp struct {
 	Server     *Server
 	Config     *CliConfig
 	ConfigPath string
+	// Reject config files containing unknown keys
+	StrictConfig bool
+	// Reader used for interactive prompts
+	Stdin io.Reader
+	// Minimum time between progress reports of long-running commands. Defaults to
+	// `defaultProgressInterval` if zero
+	ProgressInterval time.Duration
+
+	// Whether read-only mode was set via --read-only or PC_READ_ONLY, in which case it takes
+	// precedence over the config file when reloading it
+	readOnlyFromFlag bool
+}
+
+// Returns true if `r` is connected to a terminal
+var isTerminal = func(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Error caused by invalid arguments or flags
+func usageError(msg string) error {
+	return &kindError{msg, ErrInvalidArgument}
+}
+
+// Opens the storage, runs `fn` and closes the storage again, even if `fn` fails. Returns the
+// error of `fn` or, if it succeeded, the error of closing the storage
+func (cliApp *CliApp) withStorage(fn func() error) error {
+	if err := cliApp.Storage.Open(); err != nil {
+		if err == ErrStorageLocked {
+			return &kindError{"The database is in use by another process!", ErrStorageUnavailable}
+		}
+		return err
+	}
+
+	err := fn()
+	if closeErr := cliApp.Storage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Asks the user to confirm a destructive action. Skipped if the `--yes` flag is set. Refuses to
+// proceed if stdin is not a terminal and the `--yes` flag is not set
+func (cliApp *CliApp) confirm(context *cli.Context, prompt string) error {
+	if context.Bool("yes") {
+		return nil
+	}
+
+	if !isTerminal(cliApp.Stdin) {
+		return usageError("Not running interactively. Use the --yes flag to skip confirmation!")
+	}
+
+	fmt.Fprintf(cliApp.Writer, "%s [y/N] ", prompt)
+
+	answer, err := bufio.NewReader(cliApp.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		return errors.New("Aborted.")
+	}
+
+	return nil
 }
 
 func (cliApp *CliApp) InitConfig() {
@@ -48,8 +253,154 @@ func (cliApp *CliApp) InitConfig() {
 	cliApp.Server.Config = &cliApp.Config.Server
 }
 
+// Returns true if a flag was provided explicitly, either on the command line or through one of
+// its environment variables
+func flagIsSet(f cli.Flag, isSet func(string) bool) bool {
+	for _, name := range strings.Split(f.GetName(), ",") {
+		if isSet(strings.TrimSpace(name)) {
+			return true
+		}
+	}
+
+	v := reflect.ValueOf(f)
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	if env := v.FieldByName("EnvVar"); env.IsValid() && env.String() != "" {
+		for _, name := range strings.Split(env.String(), ",") {
+			if os.Getenv(strings.TrimSpace(name)) != "" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns a function restoring the current value of the flag's destination. Returns nil if the
+// flag doesn't have a destination
+func saveFlagValue(f cli.Flag) func() {
+	v := reflect.ValueOf(f)
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	dest := v.FieldByName("Destination")
+	if !dest.IsValid() || dest.Kind() != reflect.Ptr || dest.IsNil() {
+		return nil
+	}
+
+	value := reflect.ValueOf(dest.Elem().Interface())
+	return func() {
+		dest.Elem().Set(value)
+	}
+}
+
+// Loads the config file at `path` into `cfg`, rejecting unknown keys if `StrictConfig` is set
+func (cliApp *CliApp) loadConfig(cfg *CliConfig, path string) error {
+	if cliApp.StrictConfig {
+		return cfg.LoadFromFileStrict(path)
+	}
+	return cfg.LoadFromFile(path)
+}
+
+// Saves the values of all flags that have been set explicitly, returning functions for restoring them
+func (cliApp *CliApp) saveFlagValues(context *cli.Context) []func() {
+	var restore []func()
+	save := func(flags []cli.Flag, isSet func(string) bool) {
+		for _, f := range flags {
+			if flagIsSet(f, isSet) {
+				if r := saveFlagValue(f); r != nil {
+					restore = append(restore, r)
+				}
+			}
+		}
+	}
+	save(cliApp.Flags, context.GlobalIsSet)
+	save(context.Command.Flags, context.IsSet)
+	return restore
+}
+
+// Loads the config file on top of the current configuration. Values of flags that were set
+// explicitly, either on the command line or through environment variables, take precedence
+// over the file
+func (cliApp *CliApp) loadConfigFile(context *cli.Context) error {
+	if cliApp.ConfigPath == "" {
+		return nil
+	}
+
+	restore := cliApp.saveFlagValues(context)
+
+	if err := cliApp.loadConfig(cliApp.Config, cliApp.ConfigPath); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	for _, r := range restore {
+		r()
+	}
+
+	return nil
+}
+
+func (cliApp *CliApp) applyServerFlags(context *cli.Context) error {
+	// Command flags are parsed after the config file is loaded, replacing its values with the
+	// flag defaults, so the file has to be applied again
+	if err := cliApp.loadConfigFile(context); err != nil {
+		return err
+	}
+
+	if err := cliApp.Config.ReadSecretFiles(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	// String slice flags don't support destinations, so they have to be applied manually
+	if allowlist := context.StringSlice("rate-limit-allowlist"); cliApp.ConfigPath == "" || len(allowlist) != 0 {
+		cliApp.Config.Server.RateLimitAllowlist = allowlist
+	}
+	if origins := context.StringSlice("cors-allowed-origin"); cliApp.ConfigPath == "" || len(origins) != 0 {
+		cliApp.Config.Server.CorsAllowedOrigins = origins
+	}
+	if urls := context.StringSlice("webhook-url"); cliApp.ConfigPath == "" || len(urls) != 0 {
+		cliApp.Config.Server.Webhooks.URLs = urls
+	}
+	if domains := context.StringSlice("allowed-email-domain"); cliApp.ConfigPath == "" || len(domains) != 0 {
+		cliApp.Config.Server.AuthPolicy.AllowedEmailDomains = domains
+	}
+	if domains := context.StringSlice("denied-email-domain"); cliApp.ConfigPath == "" || len(domains) != 0 {
+		cliApp.Config.Server.AuthPolicy.DeniedEmailDomains = domains
+	}
+
+	return nil
+}
+
 func (cliApp *CliApp) RunServer(context *cli.Context) error {
-	cfg, _ := yaml.Marshal(cliApp.Config)
+	if err := cliApp.applyServerFlags(context); err != nil {
+		return err
+	}
+
+	for _, f := range context.Command.Flags {
+		if f.GetName() == "read-only" {
+			cliApp.readOnlyFromFlag = flagIsSet(f, context.IsSet)
+		}
+	}
+
+	if context.Bool("print-config") {
+		return cliApp.printConfig()
+	}
+
+	if err := cliApp.Config.Log.ValidateNotifyRecipients(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	if err := cliApp.Config.Log.ValidateLevel(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	if context.Bool("dry-run") {
+		return cliApp.checkServer(context.Bool("check-smtp"))
+	}
+
+	cfg, _ := yaml.Marshal(cliApp.Config.Redacted())
 	cliApp.Server.Info.Printf("Running server with the following configuration:\n%s", cfg)
 
 	if cliApp.Config.Server.BaseUrl == "" {
@@ -58,97 +409,1440 @@ func (cliApp *CliApp) RunServer(context *cli.Context) error {
 			"spoofing attacks! See the README for details.\n\n")
 	}
 
-	if err := cliApp.Server.Init(); err != nil {
+	// Reopen log files and reload config, if any, on SIGHUP
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+	go func() {
+		for range sighup {
+			if err := cliApp.Log.Reopen(); err != nil {
+				cliApp.Error.Println("Failed to reopen log files:", err)
+			}
+			if cliApp.ConfigPath == "" {
+				continue
+			}
+			if err := cliApp.ReloadConfig(); err != nil {
+				cliApp.Error.Println("Failed to reload config:", err)
+			}
+		}
+	}()
+
+	// Shut down gracefully on SIGINT and SIGTERM
+	ctx, stop := interruptContext()
+	defer stop()
+
+	return cliApp.Server.Run(ctx)
+}
+
+// Returns a context that is cancelled once the process receives SIGINT or SIGTERM
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// Runs all startup checks without starting the server and prints a summary. Returns the error of
+// the first failed check
+func (cliApp *CliApp) checkServer(smtp bool) error {
+	var failed error
+	for _, r := range cliApp.Server.Check(smtp) {
+		switch {
+		case r.Skipped:
+			fmt.Fprintf(cliApp.Writer, "%-8s skipped\n", r.Name)
+		case r.Err != nil:
+			fmt.Fprintf(cliApp.Writer, "%-8s FAILED: %v\n", r.Name, r.Err)
+			if failed == nil {
+				failed = r.Err
+			}
+		default:
+			fmt.Fprintf(cliApp.Writer, "%-8s ok\n", r.Name)
+		}
+	}
+	return failed
+}
+
+// Writes the effective configuration as YAML, with secrets masked
+func (cliApp *CliApp) printConfig() error {
+	cfg, err := yaml.Marshal(cliApp.Config.Redacted())
+	if err != nil {
 		return err
 	}
 
-	return cliApp.Server.Start()
+	_, err = cliApp.Writer.Write(cfg)
+	return err
 }
 
-func (cliApp *CliApp) ListAccounts(context *cli.Context) error {
-	if err := cliApp.Storage.Open(); err != nil {
+func (cliApp *CliApp) ShowConfig(context *cli.Context) error {
+	if err := cliApp.applyServerFlags(context); err != nil {
 		return err
 	}
-	defer cliApp.Storage.Close()
+	return cliApp.printConfig()
+}
+
+// Looks up the field for a dotted config key like `server.port`, using the yaml names of the fields
+func configField(v reflect.Value, key string) (reflect.Value, error) {
+	for _, name := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("Unknown config key '%s'", key)
+		}
+
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			if strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0] == name {
+				v = v.Field(i)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return reflect.Value{}, fmt.Errorf("Unknown config key '%s'", key)
+		}
+	}
 
-	acc := &Account{}
-	iter, err := cliApp.Storage.Iterator(acc)
+	return v, nil
+}
+
+// Sets the value at the given path in a yaml document, creating intermediate mappings as needed
+// while leaving all other items in place
+func setYAMLValue(doc yaml.MapSlice, path []string, value interface{}) yaml.MapSlice {
+	for i, item := range doc {
+		if item.Key != path[0] {
+			continue
+		}
+
+		if len(path) == 1 {
+			doc[i].Value = value
+		} else {
+			child, _ := item.Value.(yaml.MapSlice)
+			doc[i].Value = setYAMLValue(child, path[1:], value)
+		}
+		return doc
+	}
+
+	if len(path) == 1 {
+		return append(doc, yaml.MapItem{Key: path[0], Value: value})
+	}
+	return append(doc, yaml.MapItem{Key: path[0], Value: setYAMLValue(nil, path[1:], value)})
+}
+
+// Prints the effective value of a single config key. Secrets are masked
+func (cliApp *CliApp) GetConfigValue(context *cli.Context) error {
+	key := context.Args().Get(0)
+	if key == "" {
+		return usageError("Please provide a config key, e.g. 'server.port'!")
+	}
+
+	if err := cliApp.applyServerFlags(context); err != nil {
+		return err
+	}
+
+	field, err := configField(reflect.ValueOf(cliApp.Config.Redacted()).Elem(), key)
 	if err != nil {
 		return err
 	}
-	defer iter.(*LevelDBIterator).Release()
 
-	output := ""
-	for iter.Next() {
-		iter.Get(acc)
-		output = output + acc.Email + "\n"
+	switch value := field.Interface().(type) {
+	case fmt.Stringer:
+		fmt.Fprintln(cliApp.Writer, value.String())
+	default:
+		if field.Kind() == reflect.Struct || field.Kind() == reflect.Slice {
+			data, err := yaml.Marshal(value)
+			if err != nil {
+				return err
+			}
+			_, err = cliApp.Writer.Write(data)
+			return err
+		}
+		fmt.Fprintln(cliApp.Writer, value)
 	}
-	fmt.Print(output)
 
 	return nil
 }
 
-func (cliApp *CliApp) CreateAccount(context *cli.Context) error {
-	email := context.Args().Get(0)
-	if email == "" {
-		return errors.New("Please provide an email address!")
+// Updates a single key in the config file, leaving the rest of the file in place
+func (cliApp *CliApp) SetConfigValue(context *cli.Context) error {
+	key := context.Args().Get(0)
+	if key == "" || len(context.Args()) != 2 {
+		return usageError("Please provide a config key and a value, e.g. 'server.port 3000'!")
+	}
+	raw := context.Args().Get(1)
+
+	if cliApp.ConfigPath == "" {
+		return usageError("Please provide the path to the config file via --config!")
+	}
+
+	field, err := configField(reflect.ValueOf(&CliConfig{}).Elem(), key)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the value can be parsed into the field's type
+	parsed := reflect.New(field.Type())
+	if err := yaml.Unmarshal([]byte(raw), parsed.Interface()); err != nil {
+		return fmt.Errorf("Invalid value for %s: %v", key, err)
+	}
+
+	// Strings are written as is so values like 'yes' or '123' don't change their type
+	var value interface{} = raw
+	if field.Kind() != reflect.String {
+		if err := yaml.Unmarshal([]byte(raw), &value); err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Stat(cliApp.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(cliApp.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	doc = setYAMLValue(doc, strings.Split(key, "."), value)
+
+	if data, err = yaml.Marshal(doc); err != nil {
+		return err
+	}
+
+	// Validate the resulting config before writing it
+	if err := yaml.Unmarshal(data, &CliConfig{}); err != nil {
+		return fmt.Errorf("Invalid value for %s: %v", key, err)
+	}
+
+	// Write to a temporary file next to the config file and move it into place, so the config is
+	// never left half-written
+	tmp, err := ioutil.TempFile(filepath.Dir(cliApp.ConfigPath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	f := &atomicFile{tmp, cliApp.ConfigPath}
+	if err := tmp.Chmod(info.Mode()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	return f.Close()
+}
+
+// Reloads the config file and applies settings that can be changed at runtime. Currently
+// only the `read_only` setting is supported
+func (cliApp *CliApp) ReloadConfig() error {
+	if cliApp.ConfigPath == "" {
+		return fmt.Errorf("%w: no config file provided", ErrInvalidConfig)
+	}
+
+	cfg := &CliConfig{}
+	if err := cliApp.loadConfig(cfg, cliApp.ConfigPath); err != nil {
+		return err
+	}
+
+	cliApp.Info.Printf("Reloaded config from %s", cliApp.ConfigPath)
+
+	// Like on startup, an explicitly set flag takes precedence over the file
+	if !cliApp.readOnlyFromFlag {
+		cliApp.Server.SetReadOnly(cfg.Server.ReadOnly)
+	}
+
+	return nil
+}
+
+// Config keys applied by `ReloadConfig`. Changes to any other keys require a restart
+var reloadableConfigKeys = map[string]bool{
+	"server.read_only": true,
+}
+
+// A single setting that differs between two configs
+type ConfigChange struct {
+	// Dotted name of the setting, e.g. "server.port"
+	Key string
+	// Old and new values, with secrets masked
+	Old string
+	New string
+	// Set if the change only takes effect after restarting the server
+	RequiresRestart bool
+}
+
+// Compares two configs field by field and returns the changed settings, sorted by key
+func DiffConfig(current *CliConfig, updated *CliConfig) []*ConfigChange {
+	var changes []*ConfigChange
+	diffConfigValues(
+		reflect.ValueOf(current).Elem(), reflect.ValueOf(updated).Elem(),
+		reflect.ValueOf(current.Redacted()).Elem(), reflect.ValueOf(updated.Redacted()).Elem(),
+		"", &changes,
+	)
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+// Recursively compares the config values `current` and `updated`. Changes are reported using the values of
+// the redacted copies so secrets don't show up in the output
+func diffConfigValues(current, updated, currentRedacted, updatedRedacted reflect.Value, key string, changes *[]*ConfigChange) {
+	if current.Kind() == reflect.Struct {
+		for i := 0; i < current.NumField(); i++ {
+			name := strings.Split(current.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			if key != "" {
+				name = key + "." + name
+			}
+			diffConfigValues(current.Field(i), updated.Field(i), currentRedacted.Field(i), updatedRedacted.Field(i), name, changes)
+		}
+		return
+	}
+
+	switch current.Kind() {
+	case reflect.Slice, reflect.Map:
+		// Treat nil and empty values the same
+		if current.Len() == 0 && updated.Len() == 0 {
+			return
+		}
+	}
+
+	if reflect.DeepEqual(current.Interface(), updated.Interface()) {
+		return
+	}
+
+	*changes = append(*changes, &ConfigChange{
+		Key:             key,
+		Old:             formatConfigValue(currentRedacted),
+		New:             formatConfigValue(updatedRedacted),
+		RequiresRestart: !reloadableConfigKeys[key],
+	})
+}
+
+// Formats a config value for displaying it on a single line
+func formatConfigValue(v reflect.Value) string {
+	if s, ok := v.Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	if v.Kind() == reflect.String {
+		return strconv.Quote(v.String())
 	}
-	acc := &Account{
-		Email: email,
+	return fmt.Sprint(v.Interface())
+}
+
+// Prints the changes between the effective config and the config file at the given path, as they
+// would be seen when reloading the config
+func (cliApp *CliApp) DiffConfig(context *cli.Context) error {
+	path := context.Args().Get(0)
+	if path == "" {
+		return usageError("Please provide the path to the new config file!")
 	}
 
-	if err := cliApp.Storage.Open(); err != nil {
-		return err
-	}
-	defer cliApp.Storage.Close()
+	if err := cliApp.applyServerFlags(context); err != nil {
+		return err
+	}
+
+	current := *cliApp.Config
+	currentPath := cliApp.ConfigPath
+	defer func() {
+		*cliApp.Config = current
+		cliApp.ConfigPath = currentPath
+	}()
+
+	// Start over from the flag defaults and apply the new file and any flags provided the same
+	// way as for the current config
+	restore := cliApp.saveFlagValues(context)
+	*cliApp.Config = CliConfig{}
+	for _, flags := range [][]cli.Flag{cliApp.Flags, context.Command.Flags} {
+		for _, f := range flags {
+			f.Apply(flag.NewFlagSet("defaults", flag.ContinueOnError))
+		}
+	}
+	for _, r := range restore {
+		r()
+	}
+	cliApp.ConfigPath = path
+
+	if err := cliApp.applyServerFlags(context); err != nil {
+		return err
+	}
+
+	changes := DiffConfig(&current, cliApp.Config)
+	if len(changes) == 0 {
+		fmt.Fprintln(cliApp.Writer, "No changes")
+		return nil
+	}
+
+	for _, c := range changes {
+		note := "can be reloaded"
+		if c.RequiresRestart {
+			note = "requires restart"
+		}
+		fmt.Fprintf(cliApp.Writer, "%s: %s -> %s (%s)\n", c.Key, c.Old, c.New, note)
+	}
+	return nil
+}
+
+// Records an event triggered via the command line in the audit log, if enabled
+func (cliApp *CliApp) audit(event string, email string, details string) error {
+	return cliApp.auditEntry(&AuditEntry{Event: event, Email: email, Details: details})
+}
+
+// Like `audit`, but records a complete entry
+func (cliApp *CliApp) auditEntry(entry *AuditEntry) error {
+	if cliApp.Config.Server.AuditLog == "" {
+		return nil
+	}
+
+	l, err := cliApp.openAuditLog()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return l.Log(entry)
+}
+
+// Opens the configured audit log for writing
+func (cliApp *CliApp) openAuditLog() (*AuditLog, error) {
+	l := &AuditLog{Path: cliApp.Config.Server.AuditLog, Clock: cliApp.Server.Clock}
+	if err := l.Open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Parses tags provided as `key=value` pairs. If `allowKeys` is set, plain keys are accepted as well
+// and are mapped to an empty value
+func parseTags(args []string, allowKeys bool) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if parts[0] == "" || (len(parts) == 1 && !allowKeys) {
+			return nil, usageError(fmt.Sprintf("Invalid tag '%s'. Tags have to be provided as key=value!", arg))
+		}
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+// Output formats for `accounts list`
+const (
+	// One email per line
+	AccountListText = "text"
+	// One row per account with email, creation and modification time, suspension status, number
+	// of auth tokens and data size, preceded by a header row
+	AccountListCSV = "csv"
+)
+
+// Columns of the csv account list
+var accountListCSVHeader = []string{"email", "created", "updated", "suspended", "token_count", "data_size"}
+
+// Writes all accounts in `storage` having the tags in `filter` to `w` in csv format. Accounts are
+// written as they are read, so they don't all have to be loaded into memory
+func writeAccountsCSV(w io.Writer, storage Storage, filter map[string]string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(accountListCSVHeader); err != nil {
+		return err
+	}
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	sizes, err := StorageUsageByAccount(storage)
+	if err != nil {
+		return err
+	}
+
+	if err := storage.ListFunc(&Account{}, func(email string) error {
+		acc := &Account{Email: email}
+		if err := storage.Get(acc); err != nil {
+			return err
+		}
+		if !acc.HasTags(filter) {
+			return nil
+		}
+		return cw.Write([]string{
+			acc.Email,
+			formatTime(acc.Created),
+			formatTime(acc.Updated),
+			strconv.FormatBool(acc.Suspended),
+			strconv.Itoa(len(acc.AuthTokens)),
+			strconv.FormatInt(sizes[acc.Email], 10),
+		})
+	}); err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func (cliApp *CliApp) ListAccounts(context *cli.Context) error {
+	filter, err := parseTags(context.StringSlice("tag"), true)
+	if err != nil {
+		return err
+	}
+
+	format := context.String("format")
+	if format != AccountListText && format != AccountListCSV {
+		return usageError(fmt.Sprintf("Invalid format '%s'. Use '%s' or '%s'!", format, AccountListText, AccountListCSV))
+	}
+
+	return cliApp.withStorage(func() error {
+		if format == AccountListCSV {
+			return writeAccountsCSV(cliApp.Writer, cliApp.Storage, filter)
+		}
+
+		// Print emails as we go to avoid loading all accounts into memory. Accounts only have to
+		// be fetched for filtering by tags
+		return cliApp.Storage.ListFunc(&Account{}, func(email string) error {
+			if len(filter) != 0 {
+				acc := &Account{Email: email}
+				if err := cliApp.Storage.Get(acc); err != nil {
+					return err
+				}
+				if !acc.HasTags(filter) {
+					return nil
+				}
+			}
+			_, err := fmt.Fprintln(cliApp.Writer, email)
+			return err
+		})
+	})
+}
+
+func (cliApp *CliApp) TagAccount(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" || len(context.Args().Tail()) == 0 {
+		return usageError("Please provide an email address and at least one tag!")
+	}
+
+	tags, err := parseTags(context.Args().Tail(), false)
+	if err != nil {
+		return err
+	}
+
+	return cliApp.withStorage(func() error {
+		if err := TagAccount(cliApp.Storage, email, tags); err == ErrNotFound {
+			return &kindError{fmt.Sprintf("No account found for %s", email), ErrNotFound}
+		} else if err != nil {
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (cliApp *CliApp) UntagAccount(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" || len(context.Args().Tail()) == 0 {
+		return usageError("Please provide an email address and at least one tag key!")
+	}
+
+	return cliApp.withStorage(func() error {
+		if err := UntagAccount(cliApp.Storage, email, context.Args().Tail()); err == ErrNotFound {
+			return &kindError{fmt.Sprintf("No account found for %s", email), ErrNotFound}
+		} else if err != nil {
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (cliApp *CliApp) CreateAccount(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return usageError("Please provide an email address!")
+	}
+
+	ifNotExists := context.Bool("if-not-exists")
+	upsert := context.Bool("upsert")
+	if ifNotExists && upsert {
+		return usageError("The --if-not-exists and --upsert flags can't be combined!")
+	}
+
+	return cliApp.withStorage(func() error {
+		defaults := &cliApp.Config.Server.DefaultAccount
+
+		if upsert {
+			if _, err := UpsertAccountWithDefaults(cliApp.Storage, email, defaults); err != nil {
+				return err
+			}
+			return cliApp.audit("account:create", email, "cli:upsert")
+		}
+
+		if _, err := CreateAccountWithDefaults(cliApp.Storage, email, defaults); err == ErrAccountExists {
+			if ifNotExists {
+				return nil
+			}
+			return &kindError{fmt.Sprintf("An account for %s already exists. Use --if-not-exists to ignore existing accounts or --upsert to replace them!", email), ErrConflict}
+		} else if err != nil {
+			return err
+		}
+
+		return cliApp.audit("account:create", email, "cli")
+	})
+}
+
+func (cliApp *CliApp) DisplayAccount(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return usageError("Please provide an email address!")
+	}
+
+	return cliApp.withStorage(func() error {
+		acc, err := GetAccount(cliApp.Storage, email)
+		if err != nil {
+			return err
+		}
+
+		yamlData, err := yaml.Marshal(acc)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(yamlData))
+
+		return nil
+	})
+}
+
+func (cliApp *CliApp) ListAuthTokens(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return usageError("Please provide an email address!")
+	}
+
+	return cliApp.withStorage(func() error {
+		acc, err := GetAccount(cliApp.Storage, email)
+		if err == ErrNotFound {
+			return &kindError{fmt.Sprintf("No account found for %s", email), ErrNotFound}
+		} else if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(cliApp.Writer, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tTYPE\tCREATED\tLAST USED\tIP\tLOCATION\tUSER AGENT")
+		for _, t := range acc.AuthTokens {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.Id, t.DeviceName, t.Type, t.Created.Format(time.RFC3339),
+				t.LastUsed.Format(time.RFC3339), t.IP, t.Location, t.UserAgent)
+		}
+
+		return tw.Flush()
+	})
+}
+
+func (cliApp *CliApp) RevokeAllAuthTokens(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return usageError("Please provide an email address!")
+	}
+
+	return cliApp.withStorage(func() error {
+		n, err := RevokeAuthTokens(cliApp.Storage, email)
+		if err == ErrNotFound {
+			return &kindError{fmt.Sprintf("No account found for %s", email), ErrNotFound}
+		} else if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cliApp.Writer, "Revoked %d auth tokens for %s\n", n, email)
+		return cliApp.audit("auth_token:revoke_all", email, "cli")
+	})
+}
+
+func (cliApp *CliApp) ListDataVersions(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return usageError("Please provide an email address!")
+	}
+
+	return cliApp.withStorage(func() error {
+		if _, err := GetAccount(cliApp.Storage, email); err == ErrNotFound {
+			return &kindError{fmt.Sprintf("No account found for %s", email), ErrNotFound}
+		} else if err != nil {
+			return err
+		}
+
+		versions, err := ListDataVersions(cliApp.Storage, email)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(cliApp.Writer, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tCREATED\tSIZE")
+		for _, v := range versions {
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", v.Version, v.Created.Format(time.RFC3339), formatBytes(int64(len(v.Content))))
+		}
+
+		return tw.Flush()
+	})
+}
+
+func (cliApp *CliApp) RollbackData(context *cli.Context) error {
+	email := context.Args().Get(0)
+	version, err := strconv.Atoi(context.Args().Get(1))
+	if email == "" || err != nil {
+		return usageError("Please provide an email address and a version number!")
+	}
+
+	if err := cliApp.confirm(context, fmt.Sprintf("Replace the data of %s with version %d?", email, version)); err != nil {
+		return err
+	}
+
+	return cliApp.withStorage(func() error {
+		if err := RollbackData(cliApp.Storage, email, version, cliApp.Config.Server.DataVersions, cliApp.Server.Clock); err == ErrNotFound {
+			return &kindError{fmt.Sprintf("No version %d found for %s", version, email), ErrNotFound}
+		} else if err != nil {
+			return err
+		}
+
+		return cliApp.audit("data_store:rollback", email, strconv.Itoa(version))
+	})
+}
+
+func (cliApp *CliApp) DeleteAccount(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return usageError("Please provide an email address!")
+	}
+
+	if err := cliApp.confirm(context, fmt.Sprintf("Delete account %s?", email)); err != nil {
+		return err
+	}
+
+	return cliApp.withStorage(func() error {
+		if cliApp.Config.Server.TrashRetention > 0 {
+			if err := TrashAccount(cliApp.Storage, email, cliApp.Server.Clock); err != nil {
+				return err
+			}
+			return cliApp.audit("account:trash", email, "cli")
+		}
+
+		if err := DeleteAccount(cliApp.Storage, email); err != nil {
+			return err
+		}
+
+		return cliApp.audit("account:delete", email, "cli")
+	})
+}
+
+// Permanently erases an account and everything stored for it in response to a data subject request.
+// Unlike `DeleteAccount`, this bypasses the trash, requires an audit log to record the erasure in
+// and only reports success once no records of the account are left
+func (cliApp *CliApp) EraseAccount(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return usageError("Please provide an email address!")
+	}
+
+	operator := context.String("operator")
+	if operator == "" {
+		return usageError("Please provide the name of the operator performing the erasure via --operator!")
+	}
+
+	if cliApp.Config.Server.AuditLog == "" {
+		return usageError("Erasing accounts requires an audit log. Please provide one via --audit-log!")
+	}
+
+	notify := context.Bool("notify")
+	if notify && len(cliApp.Config.Server.Webhooks.URLs) == 0 {
+		return usageError("No webhooks configured for --notify. Please add them to the webhooks section of the config file!")
+	}
+
+	if err := cliApp.confirm(context, fmt.Sprintf("Permanently erase account %s and all its data?", email)); err != nil {
+		return err
+	}
+
+	// Open the audit log before touching the account, so an erasure can't happen without being
+	// recorded
+	audit, err := cliApp.openAuditLog()
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+
+	var entry *AuditEntry
+	record := func(event string, details string) error {
+		entry = &AuditEntry{
+			Event:     event,
+			Email:     email,
+			RequestID: context.String("request-id"),
+			Details:   details,
+		}
+		return audit.Log(entry)
+	}
+
+	return cliApp.withStorage(func() error {
+		details := "operator=" + operator
+		if err := record("account:erase:started", details); err != nil {
+			return err
+		}
+
+		if err := EraseAccount(cliApp.Storage, email); err != nil {
+			if lerr := record("account:erase:failed", details+" error="+err.Error()); lerr != nil {
+				return lerr
+			}
+			if err == ErrNotFound {
+				return &kindError{fmt.Sprintf("No account found for %s", email), ErrNotFound}
+			}
+			return err
+		}
+
+		if err := record("account:erase", details); err != nil {
+			return err
+		}
+
+		if notify {
+			webhooks := &Webhooks{Config: &cliApp.Config.Server.Webhooks, Error: cliApp.Error}
+			if err := webhooks.Notify(&WebhookEvent{
+				Time:    entry.Time,
+				Event:   entry.Event,
+				Email:   email,
+				Details: entry.Details,
+			}); err != nil {
+				return err
+			}
+			// Wait for the delivery to be attempted before exiting
+			webhooks.Close()
+		}
+
+		fmt.Fprintf(cliApp.Writer, "Erased account %s\n", email)
+		return nil
+	})
+}
+
+func (cliApp *CliApp) ResetAccountData(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return usageError("Please provide an email address!")
+	}
+
+	if err := cliApp.confirm(context, fmt.Sprintf("Remove all data stored for %s?", email)); err != nil {
+		return err
+	}
+
+	return cliApp.withStorage(func() error {
+		if err := ResetAccountData(cliApp.Storage, email); err == ErrNotFound {
+			return &kindError{fmt.Sprintf("No account found for %s", email), ErrNotFound}
+		} else if err != nil {
+			return err
+		}
+
+		fmt.Printf("Removed all data for %s\n", email)
+
+		return cliApp.audit("data_store:delete", email, "cli")
+	})
+}
+
+func (cliApp *CliApp) RenameAccount(context *cli.Context) error {
+	oldEmail := context.Args().Get(0)
+	newEmail := context.Args().Get(1)
+	if oldEmail == "" || newEmail == "" {
+		return usageError("Please provide the current and the new email address!")
+	}
+
+	if err := cliApp.confirm(context, fmt.Sprintf("Rename account %s to %s?", oldEmail, newEmail)); err != nil {
+		return err
+	}
+
+	return cliApp.withStorage(func() error {
+		if err := RenameAccount(cliApp.Storage, oldEmail, newEmail); err == ErrNotFound {
+			return &kindError{fmt.Sprintf("No account found for %s", oldEmail), ErrNotFound}
+		} else if err == ErrAccountExists {
+			return &kindError{fmt.Sprintf("An account for %s already exists", newEmail), ErrConflict}
+		} else if err != nil {
+			return err
+		}
+
+		return cliApp.audit("account:rename", oldEmail, newEmail)
+	})
+}
+
+func (cliApp *CliApp) RestoreAccount(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return usageError("Please provide an email address!")
+	}
+
+	return cliApp.withStorage(func() error {
+		if err := RestoreAccount(cliApp.Storage, email); err == ErrNotFound {
+			return &kindError{fmt.Sprintf("No deleted account found for %s", email), ErrNotFound}
+		} else if err == ErrAccountExists {
+			return &kindError{fmt.Sprintf("An account for %s already exists", email), ErrConflict}
+		} else if err != nil {
+			return err
+		}
+
+		return cliApp.audit("account:restore", email, "cli")
+	})
+}
+
+func (cliApp *CliApp) SuspendAccount(context *cli.Context) error {
+	return cliApp.setAccountSuspended(context, true)
+}
+
+func (cliApp *CliApp) UnsuspendAccount(context *cli.Context) error {
+	return cliApp.setAccountSuspended(context, false)
+}
+
+func (cliApp *CliApp) setAccountSuspended(context *cli.Context, suspended bool) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return usageError("Please provide an email address!")
+	}
+	reason := strings.Join(context.Args().Tail(), " ")
+
+	return cliApp.withStorage(func() error {
+		if err := SetAccountSuspended(cliApp.Storage, email, suspended, reason); err == ErrNotFound {
+			return &kindError{fmt.Sprintf("No account found for %s", email), ErrNotFound}
+		} else if err != nil {
+			return err
+		}
+
+		if suspended {
+			fmt.Printf("Suspended account %s\n", email)
+			return cliApp.audit("account:suspend", email, reason)
+		}
+
+		fmt.Printf("Reinstated account %s\n", email)
+		return cliApp.audit("account:unsuspend", email, "")
+	})
+}
+
+func (cliApp *CliApp) SetAccountRateLimit(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return usageError("Please provide an email address!")
+	}
+
+	perMin, err := strconv.Atoi(context.Args().Get(1))
+	if err != nil || perMin < 0 {
+		return usageError("Please provide the number of requests per minute! Use 0 to restore the default")
+	}
+
+	return cliApp.withStorage(func() error {
+		if err := SetAccountRateLimit(cliApp.Storage, email, perMin); err == ErrNotFound {
+			return &kindError{fmt.Sprintf("No account found for %s", email), ErrNotFound}
+		} else if err != nil {
+			return err
+		}
+
+		if perMin == 0 {
+			fmt.Printf("Restored default rate limit for %s\n", email)
+		} else {
+			fmt.Printf("Set email rate limit for %s to %d requests per minute\n", email, perMin)
+		}
+
+		return nil
+	})
+}
+
+func (cliApp *CliApp) VerifyAuditLog(context *cli.Context) error {
+	path := context.Args().Get(0)
+	if path == "" {
+		path = cliApp.Config.Server.AuditLog
+	}
+	if path == "" {
+		return usageError("Please provide the path to the audit log!")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := VerifyAuditLog(f)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cliApp.Writer, "Verified %d entries\n", n)
+	return nil
+}
+
+func (cliApp *CliApp) ListTrash(context *cli.Context) error {
+	return cliApp.withStorage(func() error {
+		trashed, err := ListTrash(cliApp.Storage)
+		if err != nil {
+			return err
+		}
+
+		for _, ta := range trashed {
+			fmt.Printf("%s (deleted %s)\n", ta.Account.Email, ta.Deleted.Format(time.RFC3339))
+		}
+
+		return nil
+	})
+}
+
+func (cliApp *CliApp) PurgeTrash(context *cli.Context) error {
+	all := context.Bool("all")
+	if all {
+		if err := cliApp.confirm(context, "Permanently remove all accounts in the trash?"); err != nil {
+			return err
+		}
+	} else if cliApp.Config.Server.TrashRetention <= 0 {
+		return usageError("No trash retention configured. Use --all to remove all accounts in the trash!")
+	}
+
+	return cliApp.withStorage(func() error {
+		var n int
+		var err error
+		if all {
+			n, err = EmptyTrash(cliApp.Storage)
+		} else {
+			n, err = PurgeTrash(cliApp.Storage, cliApp.Config.Server.TrashRetention, cliApp.Server.Clock)
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Purged %d accounts\n", n)
+
+		return nil
+	})
+}
+
+func (cliApp *CliApp) DBStats(context *cli.Context) error {
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	stats, err := cliApp.Storage.Stats()
+	if err != nil {
+		return err
+	}
+
+	if context.Bool("json") {
+		data, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	fmt.Printf("Accounts:     %d\n", stats.Accounts)
+	fmt.Printf("Data stores:  %d\n", stats.DataStores)
+	fmt.Printf("Data size:    %s\n", formatBytes(stats.DataBytes))
+	fmt.Printf("Disk size:    %s (approx.)\n", formatBytes(stats.DiskSize))
+
+	return nil
+}
+
+func (cliApp *CliApp) DBHistogram(context *cli.Context) error {
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	h, err := BlobSizeHistogram(cliApp.Storage)
+	if err != nil {
+		return err
+	}
+
+	if context.Bool("json") {
+		data, err := json.MarshalIndent(h, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cliApp.Writer, string(data))
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(cliApp.Writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tCOUNT")
+	for _, b := range h.Buckets {
+		le := "+Inf"
+		if b.Le >= 0 {
+			le = "<= " + formatBytes(b.Le)
+		}
+		fmt.Fprintf(tw, "%s\t%d\n", le, b.Count)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(cliApp.Writer, "\nData stores:  %d\n", h.Count)
+	fmt.Fprintf(cliApp.Writer, "Total size:   %s\n", formatBytes(h.Sum))
+	fmt.Fprintf(cliApp.Writer, "p50:          %s\n", formatBytes(h.P50))
+	fmt.Fprintf(cliApp.Writer, "p95:          %s\n", formatBytes(h.P95))
+	fmt.Fprintf(cliApp.Writer, "p99:          %s\n", formatBytes(h.P99))
+
+	return nil
+}
+
+func (cliApp *CliApp) DBCompact(context *cli.Context) error {
+	if err := cliApp.Storage.Open(); err != nil {
+		if err == ErrStorageLocked {
+			return &kindError{"The database is in use by another process. Please stop the server before compacting the database!", ErrStorageUnavailable}
+		}
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	before, err := cliApp.Storage.Stats()
+	if err != nil {
+		return err
+	}
+
+	cliApp.Info.Printf("Compacting database at %s (approx. size: %s)", cliApp.Storage.Config.Path, formatBytes(before.DiskSize))
+
+	if err := cliApp.Storage.Compact(); err != nil {
+		return err
+	}
+
+	after, err := cliApp.Storage.Stats()
+	if err != nil {
+		return err
+	}
+
+	cliApp.Info.Printf("Compaction finished (approx. size: %s)", formatBytes(after.DiskSize))
+
+	return nil
+}
+
+func (cliApp *CliApp) DBVerify(context *cli.Context) error {
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	result, err := cliApp.Storage.Verify()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range result.Corrupt {
+		fmt.Printf("Corrupt entry in %s: %q (%v)\n", entry.Store, entry.Key, entry.Err)
+	}
+
+	fmt.Printf("Checked %d entries, %d corrupt", result.Checked, len(result.Corrupt))
+	if result.Unchecksummed > 0 {
+		fmt.Printf(" (%d stored without checksum)", result.Unchecksummed)
+	}
+	fmt.Println()
+
+	if len(result.Corrupt) > 0 {
+		return fmt.Errorf("Found %d corrupt entries!", len(result.Corrupt))
+	}
+
+	return nil
+}
+
+func (cliApp *CliApp) DBGC(context *cli.Context) error {
+	if err := cliApp.Storage.Open(); err != nil {
+		if err == ErrStorageLocked {
+			return &kindError{"The database is in use by another process!", ErrStorageUnavailable}
+		}
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	res, err := CollectOrphanedData(cliApp.Storage, context.Bool("apply"), context.Bool("include-legacy"))
+	if err != nil {
+		return err
+	}
+
+	for _, o := range res.Orphaned {
+		fmt.Fprintf(cliApp.Writer, "%s\t%s\t%s\n", o.Kind, o.Key, formatBytes(o.Size))
+	}
+
+	if res.Applied {
+		for _, o := range res.Orphaned {
+			if err := cliApp.audit(o.Kind+":gc", o.Email, "cli"); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(cliApp.Writer, "Removed %d orphaned records, reclaimed %s\n", len(res.Orphaned), formatBytes(res.Bytes))
+	} else {
+		fmt.Fprintf(cliApp.Writer, "Found %d orphaned records (%s). Run again with --apply to remove them.\n", len(res.Orphaned), formatBytes(res.Bytes))
+	}
+
+	if res.Legacy > 0 {
+		fmt.Fprintf(cliApp.Writer, "Kept %d data stores without an account, which belong to legacy accounts. Run again with --include-legacy to remove them as well.\n", res.Legacy)
+	}
+
+	return nil
+}
+
+// Writes a backup of the database to the given path or stdout. If the database is locked by a
+// running server, the backup is streamed from the server's admin api instead, if configured
+func (cliApp *CliApp) DBBackup(context *cli.Context) error {
+	dest := context.Args().Get(0)
+	if dest == "" {
+		return usageError("Please provide a destination path or '-' for stdout!")
+	}
+
+	progress, err := cliApp.newProgress(context, "Backing up", 0)
+	if err != nil {
+		return err
+	}
+
+	backup := cliApp.Storage.Backup
+	if err := cliApp.Storage.Open(); err == ErrStorageLocked {
+		if cliApp.Config.Server.Admin.Addr == "" {
+			return &kindError{"The database is in use by another process! Configure the admin api (--admin-addr) to back up a running server.", ErrStorageUnavailable}
+		}
+		backup = cliApp.fetchBackup
+	} else if err != nil {
+		return err
+	} else {
+		defer cliApp.Storage.Close()
+	}
+
+	var out io.Writer
+	if dest == "-" {
+		out = os.Stdout
+	} else {
+		f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	w := &countingWriter{Writer: &progressWriter{out, progress}}
+	if err := backup(w); err != nil {
+		return err
+	}
+	progress.Done()
+
+	fmt.Fprintf(os.Stderr, "Wrote %d bytes\n", w.n)
+
+	return nil
+}
+
+// Streams a backup from the admin api of the server running with the current configuration
+func (cliApp *CliApp) fetchBackup(w io.Writer) error {
+	admin := cliApp.Config.Server.Admin
+	req, err := http.NewRequest("GET", "http://"+admin.Addr+"/admin/backup", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+admin.Key)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("padlock: failed to reach admin api: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("padlock: admin api responded with %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+func (cliApp *CliApp) DBRestore(context *cli.Context) error {
+	src := context.Args().Get(0)
+	if src == "" {
+		return usageError("Please provide a source path or '-' for stdin!")
+	}
+
+	var in io.Reader
+	if src == "-" {
+		in = os.Stdin
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		if err == ErrStorageLocked {
+			return &kindError{"The database is in use by another process. Please stop the server before restoring a backup!", ErrStorageUnavailable}
+		}
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	// With --force, existing data is only replaced once the backup has been validated
+	restore := cliApp.Storage.Restore
+	if context.Bool("force") {
+		restore = cliApp.Storage.Replace
+	}
+
+	if err := restore(in); err != nil {
+		if err == ErrStorageNotEmpty {
+			return &kindError{"The database is not empty. Use the --force flag to overwrite existing data!", ErrConflict}
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (cliApp *CliApp) DBRekey(context *cli.Context) error {
+	config := cliApp.Storage.Config
+
+	if context.IsSet("old-key") {
+		config.EncryptionKey = context.String("old-key")
+		config.EncryptionKeyFile = ""
+	}
+	if context.IsSet("old-key-version") {
+		config.EncryptionKeyVersion = context.Int("old-key-version")
+	}
+
+	newVersion := config.EncryptionKeyVersion + 1
+	if context.IsSet("new-key-version") {
+		newVersion = context.Int("new-key-version")
+	}
+	if newVersion < 0 || newVersion > 255 {
+		return usageError("The new key version has to be between 0 and 255!")
+	}
+
+	if context.String("new-key") == "" {
+		return usageError("Please provide a new encryption key via the --new-key option!")
+	}
+
+	newKey, err := loadEncryptionKey(context.String("new-key"), "")
+	if err != nil {
+		return err
+	}
+
+	to, err := NewEncryptor(newKey, byte(newVersion))
+	if err != nil {
+		return err
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		if err == ErrStorageLocked {
+			return &kindError{"The database is in use by another process. Please stop the server before changing the encryption key!", ErrStorageUnavailable}
+		}
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	total, err := CountRecords(cliApp.Storage, registeredStorables()...)
+	if err != nil {
+		return err
+	}
+	progress, err := cliApp.newProgress(context, "Re-encrypting", total)
+	if err != nil {
+		return err
+	}
+
+	logEvery := context.Int("log-every")
+	n, err := cliApp.Storage.Rekey(to, func(n int) {
+		progress.Add(1, 0)
+		if logEvery > 0 && n%logEvery == 0 {
+			cliApp.Info.Printf("Processed %d records", n)
+		}
+	})
+	progress.Done()
+
+	cliApp.Info.Printf("Re-encrypted %d records with key version %d", n, newVersion)
+
+	return err
+}
 
-	if err := cliApp.Storage.Put(acc); err != nil {
-		return err
+// Creates a storage from the `leveldb` section of the config file at `path`
+func (cliApp *CliApp) storageFromConfigFile(path string) (*LevelDBStorage, error) {
+	cfg := &CliConfig{}
+	if err := cliApp.loadConfig(cfg, path); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 	}
-	return nil
+	return &LevelDBStorage{Config: &cfg.LevelDB, Log: cliApp.Log}, nil
 }
 
-func (cliApp *CliApp) DisplayAccount(context *cli.Context) error {
-	email := context.Args().Get(0)
-	if email == "" {
-		return errors.New("Please provide an email address!")
+func (cliApp *CliApp) DBMigrate(context *cli.Context) error {
+	if context.String("to") == "" {
+		return usageError("Please provide the config file of the destination database via the --to option!")
 	}
-	acc := &Account{
-		Email: email,
+
+	from := cliApp.Storage
+	if path := context.String("from"); path != "" {
+		var err error
+		if from, err = cliApp.storageFromConfigFile(path); err != nil {
+			return err
+		}
 	}
 
-	if err := cliApp.Storage.Open(); err != nil {
+	to, err := cliApp.storageFromConfigFile(context.String("to"))
+	if err != nil {
 		return err
 	}
-	defer cliApp.Storage.Close()
 
-	if err := cliApp.Storage.Get(acc); err != nil {
-		return err
+	for _, s := range []*LevelDBStorage{from, to} {
+		if err := s.Open(); err != nil {
+			if err == ErrStorageLocked {
+				return &kindError{fmt.Sprintf("The database at %s is in use by another process!", s.Config.Path), ErrStorageUnavailable}
+			}
+			return err
+		}
+		defer s.Close()
 	}
 
-	yamlData, err := yaml.Marshal(acc)
+	cliApp.Info.Printf("Migrating data from %s to %s", from.Config.Path, to.Config.Path)
+
+	var types []Storable
+	for _, mt := range migrateTypes {
+		types = append(types, mt.New(""))
+	}
+	total, err := CountRecords(from, types...)
+	if err != nil {
+		return err
+	}
+	progress, err := cliApp.newProgress(context, "Migrating", total)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(string(yamlData))
+	logEvery := context.Int("log-every")
+	counts, err := MigrateStorage(from, to, func(name string, n int) {
+		progress.Add(1, 0)
+		if logEvery > 0 && n%logEvery == 0 {
+			cliApp.Info.Printf("Copied %d %s", n, name)
+		}
+	})
+	progress.Done()
 
-	return nil
+	for _, c := range counts {
+		fmt.Fprintf(cliApp.Writer, "Migrated %d %s\n", c.Count, c.Name)
+	}
+
+	return err
 }
 
-func (cliApp *CliApp) DeleteAccount(context *cli.Context) error {
-	email := context.Args().Get(0)
-	if email == "" {
-		return errors.New("Please provide an email address!")
+// Creates a progress reporter for a long-running command according to the --progress and --quiet
+// flags. Reports are printed to stderr
+func (cliApp *CliApp) newProgress(context *cli.Context, action string, total int64) (*Progress, error) {
+	format := context.String("progress")
+	if format != ProgressText && format != ProgressJSON {
+		return nil, usageError(fmt.Sprintf("Invalid progress format '%s'. Use '%s' or '%s'!", format, ProgressText, ProgressJSON))
 	}
-	acc := &Account{Email: email}
 
-	if err := cliApp.Storage.Open(); err != nil {
-		return err
+	p := &Progress{Action: action, Total: total, Format: format, Interval: cliApp.ProgressInterval}
+	if !context.Bool("quiet") {
+		p.Writer = cliApp.ErrWriter
+		if p.Writer == nil {
+			p.Writer = cli.ErrWriter
+		}
 	}
-	defer cliApp.Storage.Close()
-
-	return cliApp.Storage.Delete(acc)
+	return p, nil
 }
 
 func genSecret() (string, error) {
@@ -169,11 +1863,11 @@ func (cliApp *CliApp) GenSecret(context *cli.Context) error {
 }
 
 func NewCliApp() *CliApp {
-	storage := &LevelDBStorage{}
 	email := &EmailSender{}
 	logger := &Log{
 		Sender: email,
 	}
+	storage := &LevelDBStorage{Log: logger}
 	server := NewServer(
 		logger,
 		storage,
@@ -186,6 +1880,7 @@ func NewCliApp() *CliApp {
 		Storage: storage,
 		Email:   email,
 		Server:  server,
+		Stdin:   os.Stdin,
 	}
 	cliApp.InitConfig()
 	config := cliApp.Config
@@ -198,10 +1893,16 @@ func NewCliApp() *CliApp {
 		cli.StringFlag{
 			Name:        "config, c",
 			Value:       "",
-			Usage:       "Path to configuration file. WARNING: If provided, all other flags will be ingored",
+			Usage:       "Path to configuration file. Flags and environment variables that are set explicitly override values from the file",
 			EnvVar:      "PC_CONFIG_PATH",
 			Destination: &cliApp.ConfigPath,
 		},
+		cli.BoolFlag{
+			Name:        "strict-config",
+			Usage:       "Fail if the config file contains unknown keys, e.g. because of a typo",
+			EnvVar:      "PC_STRICT_CONFIG",
+			Destination: &cliApp.StrictConfig,
+		},
 		cli.StringFlag{
 			Name:        "log-file",
 			Value:       "",
@@ -216,13 +1917,120 @@ func NewCliApp() *CliApp {
 			EnvVar:      "PC_ERR_FILE",
 			Destination: &config.Log.ErrFile,
 		},
+		cli.StringFlag{
+			Name:        "log-level",
+			Usage:       "Minimum level of messages to log, either 'info' or 'debug'",
+			EnvVar:      "PC_LOG_LEVEL",
+			Destination: &config.Log.Level,
+		},
+		cli.IntFlag{
+			Name:        "log-max-size",
+			Usage:       "Size in megabytes after which log files are rotated. Log files are never rotated if 0",
+			EnvVar:      "PC_LOG_MAX_SIZE",
+			Destination: &config.Log.MaxSizeMB,
+		},
+		cli.IntFlag{
+			Name:        "log-max-backups",
+			Usage:       "Number of rotated log files to keep",
+			EnvVar:      "PC_LOG_MAX_BACKUPS",
+			Destination: &config.Log.MaxBackups,
+		},
 		cli.StringFlag{
 			Name:        "notify-errors",
-			Usage:       "Email address to send unexpected errors to",
+			Usage:       "Email address to send unexpected errors to. Separate multiple addresses with commas",
 			Value:       "",
 			EnvVar:      "PC_NOTIFY_ERRORS",
 			Destination: &config.Log.NotifyErrors,
 		},
+		cli.DurationFlag{
+			Name:        "trash-retention",
+			Usage:       "Move deleted accounts to the trash and only purge them after this period, e.g. '720h'",
+			EnvVar:      "PC_TRASH_RETENTION",
+			Destination: &config.Server.TrashRetention,
+		},
+		cli.IntFlag{
+			Name:        "data-versions",
+			Usage:       "Number of previous versions of each account's data to keep for rolling back. Disabled if 0",
+			EnvVar:      "PC_DATA_VERSIONS",
+			Destination: &config.Server.DataVersions,
+		},
+		cli.IntFlag{
+			Name:        "max-vaults-per-account",
+			Usage:       "Maximum number of named vaults per account. Unlimited if 0",
+			Value:       50,
+			EnvVar:      "PC_MAX_VAULTS_PER_ACCOUNT",
+			Destination: &config.Server.MaxVaultsPerAccount,
+		},
+		cli.Int64Flag{
+			Name:        "max-vault-bytes-per-account",
+			Usage:       "Maximum combined size in bytes of all named vaults of an account. Unlimited if 0",
+			Value:       100 << 20,
+			EnvVar:      "PC_MAX_VAULT_BYTES_PER_ACCOUNT",
+			Destination: &config.Server.MaxVaultBytesPerAccount,
+		},
+		cli.IntFlag{
+			Name:        "max-tokens-per-account",
+			Usage:       "Maximum number of auth tokens per account. Unlimited if 0",
+			EnvVar:      "PC_MAX_TOKENS_PER_ACCOUNT",
+			Destination: &config.Server.MaxTokensPerAccount,
+		},
+		cli.StringFlag{
+			Name:        "token-limit-policy",
+			Usage:       "What to do when an account exceeds --max-tokens-per-account: 'reject' the new token or 'evict' the least recently used one",
+			Value:       "",
+			EnvVar:      "PC_TOKEN_LIMIT_POLICY",
+			Destination: &config.Server.TokenLimitPolicy,
+		},
+		cli.BoolFlag{
+			Name:        "fail-signup-on-email-error",
+			Usage:       "Wait for activation emails to be sent and reject auth requests if sending fails instead of sending them in the background",
+			EnvVar:      "PC_FAIL_SIGNUP_ON_EMAIL_ERROR",
+			Destination: &config.Server.FailSignupOnEmailError,
+		},
+		cli.BoolFlag{
+			Name:        "disable-signup",
+			Usage:       "Only allow existing accounts to request auth tokens. New accounts have to be created via the cli or the admin api",
+			EnvVar:      "PC_DISABLE_SIGNUP",
+			Destination: &config.Server.DisableSignup,
+		},
+		cli.BoolFlag{
+			Name:        "disable-email",
+			Usage:       "Don't send any emails, disabling all routes that depend on them. Requires --disable-signup",
+			EnvVar:      "PC_DISABLE_EMAIL",
+			Destination: &config.Server.DisableEmail,
+		},
+		cli.BoolFlag{
+			Name:        "require-email-at-startup",
+			Usage:       "Fail to start if the mail server can't be reached instead of reporting it as unhealthy",
+			EnvVar:      "PC_REQUIRE_EMAIL_AT_STARTUP",
+			Destination: &config.Server.RequireEmailAtStartup,
+		},
+		cli.BoolFlag{
+			Name:        "require-email-for-readiness",
+			Usage:       "Report the server as unavailable via /healthz while the mail server can't be reached",
+			EnvVar:      "PC_REQUIRE_EMAIL_FOR_READINESS",
+			Destination: &config.Server.RequireEmailForReadiness,
+		},
+		cli.StringFlag{
+			Name:        "audit-log",
+			Usage:       "Path to the audit log file. Security-relevant events are not recorded if empty",
+			Value:       "",
+			EnvVar:      "PC_AUDIT_LOG",
+			Destination: &config.Server.AuditLog,
+		},
+		cli.StringFlag{
+			Name:        "notify-subject-prefix",
+			Usage:       "Prefix for the subject of error notifications",
+			Value:       "",
+			EnvVar:      "PC_NOTIFY_SUBJECT_PREFIX",
+			Destination: &config.Log.NotifySubjectPrefix,
+		},
+		cli.DurationFlag{
+			Name:        "notify-throttle",
+			Usage:       "Only send one notification for identical errors occurring within this time window, e.g. '10m'",
+			EnvVar:      "PC_NOTIFY_THROTTLE",
+			Destination: &config.Log.NotifyThrottle,
+		},
 		cli.StringFlag{
 			Name:        "db-path",
 			Value:       "db",
@@ -230,6 +2038,88 @@ func NewCliApp() *CliApp {
 			EnvVar:      "PC_LEVELDB_PATH",
 			Destination: &config.LevelDB.Path,
 		},
+		cli.StringFlag{
+			Name:        "encryption-key",
+			Value:       "",
+			Usage:       "Base64-encoded key for encrypting stored data. Data is stored unencrypted if not provided",
+			EnvVar:      "PC_ENCRYPTION_KEY",
+			Destination: &config.LevelDB.EncryptionKey,
+		},
+		cli.StringFlag{
+			Name:        "encryption-key-file",
+			Value:       "",
+			Usage:       "Path to file containing the base64-encoded encryption key",
+			EnvVar:      "PC_ENCRYPTION_KEY_FILE",
+			Destination: &config.LevelDB.EncryptionKeyFile,
+		},
+		cli.IntFlag{
+			Name:        "encryption-key-version",
+			Value:       0,
+			Usage:       "Version of the encryption key",
+			EnvVar:      "PC_ENCRYPTION_KEY_VERSION",
+			Destination: &config.LevelDB.EncryptionKeyVersion,
+		},
+		cli.BoolFlag{
+			Name:        "recover-db",
+			Usage:       "Attempt to recover the database if it is found to be corrupted",
+			EnvVar:      "PC_RECOVER_DB",
+			Destination: &config.LevelDB.Recover,
+		},
+		cli.IntFlag{
+			Name:        "db-cache-size",
+			Value:       0,
+			Usage:       "Size of the database block cache in megabytes. Uses the LevelDB default (8) if 0",
+			EnvVar:      "PC_DB_CACHE_SIZE",
+			Destination: &config.LevelDB.CacheSizeMB,
+		},
+		cli.IntFlag{
+			Name:        "db-write-buffer",
+			Value:       0,
+			Usage:       "Size of the database write buffer in megabytes. Uses the LevelDB default (4) if 0",
+			EnvVar:      "PC_DB_WRITE_BUFFER",
+			Destination: &config.LevelDB.WriteBufferMB,
+		},
+		cli.IntFlag{
+			Name:        "db-bloom-filter-bits",
+			Value:       0,
+			Usage:       "Bits per key for database bloom filters, e.g. 10. Bloom filters are disabled if 0",
+			EnvVar:      "PC_DB_BLOOM_FILTER_BITS",
+			Destination: &config.LevelDB.BloomFilterBits,
+		},
+		cli.StringFlag{
+			Name:        "db-codec",
+			Value:       "",
+			Usage:       "Codec for encoding stored values, e.g. 'gzip'. Values are stored as is if empty",
+			EnvVar:      "PC_DB_CODEC",
+			Destination: &config.LevelDB.Codec,
+		},
+		cli.StringFlag{
+			Name:        "db-namespace",
+			Value:       "",
+			Usage:       "Prefix for all database keys, allowing multiple isolated instances to share a database",
+			EnvVar:      "PC_DB_NAMESPACE",
+			Destination: &config.LevelDB.Namespace,
+		},
+		cli.StringFlag{
+			Name:        "db-dir-mode",
+			Value:       "",
+			Usage:       "Octal permission mode for newly created database directories, e.g. '0700'. Defaults to '0755'",
+			EnvVar:      "PC_DB_DIR_MODE",
+			Destination: &config.LevelDB.DirMode,
+		},
+		cli.StringFlag{
+			Name:        "db-file-mode",
+			Value:       "",
+			Usage:       "Octal permission mode applied to existing database files on startup, e.g. '0600'",
+			EnvVar:      "PC_DB_FILE_MODE",
+			Destination: &config.LevelDB.FileMode,
+		},
+		cli.BoolFlag{
+			Name:        "strict-perms",
+			Usage:       "Refuse to open the database if it is writable by group or others",
+			EnvVar:      "PC_STRICT_PERMS",
+			Destination: &config.LevelDB.StrictPerms,
+		},
 		cli.StringFlag{
 			Name:        "email-server",
 			Value:       "",
@@ -258,69 +2148,449 @@ func NewCliApp() *CliApp {
 			EnvVar:      "PC_EMAIL_PASSWORD",
 			Destination: &config.Email.Password,
 		},
+		cli.StringFlag{
+			Name:        "email-password-file",
+			Usage:       "File to read the mail server password from. Takes precedence over --email-password",
+			EnvVar:      "PC_EMAIL_PASSWORD_FILE",
+			Destination: &config.Email.PasswordFile,
+		},
+		cli.IntFlag{
+			Name:        "email-concurrency",
+			Value:       defaultEmailConcurrency,
+			Usage:       "Maximum number of concurrent connections to the mail server",
+			EnvVar:      "PC_EMAIL_CONCURRENCY",
+			Destination: &config.Email.Concurrency,
+		},
+		cli.DurationFlag{
+			Name:        "email-dial-timeout",
+			Value:       defaultEmailDialTimeout,
+			Usage:       "Time to wait for a connection to the mail server",
+			EnvVar:      "PC_EMAIL_DIAL_TIMEOUT",
+			Destination: &config.Email.DialTimeout,
+		},
+		cli.DurationFlag{
+			Name:        "email-send-timeout",
+			Value:       defaultEmailSendTimeout,
+			Usage:       "Time to wait for the mail server to respond during each step of sending an email",
+			EnvVar:      "PC_EMAIL_SEND_TIMEOUT",
+			Destination: &config.Email.SendTimeout,
+		},
+	}
+
+	// Flags for commands reporting their progress
+	progressFlags := []cli.Flag{
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "Don't report progress",
+		},
+		cli.StringFlag{
+			Name:  "progress",
+			Usage: "Format of the progress reports printed to stderr, either 'text' or 'json'",
+			Value: ProgressText,
+		},
+	}
+
+	// Flags for configuring the server. Shared between `runserver` and `config show`
+	serverFlags := []cli.Flag{
+		cli.IntFlag{
+			Name:        "port, p",
+			Usage:       "Port to listen on",
+			Value:       3000,
+			EnvVar:      "PC_PORT",
+			Destination: &config.Server.Port,
+		},
+		cli.StringFlag{
+			Name:        "bind-host",
+			Usage:       "Address to bind to, e.g. '127.0.0.1' or '::1'. Listens on all interfaces if empty",
+			Value:       "",
+			EnvVar:      "PC_BIND_HOST",
+			Destination: &config.Server.BindHost,
+		},
+		cli.StringFlag{
+			Name:        "assets-path",
+			Usage:       "Path to assets directory. If not provided, the built-in assets are used",
+			Value:       "",
+			EnvVar:      "PC_ASSETS_PATH",
+			Destination: &config.Server.AssetsPath,
+		},
+		cli.BoolFlag{
+			Name:        "assets-from-embed",
+			Usage:       "Use the built-in assets even if an assets path is provided",
+			EnvVar:      "PC_ASSETS_FROM_EMBED",
+			Destination: &config.Server.AssetsFromEmbed,
+		},
+		cli.StringFlag{
+			Name:        "tls-cert",
+			Usage:       "Path to TLS certification file",
+			Value:       "",
+			EnvVar:      "PC_TLS_CERT",
+			Destination: &config.Server.TLSCert,
+		},
+		cli.StringFlag{
+			Name:        "tls-key",
+			Usage:       "Path to TLS key file",
+			Value:       "",
+			EnvVar:      "PC_TLS_KEY",
+			Destination: &config.Server.TLSKey,
+		},
+		cli.Int64Flag{
+			Name:        "max-request-body",
+			Usage:       "Maximum size of request bodies in bytes. Unlimited if 0",
+			Value:       10 << 20,
+			EnvVar:      "PC_MAX_REQUEST_BODY",
+			Destination: &config.Server.MaxRequestBodyBytes,
+		},
+		cli.DurationFlag{
+			Name:        "request-timeout",
+			Usage:       "Cancel requests taking longer than this, e.g. '30s'. Unlimited if 0",
+			EnvVar:      "PC_REQUEST_TIMEOUT",
+			Destination: &config.Server.RequestTimeout,
+		},
+		cli.BoolFlag{
+			Name:        "proxy-protocol",
+			Usage:       "Expect connections to start with a PROXY protocol (v1 or v2) header, e.g. when running behind a load balancer",
+			EnvVar:      "PC_PROXY_PROTOCOL",
+			Destination: &config.Server.ProxyProtocol,
+		},
+		cli.BoolFlag{
+			Name:        "require-tls",
+			Usage:       "Answer plain http requests with 426 Upgrade Required, pointing clients to the https url",
+			EnvVar:      "PC_REQUIRE_TLS",
+			Destination: &config.Server.RequireTLS,
+		},
+		cli.BoolFlag{
+			Name:        "h2c",
+			Usage:       "Accept cleartext HTTP/2 on listeners without TLS, e.g. behind a proxy terminating TLS",
+			EnvVar:      "PC_H2C",
+			Destination: &config.Server.H2C,
+		},
+		cli.StringFlag{
+			Name:        "server-header",
+			Usage:       "Value of the Server response header. No such header is sent if empty",
+			EnvVar:      "PC_SERVER_HEADER",
+			Destination: &config.Server.ServerHeader,
+		},
+		cli.BoolFlag{
+			Name:        "version-header",
+			Usage:       "Send the server version in an X-Padlock-Version response header",
+			EnvVar:      "PC_VERSION_HEADER",
+			Destination: &config.Server.VersionHeader,
+		},
+		cli.BoolFlag{
+			Name:        "tracing",
+			Usage:       "Export request traces to an OpenTelemetry collector",
+			EnvVar:      "PC_TRACING",
+			Destination: &config.Server.Tracing.Enabled,
+		},
+		cli.StringFlag{
+			Name:        "tracing-endpoint",
+			Usage:       "Url of the OTLP/HTTP trace receiver. Defaults to " + DefaultTracingEndpoint,
+			EnvVar:      "PC_TRACING_ENDPOINT",
+			Destination: &config.Server.Tracing.Endpoint,
+		},
+		cli.StringSliceFlag{
+			Name:   "webhook-url",
+			Usage:  "Url to post audit events to. Can be provided multiple times",
+			EnvVar: "PC_WEBHOOK_URL",
+		},
+		cli.IntFlag{
+			Name:        "webhook-concurrency",
+			Usage:       fmt.Sprintf("Number of webhook deliveries made concurrently. Defaults to %d", defaultWebhookConcurrency),
+			EnvVar:      "PC_WEBHOOK_CONCURRENCY",
+			Destination: &config.Server.Webhooks.Concurrency,
+		},
+		cli.IntFlag{
+			Name:        "webhook-queue-size",
+			Usage:       fmt.Sprintf("Maximum number of webhook deliveries waiting to be made. Defaults to %d", defaultWebhookQueueSize),
+			EnvVar:      "PC_WEBHOOK_QUEUE_SIZE",
+			Destination: &config.Server.Webhooks.QueueSize,
+		},
+		cli.StringFlag{
+			Name:        "webhook-overflow-policy",
+			Usage:       "What to do while the webhook queue is full: 'drop' deliveries or 'block' until there is room",
+			EnvVar:      "PC_WEBHOOK_OVERFLOW_POLICY",
+			Destination: &config.Server.Webhooks.OverflowPolicy,
+		},
+		cli.DurationFlag{
+			Name:        "webhook-timeout",
+			Usage:       fmt.Sprintf("Time to wait for a webhook receiver to answer. Defaults to %v", defaultWebhookTimeout),
+			EnvVar:      "PC_WEBHOOK_TIMEOUT",
+			Destination: &config.Server.Webhooks.Timeout,
+		},
+		cli.IntFlag{
+			Name:        "webhook-max-attempts",
+			Usage:       fmt.Sprintf("Number of attempts per webhook delivery. Defaults to %d", defaultWebhookMaxAttempts),
+			EnvVar:      "PC_WEBHOOK_MAX_ATTEMPTS",
+			Destination: &config.Server.Webhooks.Retry.MaxAttempts,
+		},
+		cli.StringSliceFlag{
+			Name:   "allowed-email-domain",
+			Usage:  "Only accept auth token requests for emails from this domain. Can be provided multiple times",
+			EnvVar: "PC_ALLOWED_EMAIL_DOMAIN",
+		},
+		cli.StringSliceFlag{
+			Name:   "denied-email-domain",
+			Usage:  "Reject auth token requests for emails from this domain. Can be provided multiple times",
+			EnvVar: "PC_DENIED_EMAIL_DOMAIN",
+		},
+		cli.IntFlag{
+			Name:        "min-email-length",
+			Usage:       "Minimum length of emails auth tokens can be requested for",
+			EnvVar:      "PC_MIN_EMAIL_LENGTH",
+			Destination: &config.Server.AuthPolicy.MinEmailLength,
+		},
+		cli.IntFlag{
+			Name:        "max-email-length",
+			Usage:       "Maximum length of emails auth tokens can be requested for",
+			EnvVar:      "PC_MAX_EMAIL_LENGTH",
+			Destination: &config.Server.AuthPolicy.MaxEmailLength,
+		},
+		cli.IntFlag{
+			Name:        "min-secret-length",
+			Usage:       "Minimum length of the shared secret passed with auth token requests. Requires a secret if set",
+			EnvVar:      "PC_MIN_SECRET_LENGTH",
+			Destination: &config.Server.AuthPolicy.MinSecretLength,
+		},
+		cli.IntFlag{
+			Name:        "max-secret-length",
+			Usage:       "Maximum length of the shared secret passed with auth token requests",
+			EnvVar:      "PC_MAX_SECRET_LENGTH",
+			Destination: &config.Server.AuthPolicy.MaxSecretLength,
+		},
+		cli.StringFlag{
+			Name:        "rate-limit-store",
+			Usage:       "Where to keep rate limiting state. Either 'memory' or 'redis'",
+			Value:       "memory",
+			EnvVar:      "PC_RATE_LIMIT_STORE",
+			Destination: &config.Server.RateLimit.Store,
+		},
+		cli.StringFlag{
+			Name:        "redis-addr",
+			Usage:       "Address of the redis server used for rate limiting, e.g. 'localhost:6379'",
+			Value:       "",
+			EnvVar:      "PC_REDIS_ADDR",
+			Destination: &config.Server.RateLimit.RedisAddr,
+		},
+		cli.StringFlag{
+			Name:        "redis-password",
+			Usage:       "Password for the redis server",
+			Value:       "",
+			EnvVar:      "PC_REDIS_PASSWORD",
+			Destination: &config.Server.RateLimit.RedisPassword,
+		},
+		cli.StringFlag{
+			Name:        "redis-password-file",
+			Usage:       "File to read the redis password from. Takes precedence over --redis-password",
+			EnvVar:      "PC_REDIS_PASSWORD_FILE",
+			Destination: &config.Server.RateLimit.RedisPasswordFile,
+		},
+		cli.IntFlag{
+			Name:        "redis-db",
+			Usage:       "Redis database to use",
+			Value:       0,
+			EnvVar:      "PC_REDIS_DB",
+			Destination: &config.Server.RateLimit.RedisDB,
+		},
+		cli.StringSliceFlag{
+			Name:   "rate-limit-allowlist",
+			Usage:  "Network in CIDR notation whose requests are exempt from rate limiting, e.g. '10.0.0.0/8'. Can be provided multiple times",
+			EnvVar: "PC_RATE_LIMIT_ALLOWLIST",
+		},
+		cli.StringFlag{
+			Name:        "client-ca-file",
+			Usage:       "Path to PEM file with CA certificates. If provided, clients may authenticate with a certificate signed by one of these CAs",
+			Value:       "",
+			EnvVar:      "PC_CLIENT_CA_FILE",
+			Destination: &config.Server.ClientCAFile,
+		},
+		cli.StringFlag{
+			Name:        "base-url",
+			Usage:       "Base url for constructing urls",
+			Value:       "",
+			EnvVar:      "PC_BASE_URL",
+			Destination: &config.Server.BaseUrl,
+		},
+		cli.IntFlag{
+			Name:        "token-bytes",
+			Usage:       "Number of random bytes used for generating auth tokens. At least 16",
+			Value:       0,
+			EnvVar:      "PC_TOKEN_BYTES",
+			Destination: &config.Server.TokenBytes,
+		},
+		cli.BoolFlag{
+			Name:        "cors",
+			Usage:       "Enable Cross-Origin Resource Sharing",
+			EnvVar:      "PC_CORS",
+			Destination: &config.Server.Cors,
+		},
+		cli.DurationFlag{
+			Name:        "cors-max-age",
+			Usage:       "How long browsers may cache CORS preflight results, e.g. '10m'",
+			EnvVar:      "PC_CORS_MAX_AGE",
+			Destination: &config.Server.CorsMaxAge,
+		},
+		cli.StringSliceFlag{
+			Name:   "cors-allowed-origin",
+			Usage:  "Origin allowed to make cross-origin requests, e.g. 'https://app.padlock.io'. Any origin is allowed if not provided. Can be provided multiple times",
+			EnvVar: "PC_CORS_ALLOWED_ORIGINS",
+		},
+		cli.BoolFlag{
+			Name:        "cors-allow-credentials",
+			Usage:       "Allow credentials like cookies in cross-origin requests. Requires --cors-allowed-origin",
+			EnvVar:      "PC_CORS_ALLOW_CREDENTIALS",
+			Destination: &config.Server.CorsAllowCredentials,
+		},
+		cli.BoolFlag{
+			Name:        "read-only",
+			Usage:       "Start in read-only mode, rejecting any requests that would modify data",
+			EnvVar:      "PC_READ_ONLY",
+			Destination: &config.Server.ReadOnly,
+		},
+		cli.StringFlag{
+			Name:        "admin-addr",
+			Usage:       "Address to serve the admin api on, e.g. 'localhost:3001'. The admin api is disabled if not set",
+			Value:       "",
+			EnvVar:      "PC_ADMIN_ADDR",
+			Destination: &config.Server.Admin.Addr,
+		},
+		cli.StringFlag{
+			Name:        "pprof-addr",
+			Usage:       "Address to serve profiling data on, e.g. 'localhost:6060'. Disabled if not set. Never expose this publicly",
+			EnvVar:      "PC_PPROF_ADDR",
+			Destination: &config.Server.PprofAddr,
+		},
+		cli.StringFlag{
+			Name:        "internal-bind-addr",
+			Usage:       "Address for serving metrics, health checks, profiling data and the admin api, e.g. 'localhost:9090'. Never expose this publicly",
+			EnvVar:      "PC_INTERNAL_BIND_ADDR",
+			Destination: &config.Server.InternalBindAddr,
+		},
+		cli.StringFlag{
+			Name:        "admin-key",
+			Usage:       "Key for authenticating requests to the admin api",
+			Value:       "",
+			EnvVar:      "PC_ADMIN_KEY",
+			Destination: &config.Server.Admin.Key,
+		},
+		cli.StringFlag{
+			Name:        "admin-key-file",
+			Usage:       "File to read the admin key from. Takes precedence over --admin-key",
+			EnvVar:      "PC_ADMIN_KEY_FILE",
+			Destination: &config.Server.Admin.KeyFile,
+		},
+		cli.StringFlag{
+			Name:        "secret-file",
+			Usage:       "File to read the secret used for authenticating cookies from",
+			EnvVar:      "PC_SECRET_FILE",
+			Destination: &config.Server.SecretFile,
+		},
+		cli.DurationFlag{
+			Name:        "backup-interval",
+			Usage:       "Interval in which to create backups, e.g. '24h'. Backups are disabled if not set",
+			EnvVar:      "PC_BACKUP_INTERVAL",
+			Destination: &config.Server.Backup.Interval,
+		},
+		cli.StringFlag{
+			Name:        "backup-dest",
+			Usage:       "Directory to store backups in",
+			Value:       "",
+			EnvVar:      "PC_BACKUP_DEST",
+			Destination: &config.Server.Backup.Destination,
+		},
+		cli.IntFlag{
+			Name:        "backup-retention",
+			Usage:       "Number of backups to keep. If 0, all backups are kept",
+			Value:       0,
+			EnvVar:      "PC_BACKUP_RETENTION",
+			Destination: &config.Server.Backup.Retention,
+		},
 	}
 
 	cliApp.Commands = []cli.Command{
 		{
 			Name:  "runserver",
 			Usage: "Starts a Padlock Cloud server instance",
-			Flags: []cli.Flag{
-				cli.IntFlag{
-					Name:        "port, p",
-					Usage:       "Port to listen on",
-					Value:       3000,
-					EnvVar:      "PC_PORT",
-					Destination: &config.Server.Port,
-				},
-				cli.StringFlag{
-					Name:        "assets-path",
-					Usage:       "Path to assets directory",
-					Value:       DefaultAssetsPath,
-					EnvVar:      "PC_ASSETS_PATH",
-					Destination: &config.Server.AssetsPath,
-				},
-				cli.StringFlag{
-					Name:        "tls-cert",
-					Usage:       "Path to TLS certification file",
-					Value:       "",
-					EnvVar:      "PC_TLS_CERT",
-					Destination: &config.Server.TLSCert,
-				},
-				cli.StringFlag{
-					Name:        "tls-key",
-					Usage:       "Path to TLS key file",
-					Value:       "",
-					EnvVar:      "PC_TLS_KEY",
-					Destination: &config.Server.TLSKey,
-				},
-				cli.StringFlag{
-					Name:        "base-url",
-					Usage:       "Base url for constructing urls",
-					Value:       "",
-					EnvVar:      "PC_BASE_URL",
-					Destination: &config.Server.BaseUrl,
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "print-config",
+					Usage: "Print the effective configuration with secrets masked and exit",
 				},
 				cli.BoolFlag{
-					Name:        "cors",
-					Usage:       "Enable Cross-Origin Resource Sharing",
-					EnvVar:      "PC_CORS",
-					Destination: &config.Server.Cors,
+					Name:  "dry-run",
+					Usage: "Check that the server would start, i.e. that the config is valid and storage, assets and TLS certificates can be loaded, and exit",
 				},
-			},
+				cli.BoolFlag{
+					Name:  "check-smtp",
+					Usage: "With --dry-run, also test the connection to the mail server",
+				},
+			}, serverFlags...),
 			Action: cliApp.RunServer,
 		},
+		{
+			Name:  "config",
+			Usage: "Commands for inspecting the configuration",
+			Subcommands: []cli.Command{
+				{
+					Name:   "show",
+					Usage:  "Print the effective configuration with secrets masked",
+					Flags:  serverFlags,
+					Action: cliApp.ShowConfig,
+				},
+				{
+					Name:      "get",
+					Usage:     "Print the effective value of a single config key, e.g. 'server.port'",
+					ArgsUsage: "<key>",
+					Flags:     serverFlags,
+					Action:    cliApp.GetConfigValue,
+				},
+				{
+					Name:      "set",
+					Usage:     "Update a single key in the config file provided via --config",
+					ArgsUsage: "<key> <value>",
+					Action:    cliApp.SetConfigValue,
+				},
+				{
+					Name:      "diff",
+					Usage:     "Preview the changes a reload would make, comparing the effective configuration against a config file",
+					ArgsUsage: "<path>",
+					Flags:     serverFlags,
+					Action:    cliApp.DiffConfig,
+				},
+			},
+		},
 		{
 			Name:  "accounts",
 			Usage: "Commands for managing accounts",
 			Subcommands: []cli.Command{
 				{
-					Name:   "list",
-					Usage:  "List existing accounts",
+					Name:  "list",
+					Usage: "List existing accounts",
+					Flags: []cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "tag",
+							Usage: "Only list accounts with this tag, e.g. 'plan=pro' or just 'plan'. Can be repeated",
+						},
+						cli.StringFlag{
+							Name:  "format",
+							Value: AccountListText,
+							Usage: "Output format, either 'text' for one email per line or 'csv' for a spreadsheet-friendly list including account details",
+						},
+					},
 					Action: cliApp.ListAccounts,
 				},
 				{
-					Name:   "create",
-					Usage:  "Create new account",
+					Name:  "create",
+					Usage: "Create new account. Fails if an account with the same email exists",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "if-not-exists",
+							Usage: "Do nothing if the account already exists",
+						},
+						cli.BoolFlag{
+							Name:  "upsert",
+							Usage: "Replace an existing account, removing its auth tokens and settings but keeping its data",
+						},
+					},
 					Action: cliApp.CreateAccount,
 				},
 				{
@@ -329,10 +2599,297 @@ func NewCliApp() *CliApp {
 					Action: cliApp.DisplayAccount,
 				},
 				{
-					Name:   "delete",
-					Usage:  "Delete account",
+					Name:      "tokens",
+					Usage:     "List the auth tokens of an account along with the devices they were requested from",
+					ArgsUsage: "<email>",
+					Action:    cliApp.ListAuthTokens,
+					Subcommands: []cli.Command{
+						{
+							Name:      "revoke-all",
+							Usage:     "Revoke all auth tokens of an account, forcing every device to log in again",
+							ArgsUsage: "<email>",
+							Action:    cliApp.RevokeAllAuthTokens,
+						},
+					},
+				},
+				{
+					Name:  "data",
+					Usage: "Commands for managing previous versions of account data",
+					Subcommands: []cli.Command{
+						{
+							Name:      "versions",
+							Usage:     "List the stored versions of an account's data",
+							ArgsUsage: "<email>",
+							Action:    cliApp.ListDataVersions,
+						},
+						{
+							Name:      "rollback",
+							Usage:     "Restore a previous version of an account's data",
+							ArgsUsage: "<email> <version>",
+							Flags: []cli.Flag{
+								cli.BoolFlag{
+									Name:  "yes, y",
+									Usage: "Skip confirmation",
+								},
+							},
+							Action: cliApp.RollbackData,
+						},
+					},
+				},
+				{
+					Name:  "delete",
+					Usage: "Delete account. Moves the account to the trash if --trash-retention is set",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "yes, y",
+							Usage: "Skip confirmation",
+						},
+					},
 					Action: cliApp.DeleteAccount,
 				},
+				{
+					Name:      "erase",
+					Usage:     "Permanently erase an account along with its data, tokens and trashed copy, e.g. for GDPR erasure requests. Requires an audit log",
+					ArgsUsage: "<email>",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "yes, y",
+							Usage: "Skip confirmation",
+						},
+						cli.StringFlag{
+							Name:   "operator",
+							Usage:  "Name of the person performing the erasure, recorded in the audit log. Defaults to the current user",
+							EnvVar: "PC_OPERATOR,USER",
+						},
+						cli.StringFlag{
+							Name:  "request-id",
+							Usage: "Reference of the erasure request, e.g. a ticket number, recorded in the audit log",
+						},
+						cli.BoolFlag{
+							Name:  "notify",
+							Usage: "Notify the configured webhooks of the erasure",
+						},
+					},
+					Action: cliApp.EraseAccount,
+				},
+				{
+					Name:      "reset-data",
+					Usage:     "Remove the data stored for an account, keeping the account and its auth tokens",
+					ArgsUsage: "<email>",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "yes, y",
+							Usage: "Skip confirmation",
+						},
+					},
+					Action: cliApp.ResetAccountData,
+				},
+				{
+					Name:      "rename",
+					Usage:     "Change the email address of an account, keeping its data",
+					ArgsUsage: "<old-email> <new-email>",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "yes, y",
+							Usage: "Skip confirmation",
+						},
+					},
+					Action: cliApp.RenameAccount,
+				},
+				{
+					Name:      "restore",
+					Usage:     "Restore a deleted account from the trash",
+					ArgsUsage: "<email>",
+					Action:    cliApp.RestoreAccount,
+				},
+				{
+					Name:      "suspend",
+					Usage:     "Block access to an account without deleting its data",
+					ArgsUsage: "<email> [reason]",
+					Action:    cliApp.SuspendAccount,
+				},
+				{
+					Name:      "unsuspend",
+					Usage:     "Reinstate a suspended account",
+					ArgsUsage: "<email>",
+					Action:    cliApp.UnsuspendAccount,
+				},
+				{
+					Name:      "tag",
+					Usage:     "Add tags to an account, replacing existing values for the same keys",
+					ArgsUsage: "<email> <key=value>...",
+					Action:    cliApp.TagAccount,
+				},
+				{
+					Name:      "untag",
+					Usage:     "Remove tags from an account",
+					ArgsUsage: "<email> <key>...",
+					Action:    cliApp.UntagAccount,
+				},
+				{
+					Name:      "set-ratelimit",
+					Usage:     "Override the default email rate limit for an account. Use 0 to restore the default",
+					ArgsUsage: "<email> <email requests per minute>",
+					Action:    cliApp.SetAccountRateLimit,
+				},
+				{
+					Name:  "trash",
+					Usage: "Commands for managing deleted accounts",
+					Subcommands: []cli.Command{
+						{
+							Name:   "list",
+							Usage:  "List deleted accounts",
+							Action: cliApp.ListTrash,
+						},
+						{
+							Name:  "purge",
+							Usage: "Permanently remove accounts that have been in the trash longer than --trash-retention",
+							Flags: []cli.Flag{
+								cli.BoolFlag{
+									Name:  "all",
+									Usage: "Remove all accounts in the trash, regardless of when they were deleted",
+								},
+								cli.BoolFlag{
+									Name:  "yes, y",
+									Usage: "Skip confirmation",
+								},
+							},
+							Action: cliApp.PurgeTrash,
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "db",
+			Usage: "Commands for managing the database",
+			Subcommands: []cli.Command{
+				{
+					Name:  "stats",
+					Usage: "Display database statistics",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print statistics in JSON format",
+						},
+					},
+					Action: cliApp.DBStats,
+				},
+				{
+					Name:  "histogram",
+					Usage: "Display the size distribution of stored data",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print histogram in JSON format",
+						},
+					},
+					Action: cliApp.DBHistogram,
+				},
+				{
+					Name:   "compact",
+					Usage:  "Compact database to reclaim disk space",
+					Action: cliApp.DBCompact,
+				},
+				{
+					Name:   "verify",
+					Usage:  "Check stored data for corruption",
+					Action: cliApp.DBVerify,
+				},
+				{
+					Name:  "gc",
+					Usage: "Find records without a corresponding account (dry run unless --apply is set)",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "apply",
+							Usage: "Remove the orphaned records",
+						},
+						cli.BoolFlag{
+							Name:  "include-legacy",
+							Usage: "Also remove data stores without an account, which are otherwise kept as legacy accounts",
+						},
+					},
+					Action: cliApp.DBGC,
+				},
+				{
+					Name:      "backup",
+					Usage:     "Create a backup of the database",
+					ArgsUsage: "<dest>",
+					Flags:     progressFlags,
+					Action:    cliApp.DBBackup,
+				},
+				{
+					Name:      "restore",
+					Usage:     "Restore the database from a backup",
+					ArgsUsage: "<src>",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "Overwrite existing data",
+						},
+					},
+					Action: cliApp.DBRestore,
+				},
+				{
+					Name:  "rekey",
+					Usage: "Re-encrypt all stored data with a new encryption key",
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "old-key",
+							Usage: "Base64-encoded key the data is currently encrypted with. Defaults to the configured encryption key",
+						},
+						cli.IntFlag{
+							Name:  "old-key-version",
+							Usage: "Version of the old key. Defaults to the configured encryption key version",
+						},
+						cli.StringFlag{
+							Name:  "new-key",
+							Usage: "Base64-encoded key to encrypt the data with",
+						},
+						cli.IntFlag{
+							Name:  "new-key-version",
+							Usage: "Version of the new key. Defaults to the old key version + 1",
+						},
+						cli.IntFlag{
+							Name:  "log-every",
+							Usage: "Log progress every N records",
+							Value: 1000,
+						},
+					}, progressFlags...),
+					Action: cliApp.DBRekey,
+				},
+				{
+					Name:  "migrate",
+					Usage: "Copy all data to another database, e.g. one using different storage settings",
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "from",
+							Usage: "Config file whose 'leveldb' section describes the source database. Defaults to the current database",
+						},
+						cli.StringFlag{
+							Name:  "to",
+							Usage: "Config file whose 'leveldb' section describes the destination database",
+						},
+						cli.IntFlag{
+							Name:  "log-every",
+							Usage: "Log progress every N records",
+							Value: 1000,
+						},
+					}, progressFlags...),
+					Action: cliApp.DBMigrate,
+				},
+			},
+		},
+		{
+			Name:  "audit",
+			Usage: "Commands for inspecting the audit log",
+			Subcommands: []cli.Command{
+				{
+					Name:      "verify",
+					Usage:     "Check the audit log for modified or removed entries. Defaults to the file set via --audit-log",
+					ArgsUsage: "[path]",
+					Action:    cliApp.VerifyAuditLog,
+				},
 			},
 		},
 		{
@@ -340,21 +2897,42 @@ func NewCliApp() *CliApp {
 			Usage:  "Generate random 32 byte secret",
 			Action: cliApp.GenSecret,
 		},
+		{
+			Name:      "completion",
+			Usage:     "Print a shell completion script for bash or zsh",
+			ArgsUsage: "bash|zsh",
+			Action:    cliApp.Completion,
+		},
 	}
 
+	cliApp.EnableBashCompletion = true
+	cliApp.BashComplete = completeCommand(cliApp.Commands, cliApp.Flags)
+	setCompletions(cliApp.Commands)
+
 	cliApp.Before = func(context *cli.Context) error {
 		if cliApp.ConfigPath != "" {
 			absPath, _ := filepath.Abs(cliApp.ConfigPath)
 
-			fmt.Printf("Loading config from %s - all other flags and environment variables will be ignored!\n", absPath)
-			// Replace original config object to prevent flags from being applied
-			cliApp.InitConfig()
-			err := cliApp.Config.LoadFromFile(cliApp.ConfigPath)
-			if err != nil {
+			// Printed to stderr so the output of commands like `config get` can be used in scripts
+			fmt.Fprintf(os.Stderr, "Loading config from %s\n", absPath)
+			if err := cliApp.loadConfigFile(context); err != nil {
 				return err
 			}
 		}
 
+		if err := cliApp.Config.ReadSecretFiles(); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+
+		subjects, err := NewEmailSubjects(&cliApp.Config.Email)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+		cliApp.Server.EmailSubjects = subjects
+		if cliApp.Log.NotifySubject, err = subjects.RenderNotification(); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+
 		// Reinitializing log since log config may have changed
 		if err := cliApp.Log.Init(); err != nil {
 			return err
@@ -6,7 +6,26 @@ import "io/ioutil"
 import "os"
 import "path/filepath"
 import "time"
+import "io"
+import "strings"
 import "reflect"
+import "bytes"
+import "net"
+import "strconv"
+import "errors"
+import "math/big"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/pem"
+import "encoding/json"
+import "encoding/hex"
+import "archive/tar"
+import "compress/gzip"
+import "net/http/httptest"
+import "net/http"
 import "gopkg.in/yaml.v2"
 
 func NewSampleConfig(dir string) CliConfig {
@@ -122,3 +141,1435 @@ func TestCliConfigFile(t *testing.T) {
 
 	app.Server.Stop(time.Second)
 }
+
+func TestCliConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgPath := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(cfgPath, []byte(`
+server:
+  port: 5000
+  read_only: true
+  rate_limit_allowlist:
+    - 10.0.0.0/8
+leveldb:
+  path: file/db
+email:
+  user: file@example.com
+  server: smtp.example.com
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("PC_EMAIL_USER", "env@example.com")
+	defer os.Unsetenv("PC_EMAIL_USER")
+
+	var out bytes.Buffer
+	app := NewCliApp()
+	app.Writer = &out
+	if err := app.Run([]string{"padlock-cloud",
+		"--config", cfgPath,
+		"--log-file", os.DevNull,
+		"--err-file", os.DevNull,
+		"--db-path", "flag/db",
+		"config", "show",
+		"--port", "6000",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &CliConfig{}
+	if err := yaml.Unmarshal(out.Bytes(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Explicitly set flags and environment variables should override the file
+	if cfg.Server.Port != 6000 {
+		t.Errorf("Expected port to be overridden by command flag, is %d", cfg.Server.Port)
+	}
+	if cfg.LevelDB.Path != "flag/db" {
+		t.Errorf("Expected db path to be overridden by global flag, is %s", cfg.LevelDB.Path)
+	}
+	if cfg.Email.User != "env@example.com" {
+		t.Errorf("Expected email user to be overridden by environment variable, is %s", cfg.Email.User)
+	}
+
+	// Values from the file should be retained for flags that weren't set
+	if !cfg.Server.ReadOnly {
+		t.Error("Expected read_only to be retained from file")
+	}
+	if cfg.Email.Server != "smtp.example.com" {
+		t.Errorf("Expected email server to be retained from file, is %s", cfg.Email.Server)
+	}
+	if len(cfg.Server.RateLimitAllowlist) != 1 || cfg.Server.RateLimitAllowlist[0] != "10.0.0.0/8" {
+		t.Errorf("Expected allowlist to be retained from file, is %v", cfg.Server.RateLimitAllowlist)
+	}
+
+	// Settings missing from the file should fall back to the flag defaults
+	if cfg.Server.MaxRequestBodyBytes != 10<<20 {
+		t.Errorf("Expected max request body to fall back to the default, is %d", cfg.Server.MaxRequestBodyBytes)
+	}
+}
+
+func TestCliResetData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	acc := &Account{Email: testEmail}
+	token, _ := NewAuthToken(testEmail, "api", DefaultTokenBytes, nil)
+	token.Expires = time.Now().AddDate(1, 0, 0)
+	acc.AddAuthToken(token)
+	if err := storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&DataStore{Account: acc, Content: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	run := func(email string) error {
+		return NewCliApp().Run([]string{"padlock-cloud",
+			"--log-file", cfg.Log.LogFile,
+			"--err-file", cfg.Log.ErrFile,
+			"--db-path", cfg.LevelDB.Path,
+			"accounts", "reset-data", "--yes", email,
+		})
+	}
+
+	if err := run("unknown@padlock.io"); err == nil {
+		t.Fatal("Expected error for unknown account")
+	}
+
+	if err := run(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if err := storage.Get(&DataStore{Account: acc}); err != ErrNotFound {
+		t.Fatalf("Expected data to be removed, got %v", err)
+	}
+
+	acc2, err := GetAccount(storage, testEmail)
+	if err != nil {
+		t.Fatalf("Expected account to remain, got %v", err)
+	}
+	if len(acc2.AuthTokens) != 1 || acc2.AuthTokens[0].Token != token.Token {
+		t.Fatalf("Expected auth tokens to remain, got %+v", acc2.AuthTokens)
+	}
+}
+
+func TestCliConfirm(t *testing.T) {
+	prevIsTerminal := isTerminal
+	defer func() {
+		isTerminal = prevIsTerminal
+	}()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+
+	exists := func() bool {
+		if err := storage.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+		_, err := GetAccount(storage, testEmail)
+		return err == nil
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateAccount(storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	var out bytes.Buffer
+	run := func(stdin io.Reader, args ...string) error {
+		out.Reset()
+		app := NewCliApp()
+		app.Stdin = stdin
+		app.Writer = &out
+		return app.Run(append([]string{"padlock-cloud",
+			"--log-file", cfg.Log.LogFile,
+			"--err-file", cfg.Log.ErrFile,
+			"--db-path", cfg.LevelDB.Path,
+			"accounts", "delete",
+		}, args...))
+	}
+
+	// Without a terminal, destructive commands should require the --yes flag
+	isTerminal = func(io.Reader) bool { return false }
+	if err := run(strings.NewReader("y\n"), testEmail); err == nil || !exists() {
+		t.Fatalf("Expected command to be refused without --yes, got %v", err)
+	}
+
+	isTerminal = func(io.Reader) bool { return true }
+
+	for _, answer := range []string{"n\n", "\n", "", "nope\n"} {
+		if err := run(strings.NewReader(answer), testEmail); err == nil || !exists() {
+			t.Fatalf("Expected command to be aborted for answer %q, got %v", answer, err)
+		}
+	}
+
+	if err := run(strings.NewReader("y\n"), testEmail); err != nil || exists() {
+		t.Fatalf("Expected account to be deleted after confirmation, got %v", err)
+	}
+	if prompt := "Delete account " + testEmail + "? [y/N] "; !strings.HasPrefix(out.String(), prompt) {
+		t.Errorf("Expected prompt %q to be written to the app's writer, got %q", prompt, out.String())
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateAccount(storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	// The --yes flag should skip the prompt entirely
+	if err := run(strings.NewReader(""), "--yes", testEmail); err != nil || exists() {
+		t.Fatalf("Expected account to be deleted with --yes, got %v", err)
+	}
+	if strings.Contains(out.String(), "[y/N]") {
+		t.Errorf("Expected no prompt with --yes, got %q", out.String())
+	}
+}
+
+func TestCliShowConfig(t *testing.T) {
+	run := func(args ...string) string {
+		var out bytes.Buffer
+		app := NewCliApp()
+		app.Writer = &out
+		if err := app.Run(append([]string{"padlock-cloud",
+			"--log-file", os.DevNull,
+			"--err-file", os.DevNull,
+			"--email-password", "hunter2",
+		}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	for _, args := range [][]string{
+		{"config", "show", "--port", "4000", "--tls-key", "key.pem", "--rate-limit-allowlist", "10.0.0.0/8"},
+		{"runserver", "--print-config", "--port", "4000", "--tls-key", "key.pem", "--rate-limit-allowlist", "10.0.0.0/8"},
+	} {
+		out := run(args...)
+
+		cfg := &CliConfig{}
+		if err := yaml.Unmarshal([]byte(out), cfg); err != nil {
+			t.Fatalf("%v: Failed to parse output: %v", args, err)
+		}
+
+		if strings.Contains(out, "hunter2") || cfg.Email.Password != redactedValue {
+			t.Errorf("%v: Expected email password to be redacted, got %q", args, cfg.Email.Password)
+		}
+		if cfg.Server.TLSKey != redactedValue {
+			t.Errorf("%v: Expected tls key path to be redacted, got %q", args, cfg.Server.TLSKey)
+		}
+		// Unset secrets should not be reported as redacted
+		if cfg.Server.Admin.Key != "" {
+			t.Errorf("%v: Expected admin key to be empty, got %q", args, cfg.Server.Admin.Key)
+		}
+		if cfg.Server.Port != 4000 {
+			t.Errorf("%v: Expected port to be 4000, is %d", args, cfg.Server.Port)
+		}
+		if len(cfg.Server.RateLimitAllowlist) != 1 || cfg.Server.RateLimitAllowlist[0] != "10.0.0.0/8" {
+			t.Errorf("%v: Expected allowlist to be applied, got %v", args, cfg.Server.RateLimitAllowlist)
+		}
+	}
+}
+
+func TestCliSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "email_password")
+	envFile := filepath.Join(dir, "email_password_env")
+	for path, secret := range map[string]string{
+		passwordFile: "s3cret\n",
+		envFile:      "fromenv\r\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(secret), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfgPath := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(cfgPath, []byte(`
+email:
+  password: inline
+  password_file: `+passwordFile+`
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(args ...string) (*CliApp, error) {
+		app := NewCliApp()
+		app.Writer = ioutil.Discard
+		err := app.Run(append([]string{"padlock-cloud",
+			"--log-file", os.DevNull,
+			"--err-file", os.DevNull,
+		}, append(args, "config", "show")...))
+		return app, err
+	}
+
+	// The file set in the config file takes precedence over the inline password
+	app, err := run("--config", cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Config.Email.Password != "s3cret" {
+		t.Errorf("Expected email password to be read from file, got %q", app.Config.Email.Password)
+	}
+
+	// Files can be provided through `_FILE` environment variables as well
+	os.Setenv("PC_EMAIL_PASSWORD_FILE", envFile)
+	defer os.Unsetenv("PC_EMAIL_PASSWORD_FILE")
+	if app, err = run("--email-password", "inline"); err != nil {
+		t.Fatal(err)
+	}
+	if app.Config.Email.Password != "fromenv" {
+		t.Errorf("Expected email password to be read from file, got %q", app.Config.Email.Password)
+	}
+
+	// Missing files should be reported as invalid config
+	if _, err := run("--email-password-file", filepath.Join(dir, "missing")); ExitCode(err) != ExitInvalidConfig {
+		t.Errorf("Expected exit code %d for missing secret file, got %d (%v)", ExitInvalidConfig, ExitCode(err), err)
+	}
+}
+
+func TestCliConfigGetSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgPath := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(cfgPath, []byte(`
+server:
+  port: 5000
+  rate_limit_allowlist:
+    - 10.0.0.0/8
+email:
+  user: file@example.com
+  server: smtp.example.com
+  password: hunter2
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		app := NewCliApp()
+		app.Writer = &out
+		err := app.Run(append([]string{"padlock-cloud",
+			"--config", cfgPath,
+			"--log-file", os.DevNull,
+			"--err-file", os.DevNull,
+			"config",
+		}, args...))
+		return out.String(), err
+	}
+
+	for _, args := range [][]string{
+		{"set", "server.port", "4000"},
+		{"set", "server.trash_retention", "720h"},
+		{"set", "server.admin.addr", "localhost:3001"},
+	} {
+		if _, err := run(args...); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+
+	for key, expected := range map[string]string{
+		"server.port":            "4000\n",
+		"server.trash_retention": "720h0m0s\n",
+		"server.admin.addr":      "localhost:3001\n",
+		"email.server":           "smtp.example.com\n",
+		"email.password":         redactedValue + "\n",
+	} {
+		if out, err := run("get", key); err != nil {
+			t.Errorf("%s: %v", key, err)
+		} else if out != expected {
+			t.Errorf("%s: Expected %q, got %q", key, expected, out)
+		}
+	}
+
+	// Unrelated keys should be left untouched
+	cfg := &CliConfig{}
+	if err := cfg.LoadFromFile(cfgPath); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Email.User != "file@example.com" || cfg.Email.Password != "hunter2" ||
+		len(cfg.Server.RateLimitAllowlist) != 1 || cfg.Server.RateLimitAllowlist[0] != "10.0.0.0/8" {
+		t.Errorf("Expected unrelated keys to be preserved, got %+v", cfg)
+	}
+	if info, _ := os.Stat(cfgPath); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected file mode to be preserved, is %v", info.Mode())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected no temporary files to be left behind, found %d files", len(files))
+	}
+
+	for _, args := range [][]string{
+		{"get", "server.nope"},
+		{"set", "server.nope", "1"},
+		{"set", "server.port.nope", "1"},
+		{"set", "server.port", "not a number"},
+	} {
+		if _, err := run(args...); err == nil {
+			t.Errorf("%v: Expected an error", args)
+		}
+	}
+}
+
+func TestCliReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgPath := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(cfgPath, []byte("server:\n  read_only: false\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := NewCliApp()
+	app.Log.Init()
+	app.Info.SetOutput(ioutil.Discard)
+	app.ConfigPath = cfgPath
+
+	app.Server.SetReadOnly(true)
+	if err := app.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if app.Server.ReadOnly() {
+		t.Error("Expected read-only mode to be taken from the config file")
+	}
+
+	// Read-only mode set via flag or environment variable should survive reloading
+	app.readOnlyFromFlag = true
+	app.Server.SetReadOnly(true)
+	if err := app.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !app.Server.ReadOnly() {
+		t.Error("Expected read-only mode set via flag to take precedence over the config file")
+	}
+}
+
+func TestCliStrictConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgPath := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(cfgPath, []byte(`
+server:
+  port: 5000
+  prot: 6000
+  listeners:
+    - addr: localhost:5001
+      adress: localhost:5002
+emali:
+  server: smtp.example.com
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		app := NewCliApp()
+		app.Writer = &out
+		err := app.Run(append([]string{"padlock-cloud",
+			"--config", cfgPath,
+			"--log-file", os.DevNull,
+			"--err-file", os.DevNull,
+		}, args...))
+		return out.String(), err
+	}
+
+	// Unknown keys should be ignored by default
+	if out, err := run("config", "get", "server.port"); err != nil {
+		t.Fatal(err)
+	} else if out != "5000\n" {
+		t.Errorf("Expected port 5000, got %q", out)
+	}
+
+	// ...and reported in strict mode
+	_, err = run("--strict-config", "config", "get", "server.port")
+	if err == nil {
+		t.Fatal("Expected an error for unknown config keys")
+	}
+	for _, key := range []string{"server.prot", "server.listeners.0.adress", "emali"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected error to mention %s, got %v", key, err)
+		}
+	}
+
+	cfg := &CliConfig{}
+	if err := cfg.LoadFromFileStrict(cfgPath); err == nil {
+		t.Error("Expected LoadFromFileStrict to fail")
+	}
+	if err := cfg.LoadFromFile(cfgPath); err != nil {
+		t.Errorf("Expected LoadFromFile to succeed, got %v", err)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	current := &CliConfig{}
+	current.Server.Port = 3000
+	current.Email.Password = "hunter2"
+	current.Server.RateLimitAllowlist = []string{}
+
+	updated := &CliConfig{}
+	updated.Server.Port = 4000
+	updated.Server.ReadOnly = true
+	updated.Email.Password = "hunter3"
+
+	changes := DiffConfig(current, updated)
+	expected := []*ConfigChange{
+		{"email.password", strconv.Quote(redactedValue), strconv.Quote(redactedValue), true},
+		{"server.port", "3000", "4000", true},
+		{"server.read_only", "false", "true", false},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		var got []ConfigChange
+		for _, c := range changes {
+			got = append(got, *c)
+		}
+		t.Errorf("Unexpected changes: %+v", got)
+	}
+
+	if changes := DiffConfig(current, current); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %d", len(changes))
+	}
+}
+
+func TestCliConfigDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgPath := filepath.Join(dir, "config.yaml")
+	newPath := filepath.Join(dir, "new.yaml")
+	for path, data := range map[string]string{
+		cfgPath: "server:\n  port: 5000\n",
+		newPath: "server:\n  port: 6000\n  read_only: true\n  base_url: https://cloud.example.com\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	app := NewCliApp()
+	app.Writer = &out
+	if err := app.Run([]string{"padlock-cloud",
+		"--config", cfgPath,
+		"--log-file", os.DevNull,
+		"--err-file", os.DevNull,
+		"config", "diff", "--port", "4000", newPath,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The port is overridden by the flag in both cases
+	expected := "server.base_url: \"\" -> \"https://cloud.example.com\" (requires restart)\n" +
+		"server.read_only: false -> true (can be reloaded)\n"
+	if out.String() != expected {
+		t.Errorf("Expected output %q, got %q", expected, out.String())
+	}
+}
+
+func TestCliExitCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"a@padlock.io", "b@padlock.io"} {
+		if _, err := CreateAccount(storage, email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage.Close()
+
+	run := func(args ...string) error {
+		return NewCliApp().Run(append([]string{"padlock-cloud",
+			"--log-file", cfg.Log.LogFile,
+			"--err-file", cfg.Log.ErrFile,
+			"--db-path", cfg.LevelDB.Path,
+		}, args...))
+	}
+
+	for _, c := range []struct {
+		args []string
+		code int
+	}{
+		{[]string{"accounts", "suspend", "a@padlock.io"}, 0},
+		{[]string{"accounts", "suspend", "unknown@padlock.io"}, ExitNotFound},
+		{[]string{"accounts", "rename", "--yes", "a@padlock.io", "b@padlock.io"}, ExitConflict},
+		{[]string{"accounts", "create"}, ExitInvalidArgument},
+		{[]string{"accounts", "trash", "purge"}, ExitInvalidArgument},
+		{[]string{"accounts", "trash", "purge", "--all", "--yes"}, 0},
+		{[]string{"--config", filepath.Join(dir, "missing.yaml"), "accounts", "list"}, ExitInvalidConfig},
+		{[]string{"--notify-errors", "not an address", "runserver"}, ExitInvalidConfig},
+		{[]string{"runserver", "--base-url", "example.com"}, ExitInvalidConfig},
+	} {
+		if code := ExitCode(run(c.args...)); code != c.code {
+			t.Errorf("%v: Expected exit code %d, got %d", c.args, c.code, code)
+		}
+	}
+
+	// Storage held open by another process
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	for _, args := range [][]string{{"accounts", "list"}, {"db", "compact"}, {"db", "backup", filepath.Join(dir, "backup")}} {
+		if err := run(args...); ExitCode(err) != ExitStorage {
+			t.Errorf("%v: Expected exit code %d for locked storage, got %d (%v)", args, ExitStorage, ExitCode(err), err)
+		} else if !strings.Contains(err.Error(), "in use by another process") {
+			t.Errorf("%v: Expected a hint about the database being in use, got %v", args, err)
+		}
+	}
+}
+
+func TestCliBackupRunningServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if err := storage.Put(&Account{Email: testEmail}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server holds the lock on the database, so the backup has to go through its admin api
+	ctx := newServerTestContext()
+	ctx.server.Storage = storage
+	ctx.server.Config.Admin.Key = testAdminKey
+	admin := httptest.NewServer(ctx.server.AdminHandler())
+	defer admin.Close()
+
+	cfg.Server.Admin.Addr = strings.TrimPrefix(admin.URL, "http://")
+	cfg.Server.Admin.Key = testAdminKey
+	cfgPath := filepath.Join(dir, "config.yaml")
+	yamlData, _ := yaml.Marshal(cfg)
+	if err := ioutil.WriteFile(cfgPath, yamlData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "backup.tar.gz")
+	if err := NewCliApp().Run([]string{"padlock-cloud", "--config", cfgPath, "db", "backup", dest}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	restored := &LevelDBStorage{Config: &LevelDBConfig{Path: filepath.Join(dir, "restored")}}
+	if err := restored.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if err := restored.Restore(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Get(&Account{Email: testEmail}); err != nil {
+		t.Errorf("Expected account to be contained in backup, got %v", err)
+	}
+
+	// A wrong key should be reported
+	cfg.Server.Admin.Key = "wrong"
+	yamlData, _ = yaml.Marshal(cfg)
+	if err := ioutil.WriteFile(cfgPath, yamlData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewCliApp().Run([]string{"padlock-cloud", "--config", cfgPath, "db", "backup", dest + "2"}); err == nil {
+		t.Error("Expected backup with wrong admin key to fail")
+	}
+}
+
+func TestCliDBRestoreForce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&Account{Email: testEmail}); err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if err := storage.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&Account{Email: "new@padlock.io"}); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	// A backup whose framing is intact but which contains an entry that can't be decoded
+	var corrupt bytes.Buffer
+	gw := gzip.NewWriter(&corrupt)
+	tw := tar.NewWriter(gw)
+	for _, e := range []struct{ key, value string }{
+		{"a@padlock.io", "{}"},
+		{"b@padlock.io", "not an account"},
+	} {
+		tw.WriteHeader(&tar.Header{Name: "auth-accounts/" + hex.EncodeToString([]byte(e.key)), Mode: 0600, Size: int64(len(e.value))})
+		tw.Write([]byte(e.value))
+	}
+	tw.Close()
+	gw.Close()
+
+	write := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	restore := func(src string) error {
+		return NewCliApp().Run([]string{"padlock-cloud",
+			"--log-file", cfg.Log.LogFile,
+			"--err-file", cfg.Log.ErrFile,
+			"--db-path", cfg.LevelDB.Path,
+			"db", "restore", "--force", src,
+		})
+	}
+
+	accounts := func() []string {
+		if err := storage.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+		keys, err := storage.List(&Account{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	// Invalid backups should leave the existing data untouched
+	for name, src := range map[string]string{
+		"truncated": write("truncated.tar.gz", backup.Bytes()[:backup.Len()/2]),
+		"corrupt":   write("corrupt.tar.gz", corrupt.Bytes()),
+		"missing":   filepath.Join(dir, "missing.tar.gz"),
+	} {
+		if err := restore(src); err == nil {
+			t.Errorf("%s: Expected restoring to fail", name)
+		}
+		if keys := accounts(); len(keys) != 2 {
+			t.Fatalf("%s: Expected existing accounts to survive, got %v", name, keys)
+		}
+	}
+
+	// A valid backup should replace the existing data
+	if err := restore(write("backup.tar.gz", backup.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if keys := accounts(); len(keys) != 1 || keys[0] != testEmail {
+		t.Errorf("Expected only the backed up account to remain, got %v", keys)
+	}
+}
+
+func TestCliListAuthTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	acc := &Account{Email: testEmail}
+	token, _ := NewAuthToken(testEmail, "api", DefaultTokenBytes, nil)
+	token.DeviceName = "Alice's iPhone"
+	acc.AddAuthToken(token)
+	if err := storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	var out bytes.Buffer
+	app := NewCliApp()
+	app.Writer = &out
+	if err := app.Run([]string{"padlock-cloud",
+		"--log-file", cfg.Log.LogFile,
+		"--err-file", cfg.Log.ErrFile,
+		"--db-path", cfg.LevelDB.Path,
+		"accounts", "tokens", testEmail,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "NAME") || !strings.Contains(out.String(), token.Id+"  Alice's iPhone") {
+		t.Errorf("Expected device name to be listed, got:\n%s", out.String())
+	}
+}
+
+func TestCliRevokeAllAuthTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	acc := &Account{Email: testEmail}
+	for i := 0; i < 2; i++ {
+		token, _ := NewAuthToken(testEmail, "api", DefaultTokenBytes, nil)
+		acc.AddAuthToken(token)
+	}
+	if err := storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	var out bytes.Buffer
+	app := NewCliApp()
+	app.Writer = &out
+	if err := app.Run([]string{"padlock-cloud",
+		"--log-file", cfg.Log.LogFile,
+		"--err-file", cfg.Log.ErrFile,
+		"--db-path", cfg.LevelDB.Path,
+		"accounts", "tokens", "revoke-all", testEmail,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "Revoked 2 auth tokens") {
+		t.Errorf("Expected number of revoked tokens to be printed, got:\n%s", out.String())
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if err := storage.Get(acc); err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.AuthTokens) != 0 {
+		t.Errorf("Expected account to have no auth tokens, has %d", len(acc.AuthTokens))
+	}
+}
+
+func TestCliWithStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	app := NewCliApp()
+	app.Storage = &LevelDBStorage{Config: &cfg.LevelDB}
+
+	// Storage should be closed regardless of whether `fn` succeeds
+	for _, expected := range []error{nil, errors.New("fn failed")} {
+		if err := app.withStorage(func() error {
+			if err := app.Storage.Put(&Account{Email: testEmail}); err != nil {
+				t.Errorf("Expected storage to be open, got %v", err)
+			}
+			return expected
+		}); err != expected {
+			t.Errorf("Expected error %v, got %v", expected, err)
+		}
+
+		if app.Storage.stores != nil {
+			t.Error("Expected storage to be closed")
+		}
+	}
+}
+
+func TestCliCreateAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	acc := &Account{Email: testEmail, AuthTokens: []*AuthToken{{Token: "token", Id: "id"}}}
+	if err := storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&DataStore{Account: acc, Content: []byte(testData)}); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	run := func(args ...string) error {
+		app := NewCliApp()
+		app.Writer = ioutil.Discard
+		return app.Run(append([]string{"padlock-cloud",
+			"--log-file", cfg.Log.LogFile,
+			"--err-file", cfg.Log.ErrFile,
+			"--db-path", cfg.LevelDB.Path,
+			"accounts", "create",
+		}, args...))
+	}
+
+	tokens := func() int {
+		if err := storage.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+		acc, err := GetAccount(storage, testEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(acc.AuthTokens)
+	}
+
+	// By default, existing accounts should be left alone and reported as a conflict
+	if err := run(testEmail); ExitCode(err) != ExitConflict {
+		t.Errorf("Expected exit code %d for existing account, got %d (%v)", ExitConflict, ExitCode(err), err)
+	}
+	if n := tokens(); n != 1 {
+		t.Errorf("Expected auth tokens to be kept, got %d", n)
+	}
+
+	if err := run("--if-not-exists", testEmail); err != nil {
+		t.Errorf("Expected --if-not-exists to ignore existing account, got %v", err)
+	}
+	if n := tokens(); n != 1 {
+		t.Errorf("Expected auth tokens to be kept, got %d", n)
+	}
+
+	if err := run("--if-not-exists", "--upsert", testEmail); ExitCode(err) != ExitInvalidArgument {
+		t.Errorf("Expected exit code %d for conflicting flags, got %d (%v)", ExitInvalidArgument, ExitCode(err), err)
+	}
+
+	if err := run("--upsert", testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if n := tokens(); n != 0 {
+		t.Errorf("Expected --upsert to replace account, got %d auth tokens", n)
+	}
+
+	// Data should survive replacing the account
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	data := &DataStore{Account: &Account{Email: testEmail}}
+	if err := storage.Get(data); err != nil || string(data.Content) != testData {
+		t.Errorf("Expected data to be kept, got %v", err)
+	}
+	storage.Close()
+
+	// New accounts are created regardless of the mode
+	for _, args := range [][]string{{"a@padlock.io"}, {"--if-not-exists", "b@padlock.io"}, {"--upsert", "c@padlock.io"}} {
+		if err := run(args...); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+}
+
+func TestCliEraseAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	events := make(chan *WebhookEvent, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &WebhookEvent{}
+		json.NewDecoder(r.Body).Decode(event)
+		events <- event
+	}))
+	defer receiver.Close()
+
+	cfg := NewSampleConfig(dir)
+	cfg.Server.AuditLog = filepath.Join(dir, "audit.log")
+	cfg.Server.Webhooks.URLs = []string{receiver.URL}
+	cfgPath := filepath.Join(dir, "config.yaml")
+	yamlData, _ := yaml.Marshal(cfg)
+	if err = ioutil.WriteFile(cfgPath, yamlData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	acc := &Account{Email: testEmail, AuthTokens: []*AuthToken{{Token: "token", Id: "id", Email: testEmail}}}
+	if err := storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&DataStore{Account: acc, Content: []byte(testData)}); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		app := NewCliApp()
+		app.Writer = &out
+		err := app.Run(append([]string{"padlock-cloud",
+			"--config", cfgPath,
+			"accounts", "erase",
+		}, args...))
+		return out.String(), err
+	}
+
+	if _, err := run("--yes", "--operator", "", testEmail); ExitCode(err) != ExitInvalidArgument {
+		t.Errorf("Expected exit code %d without operator, got %d (%v)", ExitInvalidArgument, ExitCode(err), err)
+	}
+
+	out, err := run("--yes", "--operator", "alice", "--request-id", "GDPR-42", "--notify", testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Erased account "+testEmail+"\n" {
+		t.Errorf("Expected success to be reported, got %q", out)
+	}
+
+	// Nothing should be left of the account
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyErased(storage, testEmail); err != nil {
+		t.Errorf("Expected all records to be removed, got %v", err)
+	}
+	storage.Close()
+
+	// The erasure should be recorded in the audit log
+	auditData, err := ioutil.ReadFile(cfg.Server.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The start of the erasure is recorded before anything is deleted
+	lines := bytes.Split(bytes.TrimSpace(auditData), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 audit entries, got %d", len(lines))
+	}
+	for i, event := range []string{"account:erase:started", "account:erase"} {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(lines[i], entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Event != event || entry.Email != testEmail || entry.RequestID != "GDPR-42" ||
+			entry.Details != "operator=alice" || entry.Time.IsZero() {
+			t.Errorf("Unexpected audit entry: %+v", entry)
+		}
+	}
+
+	select {
+	case event := <-events:
+		if event.Event != "account:erase" || event.Email != testEmail {
+			t.Errorf("Unexpected webhook event: %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected webhook to be notified")
+	}
+
+	if _, err := run("--yes", "--operator", "alice", testEmail); ExitCode(err) != ExitNotFound {
+		t.Errorf("Expected exit code %d for erased account, got %d (%v)", ExitNotFound, ExitCode(err), err)
+	}
+
+	// Failed attempts are recorded as well
+	if auditData, err = ioutil.ReadFile(cfg.Server.AuditLog); err != nil {
+		t.Fatal(err)
+	}
+	lines = bytes.Split(bytes.TrimSpace(auditData), []byte("\n"))
+	entry := &AuditEntry{}
+	if err := json.Unmarshal(lines[len(lines)-1], entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Event != "account:erase:failed" || entry.Details != "operator=alice error="+ErrNotFound.Error() {
+		t.Errorf("Unexpected audit entry: %+v", entry)
+	}
+}
+
+func TestCliAccountsCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	acc := &Account{
+		Email:      "a@padlock.io",
+		Created:    created,
+		Updated:    created,
+		Suspended:  true,
+		AuthTokens: []*AuthToken{{Token: "token1", Id: "id1"}, {Token: "token2", Id: "id2"}},
+	}
+	if err := storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&DataStore{Account: acc, Content: []byte(testData)}); err != nil {
+		t.Fatal(err)
+	}
+	// Sizes are reported as stored, including the storage's framing of values
+	dataSize := 0
+	if err := storage.ListPrefixFunc(&DataStore{}, acc.Email, func(key string, size int) error {
+		dataSize = size
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		app := NewCliApp()
+		app.Writer = &out
+		err := app.Run(append([]string{"padlock-cloud",
+			"--log-file", cfg.Log.LogFile,
+			"--err-file", cfg.Log.ErrFile,
+			"--db-path", cfg.LevelDB.Path,
+			"accounts", "list",
+		}, args...))
+		return out.String(), err
+	}
+
+	out, err := run("--format", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out, "\n")
+	if len(lines) != 3 || lines[0] != "email,created,updated,suspended,token_count,data_size" || lines[2] != "" {
+		t.Fatalf("Expected header and a single row, got %q", out)
+	}
+	// Storing the account sets the modification time
+	row := strings.Split(lines[1], ",")
+	if _, err := time.Parse(time.RFC3339, row[2]); err != nil {
+		t.Errorf("Expected modification time, got %q", row[2])
+	}
+	row[2] = ""
+	expected := fmt.Sprintf("a@padlock.io,2017-03-01T12:00:00Z,,true,2,%d", dataSize)
+	if strings.Join(row, ",") != expected {
+		t.Errorf("Expected %q, got %q", expected, lines[1])
+	}
+
+	if _, err := run("--format", "xml"); ExitCode(err) != ExitInvalidArgument {
+		t.Errorf("Expected exit code %d for unsupported format, got %d (%v)", ExitInvalidArgument, ExitCode(err), err)
+	}
+
+	// Fields containing separators or quotes have to be escaped
+	var buf bytes.Buffer
+	mem := &MemoryStorage{}
+	mem.Open()
+	defer mem.Close()
+	if err := mem.Put(&Account{Email: `"quoted",name@padlock.io`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAccountsCSV(&buf, mem, nil); err != nil {
+		t.Fatal(err)
+	}
+	if line := strings.Split(buf.String(), "\n")[1]; !strings.HasPrefix(line, `"""quoted"",name@padlock.io",`) {
+		t.Errorf("Expected email to be escaped, got %q", line)
+	}
+}
+
+func TestCliAccountTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"a@padlock.io", "b@padlock.io", "c@padlock.io"} {
+		if _, err := CreateAccount(storage, email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage.Close()
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		app := NewCliApp()
+		app.Writer = &out
+		err := app.Run(append([]string{"padlock-cloud",
+			"--log-file", cfg.Log.LogFile,
+			"--err-file", cfg.Log.ErrFile,
+			"--db-path", cfg.LevelDB.Path,
+			"accounts",
+		}, args...))
+		return out.String(), err
+	}
+
+	for _, args := range [][]string{
+		{"tag", "a@padlock.io", "plan=pro", "region=eu"},
+		{"tag", "b@padlock.io", "plan=pro", "region=us"},
+		{"tag", "c@padlock.io", "plan=free"},
+		{"untag", "b@padlock.io", "region"},
+	} {
+		if _, err := run(args...); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+
+	for _, c := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"list"}, "a@padlock.io\nb@padlock.io\nc@padlock.io\n"},
+		{[]string{"list", "--tag", "plan=pro"}, "a@padlock.io\nb@padlock.io\n"},
+		{[]string{"list", "--tag", "region"}, "a@padlock.io\n"},
+		{[]string{"list", "--tag", "plan=pro", "--tag", "region=us"}, ""},
+	} {
+		if out, err := run(c.args...); err != nil {
+			t.Errorf("%v: %v", c.args, err)
+		} else if out != c.expected {
+			t.Errorf("%v: Expected %q, got %q", c.args, c.expected, out)
+		}
+	}
+
+	if _, err := run("tag", "a@padlock.io", "plan"); ExitCode(err) != ExitInvalidArgument {
+		t.Errorf("Expected an invalid argument error for a tag without value, got %v", err)
+	}
+}
+
+// Writes a self-signed server certificate and its key to `dir`
+func writeTestServerCert(dir string) (certFile string, keyFile string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return
+}
+
+func TestCliDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	certFile, keyFile, err := writeTestServerCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The dry run must not bind the port, so it should pass even if the port is taken
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		app := NewCliApp()
+		app.Writer = &out
+		err := app.Run(append([]string{"padlock-cloud",
+			"--log-file", cfg.Log.LogFile,
+			"--err-file", cfg.Log.ErrFile,
+			"--db-path", cfg.LevelDB.Path,
+			"runserver", "--dry-run",
+			"--assets-path", "../assets",
+			"--bind-host", "127.0.0.1",
+			"--port", port,
+			"--base-url", "https://example.com",
+		}, args...))
+		return out.String(), err
+	}
+
+	out, err := run("--tls-cert", certFile, "--tls-key", keyFile)
+	if err != nil {
+		t.Fatalf("Expected dry run to pass, got %v\n%s", err, out)
+	}
+	for _, line := range []string{"config   ok", "storage  ok", "tls      ok", "smtp     skipped"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Expected output to contain %q, got:\n%s", line, out)
+		}
+	}
+
+	// The storage should have been closed again
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+	if err := storage.Open(); err != nil {
+		t.Fatalf("Expected storage to be released after dry run, got %v", err)
+	}
+	storage.Close()
+
+	badCert := filepath.Join(dir, "bad.pem")
+	if err := ioutil.WriteFile(badCert, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = run("--tls-cert", badCert, "--tls-key", keyFile)
+	if ExitCode(err) != ExitInvalidConfig {
+		t.Errorf("Expected dry run with bad certificate to fail with exit code %d, got %v", ExitInvalidConfig, err)
+	}
+	if !strings.Contains(out, "config   ok") || !strings.Contains(out, "tls      FAILED") {
+		t.Errorf("Expected tls check to fail, got:\n%s", out)
+	}
+}
+
+func TestCliCompletion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		app := NewCliApp()
+		app.Writer = &out
+		err := app.Run(append([]string{"padlock-cloud",
+			"--log-file", cfg.Log.LogFile,
+			"--err-file", cfg.Log.ErrFile,
+			"--db-path", cfg.LevelDB.Path,
+		}, args...))
+		return out.String(), err
+	}
+
+	for _, shell := range []string{"bash", "zsh"} {
+		out, err := run("completion", shell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, "padlock-cloud") || !strings.Contains(out, "--generate-bash-completion") {
+			t.Errorf("%s: Expected completion script, got:\n%s", shell, out)
+		}
+	}
+
+	if _, err := run("completion", "fish"); ExitCode(err) != ExitInvalidArgument {
+		t.Errorf("Expected exit code %d for unsupported shell, got %d (%v)", ExitInvalidArgument, ExitCode(err), err)
+	}
+
+	for _, c := range []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{}, []string{"runserver", "accounts", "completion", "--db-path", "-c"}},
+		{[]string{"accounts"}, []string{"list", "tokens", "data"}},
+		{[]string{"accounts", "list"}, []string{"--tag"}},
+	} {
+		out, err := run(append(c.args, "--generate-bash-completion")...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(out, "\n")
+		for _, exp := range c.expected {
+			found := false
+			for _, line := range lines {
+				if line == exp {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%v: Expected '%s' among completions, got:\n%s", c.args, exp, out)
+			}
+		}
+	}
+}
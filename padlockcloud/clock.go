@@ -0,0 +1,55 @@
+package padlockcloud
+
+import "sync"
+import "time"
+
+// Source of the current time. Everything depending on the time takes a `Clock`, which can be
+// replaced for testing time-dependent behaviour of a single instance
+type Clock interface {
+	Now() time.Time
+}
+
+// Default clock, returning the system time
+type SystemClock struct{}
+
+func (c SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Returns the time from `c` or, if it is nil, from the system clock
+func clockNow(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// Clock that only moves when told to. Useful for testing
+type FakeClock struct {
+	mutex sync.Mutex
+	t     time.Time
+}
+
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{t: t}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.t
+}
+
+// Sets the clock to `t`
+func (c *FakeClock) Set(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.t = t
+}
+
+// Moves the clock forward by `d`
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.t = c.t.Add(d)
+}
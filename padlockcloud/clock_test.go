@@ -0,0 +1,58 @@
+package padlockcloud
+
+import "net/http"
+import "strings"
+import "testing"
+import "time"
+
+func TestServerClock(t *testing.T) {
+	ctx := newServerTestContext()
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx.server.Clock = clock
+	ctx.storage.Clock = clock
+
+	acc := &Account{Email: testEmail}
+	token, _ := NewAuthToken(testEmail, "api", DefaultTokenBytes, clock)
+	token.Expires = clock.Now().Add(time.Hour)
+	acc.AddAuthToken(token)
+	if err := ctx.storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	ctx.authToken = token
+
+	res, err := ctx.request("GET", ctx.host+"/authtestapi/", "", ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "")
+
+	// The token's last use should be recorded using the server's clock
+	if err := ctx.storage.Get(acc); err != nil {
+		t.Fatal(err)
+	}
+	if lastUsed := acc.AuthTokens[0].LastUsed; !lastUsed.Equal(clock.Now()) {
+		t.Errorf("Expected last used time to be %v, got %v", clock.Now(), lastUsed)
+	}
+
+	// Token should be considered expired once the clock passes its expiry date
+	clock.Advance(2 * time.Hour)
+	res, err = ctx.request("GET", ctx.host+"/authtestapi/", "", ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &ExpiredAuthToken{})
+}
+
+func TestEmailSenderClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	sender := &EmailSender{Config: &EmailConfig{User: "padlock@padlock.io"}, Clock: clock}
+
+	msg, err := sender.message(testEmail, "Subject", "Body")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if date := "Date: " + clock.Now().Format(time.RFC1123Z); !strings.Contains(string(msg), date) {
+		t.Errorf("Expected message to contain '%s', got:\n%s", date, msg)
+	}
+}
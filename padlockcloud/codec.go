@@ -0,0 +1,132 @@
+package padlockcloud
+
+import "bytes"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "compress/gzip"
+
+// Prefix used for identifying values encoded with a `Codec`. It is followed by the id of the codec.
+// Values without this prefix are stored as is
+var codecMagic = []byte("\x00PCZ")
+
+// A stored value was encoded with a codec that is not known
+var ErrUnknownCodec = errors.New("padlock: value was encoded with an unknown codec")
+
+// Transforms serialized values before they are written to disk, e.g. for compression
+type Codec interface {
+	// Unique id of the codec, stored alongside each encoded value
+	ID() byte
+	Encode([]byte) ([]byte, error)
+	Decode([]byte) ([]byte, error)
+}
+
+// Leaves values untouched
+type IdentityCodec struct{}
+
+func (c IdentityCodec) ID() byte {
+	return 0
+}
+
+func (c IdentityCodec) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (c IdentityCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// Compresses values using gzip
+type GzipCodec struct{}
+
+func (c GzipCodec) ID() byte {
+	return 1
+}
+
+func (c GzipCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c GzipCodec) Decode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Available codecs by name, as used for the `codec` config option
+var Codecs = map[string]Codec{
+	"identity": IdentityCodec{},
+	"gzip":     GzipCodec{},
+}
+
+// Returns the codec with the given name. An empty name selects the `IdentityCodec`
+func CodecByName(name string) (Codec, error) {
+	if name == "" {
+		return IdentityCodec{}, nil
+	}
+	c, ok := Codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("padlock: unknown codec %q", name)
+	}
+	return c, nil
+}
+
+// Returns true if `data` has been encoded by `encodeValue`
+func hasCodec(data []byte) bool {
+	return bytes.HasPrefix(data, codecMagic)
+}
+
+// Encodes `data` using `c`. The result has the form `magic | codec id | encoded data`. Values
+// encoded with the `IdentityCodec` are returned as is so they remain readable by older versions,
+// unless they happen to start with the codec prefix themselves
+func encodeValue(c Codec, data []byte) ([]byte, error) {
+	if c == nil {
+		c = IdentityCodec{}
+	}
+
+	if c.ID() == (IdentityCodec{}).ID() && !hasCodec(data) {
+		return data, nil
+	}
+
+	encoded, err := c.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(codecMagic)+1, len(codecMagic)+1+len(encoded))
+	copy(out, codecMagic)
+	out[len(codecMagic)] = c.ID()
+	return append(out, encoded...), nil
+}
+
+// Decodes `data` using the codec it was encoded with, regardless of the currently configured one.
+// Values without a codec prefix are returned as is
+func decodeCodec(data []byte) ([]byte, error) {
+	if !hasCodec(data) {
+		return data, nil
+	}
+
+	if len(data) <= len(codecMagic) {
+		return nil, ErrUnknownCodec
+	}
+
+	id := data[len(codecMagic)]
+	for _, c := range Codecs {
+		if c.ID() == id {
+			return c.Decode(data[len(codecMagic)+1:])
+		}
+	}
+
+	return nil, ErrUnknownCodec
+}
@@ -0,0 +1,113 @@
+package padlockcloud
+
+import "testing"
+import "bytes"
+import "io/ioutil"
+import "os"
+
+func TestCodecs(t *testing.T) {
+	data := bytes.Repeat([]byte(testData), 10)
+
+	var encoded [][]byte
+	for _, name := range []string{"identity", "gzip"} {
+		c, err := CodecByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		enc, err := encodeValue(c, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, enc)
+
+		dec, err := decodeCodec(enc)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(dec, data) {
+			t.Errorf("%s: Expected round trip to preserve data, got %q", name, dec)
+		}
+	}
+
+	// Identity encoded values should be stored as is, gzip encoded ones tagged and compressed
+	if !bytes.Equal(encoded[0], data) {
+		t.Errorf("Expected identity codec to leave data untouched, got %q", encoded[0])
+	}
+	if !hasCodec(encoded[1]) || encoded[1][len(codecMagic)] != (GzipCodec{}).ID() || len(encoded[1]) >= len(data) {
+		t.Errorf("Expected gzip encoded value to be tagged and compressed, got %q", encoded[1])
+	}
+
+	// Values that look like encoded values need to be tagged even by the identity codec
+	tricky := append(append([]byte{}, codecMagic...), 1, 2, 3)
+	enc, err := encodeValue(IdentityCodec{}, tricky)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := decodeCodec(enc); err != nil || !bytes.Equal(dec, tricky) {
+		t.Errorf("Expected round trip to preserve data, got %q, %v", dec, err)
+	}
+
+	if _, err := decodeCodec(append(append([]byte{}, codecMagic...), 99)); err != ErrUnknownCodec {
+		t.Errorf("Expected ErrUnknownCodec, got %v", err)
+	}
+
+	if _, err := CodecByName("lzma"); err == nil {
+		t.Error("Expected error for unknown codec")
+	}
+}
+
+func TestLevelDBCodec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &LevelDBStorage{Config: &LevelDBConfig{Path: dir}}
+
+	// Write one account with each codec
+	for _, c := range []struct {
+		codec string
+		email string
+	}{
+		{"", "identity@padlock.io"},
+		{"gzip", "gzip@padlock.io"},
+	} {
+		storage.Config.Codec = c.codec
+		if err := storage.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(&Account{Email: c.email}); err != nil {
+			t.Fatal(err)
+		}
+		storage.Close()
+	}
+
+	// Both accounts should be readable regardless of the configured codec
+	for _, codec := range []string{"", "gzip"} {
+		storage.Config.Codec = codec
+		if err := storage.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, email := range []string{"identity@padlock.io", "gzip@padlock.io"} {
+			acc := &Account{Email: email}
+			if err := storage.Get(acc); err != nil || acc.Created.IsZero() {
+				t.Errorf("Expected %s to be read with codec %q, got %v", email, codec, err)
+			}
+		}
+
+		if res, err := storage.Verify(); err != nil || len(res.Corrupt) != 0 {
+			t.Errorf("Expected verification to succeed, got %+v, %v", res, err)
+		}
+
+		storage.Close()
+	}
+
+	storage.Config.Codec = "lzma"
+	if err := storage.Open(); err == nil {
+		storage.Close()
+		t.Error("Expected error for unknown codec")
+	}
+}
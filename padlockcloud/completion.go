@@ -0,0 +1,90 @@
+package padlockcloud
+
+import "fmt"
+import "strings"
+import "gopkg.in/urfave/cli.v1"
+
+// Bash completion script. Candidates are obtained by invoking the program with the words typed so
+// far and the `--generate-bash-completion` flag. `%[1]s` is replaced with the program name and
+// `%[2]s` with a version of it usable as a function name
+const bashCompletionScript = `# bash completion for %[1]s
+_%[2]s_complete() {
+	local cur opts
+	COMPREPLY=()
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	opts=$("${COMP_WORDS[0]}" "${COMP_WORDS[@]:1:$COMP_CWORD-1}" --generate-bash-completion 2>/dev/null)
+	COMPREPLY=($(compgen -W "${opts}" -- "${cur}"))
+	return 0
+}
+
+complete -o default -F _%[2]s_complete %[1]s
+`
+
+// Zsh completion script. Works both when sourced and when installed in a directory in `$fpath`
+const zshCompletionScript = `#compdef %[1]s
+
+_%[2]s() {
+	local -a opts
+	opts=("${(@f)$(${words[1]} ${words[@]:1:$((CURRENT-2))} --generate-bash-completion 2>/dev/null)}")
+	_describe 'values' opts
+}
+
+compdef _%[2]s %[1]s
+`
+
+var completionScripts = map[string]string{
+	"bash": bashCompletionScript,
+	"zsh":  zshCompletionScript,
+}
+
+// Returns a completion function printing the names of the given commands and flags, one per line.
+// Filtering by the word being completed is left to the shell
+func completeCommand(commands []cli.Command, flags []cli.Flag) cli.BashCompleteFunc {
+	return func(context *cli.Context) {
+		for _, cmd := range commands {
+			if cmd.Hidden {
+				continue
+			}
+			for _, name := range cmd.Names() {
+				fmt.Fprintln(context.App.Writer, name)
+			}
+		}
+		for _, flag := range flags {
+			for _, name := range strings.Split(flag.GetName(), ",") {
+				if name = strings.TrimSpace(name); len(name) == 1 {
+					fmt.Fprintln(context.App.Writer, "-"+name)
+				} else if name != "" {
+					fmt.Fprintln(context.App.Writer, "--"+name)
+				}
+			}
+		}
+	}
+}
+
+// Sets up completion of subcommands and flags for the given commands and, recursively, all their
+// subcommands
+func setCompletions(commands []cli.Command) {
+	for i := range commands {
+		commands[i].BashComplete = completeCommand(commands[i].Subcommands, commands[i].Flags)
+		setCompletions(commands[i].Subcommands)
+	}
+}
+
+// Prints a completion script for the shell passed as the first argument
+func (cliApp *CliApp) Completion(context *cli.Context) error {
+	shell := context.Args().First()
+	script, ok := completionScripts[shell]
+	if !ok {
+		return usageError("Please specify a supported shell: bash or zsh!")
+	}
+
+	fn := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, cliApp.Name)
+
+	fmt.Fprintf(cliApp.Writer, script, cliApp.Name, fn)
+	return nil
+}
@@ -1,13 +1,106 @@
 package padlockcloud
 
+import "errors"
+import "fmt"
 import "net/http"
+import "strings"
+import "time"
 import "github.com/rs/cors"
 
-func Cors(handler http.Handler) http.Handler {
+// Cross-Origin Resource Sharing settings for a group of paths
+type CorsPolicy struct {
+	// Origins browsers may send cross-origin requests from, e.g. "https://app.padlock.io". "*"
+	// allows any origin. If empty, no CORS headers are sent at all, which makes browsers reject
+	// cross-origin requests
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// How long browsers may cache the results of preflight requests. Browser default if zero
+	MaxAge time.Duration `yaml:"max_age"`
+	// Allow browsers to include credentials like cookies in cross-origin requests
+	AllowCredentials bool `yaml:"allow_credentials"`
+}
+
+// Policies applied in addition to the configured ones unless overridden. Browsers have no
+// business talking to the admin api
+var DefaultCorsPolicies = map[string]*CorsPolicy{
+	"/admin/": &CorsPolicy{},
+}
+
+// Validates the policy. Allowing credentials for any origin is rejected, since every website could
+// then make requests on behalf of logged in users
+func (p *CorsPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.MaxAge < 0 {
+		return errors.New("padlock: cors max age must not be negative")
+	}
+	if p.AllowCredentials {
+		for _, origin := range p.AllowedOrigins {
+			if origin == "*" {
+				return errors.New("padlock: cors credentials can't be allowed for any origin ('*'), list the allowed origins explicitly")
+			}
+		}
+	}
+	return nil
+}
+
+// Validates a set of policies keyed by path prefix
+func validateCorsPolicies(policies map[string]*CorsPolicy) error {
+	for prefix, p := range policies {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("padlock: cors policy path '%s' has to start with '/'", prefix)
+		}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("%w (policy for '%s')", err, prefix)
+		}
+	}
+	return nil
+}
+
+// Wraps `handler` to apply the policy
+func (p *CorsPolicy) handler(handler http.Handler) http.Handler {
+	if p == nil || len(p.AllowedOrigins) == 0 {
+		return handler
+	}
 	return cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"HEAD", "GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders: []string{"Authorization", "Accept", "Content-Type", "X-Client-Version"},
-		ExposedHeaders: []string{"X-Sub-Required", "X-Sub-Status", "X-Sub-Trial-End"},
+		AllowedOrigins:   p.AllowedOrigins,
+		AllowedMethods:   []string{"HEAD", "GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Authorization", "Accept", "Content-Type", "X-Client-Version"},
+		ExposedHeaders:   []string{"X-Sub-Required", "X-Sub-Status", "X-Sub-Trial-End"},
+		MaxAge:           int(p.MaxAge / time.Second),
+		AllowCredentials: p.AllowCredentials,
 	}).Handler(handler)
 }
+
+// Enables Cross-Origin Resource Sharing for `handler`, allowing requests from `origins` ("*" for
+// any origin). Preflight results are cached by browsers for `maxAge` (or the browser default if
+// zero). If `allowCredentials` is set, browsers are allowed to include cookies in cross-origin
+// requests. Origins are always echoed back explicitly, as required for credentialed requests
+func Cors(handler http.Handler, origins []string, maxAge time.Duration, allowCredentials bool) http.Handler {
+	return CorsWithPolicies(handler, &CorsPolicy{
+		AllowedOrigins:   origins,
+		MaxAge:           maxAge,
+		AllowCredentials: allowCredentials,
+	}, nil)
+}
+
+// Like `Cors`, but applies the policy from `policies` whose path prefix is the longest match for
+// the request path. Requests not matching any prefix fall back to `def`
+func CorsWithPolicies(handler http.Handler, def *CorsPolicy, policies map[string]*CorsPolicy) http.Handler {
+	defHandler := def.handler(handler)
+	handlers := make(map[string]http.Handler, len(policies))
+	for prefix, p := range policies {
+		handlers[prefix] = p.handler(handler)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := defHandler
+		match := ""
+		for prefix, ph := range handlers {
+			if len(prefix) > len(match) && strings.HasPrefix(r.URL.Path, prefix) {
+				h, match = ph, prefix
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
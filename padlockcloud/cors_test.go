@@ -0,0 +1,151 @@
+package padlockcloud
+
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "time"
+
+func TestCors(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	preflight := func(h http.Handler) http.Header {
+		r := httptest.NewRequest("OPTIONS", "/store/", nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Header()
+	}
+
+	request := func(h http.Handler) http.Header {
+		r := httptest.NewRequest("GET", "/store/", nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Header()
+	}
+
+	// Without the new options, neither Max-Age nor credentials should be announced
+	h := Cors(handler, []string{"*"}, 0, false)
+	if v := preflight(h).Get("Access-Control-Max-Age"); v != "" {
+		t.Errorf("Expected no Max-Age header by default, got %q", v)
+	}
+	if v := request(h).Get("Access-Control-Allow-Credentials"); v != "" {
+		t.Errorf("Expected no Allow-Credentials header by default, got %q", v)
+	}
+
+	h = Cors(handler, []string{"https://app.example.com"}, 10*time.Minute, true)
+
+	header := preflight(h)
+	if v := header.Get("Access-Control-Max-Age"); v != "600" {
+		t.Errorf("Expected Max-Age to be 600, got %q", v)
+	}
+	if v := header.Get("Access-Control-Allow-Credentials"); v != "true" {
+		t.Errorf("Expected preflight to allow credentials, got %q", v)
+	}
+
+	// Credentialed responses must name the requesting origin instead of using a wildcard
+	header = request(h)
+	if v := header.Get("Access-Control-Allow-Origin"); v != "https://app.example.com" {
+		t.Errorf("Expected origin to be echoed, got %q", v)
+	}
+	if v := header.Get("Access-Control-Allow-Credentials"); v != "true" {
+		t.Errorf("Expected credentials to be allowed, got %q", v)
+	}
+}
+
+func TestCorsPolicies(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	request := func(h http.Handler, path string, origin string) http.Header {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Header()
+	}
+
+	h := CorsWithPolicies(handler, &CorsPolicy{AllowedOrigins: []string{"https://app.padlock.io"}}, map[string]*CorsPolicy{
+		"/admin/":         &CorsPolicy{},
+		"/admin/metrics/": &CorsPolicy{AllowedOrigins: []string{"*"}},
+	})
+
+	// Public paths should fall back to the default policy
+	if v := request(h, "/store/", "https://app.padlock.io").Get("Access-Control-Allow-Origin"); v != "https://app.padlock.io" {
+		t.Errorf("Expected app origin to be allowed on public path, got %q", v)
+	}
+	if v := request(h, "/store/", "https://evil.example.com").Get("Access-Control-Allow-Origin"); v != "" {
+		t.Errorf("Expected other origins to be rejected on public path, got %q", v)
+	}
+
+	// Admin paths should not allow any origin, including the app
+	if v := request(h, "/admin/accounts/", "https://app.padlock.io").Get("Access-Control-Allow-Origin"); v != "" {
+		t.Errorf("Expected no origin to be allowed on admin path, got %q", v)
+	}
+
+	// The longest matching prefix wins
+	if v := request(h, "/admin/metrics/", "https://evil.example.com").Get("Access-Control-Allow-Origin"); v != "https://evil.example.com" {
+		t.Errorf("Expected longest prefix policy to apply, got %q", v)
+	}
+}
+
+func TestServerCors(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.Cors = true
+	ctx.server.Config.Admin.Key = "secret"
+	ctx.server.Config.CorsPolicies = map[string]*CorsPolicy{
+		"/auth/": &CorsPolicy{AllowedOrigins: []string{"https://app.padlock.io"}},
+	}
+	ctx.server.InitHandler()
+
+	request := func(h http.Handler, path string, origin string) http.Header {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Header()
+	}
+
+	const origin = "https://other.example.com"
+	if v := request(ctx.server.Handler, "/store/", origin).Get("Access-Control-Allow-Origin"); v == "" {
+		t.Error("Expected default policy to allow any origin")
+	}
+	if v := request(ctx.server.Handler, "/auth/", origin).Get("Access-Control-Allow-Origin"); v != "" {
+		t.Errorf("Expected configured policy to reject origin, got %q", v)
+	}
+	if v := request(ctx.server.AdminHandler(), "/admin/accounts", origin).Get("Access-Control-Allow-Origin"); v != "" {
+		t.Errorf("Expected admin api to reject cross-origin requests, got %q", v)
+	}
+
+	ctx.server.Config.CorsPolicies = map[string]*CorsPolicy{"admin": &CorsPolicy{}}
+	if err := ctx.server.initConfig(); err == nil {
+		t.Error("Expected policy paths without leading slash to be rejected")
+	}
+
+	// Credentials must not be allowed for any origin
+	ctx.server.Config.CorsPolicies = map[string]*CorsPolicy{
+		"/auth/": &CorsPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+	}
+	if err := ctx.server.initConfig(); err == nil {
+		t.Error("Expected credentials for any origin to be rejected in policies")
+	}
+	ctx.server.Config.CorsPolicies = nil
+	ctx.server.Config.CorsAllowCredentials = true
+	if err := ctx.server.initConfig(); err == nil {
+		t.Error("Expected credentials without allowed origins to be rejected")
+	}
+
+	// With explicit origins, only those should be allowed
+	ctx.server.Config.CorsAllowedOrigins = []string{"https://app.padlock.io"}
+	if err := ctx.server.initConfig(); err != nil {
+		t.Fatal(err)
+	}
+	ctx.server.InitHandler()
+	if v := request(ctx.server.Handler, "/store/", origin).Get("Access-Control-Allow-Origin"); v != "" {
+		t.Errorf("Expected other origins to be rejected, got %q", v)
+	}
+	header := request(ctx.server.Handler, "/store/", "https://app.padlock.io")
+	if header.Get("Access-Control-Allow-Origin") != "https://app.padlock.io" || header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("Expected configured origin to be allowed with credentials, got %v", header)
+	}
+}
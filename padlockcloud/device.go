@@ -0,0 +1,90 @@
+package padlockcloud
+
+import "strings"
+import "unicode"
+
+// Maximum length of device names in characters
+const maxDeviceNameLength = 64
+
+// Substrings of user agents identifying a platform, in order of precedence
+var userAgentPlatforms = []struct{ token, name string }{
+	{"iPhone", "iPhone"},
+	{"iPad", "iPad"},
+	{"Android", "Android"},
+	{"CrOS", "Chromebook"},
+	{"Windows", "Windows"},
+	{"Macintosh", "Mac"},
+	{"Linux", "Linux"},
+}
+
+// Substrings of user agents identifying an application or browser, in order of precedence
+var userAgentApps = []struct{ token, name string }{
+	{"Padlock", "Padlock"},
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Firefox/", "Firefox"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+}
+
+// Cleans up a device name supplied by a client: Control characters are removed, whitespace is
+// collapsed and the name is cut off after `maxDeviceNameLength` characters
+func sanitizeDeviceName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		} else if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Join(strings.Fields(name), " ")
+
+	if runes := []rune(name); len(runes) > maxDeviceNameLength {
+		name = strings.TrimSpace(string(runes[:maxDeviceNameLength]))
+	}
+
+	return name
+}
+
+// Derives a device name like "Firefox on Windows" from a user agent string. Falls back to the
+// first product token (e.g. "curl") for unknown user agents
+func deviceNameFromUserAgent(ua string) string {
+	var app, platform string
+	for _, a := range userAgentApps {
+		if strings.Contains(ua, a.token) {
+			app = a.name
+			break
+		}
+	}
+	for _, p := range userAgentPlatforms {
+		if strings.Contains(ua, p.token) {
+			platform = p.name
+			break
+		}
+	}
+
+	switch {
+	case app != "" && platform != "":
+		return app + " on " + platform
+	case app != "":
+		return app
+	case platform != "":
+		return platform
+	}
+
+	product := strings.Fields(ua)
+	if len(product) == 0 {
+		return ""
+	}
+	return sanitizeDeviceName(strings.SplitN(product[0], "/", 2)[0])
+}
+
+// Returns the sanitized device name supplied by the client or, if there is none, a name derived
+// from its user agent
+func deviceName(name string, ua string) string {
+	if name = sanitizeDeviceName(name); name != "" {
+		return name
+	}
+	return deviceNameFromUserAgent(ua)
+}
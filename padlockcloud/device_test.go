@@ -0,0 +1,24 @@
+package padlockcloud
+
+import "testing"
+
+func TestDeviceName(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		ua       string
+		expected string
+	}{
+		{"My Laptop", "curl/8.0", "My Laptop"},
+		{" \t\n", "curl/8.0", "curl"},
+		{"", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Version/17.0 Mobile/15E148 Safari/604.1", "Safari on iPhone"},
+		{"", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 Chrome/120.0 Safari/537.36", "Chrome on Mac"},
+		{"", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36 Edg/120.0", "Edge on Linux"},
+		{"", "Mozilla/5.0 (Linux; Android 14)", "Android"},
+		{"", "Padlock/2.0", "Padlock"},
+		{"", "", ""},
+	} {
+		if name := deviceName(c.name, c.ua); name != c.expected {
+			t.Errorf("Expected device name for (%q, %q) to be %q, got %q", c.name, c.ua, c.expected, name)
+		}
+	}
+}
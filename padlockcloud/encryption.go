@@ -0,0 +1,107 @@
+package padlockcloud
+
+import "bytes"
+import "errors"
+import "strings"
+import "io/ioutil"
+import "crypto/aes"
+import "crypto/cipher"
+import "encoding/base64"
+
+// Prefix used for identifying encrypted values. Values without this prefix are considered
+// unencrypted legacy data
+var encryptionMagic = []byte("\x00PCE")
+
+var (
+	// An encrypted value was encountered but no encryption key is configured
+	ErrNoEncryptionKey = errors.New("padlock: value is encrypted but no encryption key was provided")
+	// An encrypted value was encrypted with a different key version than the configured one
+	ErrEncryptionKeyVersion = errors.New("padlock: value was encrypted with a different key version")
+	// An encrypted value could not be decrypted
+	ErrDecryptionFailed = errors.New("padlock: failed to decrypt value")
+)
+
+// Returns true if `data` has been encrypted by an `Encryptor`
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptionMagic)
+}
+
+// Returns the key version an encrypted value was encrypted with
+func encryptionKeyVersion(data []byte) (byte, bool) {
+	if !isEncrypted(data) || len(data) <= len(encryptionMagic) {
+		return 0, false
+	}
+	return data[len(encryptionMagic)], true
+}
+
+// Encrypts and decrypts values using AES-GCM. Encrypted values have the form
+// `magic | key version | nonce | ciphertext`
+type Encryptor struct {
+	// Version of the key; stored alongside each encrypted value to support key rotation
+	Version byte
+	aead    cipher.AEAD
+}
+
+// Creates a new `Encryptor` from a 16, 24 or 32 byte key
+func NewEncryptor(key []byte, version byte) (*Encryptor, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encryptor{version, aead}, nil
+}
+
+// Encrypts `data`. `ad` is authenticated but not encrypted and has to be provided again for decryption
+func (e *Encryptor) Encrypt(data []byte, ad []byte) ([]byte, error) {
+	nonce, err := randomBytes(e.aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	out := append(append([]byte{}, encryptionMagic...), e.Version)
+	out = append(out, nonce...)
+	return e.aead.Seal(out, nonce, data, ad), nil
+}
+
+// Decrypts `data`. Unencrypted data is returned as is
+func (e *Encryptor) Decrypt(data []byte, ad []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+
+	if v, _ := encryptionKeyVersion(data); v != e.Version {
+		return nil, ErrEncryptionKeyVersion
+	}
+
+	data = data[len(encryptionMagic)+1:]
+	if len(data) < e.aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+
+	nonce := data[:e.aead.NonceSize()]
+	out, err := e.aead.Open(nil, nonce, data[e.aead.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return out, nil
+}
+
+// Decodes a base64-encoded encryption key. If `keyFile` is provided, the key is read from that file
+func loadEncryptionKey(key string, keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = string(data)
+	}
+
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+}
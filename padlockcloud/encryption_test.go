@@ -0,0 +1,56 @@
+package padlockcloud
+
+import "testing"
+import "bytes"
+
+func TestEncryptor(t *testing.T) {
+	key, _ := randomBytes(32)
+	e, err := NewEncryptor(key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := e.Encrypt([]byte(testData), []byte(testEmail))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isEncrypted(enc) || bytes.Contains(enc, []byte(testData)) {
+		t.Fatal("Encrypted value should be marked as encrypted and not contain plain text")
+	}
+
+	if v, _ := encryptionKeyVersion(enc); v != 1 {
+		t.Fatalf("Expected key version 1, got %d", v)
+	}
+
+	dec, err := e.Decrypt(enc, []byte(testEmail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec) != testData {
+		t.Fatalf("Expected decrypted value to be '%s', got '%s'", testData, dec)
+	}
+
+	// Decrypting with different additional data should fail
+	if _, err := e.Decrypt(enc, []byte("other")); err != ErrDecryptionFailed {
+		t.Fatalf("Expected decryption to fail, got %v", err)
+	}
+
+	// Decrypting with a different key should fail
+	key2, _ := randomBytes(32)
+	e2, _ := NewEncryptor(key2, 1)
+	if _, err := e2.Decrypt(enc, []byte(testEmail)); err != ErrDecryptionFailed {
+		t.Fatalf("Expected decryption to fail, got %v", err)
+	}
+
+	// Decrypting with a different key version should fail
+	e3, _ := NewEncryptor(key, 2)
+	if _, err := e3.Decrypt(enc, []byte(testEmail)); err != ErrEncryptionKeyVersion {
+		t.Fatalf("Expected key version error, got %v", err)
+	}
+
+	// Unencrypted values should be returned as is
+	if dec, err := e.Decrypt([]byte(testData), nil); err != nil || string(dec) != testData {
+		t.Fatalf("Expected unencrypted value to be returned unchanged, got %s, %v", dec, err)
+	}
+}
@@ -1,10 +1,67 @@
 package padlockcloud
 
 import "fmt"
+import "mime"
 import "net/http"
+import "errors"
+import "encoding/json"
+import "strconv"
+import "strings"
 
 func JsonifyErrorResponse(e ErrorResponse) []byte {
-	return []byte(fmt.Sprintf("{\"error\":\"%s\",\"message\":\"%s\"}", e.Code(), e.Message()))
+	data, _ := json.Marshal(&struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}{e.Code(), e.Message()})
+	return data
+}
+
+// Formats error responses can be rendered in
+const (
+	errorFormatText = "text"
+	errorFormatJSON = "json"
+	errorFormatHTML = "html"
+)
+
+// Picks the error format preferred by a client based on its `Accept` header. JSON is used for
+// api clients, html for browsers and plain text if the client accepts neither
+func negotiateErrorFormat(accept string) string {
+	var jsonQ, htmlQ float64
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		switch {
+		case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"),
+			strings.HasPrefix(mediaType, "application/vnd.padlock"):
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case mediaType == "text/html":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		}
+	}
+
+	switch {
+	case jsonQ > 0 && jsonQ >= htmlQ:
+		return errorFormatJSON
+	case htmlQ > 0:
+		return errorFormatHTML
+	default:
+		return errorFormatText
+	}
 }
 
 type ErrorResponse interface {
@@ -156,6 +213,30 @@ func (e *AccountNotFound) Message() string {
 	return http.StatusText(e.Status())
 }
 
+type AccountSuspended struct {
+	email  string
+	reason string
+}
+
+func (e *AccountSuspended) Code() string {
+	return "account_suspended"
+}
+
+func (e *AccountSuspended) Error() string {
+	return fmt.Sprintf("%s - %s", e.Code(), e.email)
+}
+
+func (e *AccountSuspended) Status() int {
+	return http.StatusForbidden
+}
+
+func (e *AccountSuspended) Message() string {
+	if e.reason != "" {
+		return fmt.Sprintf("This account has been suspended: %s", e.reason)
+	}
+	return "This account has been suspended"
+}
+
 type UnsupportedApiVersion struct {
 	found    int
 	expected int
@@ -196,6 +277,304 @@ func (e *RateLimitExceeded) Message() string {
 	return http.StatusText(e.Status())
 }
 
+// Returned by routes depending on a feature that has been turned off, e.g. via
+// `ServerConfig.DisableSignup`
+type FeatureDisabled struct {
+	feature string
+}
+
+func (e *FeatureDisabled) Code() string {
+	return "feature_disabled"
+}
+
+func (e *FeatureDisabled) Error() string {
+	return fmt.Sprintf("%s - %s", e.Code(), e.feature)
+}
+
+func (e *FeatureDisabled) Status() int {
+	return http.StatusForbidden
+}
+
+func (e *FeatureDisabled) Message() string {
+	return fmt.Sprintf("%s is disabled on this server", e.feature)
+}
+
+type UnsupportedMediaType struct {
+	contentType string
+}
+
+func (e *UnsupportedMediaType) Code() string {
+	return "unsupported_media_type"
+}
+
+func (e *UnsupportedMediaType) Error() string {
+	return fmt.Sprintf("%s - %s", e.Code(), e.contentType)
+}
+
+func (e *UnsupportedMediaType) Status() int {
+	return http.StatusUnsupportedMediaType
+}
+
+func (e *UnsupportedMediaType) Message() string {
+	return fmt.Sprintf("Unsupported content type %s", e.contentType)
+}
+
+type TooManyAuthTokens struct {
+	limit int
+}
+
+func (e *TooManyAuthTokens) Code() string {
+	return "too_many_auth_tokens"
+}
+
+func (e *TooManyAuthTokens) Error() string {
+	return fmt.Sprintf("%s - %d", e.Code(), e.limit)
+}
+
+func (e *TooManyAuthTokens) Status() int {
+	return http.StatusForbidden
+}
+
+func (e *TooManyAuthTokens) Message() string {
+	return fmt.Sprintf("This account has reached the maximum of %d devices. Please log out of an unused device first", e.limit)
+}
+
+type TooManyVaults struct {
+	limit int
+}
+
+func (e *TooManyVaults) Code() string {
+	return "too_many_vaults"
+}
+
+func (e *TooManyVaults) Error() string {
+	return fmt.Sprintf("%s - %d", e.Code(), e.limit)
+}
+
+func (e *TooManyVaults) Status() int {
+	return http.StatusConflict
+}
+
+func (e *TooManyVaults) Message() string {
+	return fmt.Sprintf("This account has reached the maximum of %d vaults. Please delete an unused vault first", e.limit)
+}
+
+type VaultStorageExceeded struct {
+	limit int64
+}
+
+func (e *VaultStorageExceeded) Code() string {
+	return "vault_storage_exceeded"
+}
+
+func (e *VaultStorageExceeded) Error() string {
+	return fmt.Sprintf("%s - %d", e.Code(), e.limit)
+}
+
+func (e *VaultStorageExceeded) Status() int {
+	return http.StatusRequestEntityTooLarge
+}
+
+func (e *VaultStorageExceeded) Message() string {
+	return fmt.Sprintf("The vaults of this account may take up at most %d bytes combined", e.limit)
+}
+
+type DataQuotaExceeded struct {
+	limit int64
+}
+
+func (e *DataQuotaExceeded) Code() string {
+	return "data_quota_exceeded"
+}
+
+func (e *DataQuotaExceeded) Error() string {
+	return fmt.Sprintf("%s - %d", e.Code(), e.limit)
+}
+
+func (e *DataQuotaExceeded) Status() int {
+	return http.StatusRequestEntityTooLarge
+}
+
+func (e *DataQuotaExceeded) Message() string {
+	return fmt.Sprintf("This account may store at most %d bytes of data", e.limit)
+}
+
+type RequestEntityTooLarge struct {
+	limit int64
+}
+
+func (e *RequestEntityTooLarge) Code() string {
+	return "request_entity_too_large"
+}
+
+func (e *RequestEntityTooLarge) Error() string {
+	return fmt.Sprintf("%s - %d", e.Code(), e.limit)
+}
+
+func (e *RequestEntityTooLarge) Status() int {
+	return http.StatusRequestEntityTooLarge
+}
+
+func (e *RequestEntityTooLarge) Message() string {
+	return http.StatusText(e.Status())
+}
+
+type InsufficientStorage struct{}
+
+func (e *InsufficientStorage) Code() string {
+	return "insufficient_storage"
+}
+
+func (e *InsufficientStorage) Error() string {
+	return e.Code()
+}
+
+func (e *InsufficientStorage) Status() int {
+	return http.StatusInsufficientStorage
+}
+
+func (e *InsufficientStorage) Message() string {
+	return fmt.Sprintf("%s: The server is running out of storage space. Please try again later", http.StatusText(e.Status()))
+}
+
+type NotFound struct{}
+
+func (e *NotFound) Code() string {
+	return "not_found"
+}
+
+func (e *NotFound) Error() string {
+	return e.Code()
+}
+
+func (e *NotFound) Status() int {
+	return http.StatusNotFound
+}
+
+func (e *NotFound) Message() string {
+	return http.StatusText(e.Status())
+}
+
+type Conflict struct{}
+
+func (e *Conflict) Code() string {
+	return "conflict"
+}
+
+func (e *Conflict) Error() string {
+	return e.Code()
+}
+
+func (e *Conflict) Status() int {
+	return http.StatusConflict
+}
+
+func (e *Conflict) Message() string {
+	return http.StatusText(e.Status())
+}
+
+type TLSRequired struct {
+	url string
+}
+
+func (e *TLSRequired) Code() string {
+	return "tls_required"
+}
+
+func (e *TLSRequired) Error() string {
+	return e.Code()
+}
+
+func (e *TLSRequired) Status() int {
+	return http.StatusUpgradeRequired
+}
+
+func (e *TLSRequired) Message() string {
+	return fmt.Sprintf("This server only accepts requests over HTTPS. Please use %s instead", e.url)
+}
+
+type BackupInProgress struct{}
+
+func (e *BackupInProgress) Code() string {
+	return "backup_in_progress"
+}
+
+func (e *BackupInProgress) Error() string {
+	return e.Code()
+}
+
+func (e *BackupInProgress) Status() int {
+	return http.StatusConflict
+}
+
+func (e *BackupInProgress) Message() string {
+	return "Another backup is still in progress"
+}
+
+// The storage can't be accessed, e.g. because it has been closed. Unlike `ServiceUnavailable` this
+// is logged as an error
+type StorageUnavailable struct {
+	error
+}
+
+func (e *StorageUnavailable) Code() string {
+	return "storage_unavailable"
+}
+
+func (e *StorageUnavailable) Error() string {
+	return fmt.Sprintf("%s - %v", e.Code(), e.error)
+}
+
+func (e *StorageUnavailable) Status() int {
+	return http.StatusServiceUnavailable
+}
+
+func (e *StorageUnavailable) Message() string {
+	return fmt.Sprintf("%s: The storage is currently unavailable. Please try again later", http.StatusText(e.Status()))
+}
+
+type ServiceUnavailable struct {
+	Msg string
+}
+
+func (e *ServiceUnavailable) Code() string {
+	return "service_unavailable"
+}
+
+func (e *ServiceUnavailable) Error() string {
+	return fmt.Sprintf("%s - %s", e.Code(), e.Msg)
+}
+
+func (e *ServiceUnavailable) Status() int {
+	return http.StatusServiceUnavailable
+}
+
+func (e *ServiceUnavailable) Message() string {
+	return fmt.Sprintf("%s: %s", http.StatusText(e.Status()), e.Msg)
+}
+
+// The activation email for an auth request could not be sent
+type EmailDeliveryFailed struct {
+	email string
+	error
+}
+
+func (e *EmailDeliveryFailed) Code() string {
+	return "email_delivery_failed"
+}
+
+func (e *EmailDeliveryFailed) Error() string {
+	return fmt.Sprintf("%s - %s: %v", e.Code(), e.email, e.error)
+}
+
+func (e *EmailDeliveryFailed) Status() int {
+	return http.StatusInternalServerError
+}
+
+func (e *EmailDeliveryFailed) Message() string {
+	return fmt.Sprintf("%s: The activation email could not be sent. Please try again later", http.StatusText(e.Status()))
+}
+
 type ServerError struct {
 	error
 }
@@ -215,3 +594,60 @@ func (e *ServerError) Status() int {
 func (e *ServerError) Message() string {
 	return http.StatusText(e.Status())
 }
+
+// Maps errors to error responses. Errors returned by the storage layer are mapped to the
+// appropriate status codes, any other errors are treated as internal server errors
+func toErrorResponse(e error) ErrorResponse {
+	if err, ok := e.(ErrorResponse); ok {
+		return err
+	}
+
+	switch {
+	case errors.Is(e, ErrNotFound):
+		return &NotFound{}
+	case errors.Is(e, ErrConflict):
+		return &Conflict{}
+	case errors.Is(e, ErrStorageFull):
+		return &InsufficientStorage{}
+	case errors.Is(e, ErrStorageUnavailable):
+		return &StorageUnavailable{e}
+	}
+
+	return &ServerError{e}
+}
+
+var (
+	// Invalid arguments or flags were provided on the command line
+	ErrInvalidArgument = errors.New("padlock: invalid argument")
+	// The configuration is invalid or could not be loaded
+	ErrInvalidConfig = errors.New("padlock: invalid configuration")
+)
+
+// Exit codes of the command line interface
+const (
+	ExitError           = 1
+	ExitInvalidArgument = 2
+	ExitNotFound        = 3
+	ExitConflict        = 4
+	ExitStorage         = 5
+	ExitInvalidConfig   = 6
+)
+
+// Returns the exit code the command line interface should use for an error
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrInvalidArgument):
+		return ExitInvalidArgument
+	case errors.Is(err, ErrInvalidConfig):
+		return ExitInvalidConfig
+	case errors.Is(err, ErrNotFound):
+		return ExitNotFound
+	case errors.Is(err, ErrConflict):
+		return ExitConflict
+	case errors.Is(err, ErrStorageUnavailable), errors.Is(err, ErrStorageFull):
+		return ExitStorage
+	}
+	return ExitError
+}
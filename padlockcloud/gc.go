@@ -0,0 +1,157 @@
+package padlockcloud
+
+// Record left behind by an account that no longer exists, or an auth request index entry whose
+// auth request is gone
+type OrphanedData struct {
+	// Type of the record, one of "data_store", "vault", "data_history" or "auth_request_index"
+	Kind  string `json:"kind"`
+	Email string `json:"email"`
+	// Storage key of the record
+	Key string `json:"key"`
+	// Size of the data in bytes
+	Size int64 `json:"size"`
+
+	record Storable
+}
+
+// Outcome of `CollectOrphanedData`
+type GCResult struct {
+	Orphaned []*OrphanedData `json:"orphaned"`
+	// Aggregate size of all orphaned records in bytes
+	Bytes int64 `json:"bytes"`
+	// Whether the orphaned records were actually removed
+	Applied bool `json:"applied"`
+	// Number of data stores without an account that were kept because they belong to legacy
+	// accounts
+	Legacy int `json:"legacy"`
+}
+
+func (res *GCResult) add(kind string, email string, record Storable, size int64) {
+	res.Orphaned = append(res.Orphaned, &OrphanedData{kind, email, string(record.Key()), size, record})
+	res.Bytes += size
+}
+
+// Same as `Storage.ListFunc` but treats types that haven't been stored yet as empty
+func listStored(storage Storage, t Storable, fn func(key string) error) error {
+	if err := storage.ListFunc(t, fn); err != nil && err != ErrUnregisteredStorable {
+		return err
+	}
+	return nil
+}
+
+// Fetches `record`, returning false if it doesn't exist
+func getStored(storage Storage, record Storable) (bool, error) {
+	if err := storage.Get(record); err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Finds data stores, vaults and stored data versions whose account no longer exists as well as
+// auth request index entries pointing to auth requests that are gone, streaming the keys via
+// `ListFunc`. Accounts created before accounts were stored separately only have a data store, so
+// data stores without an account are treated as legacy accounts and kept along with their other
+// records unless `includeLegacy` is set. Orphaned records are only removed if `apply` is set
+func CollectOrphanedData(storage Storage, apply bool, includeLegacy bool) (*GCResult, error) {
+	accounts := make(map[string]bool)
+	if err := listStored(storage, &Account{}, func(email string) error {
+		accounts[email] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	res := &GCResult{Applied: apply}
+
+	var legacy []string
+	if err := listStored(storage, &DataStore{}, func(email string) error {
+		if accounts[email] {
+			return nil
+		}
+
+		if !includeLegacy {
+			legacy = append(legacy, email)
+			return nil
+		}
+
+		data := &DataStore{Account: &Account{Email: email}}
+		if found, err := getStored(storage, data); !found {
+			return err
+		}
+
+		res.add("data_store", email, data, int64(len(data.Content)))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Records of legacy accounts are still in use
+	for _, email := range legacy {
+		accounts[email] = true
+	}
+	res.Legacy = len(legacy)
+
+	if err := listStored(storage, &Vault{}, func(key string) error {
+		vault := vaultFromKey(key)
+		if accounts[vault.Email] {
+			return nil
+		}
+
+		if found, err := getStored(storage, vault); !found {
+			return err
+		}
+
+		res.add("vault", vault.Email, vault, int64(len(vault.Content)))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := listStored(storage, &DataHistory{}, func(email string) error {
+		if accounts[email] {
+			return nil
+		}
+
+		history := &DataHistory{Email: email}
+		if found, err := getStored(storage, history); !found {
+			return err
+		}
+
+		var size int64
+		for _, v := range history.Versions {
+			size += int64(len(v.Content))
+		}
+		res.add("data_history", email, history, size)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Index entries are written before the account is created, so they are orphaned once the auth
+	// request itself is gone rather than the account
+	if err := listStored(storage, &authRequestRef{}, func(key string) error {
+		ref := authRequestRefFromKey(key)
+		if found, err := getStored(storage, &AuthRequest{Token: ref.Token}); found || err != nil {
+			return err
+		}
+
+		res.add("auth_request_index", ref.Email, ref, 0)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if apply {
+		// Deleting is deferred until the listing is done so we don't modify the key space while
+		// iterating over it
+		for _, o := range res.Orphaned {
+			if err := storage.Delete(o.record); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,150 @@
+package padlockcloud
+
+import "testing"
+import "bytes"
+import "io/ioutil"
+import "os"
+import "strings"
+
+func TestCliDBGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	acc := &Account{Email: testEmail}
+	if err := storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&DataStore{Account: acc, Content: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+	// Legacy accounts only have a data store
+	for _, email := range []string{"legacy1@padlock.io", "legacy2@padlock.io"} {
+		if err := storage.Put(&DataStore{Account: &Account{Email: email}, Content: make([]byte, 100)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Batch(append(putVaultOps(testEmail, map[string][]byte{"work": []byte("work")}),
+		PutOp(&Vault{Email: "legacy1@padlock.io", Name: "work", Content: make([]byte, 10)}),
+		PutOp(&Vault{Email: "orphan@padlock.io", Name: "work", Content: make([]byte, 20)}),
+		PutOp(&DataHistory{Email: testEmail, Versions: []*DataVersion{{Version: 1, Content: []byte("old")}}}),
+		PutOp(&DataHistory{Email: "legacy2@padlock.io", Versions: []*DataVersion{{Version: 1, Content: make([]byte, 5)}}}),
+		PutOp(&DataHistory{Email: "orphan@padlock.io", Versions: []*DataVersion{{Version: 1, Content: make([]byte, 7)}}}),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	// Pending auth requests are indexed before their account exists, so only index entries without
+	// an auth request count as orphaned
+	pending, err := NewAuthRequest("new@padlock.io", "api", DefaultTokenBytes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Batch(append(putAuthRequestOps(pending),
+		PutOp(&authRequestRef{Email: testEmail, Token: "expired"}),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	run := func(args ...string) string {
+		var out bytes.Buffer
+		app := NewCliApp()
+		app.Writer = &out
+		if err := app.Run(append([]string{"padlock-cloud",
+			"--log-file", cfg.Log.LogFile,
+			"--err-file", cfg.Log.ErrFile,
+			"--db-path", cfg.LevelDB.Path,
+			"db", "gc",
+		}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	remaining := func(typ Storable) []string {
+		if err := storage.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+		keys, err := storage.List(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	// A dry run should report the orphaned data without touching it
+	out := run()
+	for _, line := range []string{
+		"vault\torphan@padlock.io/work\t20 B",
+		"data_history\torphan@padlock.io\t7 B",
+		"auth_request_index\t" + testEmail + "/expired\t0 B",
+		"Found 3 orphaned records (27 B)",
+		"Kept 2 data stores without an account",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Expected dry run output to contain %q, got:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "new@padlock.io") || strings.Contains(out, testEmail+"\t") ||
+		strings.Contains(out, testEmail+"/work") || strings.Contains(out, "legacy1@") || strings.Contains(out, "legacy2@") {
+		t.Errorf("Expected records in use not to be reported, got:\n%s", out)
+	}
+	if keys := remaining(&Vault{}); len(keys) != 3 {
+		t.Fatalf("Expected dry run to keep all vaults, got %v", keys)
+	}
+
+	// Legacy accounts should be kept along with their other records
+	out = run("--apply")
+	if !strings.Contains(out, "Removed 3 orphaned records, reclaimed 27 B") {
+		t.Errorf("Unexpected output:\n%s", out)
+	}
+	for _, c := range []struct {
+		typ      Storable
+		expected []string
+	}{
+		{&DataStore{}, []string{"legacy1@padlock.io", "legacy2@padlock.io", testEmail}},
+		{&Vault{}, []string{"legacy1@padlock.io/work", testEmail + "/work"}},
+		{&DataHistory{}, []string{"legacy2@padlock.io", testEmail}},
+		{&authRequestRef{}, []string{"new@padlock.io/" + pending.Token}},
+	} {
+		if keys := remaining(c.typ); strings.Join(keys, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("Expected %v to remain, got %v", c.expected, keys)
+		}
+	}
+
+	// ...unless explicitly included
+	out = run("--apply", "--include-legacy")
+	for _, line := range []string{
+		"data_store\tlegacy1@padlock.io\t100 B",
+		"data_store\tlegacy2@padlock.io\t100 B",
+		"vault\tlegacy1@padlock.io/work\t10 B",
+		"data_history\tlegacy2@padlock.io\t5 B",
+		"Removed 4 orphaned records, reclaimed 215 B",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Expected output to contain %q, got:\n%s", line, out)
+		}
+	}
+	for _, c := range []struct {
+		typ      Storable
+		expected string
+	}{
+		{&DataStore{}, testEmail},
+		{&Vault{}, testEmail + "/work"},
+		{&DataHistory{}, testEmail},
+		{&authRequestRef{}, "new@padlock.io/" + pending.Token},
+	} {
+		if keys := remaining(c.typ); len(keys) != 1 || keys[0] != c.expected {
+			t.Errorf("Expected only %s to remain, got %v", c.expected, keys)
+		}
+	}
+}
@@ -2,12 +2,17 @@ package padlockcloud
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
+	"runtime"
+	"strings"
 	"time"
 )
 
@@ -22,19 +27,80 @@ func (h *VoidHandler) Handle(w http.ResponseWriter, r *http.Request, a *AuthToke
 	return nil
 }
 
+// Maximum time an auth request waits for the activation email to be sent if
+// `FailSignupOnEmailError` is set
+var signupEmailTimeout = 10 * time.Second
+
 type RequestAuthToken struct {
 	*Server
 }
 
+// Activation emails are rate limited, see `emailRateLimitedHandler`
+func (h *RequestAuthToken) emailRateLimited() {}
+
+// Parameters of auth token requests
+type authTokenParams struct {
+	Email      string `json:"email"`
+	Type       string `json:"type"`
+	Redirect   string `json:"redirect"`
+	DeviceName string `json:"device_name"`
+	// Shared secret passed by integrators. Only checked against `AuthPolicyConfig`, never stored
+	Secret string `json:"secret"`
+}
+
+// Reads the parameters of an auth token request from a JSON or form-encoded body, depending on the
+// content type. Parameters sent as JSON are made available as form values as well
+func parseAuthTokenParams(r *http.Request) (*authTokenParams, error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch contentType {
+	case "application/json":
+		params := &authTokenParams{}
+		if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+			if e, ok := err.(*http.MaxBytesError); ok {
+				return nil, &RequestEntityTooLarge{e.Limit}
+			}
+			return nil, &BadRequest{"invalid json body"}
+		}
+		r.PostForm = url.Values{
+			"email":       {params.Email},
+			"type":        {params.Type},
+			"redirect":    {params.Redirect},
+			"device_name": {params.DeviceName},
+			"secret":      {params.Secret},
+		}
+		return params, r.ParseForm()
+	case "", "application/x-www-form-urlencoded", "multipart/form-data":
+		return &authTokenParams{
+			Email:      r.PostFormValue("email"),
+			Type:       r.PostFormValue("type"),
+			Redirect:   r.PostFormValue("redirect"),
+			DeviceName: r.PostFormValue("device_name"),
+			Secret:     r.PostFormValue("secret"),
+		}, nil
+	default:
+		return nil, &UnsupportedMediaType{contentType}
+	}
+}
+
 // Handler function for requesting an api key. Generates a key-token pair and stores them.
 // The token can later be used to activate the api key. An email is sent to the corresponding
 // email address with an activation url. Expects `email` and `device_name` parameters through either
-// multipart/form-data or application/x-www-urlencoded parameters
+// multipart/form-data, application/x-www-urlencoded or application/json bodies
 func (h *RequestAuthToken) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	if h.Config.DisableEmail {
+		return &FeatureDisabled{"Email"}
+	}
+
+	params, err := parseAuthTokenParams(r)
+	if err != nil {
+		return err
+	}
+
 	create := r.Method == "POST"
-	email := r.PostFormValue("email")
-	tType := r.PostFormValue("type")
-	redirect := r.PostFormValue("redirect")
+	email := params.Email
+	tType := params.Type
+	redirect := params.Redirect
 	if tType == "" {
 		tType = "api"
 	}
@@ -44,6 +110,14 @@ func (h *RequestAuthToken) Handle(w http.ResponseWriter, r *http.Request, auth *
 		return &BadRequest{"no email provided"}
 	}
 
+	// Enforce the configured policy before any account or token is created
+	if err := h.Config.AuthPolicy.Check(email); err != nil {
+		return err
+	}
+	if err := h.Config.AuthPolicy.CheckSecret(params.Secret); err != nil {
+		return err
+	}
+
 	if tType != "api" && tType != "web" {
 		return &BadRequest{"unsupported auth token type"}
 	}
@@ -54,71 +128,207 @@ func (h *RequestAuthToken) Handle(w http.ResponseWriter, r *http.Request, auth *
 		}
 	}
 
+	acc := &Account{Email: email}
+	err = h.Storage.GetCtx(r.Context(), acc)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	// Suspended accounts can't log in or connect new devices. Instead of an activation link, the
+	// owner is emailed the reason while the response looks the same as for any other account, so it
+	// doesn't reveal which accounts exist
+	suspended := err == nil && acc.Suspended
+
 	// If the client does not explicitly state that the server should create a new account for this email
-	// address in case it does not exist, we have to check if an account exists first
-	if !create {
-		acc := &Account{Email: email}
-		if err := h.Storage.Get(acc); err != nil {
-			if err == ErrNotFound {
-				// See if there exists a data store for this account
-				if err := h.Storage.Get(&DataStore{Account: acc}); err != nil {
-					if err == ErrNotFound {
-						return &AccountNotFound{email}
-					} else {
-						return err
-					}
-				}
-			} else {
+	// address in case it does not exist, we have to check if an account exists first. The same goes
+	// if creating new accounts is disabled
+	if (!create || h.Config.DisableSignup) && err == ErrNotFound {
+		// See if there exists a data store for this account
+		if err := h.Storage.GetCtx(r.Context(), &DataStore{Account: acc}); err != nil {
+			if err != ErrNotFound {
 				return err
+			} else if create {
+				return &FeatureDisabled{"Signup"}
+			} else {
+				return &AccountNotFound{email}
 			}
 		}
 	}
 
-	authRequest, err := NewAuthRequest(email, tType)
+	authRequest, err := NewAuthRequest(email, tType, h.tokenBytes(), h.Clock)
 	if err != nil {
 		return err
 	}
 
 	authRequest.Redirect = redirect
+	h.recordClient(authRequest.AuthToken, r)
 
-	// Save key-token pair to database for activating it later in a separate request
-	err = h.Storage.Put(authRequest)
-	if err != nil {
-		return err
+	var emailBody bytes.Buffer
+	var emailSubj string
+
+	if suspended {
+		if emailSubj, err = h.emailSubject(h.EmailSubjects.AccountSuspended, r, email); err != nil {
+			return err
+		}
+		if err := h.Templates.AccountSuspendedEmail.Execute(&emailBody, map[string]interface{}{
+			"email":  email,
+			"type":   tType,
+			"reason": acc.SuspendedReason,
+		}); err != nil {
+			return err
+		}
+	} else {
+		// Save key-token pair to database for activating it later in a separate request
+		if err := h.Storage.BatchCtx(r.Context(), putAuthRequestOps(authRequest)); err != nil {
+			return err
+		}
+
+		if emailSubj, err = h.emailSubject(h.EmailSubjects.ForAuthType(tType), r, email); err != nil {
+			return err
+		}
+
+		// Render activation email
+		if err := h.Templates.ActivateAuthTokenEmail.Execute(&emailBody, map[string]interface{}{
+			"activation_link": fmt.Sprintf("%s/activate/?t=%s", h.BaseUrl(r), authRequest.Token),
+			"token":           authRequest.AuthToken,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if h.emailRateLimiter.RateLimitRequest(r, email) {
+		return &RateLimitExceeded{}
+	}
+
+	var emailErr error
+	if h.Config.FailSignupOnEmailError {
+		// Wait for the email to be sent so the request can be rejected if it fails, but not for
+		// longer than `signupEmailTimeout`
+		emailCtx, cancel := context.WithTimeout(r.Context(), signupEmailTimeout)
+		emailCtx, span := startSpan(emailCtx, "email.send")
+		emailErr = sendCtx(emailCtx, h.Sender, email, emailSubj, emailBody.String())
+		span.SetError(emailErr)
+		span.End()
+		cancel()
+
+		if emailErr != nil {
+			// Discard the auth request since it can never be activated
+			if !suspended {
+				if err := h.Storage.BatchCtx(r.Context(), deleteAuthRequestOps(authRequest)); err != nil {
+					return err
+				}
+			}
+			return &EmailDeliveryFailed{email, emailErr}
+		}
+	} else {
+		// Send email with activation link in the background. Only failing to queue it can be
+		// reported to the client, delivery errors are logged
+		emailErr = h.sendEmail(r, email, emailSubj, emailBody.String())
 	}
 
 	var response []byte
-	var emailBody bytes.Buffer
-	var emailSubj string
 
 	switch tType {
 	case "api":
-		if response, err = json.Marshal(map[string]string{
+		res := map[string]string{
 			"id":    authRequest.AuthToken.Id,
 			"token": authRequest.AuthToken.Token,
 			"email": authRequest.AuthToken.Email,
-		}); err != nil {
+		}
+		if emailErr != nil {
+			res["emailError"] = "The activation email could not be sent. Please try again later"
+		}
+		if response, err = json.Marshal(res); err != nil {
 			return err
 		}
-		emailSubj = "Connect to Padlock Cloud"
 
 		w.Header().Set("Content-Type", "application/json")
 	case "web":
 		var buff bytes.Buffer
 		if err := h.Templates.LoginPage.Execute(&buff, map[string]interface{}{
-			"submitted": true,
-			"email":     email,
+			"submitted":   true,
+			"email":       email,
+			"emailFailed": emailErr != nil,
 		}); err != nil {
 			return err
 		}
 
 		response = buff.Bytes()
-		emailSubj = "Log in to Padlock Cloud"
 
 		w.Header().Set("Content-Type", "text/html")
 	}
 
-	// Render activation email
+	h.Info.Printf("%s - auth_token:request - %s:%s:%s\n", FormatRequest(r), email, tType, authRequest.AuthToken.Id)
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(response)
+
+	return nil
+}
+
+// Minimum time between two activation emails for the same email address
+const resendActivationCooldown = 5 * time.Minute
+
+type ResendActivation struct {
+	*Server
+}
+
+// Resent activation emails count towards the same limits as the original ones
+func (h *ResendActivation) emailRateLimited() {}
+
+// Handler function for resending the activation email of a pending auth request. A new activation
+// token is generated, invalidating the previous link, while the request keeps expiring relative
+// to when it was originally made. To avoid revealing whether an email address has a pending
+// request, the response is always empty with a 200 status code, even if no email was sent
+// because of the cooldown or rate limiting
+func (h *ResendActivation) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	if h.Config.DisableEmail {
+		return &FeatureDisabled{"Email"}
+	}
+
+	email := r.PostFormValue("email")
+	if email == "" {
+		return &BadRequest{"no email provided"}
+	}
+
+	// Rate limit before looking up the request, so this endpoint can't be used to put load on
+	// the database
+	if h.emailRateLimiter.RateLimitRequest(r, email) {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	authRequest, err := LatestAuthRequest(h.Storage, email, h.Clock)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	if err == nil && h.now().Sub(authRequest.LastSent()) >= resendActivationCooldown {
+		if err := h.resend(r, authRequest); err != nil {
+			return err
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// Replaces the activation token of `authRequest` and sends a new activation email
+func (h *ResendActivation) resend(r *http.Request, authRequest *AuthRequest) error {
+	ops := deleteAuthRequestOps(authRequest)
+
+	actToken, err := token(h.tokenBytes())
+	if err != nil {
+		return err
+	}
+	authRequest.Token = actToken
+	authRequest.Resent = h.now()
+
+	if err := h.Storage.BatchCtx(r.Context(), append(ops, putAuthRequestOps(authRequest)...)); err != nil {
+		return err
+	}
+
+	var emailBody bytes.Buffer
 	if err := h.Templates.ActivateAuthTokenEmail.Execute(&emailBody, map[string]interface{}{
 		"activation_link": fmt.Sprintf("%s/activate/?t=%s", h.BaseUrl(r), authRequest.Token),
 		"token":           authRequest.AuthToken,
@@ -126,21 +336,14 @@ func (h *RequestAuthToken) Handle(w http.ResponseWriter, r *http.Request, auth *
 		return err
 	}
 
-	if !h.emailRateLimiter.RateLimit(getIp(r), email) {
-		// Send email with activation link
-		go func() {
-			if err := h.Sender.Send(email, emailSubj, emailBody.String()); err != nil {
-				h.LogError(&ServerError{err}, r)
-			}
-		}()
-	} else {
-		return &RateLimitExceeded{}
+	at := authRequest.AuthToken
+	subject, err := h.emailSubject(h.EmailSubjects.ForAuthType(at.Type), r, at.Email)
+	if err != nil {
+		return err
 	}
+	h.sendEmail(r, at.Email, subject, emailBody.String())
 
-	h.Info.Printf("%s - auth_token:request - %s:%s:%s\n", FormatRequest(r), email, tType, authRequest.AuthToken.Id)
-
-	w.WriteHeader(http.StatusAccepted)
-	w.Write(response)
+	h.Info.Printf("%s - auth_token:resend - %s:%s:%s\n", FormatRequest(r), at.Email, at.Type, at.Id)
 
 	return nil
 }
@@ -159,7 +362,7 @@ func (h *ActivateAuthToken) GetAuthRequest(r *http.Request) (*AuthRequest, error
 	// Let's check if an unactivate api key exists for this token. If not,
 	// the token is not valid
 	authRequest := &AuthRequest{Token: token}
-	if err := h.Storage.Get(authRequest); err != nil {
+	if err := h.Storage.GetCtx(r.Context(), authRequest); err != nil {
 		if err == ErrNotFound {
 			return nil, &BadRequest{"invalid activation token"}
 		} else {
@@ -170,7 +373,7 @@ func (h *ActivateAuthToken) GetAuthRequest(r *http.Request) (*AuthRequest, error
 	return authRequest, nil
 }
 
-func (h *ActivateAuthToken) Activate(authRequest *AuthRequest) error {
+func (h *ActivateAuthToken) Activate(authRequest *AuthRequest, r *http.Request) error {
 	at := authRequest.AuthToken
 
 	// Create account instance with the given email address.
@@ -178,22 +381,40 @@ func (h *ActivateAuthToken) Activate(authRequest *AuthRequest) error {
 
 	// Fetch existing account data. It's fine if no existing data is found. In that case we'll create
 	// a new entry in the database
-	if err := h.Storage.Get(acc); err != nil && err != ErrNotFound {
+	err := h.Storage.Get(acc)
+	if err != nil && err != ErrNotFound {
 		return err
 	}
+	created := err == ErrNotFound
+	if created {
+		h.Config.DefaultAccount.Apply(acc)
+	}
+
+	// Make room for the new key if the account has reached its limit
+	if max := h.Config.MaxTokensPerAccount; max > 0 && len(acc.AuthTokens) >= max {
+		if h.Config.TokenLimitPolicy != TokenLimitEvict {
+			return &TooManyAuthTokens{max}
+		}
+		for len(acc.AuthTokens) >= max {
+			evicted := acc.LeastRecentlyUsedAuthToken()
+			acc.RemoveAuthToken(evicted)
+			h.audit(r, "auth_token:evict", at.Email, fmt.Sprintf("%s:%s", evicted.Type, evicted.Id))
+		}
+	}
 
 	// Add the new key to the account
 	acc.AddAuthToken(at)
 
-	// Save the changes
-	if err := h.Storage.Put(acc); err != nil {
+	// Save the changes and delete the authentication request from the database, so the request
+	// can't be used again
+	if err := h.Storage.Batch(append(deleteAuthRequestOps(authRequest), PutOp(acc))); err != nil {
 		return err
 	}
 
-	// Delete the authentication request from the database
-	if err := h.Storage.Delete(authRequest); err != nil {
-		return err
+	if created {
+		h.audit(r, "account:create", at.Email, "")
 	}
+	h.audit(r, "auth_token:create", at.Email, fmt.Sprintf("%s:%s", at.Type, at.Id))
 
 	return nil
 }
@@ -222,12 +443,13 @@ func (h *ActivateAuthToken) Success(w http.ResponseWriter, r *http.Request, auth
 
 	if at.Type == "api" {
 		// If auth type is "api" also log them in so they can be redirected to dashboard
-		login, err := NewAuthRequest(at.Email, "web")
+		login, err := NewAuthRequest(at.Email, "web", h.tokenBytes(), h.Clock)
 		if err != nil {
 			return err
 		}
+		h.recordClient(login.AuthToken, r)
 
-		if err := h.Activate(login); err != nil {
+		if err := h.Activate(login, r); err != nil {
 			return err
 		}
 
@@ -249,13 +471,114 @@ func (h *ActivateAuthToken) Handle(w http.ResponseWriter, r *http.Request, auth
 		return err
 	}
 
-	if err := h.Activate(authRequest); err != nil {
+	if err := h.Activate(authRequest, r); err != nil {
 		return err
 	}
 
 	return h.Success(w, r, authRequest)
 }
 
+// Returns the name of the vault addressed by requests to `/store/{name}` or an empty string for
+// requests to the account's default data store
+func vaultName(r *http.Request) (string, error) {
+	name := strings.TrimPrefix(r.URL.Path, "/store/")
+	if name != "" && !ValidVaultName(name) {
+		return "", &BadRequest{"invalid vault name"}
+	}
+	return name, nil
+}
+
+type StoreUsage struct {
+	*Server
+}
+
+// Handler function for retrieving the number of bytes stored for the authenticated account along
+// with its data quota, if any
+func (h *StoreUsage) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc := auth.Account()
+
+	usage, err := GetStorageUsage(h.Storage, acc.Email)
+	if err != nil {
+		return err
+	}
+	usage.setQuota(acc.DataQuota)
+
+	h.Info.Printf("%s - data_store:usage - %s\n", FormatRequest(r), acc.Email)
+
+	return writeJSON(w, http.StatusOK, usage)
+}
+
+// Representation of an auth token in session listings. Secrets like the token itself are omitted
+type session struct {
+	Id         string    `json:"id"`
+	Type       string    `json:"type"`
+	DeviceName string    `json:"deviceName"`
+	Created    time.Time `json:"created"`
+	LastUsed   time.Time `json:"lastUsed"`
+	LastIP     string    `json:"lastIp"`
+	Location   string    `json:"location,omitempty"`
+	// Whether this is the token used for the request
+	Current bool `json:"current"`
+}
+
+type ListSessions struct {
+	*Server
+}
+
+// Handler function for listing the active auth tokens of the authenticated account
+func (h *ListSessions) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc := auth.Account()
+
+	sessions := []*session{}
+	for _, t := range acc.AuthTokens {
+		if t == nil || t.ExpiredAt(h.now()) {
+			continue
+		}
+		sessions = append(sessions, &session{
+			Id:         t.Id,
+			Type:       t.Type,
+			DeviceName: t.DeviceName,
+			Created:    t.Created,
+			LastUsed:   t.LastUsed,
+			LastIP:     t.LastIP,
+			Location:   t.Location,
+			Current:    t.Id == auth.Id,
+		})
+	}
+
+	return writeJSON(w, http.StatusOK, sessions)
+}
+
+type RevokeSession struct {
+	*Server
+}
+
+// Handler function for revoking one of the authenticated account's auth tokens by its id. Tokens
+// of other accounts can't be found this way and result in a `NotFound` error
+func (h *RevokeSession) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	id := strings.TrimPrefix(r.URL.Path, "/auth/sessions/")
+	if id == "" {
+		return &BadRequest{"no session id provided"}
+	}
+
+	acc := auth.Account()
+
+	_, t := acc.findAuthToken(&AuthToken{Id: id})
+	if t == nil {
+		return &NotFound{}
+	}
+
+	acc.RemoveAuthToken(t)
+	if err := h.Storage.PutCtx(r.Context(), acc); err != nil {
+		return err
+	}
+
+	h.audit(r, "auth_token:revoke", acc.Email, t.Id)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 type ReadStore struct {
 	*Server
 }
@@ -264,11 +587,28 @@ type ReadStore struct {
 func (h *ReadStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
 	acc := auth.Account()
 
+	name, err := vaultName(r)
+	if err != nil {
+		return err
+	}
+
+	if name != "" {
+		v := &Vault{Email: acc.Email, Name: name}
+		if err := h.Storage.GetCtx(r.Context(), v); err != nil && err != ErrNotFound {
+			return err
+		}
+
+		h.Info.Printf("%s - vault:read - %s:%s\n", FormatRequest(r), acc.Email, name)
+
+		w.Write(v.Content)
+		return nil
+	}
+
 	// Retrieve data from database. If not database entry is found, the `Content` field simply stays empty.
 	// This is not considered an error. Instead we simply return an empty response body. Clients should
 	// know how to deal with this.
 	data := &DataStore{Account: acc}
-	if err := h.Storage.Get(data); err != nil && err != ErrNotFound {
+	if err := h.Storage.GetCtx(r.Context(), data); err != nil && err != ErrNotFound {
 		return err
 	}
 
@@ -292,16 +632,46 @@ type WriteStore struct {
 func (h *WriteStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
 	acc := auth.Account()
 
+	name, err := vaultName(r)
+	if err != nil {
+		return err
+	}
+
 	// Read data from request body into `DataStore` instance
 	data := &DataStore{Account: acc}
 	content, err := ioutil.ReadAll(r.Body)
-	if err != nil {
+	if e, ok := err.(*http.MaxBytesError); ok {
+		return &RequestEntityTooLarge{e.Limit}
+	} else if err != nil {
 		return err
 	}
 	data.Content = content
 
-	// Update database entry
-	if err := h.Storage.Put(data); err != nil {
+	if err := h.checkDataQuota(acc, name, len(content)); err != nil {
+		return err
+	}
+
+	// Named vaults are stored separately and aren't versioned
+	if name != "" {
+		if err := h.checkVaultLimits(r.Context(), acc.Email, name, len(content)); err != nil {
+			return err
+		}
+		if err := h.Storage.PutCtx(r.Context(), &Vault{Email: acc.Email, Name: name, Content: content}); err != nil {
+			return err
+		}
+
+		h.Info.Printf("%s - vault:write - %s:%s\n", FormatRequest(r), acc.Email, name)
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	// Update database entry along with its version history
+	ops, err := recordDataVersionOps(h.Storage, acc.Email, content, h.Config.DataVersions, h.Clock)
+	if err != nil {
+		return err
+	}
+	if err := h.Storage.BatchCtx(r.Context(), append(ops, PutOp(data))); err != nil {
 		return err
 	}
 
@@ -313,6 +683,66 @@ func (h *WriteStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthTo
 	return nil
 }
 
+// Makes sure that writing `size` bytes to the vault `name`, or the data store if `name` is empty,
+// keeps `acc` within its `DataQuota`
+func (h *WriteStore) checkDataQuota(acc *Account, name string, size int) error {
+	if acc.DataQuota <= 0 {
+		return nil
+	}
+
+	usage, err := GetStorageUsage(h.Storage, acc.Email)
+	if err != nil {
+		return err
+	}
+
+	// The data being replaced doesn't count towards the quota
+	replaced := usage.Bytes
+	if name != "" {
+		replaced = usage.Vaults[name]
+	} else {
+		for _, n := range usage.Vaults {
+			replaced -= n
+		}
+	}
+
+	if usage.Bytes-replaced+int64(size) > acc.DataQuota {
+		return &DataQuotaExceeded{acc.DataQuota}
+	}
+	return nil
+}
+
+// Makes sure that writing `size` bytes to the vault `name` keeps the account within
+// `ServerConfig.MaxVaultsPerAccount` and `ServerConfig.MaxVaultBytesPerAccount`
+func (h *WriteStore) checkVaultLimits(ctx context.Context, email string, name string, size int) error {
+	maxVaults := h.Config.MaxVaultsPerAccount
+	maxBytes := h.Config.MaxVaultBytesPerAccount
+	if maxVaults <= 0 && maxBytes <= 0 {
+		return nil
+	}
+
+	// Count all other vaults, since `name` is about to be replaced
+	count := 0
+	total := int64(size)
+	prefix := email + "/"
+	if err := h.Storage.ListPrefixFuncCtx(ctx, &Vault{}, prefix, func(key string, size int) error {
+		if key != prefix+name {
+			count++
+			total += int64(size)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if maxVaults > 0 && count >= maxVaults {
+		return &TooManyVaults{maxVaults}
+	}
+	if maxBytes > 0 && total > maxBytes {
+		return &VaultStorageExceeded{maxBytes}
+	}
+	return nil
+}
+
 type DeleteStore struct {
 	*Server
 }
@@ -320,10 +750,16 @@ type DeleteStore struct {
 func (h *DeleteStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
 	acc := auth.Account()
 
-	if err := h.Storage.Delete(&DataStore{Account: acc}); err != nil {
+	ops, err := resetAccountDataOps(h.Storage, acc)
+	if err != nil {
+		return err
+	}
+	if err := h.Storage.BatchCtx(r.Context(), ops); err != nil {
 		return err
 	}
 
+	h.audit(r, "data_store:delete", acc.Email, "")
+
 	http.Redirect(w, r, "/dashboard/?datareset=1", http.StatusFound)
 	return nil
 }
@@ -332,12 +768,39 @@ type RequestDeleteStore struct {
 	*Server
 }
 
+// Emails confirming data deletion are rate limited as well
+func (h *RequestDeleteStore) emailRateLimited() {}
+
 // Handler function for requesting a data reset for a given account
 func (h *RequestDeleteStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	name, err := vaultName(r)
+	if err != nil {
+		return err
+	}
+
+	// Named vaults can be overwritten by any client anyway, so they are deleted right away instead of
+	// requiring confirmation via email
+	if name != "" {
+		acc := auth.Account()
+		if err := h.Storage.DeleteCtx(r.Context(), &Vault{Email: acc.Email, Name: name}); err != nil {
+			return err
+		}
+
+		h.Info.Printf("%s - vault:delete - %s:%s\n", FormatRequest(r), acc.Email, name)
+		h.audit(r, "vault:delete", acc.Email, name)
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if h.Config.DisableEmail {
+		return &FeatureDisabled{"Email"}
+	}
+
 	acc := auth.Account()
 
 	// Create AuthRequest
-	authRequest, err := NewAuthRequest(acc.Email, "web")
+	authRequest, err := NewAuthRequest(acc.Email, "web", h.tokenBytes(), h.Clock)
 	if err != nil {
 		return err
 	}
@@ -346,7 +809,7 @@ func (h *RequestDeleteStore) Handle(w http.ResponseWriter, r *http.Request, auth
 	authRequest.Redirect = "/dashboard/?action=resetdata"
 
 	// Save authrequest
-	if err := h.Storage.Put(authRequest); err != nil {
+	if err := h.Storage.BatchCtx(r.Context(), putAuthRequestOps(authRequest)); err != nil {
 		return err
 	}
 
@@ -361,13 +824,14 @@ func (h *RequestDeleteStore) Handle(w http.ResponseWriter, r *http.Request, auth
 
 	body := buff.String()
 
-	if !h.emailRateLimiter.RateLimit(getIp(r), acc.Email) {
+	subject, err := h.emailSubject(h.EmailSubjects.DeleteRequest, r, acc.Email)
+	if err != nil {
+		return err
+	}
+
+	if !h.emailRateLimiter.RateLimitRequest(r, acc.Email) {
 		// Send email with activation link
-		go func() {
-			if err := h.Sender.Send(acc.Email, "Padlock Cloud Delete Request", body); err != nil {
-				h.LogError(&ServerError{err}, r)
-			}
-		}()
+		h.sendEmail(r, acc.Email, subject, body)
 	} else {
 		return &RateLimitExceeded{}
 	}
@@ -426,9 +890,11 @@ func (h *Logout) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken)
 	acc := auth.Account()
 
 	acc.RemoveAuthToken(auth)
-	if err := h.Storage.Put(acc); err != nil {
+	if err := h.Storage.PutCtx(r.Context(), acc); err != nil {
 		return err
 	}
+
+	h.audit(r, "auth_token:revoke", acc.Email, auth.Id+" (logout)")
 	http.SetCookie(w, &http.Cookie{
 		Name:     "auth",
 		Value:    "",
@@ -459,14 +925,16 @@ func (h *Revoke) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken)
 		return &BadRequest{"No such token"}
 	}
 
-	t.Expires = time.Now().Add(-time.Minute)
+	t.Expires = h.now().Add(-time.Minute)
 
 	acc.UpdateAuthToken(t)
 
-	if err := h.Storage.Put(acc); err != nil {
+	if err := h.Storage.PutCtx(r.Context(), acc); err != nil {
 		return err
 	}
 
+	h.audit(r, "auth_token:revoke", acc.Email, t.Id)
+
 	http.Redirect(w, r, fmt.Sprintf("/dashboard/?revoked=%s", t.Id), http.StatusFound)
 
 	return nil
@@ -476,8 +944,34 @@ type StaticHandler struct {
 	fh http.Handler
 }
 
+// Discards the plain text error written by `http.FileServer` for missing files so a 404 can be
+// returned in the format preferred by the client instead
+type notFoundWriter struct {
+	http.ResponseWriter
+	notFound bool
+}
+
+func (w *notFoundWriter) WriteHeader(code int) {
+	if code == http.StatusNotFound {
+		w.notFound = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *notFoundWriter) Write(p []byte) (int, error) {
+	if w.notFound {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
 func (h *StaticHandler) Handle(w http.ResponseWriter, r *http.Request, a *AuthToken) error {
-	h.fh.ServeHTTP(w, r)
+	nw := &notFoundWriter{ResponseWriter: w}
+	h.fh.ServeHTTP(nw, r)
+	if nw.notFound {
+		return &UnsupportedEndpoint{r.URL.Path}
+	}
 	return nil
 }
 
@@ -487,6 +981,36 @@ func NewStaticHandler(dir string, path string) *StaticHandler {
 	return &StaticHandler{fh}
 }
 
+func NewStaticHandlerFS(fsys fs.FS, path string) *StaticHandler {
+	// Serve up static files
+	fh := http.StripPrefix(path, http.FileServer(http.FS(fsys)))
+	return &StaticHandler{fh}
+}
+
+// Version and build information returned by the `/version/` endpoint
+type VersionInfo struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit,omitempty"`
+	GoVersion string    `json:"go_version"`
+	Started   time.Time `json:"started"`
+	// Time since the server was started in seconds
+	Uptime float64 `json:"uptime"`
+}
+
+type VersionHandler struct {
+	*Server
+}
+
+func (h *VersionHandler) Handle(w http.ResponseWriter, r *http.Request, a *AuthToken) error {
+	return writeJSON(w, http.StatusOK, &VersionInfo{
+		Version:   Version,
+		Commit:    Commit,
+		GoVersion: runtime.Version(),
+		Started:   h.started,
+		Uptime:    h.now().Sub(h.started).Seconds(),
+	})
+}
+
 type RootHandler struct {
 	*Server
 }
@@ -510,6 +1034,14 @@ type Endpoint struct {
 	Handlers map[string]Handler
 	Version  int
 	AuthType string
+	// Maximum size of request bodies in bytes. Overrides `ServerConfig.MaxRequestBodyBytes` if not zero
+	MaxBodyBytes int64
+	// Exempt this endpoint from `ServerConfig.RequestTimeout`, e.g. for long-polling
+	NoTimeout bool
+	// Methods that modify data and are therefore rejected in read-only mode
+	Writes []string
+	// Also accept verified client certificates instead of auth tokens of type `AuthType`
+	ClientCert bool
 }
 
 func (endpoint *Endpoint) Handle(w http.ResponseWriter, r *http.Request, a *AuthToken) error {
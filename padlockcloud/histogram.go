@@ -0,0 +1,95 @@
+package padlockcloud
+
+import "math"
+import "sort"
+
+// Upper bounds of the buckets used for `BlobSizeHistogram`, in bytes. Sizes above the last bound
+// fall into an additional, unbounded bucket
+var blobSizeBuckets = []int64{
+	1 << 10,
+	4 << 10,
+	16 << 10,
+	64 << 10,
+	256 << 10,
+	1 << 20,
+	4 << 20,
+	16 << 20,
+}
+
+// Single bucket of a `SizeHistogram`
+type SizeBucket struct {
+	// Inclusive upper bound in bytes. -1 for the last, unbounded bucket
+	Le int64 `json:"le"`
+	// Number of sizes in this bucket (not including smaller buckets)
+	Count int `json:"count"`
+}
+
+// Distribution of data store sizes
+type SizeHistogram struct {
+	Buckets []SizeBucket `json:"buckets"`
+	// Total number of data stores
+	Count int `json:"count"`
+	// Aggregate size of all data stores in bytes
+	Sum int64 `json:"sum"`
+	P50 int64 `json:"p50"`
+	P95 int64 `json:"p95"`
+	P99 int64 `json:"p99"`
+}
+
+// Returns the value at percentile `p` (0 < p <= 1) of `sorted` using the nearest-rank method
+func percentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// Builds a histogram from a list of sizes in bytes
+func NewSizeHistogram(sizes []int64) *SizeHistogram {
+	h := &SizeHistogram{}
+	for _, le := range blobSizeBuckets {
+		h.Buckets = append(h.Buckets, SizeBucket{Le: le})
+	}
+	h.Buckets = append(h.Buckets, SizeBucket{Le: -1})
+
+	sorted := append([]int64{}, sizes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for _, size := range sorted {
+		i := sort.Search(len(blobSizeBuckets), func(i int) bool { return size <= blobSizeBuckets[i] })
+		h.Buckets[i].Count++
+		h.Count++
+		h.Sum += size
+	}
+
+	h.P50 = percentile(sorted, 0.5)
+	h.P95 = percentile(sorted, 0.95)
+	h.P99 = percentile(sorted, 0.99)
+
+	return h
+}
+
+// Collects the size distribution of the data stores of all accounts. Accounts are streamed via
+// `ListFunc` so only the sizes are kept in memory. Accounts without data are skipped
+func BlobSizeHistogram(storage Storage) (*SizeHistogram, error) {
+	var sizes []int64
+
+	if err := storage.ListFunc(&Account{}, func(email string) error {
+		data := &DataStore{Account: &Account{Email: email}}
+		if err := storage.Get(data); err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		sizes = append(sizes, int64(len(data.Content)))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return NewSizeHistogram(sizes), nil
+}
@@ -0,0 +1,68 @@
+package padlockcloud
+
+import "testing"
+import "fmt"
+
+func TestBlobSizeHistogram(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	var sizes []int
+	for i := 0; i < 10; i++ {
+		sizes = append(sizes, 100)
+	}
+	for i := 0; i < 5; i++ {
+		sizes = append(sizes, 2000)
+	}
+	for i := 0; i < 3; i++ {
+		sizes = append(sizes, 10000)
+	}
+	sizes = append(sizes, 100000, 17<<20)
+
+	for i, size := range sizes {
+		acc := &Account{Email: fmt.Sprintf("user%02d@padlock.io", i)}
+		if err := storage.Put(acc); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(&DataStore{Account: acc, Content: make([]byte, size)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Accounts without data should be skipped
+	if err := storage.Put(&Account{Email: "empty@padlock.io"}); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := BlobSizeHistogram(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{10, 5, 3, 0, 1, 0, 0, 0, 1}
+	if len(h.Buckets) != len(expected) {
+		t.Fatalf("Expected %d buckets, got %d", len(expected), len(h.Buckets))
+	}
+	for i, b := range h.Buckets {
+		if b.Count != expected[i] {
+			t.Errorf("Expected %d entries in bucket <= %d, got %d", expected[i], b.Le, b.Count)
+		}
+	}
+
+	if h.Count != 20 {
+		t.Errorf("Expected count to be 20, is %d", h.Count)
+	}
+	if h.Sum != 10*100+5*2000+3*10000+100000+17<<20 {
+		t.Errorf("Unexpected sum %d", h.Sum)
+	}
+	if h.P50 != 100 || h.P95 != 100000 || h.P99 != 17<<20 {
+		t.Errorf("Unexpected percentiles: p50=%d, p95=%d, p99=%d", h.P50, h.P95, h.P99)
+	}
+
+	if empty := NewSizeHistogram(nil); empty.Count != 0 || empty.P50 != 0 {
+		t.Errorf("Expected empty histogram, got %+v", empty)
+	}
+}
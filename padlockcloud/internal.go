@@ -0,0 +1,83 @@
+package padlockcloud
+
+import "fmt"
+import "net"
+import "net/http"
+
+// Creates the handler for the internal listener, carrying all operational endpoints: Metrics under
+// /metrics, a health check under /healthz, profiling data under /debug/pprof/ and, if an admin key
+// is configured, the admin api under /admin/
+func (server *Server) InternalHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, server.MetricsSnapshot())
+	})
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if server.Starting() || !server.Storage.Ready() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if server.Config.RequireEmailForReadiness {
+			if h := server.checkEmailReadiness(); h != nil && h.Status == EmailHealthUnhealthy {
+				http.Error(w, "unavailable\nemail unhealthy: "+h.Error, http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ok"))
+		// Unless required for readiness, a mail server that can't be reached doesn't make the server
+		// unavailable, so it is only reported here
+		if h := server.EmailHealth(); h != nil && h.Status == EmailHealthUnhealthy {
+			fmt.Fprintf(w, "\nemail unhealthy: %s", h.Error)
+		}
+	})
+
+	mux.Handle("/debug/pprof/", PprofHandler())
+
+	if server.Config.Admin.Key != "" {
+		mux.Handle("/admin/", server.AdminHandler())
+	}
+
+	mux.Handle("/", server.NotFoundHandler())
+
+	return mux
+}
+
+// Starts the internal listener in the background if an address is configured. It is closed along
+// with the public listeners in `CleanUp`
+func (server *Server) StartInternal() error {
+	if server.Config.InternalBindAddr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", server.Config.InternalBindAddr)
+	if err != nil {
+		return err
+	}
+
+	server.internal = &http.Server{
+		Handler:  server.InternalHandler(),
+		ErrorLog: server.Error,
+	}
+	server.listenersMutex.Lock()
+	server.internalAddr = l.Addr()
+	server.listenersMutex.Unlock()
+
+	server.Info.Printf("Starting internal endpoints on %s", l.Addr())
+
+	go func() {
+		if err := server.internal.Serve(l); err != nil && err != http.ErrServerClosed {
+			server.Error.Println("Internal endpoints stopped unexpectedly:", err)
+		}
+	}()
+
+	return nil
+}
+
+// Address the internal listener is bound to, or nil if it isn't running
+func (server *Server) InternalAddr() net.Addr {
+	server.listenersMutex.Lock()
+	defer server.listenersMutex.Unlock()
+	return server.internalAddr
+}
@@ -0,0 +1,196 @@
+package padlockcloud
+
+import "crypto/tls"
+import "errors"
+import "net"
+import "net/http"
+import "strconv"
+import "strings"
+import "time"
+
+import "gopkg.in/tylerb/graceful.v1"
+
+// Configuration for a single address the server should listen on
+type ListenerConfig struct {
+	// Address to listen on, e.g. ":443" or "127.0.0.1:3000"
+	Addr string `yaml:"addr"`
+	// Serve TLS on this address using the configured certificate and key
+	TLS bool `yaml:"tls"`
+}
+
+// Returns the configured listeners. If none are configured explicitly, a single listener is created
+// from the `BindHost`, `Port`, `TLSCert` and `TLSKey` options
+func (server *Server) listenerConfigs() []ListenerConfig {
+	if len(server.Config.Listeners) != 0 {
+		return server.Config.Listeners
+	}
+
+	// IPv6 literals may be provided with or without brackets
+	host := strings.TrimSuffix(strings.TrimPrefix(server.Config.BindHost, "["), "]")
+
+	return []ListenerConfig{{
+		Addr: net.JoinHostPort(host, strconv.Itoa(server.Config.Port)),
+		TLS:  server.Config.TLSCert != "" && server.Config.TLSKey != "",
+	}}
+}
+
+// Creates the TLS configuration used for TLS listeners
+func (server *Server) listenerTLSConfig() (*tls.Config, error) {
+	if server.Config.TLSCert == "" || server.Config.TLSKey == "" {
+		return nil, errors.New("padlock: TLS listeners require a TLS certificate and key")
+	}
+
+	cert, err := tls.LoadX509KeyPair(server.Config.TLSCert, server.Config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{}
+	if server.TLSConfig != nil {
+		config = server.TLSConfig.Clone()
+	}
+	config.Certificates = []tls.Certificate{cert}
+	config.NextProtos = []string{"h2", "http/1.1"}
+
+	return config, nil
+}
+
+// Returns the http versions served on a listener. TLS listeners negotiate HTTP/2 via ALPN, while
+// plain listeners only accept HTTP/2 if h2c is enabled
+func (server *Server) listenerProtocols(c ListenerConfig) *http.Protocols {
+	p := &http.Protocols{}
+	p.SetHTTP1(true)
+	if c.TLS {
+		p.SetHTTP2(true)
+	} else if server.Config.H2C {
+		p.SetUnencryptedHTTP2(true)
+	}
+	return p
+}
+
+// Opens all configured listeners. If any of them fails, the others are closed again and the
+// errors are returned together
+func (server *Server) openListeners(configs []ListenerConfig) ([]net.Listener, error) {
+	var listeners []net.Listener
+	var errs []error
+	var tlsConfig *tls.Config
+
+	for _, c := range configs {
+		l, err := net.Listen("tcp", c.Addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if server.Config.ProxyProtocol {
+			l = &proxyListener{l}
+		}
+
+		if c.TLS {
+			if tlsConfig == nil {
+				if tlsConfig, err = server.listenerTLSConfig(); err != nil {
+					l.Close()
+					errs = append(errs, err)
+					continue
+				}
+			}
+			l = tls.NewListener(l, tlsConfig)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	if len(errs) != 0 {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	return listeners, nil
+}
+
+// Serves requests on all configured listeners. Blocks until all of them have been stopped
+func (server *Server) serveListeners() error {
+	configs := server.listenerConfigs()
+
+	listeners, err := server.openListeners(configs)
+	if err != nil {
+		return err
+	}
+
+	server.listenersMutex.Lock()
+	if server.stopped {
+		// `Stop` was called before the server was started
+		server.listenersMutex.Unlock()
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil
+	}
+	server.listeners = nil
+	for i, l := range listeners {
+		server.listeners = append(server.listeners, &graceful.Server{
+			Server: &http.Server{
+				Handler:   server.Handler,
+				ErrorLog:  server.ErrorLog,
+				Protocols: server.listenerProtocols(configs[i]),
+			},
+			Timeout:          server.Timeout,
+			Logger:           server.Logger,
+			ConnState:        server.Metrics.ConnState,
+			NoSignalHandling: server.NoSignalHandling,
+		})
+
+		if configs[i].TLS {
+			server.Secure = true
+			server.Info.Printf("Starting server with TLS on %v", l.Addr())
+		} else {
+			server.Info.Printf("Starting server on %v", l.Addr())
+		}
+	}
+	server.addrs = nil
+	for _, l := range listeners {
+		server.addrs = append(server.addrs, l.Addr())
+	}
+	server.listenersMutex.Unlock()
+
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		go func(srv *graceful.Server, l net.Listener) {
+			errs <- srv.Serve(l)
+		}(server.listeners[i], l)
+	}
+
+	var serveErrs []error
+	for range listeners {
+		if err := <-errs; err != nil {
+			// Stop remaining listeners if one of them fails
+			if len(serveErrs) == 0 {
+				go server.Stop(server.Timeout)
+			}
+			serveErrs = append(serveErrs, err)
+		}
+	}
+
+	return errors.Join(serveErrs...)
+}
+
+// Addresses the server is currently listening on
+func (server *Server) Addrs() []net.Addr {
+	server.listenersMutex.Lock()
+	defer server.listenersMutex.Unlock()
+	return append([]net.Addr{}, server.addrs...)
+}
+
+// Gracefully stops all listeners, waiting up to `timeout` for active requests to finish
+func (server *Server) Stop(timeout time.Duration) {
+	server.listenersMutex.Lock()
+	server.stopped = true
+	listeners := server.listeners
+	server.listenersMutex.Unlock()
+
+	for _, l := range listeners {
+		l.Stop(timeout)
+	}
+}
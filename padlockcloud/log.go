@@ -3,6 +3,12 @@ package padlockcloud
 import "os"
 import "io"
 import "log"
+import "fmt"
+import "sync"
+import "time"
+import "regexp"
+import "strings"
+import "net/mail"
 
 var stdout io.Writer = os.Stdout
 var stderr io.Writer = os.Stderr
@@ -12,45 +18,173 @@ type LogConfig struct {
 	LogFile string `yaml:"log_file"`
 	// File to write errors to. Defaults to the value of `LogFile`
 	ErrFile string `yaml:"err_file"`
-	// An address to send error notifications to
+	// Size in megabytes after which log files are rotated. Log files are never rotated if zero
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// Number of rotated log files to keep
+	MaxBackups int `yaml:"max_backups"`
+	// Comma-separated list of addresses to send error notifications to
 	NotifyErrors string `yaml:"notify_errors"`
+	// Prefix for the subject of error notifications
+	NotifySubjectPrefix string `yaml:"notify_subject_prefix"`
+	// Identical errors occurring within this time window are only sent once. Suppressed errors
+	// are summarized in a separate notification at the end of the window
+	NotifyThrottle time.Duration `yaml:"notify_throttle"`
+	// Minimum level of messages to log, either `LogLevelInfo` (the default if empty) or
+	// `LogLevelDebug`
+	Level string `yaml:"level"`
 }
 
+// Log levels
+const (
+	// Informational messages and errors
+	LogLevelInfo = "info"
+	// Additionally log details useful for debugging, like the effective route table on startup
+	LogLevelDebug = "debug"
+)
+
+// Checks that `Level` is a known log level
+func (c *LogConfig) ValidateLevel() error {
+	if c.Level != "" && c.Level != LogLevelInfo && c.Level != LogLevelDebug {
+		return fmt.Errorf("padlock: invalid log level '%s', use '%s' or '%s'", c.Level, LogLevelInfo, LogLevelDebug)
+	}
+	return nil
+}
+
+// Returns the addresses error notifications should be sent to
+func (c *LogConfig) NotifyRecipients() []string {
+	var recs []string
+	for _, rec := range strings.Split(c.NotifyErrors, ",") {
+		if rec = strings.TrimSpace(rec); rec != "" {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+// Checks that all notification recipients are valid email addresses
+func (c *LogConfig) ValidateNotifyRecipients() error {
+	for _, rec := range c.NotifyRecipients() {
+		if _, err := mail.ParseAddress(rec); err != nil {
+			return fmt.Errorf("padlock: invalid error notification recipient '%s': %v", rec, err)
+		}
+	}
+	return nil
+}
+
+// Matches the prefix and timestamp of log lines
+var logPrefixPattern = regexp.MustCompile(`^[A-Z]+: \d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} `)
+
 type Log struct {
-	Info   *log.Logger
-	Error  *log.Logger
+	Info  *log.Logger
+	Error *log.Logger
+	// Only writes anything if the log level is `LogLevelDebug`
+	Debug  *log.Logger
 	Sender Sender
 	Config *LogConfig
+	// Subject of error notifications. Defaults to `DefaultNotificationSubject` if empty
+	NotifySubject string
+
+	files []*RotatingFile
 }
 
 type SendWriter struct {
 	Sender
-	Recipient string
-	Subject   string
+	Recipients []string
+	Subject    string
+	// Identical messages written within this time window are only sent once
+	Throttle time.Duration
+
+	mutex      sync.Mutex
+	suppressed map[string]int
 }
 
 func (sw *SendWriter) Write(p []byte) (int, error) {
-	go sw.Send(sw.Recipient, sw.Subject, string(p))
+	msg := string(p)
+	if sw.Throttle == 0 || sw.allow(msg) {
+		go sw.sendAll(msg)
+	}
 	return len(p), nil
 }
 
+// Sends a message to all recipients. A failed delivery doesn't keep the others from being sent
+func (sw *SendWriter) sendAll(msg string) {
+	for _, rec := range sw.Recipients {
+		sw.Send(rec, sw.Subject, msg)
+	}
+}
+
+// Returns false if an identical message has already been sent within the throttle window.
+// Suppressed messages are counted and summarized once the window has passed
+func (sw *SendWriter) allow(msg string) bool {
+	key := logPrefixPattern.ReplaceAllString(msg, "")
+
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if sw.suppressed == nil {
+		sw.suppressed = make(map[string]int)
+	}
+
+	if count, ok := sw.suppressed[key]; ok {
+		sw.suppressed[key] = count + 1
+		return false
+	}
+
+	sw.suppressed[key] = 0
+	time.AfterFunc(sw.Throttle, func() {
+		sw.flush(key)
+	})
+
+	return true
+}
+
+// Sends a summary for a message that has been suppressed during the throttle window
+func (sw *SendWriter) flush(key string) {
+	sw.mutex.Lock()
+	count := sw.suppressed[key]
+	delete(sw.suppressed, key)
+	sw.mutex.Unlock()
+
+	if count > 0 {
+		sw.sendAll(fmt.Sprintf(
+			"The following error occurred %d more time(s) within %v:\n\n%s",
+			count, sw.Throttle, key,
+		))
+	}
+}
+
+// Opens a log file, rotating it according to the config
+func (l *Log) openFile(path string) (*RotatingFile, error) {
+	f, err := OpenRotatingFile(path, int64(l.Config.MaxSizeMB)<<20, l.Config.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	l.files = append(l.files, f)
+	return f, nil
+}
+
 func (l *Log) Init() error {
 	var out io.Writer
 	var errOut io.Writer
-	var err error
 
 	config := l.Config
 
+	l.Close()
+
 	if config.LogFile != "" {
-		if out, err = os.OpenFile(config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666); err != nil {
+		f, err := l.openFile(config.LogFile)
+		if err != nil {
 			return err
 		}
+		out = f
 	}
 
-	if config.ErrFile != "" {
-		if errOut, err = os.OpenFile(config.ErrFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666); err != nil {
+	if config.ErrFile != "" && config.ErrFile != config.LogFile {
+		f, err := l.openFile(config.ErrFile)
+		if err != nil {
 			return err
 		}
+		errOut = f
 	} else {
 		errOut = out
 	}
@@ -62,21 +196,58 @@ func (l *Log) Init() error {
 		errOut = stderr
 	}
 
-	if l.Config.NotifyErrors != "" && l.Sender != nil {
+	if recs := l.Config.NotifyRecipients(); len(recs) != 0 && l.Sender != nil {
+		subject := l.NotifySubject
+		if subject == "" {
+			subject = DefaultNotificationSubject
+		}
 		sw := &SendWriter{
-			l.Sender,
-			l.Config.NotifyErrors,
-			"Padlock Cloud Error Notification",
+			Sender:     l.Sender,
+			Recipients: recs,
+			Subject:    l.Config.NotifySubjectPrefix + subject,
+			Throttle:   l.Config.NotifyThrottle,
 		}
 		errOut = io.MultiWriter(sw, errOut)
 	}
 
 	l.Info = log.New(out, "INFO: ", log.Ldate|log.Ltime)
 	l.Error = log.New(errOut, "ERROR: ", log.Ldate|log.Ltime)
+	if l.DebugEnabled() {
+		l.Debug = log.New(out, "DEBUG: ", log.Ldate|log.Ltime)
+	} else {
+		l.Debug = log.New(io.Discard, "DEBUG: ", log.Ldate|log.Ltime)
+	}
 
 	return nil
 }
 
+// Reports whether debug messages are logged
+func (l *Log) DebugEnabled() bool {
+	return l.Config != nil && l.Config.Level == LogLevelDebug
+}
+
+// Reopens all log files, e.g. after they have been moved by logrotate
+func (l *Log) Reopen() error {
+	for _, f := range l.files {
+		if err := f.Reopen(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Closes all log files
+func (l *Log) Close() error {
+	var err error
+	for _, f := range l.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	l.files = nil
+	return err
+}
+
 func (l *Log) InitWithConfig(config *LogConfig) {
 	l.Config = config
 	l.Init()
@@ -7,6 +7,8 @@ import "io/ioutil"
 import "bytes"
 import "path/filepath"
 import "time"
+import "sync"
+import "log"
 
 func TestLogStdout(t *testing.T) {
 	// Replace standard outputs with buffer for recording
@@ -71,6 +73,53 @@ func TestLogFile(t *testing.T) {
 	}
 }
 
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "LOG.txt")
+	f, err := OpenRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	l := log.New(f, "", 0)
+	line := strings.Repeat("x", 39)
+	for i := 0; i < 10; i++ {
+		l.Println(line)
+	}
+
+	// Each file should hold two lines, with only the two most recent rotated files kept
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 80 {
+			t.Errorf("Expected %s to contain 80 bytes, got %d", p, len(data))
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected old rotated files to be removed, got %v", err)
+	}
+
+	// Reopening should create a new file after the current one has been moved away
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	l.Println("reopened")
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "reopened\n" {
+		t.Errorf("Expected new file to be created, got %q, %v", data, err)
+	}
+}
+
 func TestLogNotifyErrors(t *testing.T) {
 	// Disable standard error output so it doesn'ts show up during tests
 	preverr := stderr
@@ -104,3 +153,104 @@ func TestLogNotifyErrors(t *testing.T) {
 		t.Fatalf("Expected message to end in printed string '%s', got '%s'", testStr, rc.Message)
 	}
 }
+
+// `Sender` implementation that records all sent messages
+type recordAllSender struct {
+	mutex      sync.Mutex
+	recipients []string
+	subjects   []string
+	messages   []string
+}
+
+func (s *recordAllSender) Send(rec string, subj string, message string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.recipients = append(s.recipients, rec)
+	s.subjects = append(s.subjects, subj)
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+func (s *recordAllSender) sent() ([]string, []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.subjects, s.messages
+}
+
+func TestLogNotifyThrottle(t *testing.T) {
+	preverr := stderr
+	stderr = ioutil.Discard
+	defer func() {
+		stderr = preverr
+	}()
+
+	rc := &recordAllSender{}
+	l := NewLog(&LogConfig{
+		NotifyErrors:        "me",
+		NotifySubjectPrefix: "[test] ",
+		NotifyThrottle:      time.Millisecond * 100,
+	}, rc)
+
+	for i := 0; i < 10; i++ {
+		l.Error.Print("same error")
+	}
+	l.Error.Print("other error")
+
+	time.Sleep(time.Millisecond * 20)
+
+	// Only one notification should be sent per distinct error within the window
+	subjects, messages := rc.sent()
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 notifications, got %d: %v", len(messages), messages)
+	}
+	if subjects[0] != "[test] Padlock Cloud Error Notification" {
+		t.Fatalf("Expected subject to be prefixed, got '%s'", subjects[0])
+	}
+
+	// After the window has passed, suppressed errors should be summarized in one notification
+	time.Sleep(time.Millisecond * 150)
+
+	if _, messages = rc.sent(); len(messages) != 3 {
+		t.Fatalf("Expected 3 notifications, got %d: %v", len(messages), messages)
+	}
+	if !strings.Contains(messages[2], "9 more time(s)") || !strings.Contains(messages[2], "same error") {
+		t.Fatalf("Expected summary of suppressed errors, got '%s'", messages[2])
+	}
+}
+
+func TestLogNotifyMultipleRecipients(t *testing.T) {
+	preverr := stderr
+	stderr = ioutil.Discard
+	defer func() {
+		stderr = preverr
+	}()
+
+	rc := &recordAllSender{}
+	config := &LogConfig{
+		NotifyErrors: "oncall@example.com, Alerts <alerts@example.com>,",
+	}
+	if err := config.ValidateNotifyRecipients(); err != nil {
+		t.Fatal(err)
+	}
+	l := NewLog(config, rc)
+
+	l.Error.Print("hello world")
+
+	time.Sleep(time.Millisecond * 20)
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if strings.Join(rc.recipients, ",") != "oncall@example.com,Alerts <alerts@example.com>" {
+		t.Fatalf("Expected error report to be sent to every recipient, got %v", rc.recipients)
+	}
+	for _, msg := range rc.messages {
+		if !strings.HasSuffix(msg, "hello world\n") {
+			t.Errorf("Expected message to end in printed string, got '%s'", msg)
+		}
+	}
+
+	config.NotifyErrors = "oncall@example.com,not an address"
+	if err := config.ValidateNotifyRecipients(); err == nil {
+		t.Error("Expected an error for an invalid recipient")
+	}
+}
@@ -0,0 +1,68 @@
+package padlockcloud
+
+import "net"
+import "net/http"
+import "runtime"
+import "sync/atomic"
+
+// Operational gauges for diagnosing leaks and capacity issues
+type Metrics struct {
+	activeConnections int64
+	inFlightRequests  int64
+}
+
+// Snapshot of the current gauge values as returned by the admin api
+type MetricsSnapshot struct {
+	ActiveConnections int64 `json:"activeConnections"`
+	InFlightRequests  int64 `json:"inFlightRequests"`
+	Goroutines        int   `json:"goroutines"`
+	// Health of the mail server, if known to the sender
+	Email *EmailHealth `json:"email,omitempty"`
+	// Delivery counts of webhooks, if enabled
+	Webhooks *WebhookStats `json:"webhooks,omitempty"`
+	// Request counts of routes guarded by the email rate limiter, keyed by method and path
+	RateLimits map[string]RouteRateLimitStats `json:"rateLimits,omitempty"`
+	// Outcome of the last backup, if backups are enabled
+	Backup *BackupStats `json:"backup,omitempty"`
+}
+
+// Callback for `http.Server.ConnState`, keeping track of open connections
+func (m *Metrics) ConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&m.activeConnections, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&m.activeConnections, -1)
+	}
+}
+
+// Number of currently open connections
+func (m *Metrics) ActiveConnections() int64 {
+	return atomic.LoadInt64(&m.activeConnections)
+}
+
+// Number of requests currently being handled
+func (m *Metrics) InFlightRequests() int64 {
+	return atomic.LoadInt64(&m.inFlightRequests)
+}
+
+func (m *Metrics) Snapshot() *MetricsSnapshot {
+	return &MetricsSnapshot{
+		ActiveConnections: m.ActiveConnections(),
+		InFlightRequests:  m.InFlightRequests(),
+		Goroutines:        runtime.NumGoroutine(),
+	}
+}
+
+// Keeps track of the number of requests in flight
+type CountInFlight struct {
+	*Metrics
+}
+
+func (m *CountInFlight) Wrap(h Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, a *AuthToken) error {
+		atomic.AddInt64(&m.inFlightRequests, 1)
+		defer atomic.AddInt64(&m.inFlightRequests, -1)
+		return h.Handle(w, r, a)
+	})
+}
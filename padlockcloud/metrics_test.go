@@ -0,0 +1,158 @@
+package padlockcloud
+
+import "testing"
+import "encoding/json"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "time"
+
+func waitForGauge(t *testing.T, name string, get func() int64, expected int64) {
+	for i := 0; i < 100 && get() != expected; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := get(); v != expected {
+		t.Fatalf("Expected %s to be %d, is %d", name, expected, v)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := newServerTestContext()
+	metrics := ctx.server.Metrics
+
+	release := make(chan struct{})
+	ctx.server.Endpoints["/block/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET": HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+				<-release
+				return nil
+			}),
+		},
+	}
+	ctx.server.InitHandler()
+	ctx.server.Config.Listeners = []ListenerConfig{{Addr: "127.0.0.1:0"}}
+
+	done := make(chan error)
+	go func() {
+		done <- ctx.server.Start()
+	}()
+	defer func() {
+		ctx.server.Stop(time.Second)
+		<-done
+	}()
+
+	var addrs []net.Addr
+	for i := 0; i < 100 && len(addrs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		addrs = ctx.server.Addrs()
+	}
+	if len(addrs) == 0 {
+		t.Fatal("Server did not start")
+	}
+
+	// Opening connections should increment the active connection gauge
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addrs[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	waitForGauge(t, "active connections", metrics.ActiveConnections, 3)
+
+	// ...and closing them should decrement it again
+	for _, conn := range conns {
+		conn.Close()
+	}
+	waitForGauge(t, "active connections", metrics.ActiveConnections, 0)
+
+	// Requests that are being handled should be counted as in flight
+	go func() {
+		if res, err := http.Get("http://" + addrs[0].String() + "/block/"); err == nil {
+			res.Body.Close()
+		}
+	}()
+	waitForGauge(t, "in-flight requests", metrics.InFlightRequests, 1)
+
+	ctx.server.Config.Admin.Key = testAdminKey
+	admin := httptest.NewServer(ctx.server.AdminHandler())
+	defer admin.Close()
+
+	res, err := adminRequest(admin.URL, "GET", "/admin/metrics", "", testAdminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := validateResponse(res, http.StatusOK, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &MetricsSnapshot{}
+	if err := json.Unmarshal(body, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.ActiveConnections != 1 || snapshot.InFlightRequests != 1 || snapshot.Goroutines == 0 {
+		t.Errorf("Unexpected metrics: %+v", snapshot)
+	}
+
+	close(release)
+	waitForGauge(t, "in-flight requests", metrics.InFlightRequests, 0)
+}
+
+func TestInternalListener(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.Listeners = []ListenerConfig{{Addr: "127.0.0.1:0"}}
+	ctx.server.Config.InternalBindAddr = "127.0.0.1:0"
+	ctx.server.Config.Admin.Key = testAdminKey
+
+	done := make(chan error)
+	go func() {
+		done <- ctx.server.Start()
+	}()
+
+	var addrs []net.Addr
+	for i := 0; i < 100 && (len(addrs) == 0 || ctx.server.InternalAddr() == nil); i++ {
+		time.Sleep(10 * time.Millisecond)
+		addrs = ctx.server.Addrs()
+	}
+	if len(addrs) == 0 || ctx.server.InternalAddr() == nil {
+		t.Fatal("Server did not start")
+	}
+	public := "http://" + addrs[0].String()
+	internal := "http://" + ctx.server.InternalAddr().String()
+
+	get := func(url string) int {
+		res, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	for _, path := range []string{"/metrics", "/healthz", "/debug/pprof/"} {
+		if code := get(internal + path); code != http.StatusOK {
+			t.Errorf("Expected %s to be served on the internal listener, got %d", path, code)
+		}
+		if code := get(public + path); code != http.StatusNotFound {
+			t.Errorf("Expected %s not to be served on the public listener, got %d", path, code)
+		}
+	}
+
+	res, err := adminRequest(internal, "GET", "/admin/metrics", "", testAdminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateResponse(res, http.StatusOK, "inFlightRequests"); err != nil {
+		t.Error(err)
+	}
+
+	// Stopping the server should close the internal listener as well
+	ctx.server.Stop(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(internal + "/metrics"); err == nil {
+		t.Error("Expected internal listener to be closed")
+	}
+}
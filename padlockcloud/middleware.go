@@ -2,8 +2,16 @@ package padlockcloud
 
 import "net/http"
 import "errors"
+import "context"
 import "fmt"
 import "strings"
+import "net"
+import "net/url"
+import "sort"
+import "strconv"
+import "time"
+import "bytes"
+import "sync"
 import "github.com/gorilla/csrf"
 
 var CSRFTemplateTag = csrf.TemplateTag
@@ -34,20 +42,50 @@ func (m *CheckEndpointVersion) Wrap(h Handler) Handler {
 	})
 }
 
+// Makes the subject of a verified client certificate available through the request context
+type ClientCertificate struct {
+}
+
+func (m *ClientCertificate) Wrap(h Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			subject := r.TLS.VerifiedChains[0][0].Subject.String()
+			r = r.WithContext(context.WithValue(r.Context(), clientCertContextKey, subject))
+		}
+
+		return h.Handle(w, r, auth)
+	})
+}
+
+// Authenticates requests via auth tokens of the given type or, for the "cert" type, via client
+// certificates. If `ClientCert` is set, requests with a verified client certificate are
+// authenticated via the certificate instead
 type Authenticate struct {
 	*Server
-	Type string
+	Type       string
+	ClientCert bool
 }
 
 func (m *Authenticate) Wrap(h Handler) Handler {
 	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+		// Endpoint uses client certificates for authentication instead of auth tokens
+		if m.Type == "cert" || (m.ClientCert && ClientCertSubject(r) != "") {
+			auth, err := m.AuthenticateClientCert(r)
+			if err != nil {
+				return err
+			}
+			SpanFromContext(r.Context()).SetAttribute("padlock.auth_token", auth.Id)
+			return h.Handle(w, r, auth)
+		}
+
 		// Get auth token from request
 		auth, err := m.Authenticate(r)
 
 		// Endpoint requires authentation but no auth token could be aquired
 		if m.Type != "" && err != nil {
-			// If this endpoint requires web authentication, simply redirect to login page
-			if m.Type == "web" {
+			// If this endpoint requires web authentication, simply redirect to login page. Suspended
+			// accounts get an error instead since logging in again won't help
+			if _, suspended := err.(*AccountSuspended); m.Type == "web" && !suspended {
 				http.Redirect(w, r, "/login/", http.StatusFound)
 				return nil
 			}
@@ -60,6 +98,11 @@ func (m *Authenticate) Wrap(h Handler) Handler {
 			return &InvalidAuthToken{auth.Email, auth.Token}
 		}
 
+		// Record the token id rather than the email, so traces don't contain personal data
+		if auth != nil {
+			SpanFromContext(r.Context()).SetAttribute("padlock.auth_token", auth.Id)
+		}
+
 		return h.Handle(w, r, auth)
 	})
 }
@@ -112,6 +155,18 @@ func (m *HandleError) Wrap(h Handler) Handler {
 	})
 }
 
+// Returns the methods an endpoint has handlers for in alphabetical order
+func allowedMethods(handlers map[string]Handler) []string {
+	var methods []string
+	for method := range handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// Rejects requests with methods the endpoint has no handler for with a `405` error and an `Allow`
+// header listing the supported methods
 type CheckMethod struct {
 	Allowed map[string]Handler
 }
@@ -119,6 +174,7 @@ type CheckMethod struct {
 func (m *CheckMethod) Wrap(h Handler) Handler {
 	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
 		if m.Allowed[r.Method] == nil {
+			w.Header().Set("Allow", strings.Join(allowedMethods(m.Allowed), ", "))
 			return &MethodNotAllowed{r.Method}
 		}
 
@@ -126,6 +182,106 @@ func (m *CheckMethod) Wrap(h Handler) Handler {
 	})
 }
 
+// Rejects requests that modify data while the server is in read-only mode. Which methods modify
+// data is declared per endpoint via `Endpoint.Writes`
+type CheckReadOnly struct {
+	*Server
+	Writes []string
+}
+
+func (m *CheckReadOnly) Wrap(h Handler) Handler {
+	writes := make(map[string]bool)
+	for _, method := range m.Writes {
+		writes[method] = true
+	}
+
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+		if writes[r.Method] && m.ReadOnly() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(readOnlyRetryAfter/time.Second)))
+			return &ServiceUnavailable{"The server is in read-only mode. Please try again later"}
+		}
+
+		return h.Handle(w, r, auth)
+	})
+}
+
+// Rejects requests that weren't received over TLS, telling the client which url to use instead
+type RequireTLS struct {
+	*Server
+}
+
+func (m *RequireTLS) Wrap(h Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+		if r.TLS == nil {
+			w.Header().Set("Upgrade", "TLS/1.2, HTTP/1.1")
+			w.Header().Set("Connection", "Upgrade")
+			return &TLSRequired{m.httpsUrl(r)}
+		}
+
+		return h.Handle(w, r, auth)
+	})
+}
+
+// Returns the https version of the requested url, based on `BaseUrl` if it uses https or on the
+// request's host and the port of the first TLS listener otherwise
+func (m *RequireTLS) httpsUrl(r *http.Request) string {
+	if strings.HasPrefix(m.Config.BaseUrl, "https://") {
+		return strings.TrimSuffix(m.Config.BaseUrl, "/") + r.URL.RequestURI()
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, l := range m.listenerConfigs() {
+		if !l.TLS {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(l.Addr); err == nil && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		break
+	}
+
+	u := &url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	return u.String()
+}
+
+// Rejects requests while the server is starting up
+type CheckStarting struct {
+	*Server
+}
+
+func (m *CheckStarting) Wrap(h Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+		if m.Starting() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(startingRetryAfter/time.Second)))
+			return &ServiceUnavailable{"The server is starting up. Please try again shortly"}
+		}
+
+		return h.Handle(w, r, auth)
+	})
+}
+
+// Limits the size of request bodies to `Limit` bytes. Requests announcing a larger body are rejected
+// right away, others will fail when reading past the limit
+type LimitRequestBody struct {
+	Limit int64
+}
+
+func (m *LimitRequestBody) Wrap(h Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+		if m.Limit > 0 {
+			if r.ContentLength > m.Limit {
+				return &RequestEntityTooLarge{m.Limit}
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, m.Limit)
+		}
+
+		return h.Handle(w, r, auth)
+	})
+}
+
 type HandlePanic struct {
 }
 
@@ -150,3 +306,137 @@ func (m *HandlePanic) Wrap(h Handler) Handler {
 		return err
 	})
 }
+
+// Buffers the response of a handler running under `RequestTimeout` so it can be discarded
+// if the deadline passes before the handler finishes
+type timeoutWriter struct {
+	mutex    sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	code     int
+	timedOut bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.buf.Write(p)
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.timedOut && w.code == 0 {
+		w.code = code
+	}
+}
+
+// Cancels requests taking longer than `Timeout` and responds with `ServiceUnavailable`. The
+// request context is cancelled once the deadline passes so handlers can abort early
+type RequestTimeout struct {
+	Timeout time.Duration
+}
+
+func (m *RequestTimeout) Wrap(h Handler) Handler {
+	if m.Timeout <= 0 {
+		return h
+	}
+
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, a *AuthToken) error {
+		ctx, cancel := context.WithTimeout(r.Context(), m.Timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan error, 1)
+
+		go func() {
+			done <- h.Handle(tw, r.WithContext(ctx), a)
+		}()
+
+		select {
+		case err := <-done:
+			dst := w.Header()
+			for k, v := range tw.header {
+				dst[k] = v
+			}
+			if tw.code != 0 {
+				w.WriteHeader(tw.code)
+				w.Write(tw.buf.Bytes())
+			}
+			return err
+		case <-ctx.Done():
+			tw.mutex.Lock()
+			tw.timedOut = true
+			tw.mutex.Unlock()
+			if ctx.Err() == context.DeadlineExceeded {
+				return &ServiceUnavailable{"Request timed out"}
+			}
+			return ctx.Err()
+		}
+	})
+}
+
+// Applies the identification headers right before the response is written, overriding anything
+// set by the handler
+type serverHeaderWriter struct {
+	http.ResponseWriter
+	server  string
+	version bool
+	written bool
+}
+
+func (w *serverHeaderWriter) apply() {
+	if w.written {
+		return
+	}
+	w.written = true
+
+	h := w.Header()
+	if w.server != "" {
+		h.Set("Server", w.server)
+	} else {
+		h.Del("Server")
+	}
+	if w.version {
+		h.Set("X-Padlock-Version", Version)
+	}
+}
+
+func (w *serverHeaderWriter) WriteHeader(code int) {
+	w.apply()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serverHeaderWriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+// Gives `http.ResponseController` access to the underlying writer, e.g. for flushing
+func (w *serverHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Sets the identification headers of all responses. The `Server` header is set to `serverHeader`
+// or removed if it's empty, so handlers can't reveal any details about the server by accident.
+// If `version` is set, the server version is sent in an `X-Padlock-Version` header
+func ServerHeaders(handler http.Handler, serverHeader string, version bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &serverHeaderWriter{ResponseWriter: w, server: serverHeader, version: version}
+		handler.ServeHTTP(sw, r)
+		// Handlers not writing anything leave it to net/http to send the headers
+		sw.apply()
+	})
+}
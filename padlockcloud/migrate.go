@@ -0,0 +1,81 @@
+package padlockcloud
+
+import "context"
+import "fmt"
+
+// A type of stored object copied by `MigrateStorage`
+type migrateType struct {
+	Name string
+	// Creates an empty object whose `Key` method returns `key`, to be populated via `Storage.Get`
+	New func(key string) Storable
+}
+
+// Types copied by `MigrateStorage`, in the order they are migrated
+var migrateTypes = []migrateType{
+	{"accounts", func(key string) Storable { return &Account{Email: key} }},
+	{"data stores", func(key string) Storable { return &DataStore{Account: &Account{Email: key}} }},
+	{"data versions", func(key string) Storable { return &DataHistory{Email: key} }},
+	{"vaults", func(key string) Storable { return vaultFromKey(key) }},
+	{"trashed accounts", func(key string) Storable { return &TrashedAccount{Account: &Account{Email: key}} }},
+	{"auth requests", func(key string) Storable { return &AuthRequest{Token: key} }},
+	{"auth request index", func(key string) Storable { return authRequestRefFromKey(key) }},
+}
+
+// Number of objects of a given type copied by `MigrateStorage`
+type MigrateCount struct {
+	Name  string
+	Count int
+}
+
+// Copies all stored objects from `from` to `to` without modifying `from`. Objects already present in
+// `to` are overwritten, so an interrupted migration can simply be run again. Timestamps are copied
+// as is. Once all objects of a type have been copied, `to` is checked to contain each of them.
+// `progress` (if not nil) is called after each copied object with the type name and the number
+// of objects of that type copied so far
+func MigrateStorage(from Storage, to Storage, progress func(name string, n int)) ([]*MigrateCount, error) {
+	ctx := PreserveTimestamps(context.Background())
+	var counts []*MigrateCount
+
+	for _, mt := range migrateTypes {
+		keys := make(map[string]bool)
+
+		if err := from.ListFunc(mt.New(""), func(key string) error {
+			t := mt.New(key)
+			if err := from.Get(t); err == ErrNotFound {
+				// Removed since listing started
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if err := to.PutCtx(ctx, t); err != nil {
+				return err
+			}
+
+			keys[key] = true
+			if progress != nil {
+				progress(mt.Name, len(keys))
+			}
+			return nil
+		}); err != nil {
+			return counts, err
+		}
+
+		count := &MigrateCount{mt.Name, len(keys)}
+
+		if err := to.ListFunc(mt.New(""), func(key string) error {
+			delete(keys, key)
+			return nil
+		}); err != nil {
+			return counts, err
+		}
+
+		if len(keys) != 0 {
+			return counts, fmt.Errorf("padlock: %d %s missing in the destination after migrating", len(keys), mt.Name)
+		}
+
+		counts = append(counts, count)
+	}
+
+	return counts, nil
+}
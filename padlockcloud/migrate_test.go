@@ -0,0 +1,191 @@
+package padlockcloud
+
+import "testing"
+import "bytes"
+import "encoding/json"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "time"
+import "gopkg.in/yaml.v2"
+
+func TestMigrateStorage(t *testing.T) {
+	from := &MemoryStorage{}
+	if err := from.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+
+	for _, email := range []string{"a@padlock.io", "b@padlock.io", "c@padlock.io"} {
+		acc, err := CreateAccount(from, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := from.Put(&DataStore{Account: acc, Content: []byte("data of " + email)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RecordDataVersion(from, "a@padlock.io", []byte("old data"), 5, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.Put(&Vault{Email: "a@padlock.io", Name: "work", Content: []byte("work data")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := TrashAccount(from, "c@padlock.io", nil); err != nil {
+		t.Fatal(err)
+	}
+	ar, err := NewAuthRequest("a@padlock.io", "api", DefaultTokenBytes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := from.Batch(putAuthRequestOps(ar)); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Make sure timestamps aren't updated when writing to the destination
+	to := &LevelDBStorage{
+		Config: &LevelDBConfig{Path: dir},
+		Clock:  NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	if err := to.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+
+	expected := map[string]int{
+		"accounts":           2,
+		"data stores":        2,
+		"data versions":      1,
+		"vaults":             1,
+		"trashed accounts":   1,
+		"auth requests":      1,
+		"auth request index": 1,
+	}
+
+	// Running the migration again should yield the same result
+	for i := 0; i < 2; i++ {
+		counts, err := MigrateStorage(from, to, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(counts) != len(expected) {
+			t.Fatalf("Expected counts for %d types, got %d", len(expected), len(counts))
+		}
+		for _, c := range counts {
+			if c.Count != expected[c.Name] {
+				t.Errorf("Expected %d %s to be migrated, got %d", expected[c.Name], c.Name, c.Count)
+			}
+		}
+	}
+
+	for _, mt := range migrateTypes {
+		keys, err := from.List(mt.New(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			src, dst := mt.New(key), mt.New(key)
+			if err := from.Get(src); err != nil {
+				t.Fatal(err)
+			}
+			if err := to.Get(dst); err != nil {
+				t.Fatalf("Expected %s %s to be migrated, got %v", mt.Name, key, err)
+			}
+			srcData, _ := src.Serialize()
+			dstData, _ := dst.Serialize()
+			if !bytes.Equal(srcData, dstData) {
+				t.Errorf("Expected %s %s to be copied as is, got %s, expected %s", mt.Name, key, dstData, srcData)
+			}
+		}
+	}
+}
+
+func TestCliDBMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewSampleConfig(dir)
+	storage := &LevelDBStorage{Config: &cfg.LevelDB}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateAccount(storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	dest := &CliConfig{LevelDB: LevelDBConfig{Path: filepath.Join(dir, "db2"), Codec: "gzip"}}
+	destFile := filepath.Join(dir, "dest.yaml")
+	data, _ := yaml.Marshal(dest)
+	if err := ioutil.WriteFile(destFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var progress bytes.Buffer
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		progress.Reset()
+		app := NewCliApp()
+		app.Writer = &out
+		app.ErrWriter = &progress
+		err := app.Run(append([]string{"padlock-cloud",
+			"--log-file", cfg.Log.LogFile,
+			"--err-file", cfg.Log.ErrFile,
+			"--db-path", cfg.LevelDB.Path,
+			"db", "migrate",
+		}, args...))
+		return out.String(), err
+	}
+
+	if _, err := run(); ExitCode(err) != ExitInvalidArgument {
+		t.Errorf("Expected invalid argument error without --to, got %v", err)
+	}
+
+	if _, err := run("--to", destFile, "--progress", "xml"); ExitCode(err) != ExitInvalidArgument {
+		t.Errorf("Expected invalid argument error for unknown progress format, got %v", err)
+	}
+
+	out, err := run("--to", destFile, "--progress", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Migrated 1 accounts") {
+		t.Errorf("Unexpected output:\n%s", out)
+	}
+
+	// The final progress report should cover all records
+	lines := strings.Split(strings.TrimSpace(progress.String()), "\n")
+	report := &ProgressReport{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Done || report.Records != 1 || report.Total != 1 || report.Action != "Migrating" {
+		t.Errorf("Unexpected progress report: %+v", report)
+	}
+
+	if _, err := run("--to", destFile, "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+	if progress.Len() != 0 {
+		t.Errorf("Expected no progress to be reported with --quiet, got %q", progress.String())
+	}
+
+	storage = &LevelDBStorage{Config: &dest.LevelDB}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if _, err := GetAccount(storage, testEmail); err != nil {
+		t.Errorf("Expected account to be migrated, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package padlockcloud
+
+import "fmt"
+import "os"
+import "io/ioutil"
+import "path/filepath"
+import "strconv"
+
+// Mode database directories are created with if no `DirMode` is configured
+const defaultDBDirMode os.FileMode = 0755
+
+// Permission bits rejected by `LevelDBConfig.StrictPerms`, i.e. write access for group and others
+const broadPermBits os.FileMode = 0022
+
+// Parses an octal permission mode like "0750". Returns `def` if `s` is empty
+func parseFileMode(s string, def os.FileMode) (os.FileMode, error) {
+	if s == "" {
+		return def, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("padlock: invalid permission mode '%s'", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// The database directory followed by the directories of all stores and the journal
+func (s *LevelDBStorage) dirs() []string {
+	var dirs []string
+	if s.Config.Path != "" {
+		dirs = append(dirs, s.Config.Path)
+	}
+	for _, loc := range StorableTypes {
+		dirs = append(dirs, filepath.Join(s.Config.Path, loc))
+	}
+	dirs = append(dirs, filepath.Join(s.Config.Path, journalLoc))
+	return dirs
+}
+
+// Creates the database directory and the directories of all stores if they don't exist yet.
+// Newly created directories get exactly the configured `DirMode`, regardless of the umask
+func (s *LevelDBStorage) createDirs() error {
+	mode, err := parseFileMode(s.Config.DirMode, defaultDBDirMode)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range s.dirs() {
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := os.MkdirAll(dir, mode); err != nil {
+			return err
+		}
+		if err := os.Chmod(dir, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Applies the configured `FileMode` to all database files. Called after opening the database so it
+// covers the files LevelDB creates on startup. Files created while running use LevelDB's default
+// mode, so access should be restricted through `DirMode` as well
+func (s *LevelDBStorage) chmodFiles() error {
+	if s.Config.FileMode == "" {
+		return nil
+	}
+
+	mode, err := parseFileMode(s.Config.FileMode, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range s.dirs() {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range entries {
+			if info.Mode().IsRegular() && info.Mode().Perm() != mode {
+				if err := os.Chmod(filepath.Join(dir, info.Name()), mode); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns an error if the database directory or any of the files in it are writable by group or
+// others
+func (s *LevelDBStorage) checkPerms() error {
+	check := func(p string, info os.FileInfo) error {
+		if info.Mode()&broadPermBits != 0 {
+			return fmt.Errorf("padlock: %s is writable by other users (mode %#o). Restrict its "+
+				"permissions or disable the strict_perms option", p, info.Mode().Perm())
+		}
+		return nil
+	}
+
+	for _, dir := range s.dirs() {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if err := check(dir, info); err != nil {
+			return err
+		}
+
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range entries {
+			if info.Mode().IsRegular() {
+				if err := check(filepath.Join(dir, info.Name()), info); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Prepares the database directory for opening: Creates missing directories and, if `StrictPerms`
+// is set, checks for overly broad permissions
+func (s *LevelDBStorage) preparePath() error {
+	if _, err := parseFileMode(s.Config.FileMode, 0); err != nil {
+		return err
+	}
+
+	if err := s.createDirs(); err != nil {
+		return err
+	}
+
+	if s.Config.StrictPerms {
+		return s.checkPerms()
+	}
+
+	return nil
+}
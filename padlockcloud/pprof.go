@@ -0,0 +1,39 @@
+package padlockcloud
+
+import "net/http"
+import "net/http/pprof"
+
+// Creates a handler serving runtime profiling data under /debug/pprof/
+func PprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// Starts serving profiling data in the background if an address is configured. The profiling
+// endpoints are never served on the public listeners
+func (server *Server) StartPprof() error {
+	if server.Config.PprofAddr == "" {
+		return nil
+	}
+
+	server.pprof = &http.Server{
+		Addr:     server.Config.PprofAddr,
+		Handler:  PprofHandler(),
+		ErrorLog: server.Error,
+	}
+
+	server.Info.Printf("Starting profiling endpoints on %s", server.Config.PprofAddr)
+
+	go func() {
+		if err := server.pprof.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			server.Error.Println("Profiling endpoints stopped unexpectedly:", err)
+		}
+	}()
+
+	return nil
+}
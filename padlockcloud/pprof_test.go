@@ -0,0 +1,50 @@
+package padlockcloud
+
+import "testing"
+import "net"
+import "net/http"
+import "time"
+
+func TestPprof(t *testing.T) {
+	ctx := newServerTestContext()
+
+	// Profiling endpoints should never be served on the public listener
+	res, err := ctx.request("GET", ctx.host+"/debug/pprof/", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &UnsupportedEndpoint{"/debug/pprof/"})
+
+	// Disabled by default
+	if err := ctx.server.StartPprof(); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.server.pprof != nil {
+		t.Fatal("Expected profiling endpoints to be disabled by default")
+	}
+
+	// Find a free port to serve the profiling endpoints on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx.server.Config.PprofAddr = addr
+	if err := ctx.server.StartPprof(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.server.pprof.Close()
+
+	for i := 0; i < 100; i++ {
+		if res, err = http.Get("http://" + addr + "/debug/pprof/"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "goroutine")
+}
@@ -0,0 +1,185 @@
+package padlockcloud
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "reflect"
+import "strings"
+import "sync"
+import "time"
+
+// Formats for progress reports
+const (
+	// Human-readable lines like "Migrating: 500/1000 records, 1.2 MB, ETA 10s"
+	ProgressText = "text"
+	// One JSON-encoded `ProgressReport` per line
+	ProgressJSON = "json"
+)
+
+// Default time between two progress reports
+const defaultProgressInterval = 2 * time.Second
+
+// Snapshot of the progress of a long-running operation
+type ProgressReport struct {
+	// Description of the operation, e.g. "Migrating"
+	Action string `json:"action"`
+	// Number of records processed so far
+	Records int64 `json:"records"`
+	// Total number of records, if known
+	Total int64 `json:"total,omitempty"`
+	// Number of bytes processed so far, if applicable
+	Bytes int64 `json:"bytes,omitempty"`
+	// Time since the operation started, in seconds
+	Elapsed float64 `json:"elapsed"`
+	// Estimated time remaining, in seconds. Only available if the total is known
+	ETA float64 `json:"eta,omitempty"`
+	// Set for the final report
+	Done bool `json:"done,omitempty"`
+}
+
+// Prints progress reports of a long-running operation at regular intervals. Safe for concurrent use
+type Progress struct {
+	// Description of the operation, e.g. "Migrating"
+	Action string
+	// Total number of records, used for estimating the remaining time. Unknown if zero
+	Total int64
+	// Where to print reports. Nothing is printed if nil
+	Writer io.Writer
+	// One of `ProgressText` (the default) and `ProgressJSON`
+	Format string
+	// Minimum time between two reports. Defaults to `defaultProgressInterval` if zero
+	Interval time.Duration
+	// Source of the current time. Defaults to the system clock
+	Clock Clock
+
+	mutex   sync.Mutex
+	records int64
+	bytes   int64
+	started time.Time
+	last    time.Time
+}
+
+// Records progress, printing a report if the interval has passed since the last one
+func (p *Progress) Add(records int64, bytes int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	t := clockNow(p.Clock)
+	if p.started.IsZero() {
+		p.started = t
+		p.last = t
+	}
+
+	p.records += records
+	p.bytes += bytes
+
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	if t.Sub(p.last) >= interval {
+		p.last = t
+		p.print(p.report(t, false))
+	}
+}
+
+// Prints the final report
+func (p *Progress) Done() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	t := clockNow(p.Clock)
+	if p.started.IsZero() {
+		p.started = t
+	}
+	p.print(p.report(t, true))
+}
+
+func (p *Progress) report(t time.Time, done bool) *ProgressReport {
+	elapsed := t.Sub(p.started)
+	r := &ProgressReport{
+		Action:  p.Action,
+		Records: p.records,
+		Total:   p.Total,
+		Bytes:   p.bytes,
+		Elapsed: elapsed.Seconds(),
+		Done:    done,
+	}
+	if !done && p.Total > 0 && p.records > 0 && p.records < p.Total {
+		r.ETA = (elapsed * time.Duration(p.Total-p.records) / time.Duration(p.records)).Seconds()
+	}
+	return r
+}
+
+func (p *Progress) print(r *ProgressReport) {
+	if p.Writer == nil {
+		return
+	}
+
+	if p.Format == ProgressJSON {
+		data, _ := json.Marshal(r)
+		p.Writer.Write(append(data, '\n'))
+		return
+	}
+
+	// Operations only dealing with bytes, like backups, don't count records
+	var parts []string
+	if r.Records > 0 || r.Total > 0 || r.Bytes == 0 {
+		records := fmt.Sprintf("%d", r.Records)
+		if r.Total > 0 {
+			records += fmt.Sprintf("/%d", r.Total)
+		}
+		parts = append(parts, records+" records")
+	}
+	if r.Bytes > 0 {
+		parts = append(parts, formatBytes(r.Bytes))
+	}
+	line := r.Action + ": " + strings.Join(parts, ", ")
+	if r.Done {
+		line += fmt.Sprintf(", done in %v", roundDuration(r.Elapsed))
+	} else if r.ETA > 0 {
+		line += fmt.Sprintf(", ETA %v", roundDuration(r.ETA))
+	}
+	fmt.Fprintln(p.Writer, line)
+}
+
+// Converts seconds into a duration rounded to whole seconds for display
+func roundDuration(seconds float64) time.Duration {
+	return (time.Duration(seconds * float64(time.Second))).Round(time.Second)
+}
+
+// Wraps a writer, adding the number of bytes written to a `Progress`
+type progressWriter struct {
+	io.Writer
+	progress *Progress
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.progress.Add(0, int64(n))
+	return n, err
+}
+
+// Counts the records of the given types using `ListFunc`. Types that haven't been stored yet are
+// counted as zero
+func CountRecords(storage Storage, types ...Storable) (int64, error) {
+	var n int64
+	for _, t := range types {
+		if err := storage.ListFunc(t, func(key string) error {
+			n++
+			return nil
+		}); err != nil && err != ErrUnregisteredStorable {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Returns an instance of each registered storable type
+func registeredStorables() []Storable {
+	var types []Storable
+	for t := range StorableTypes {
+		types = append(types, reflect.New(t).Interface().(Storable))
+	}
+	return types
+}
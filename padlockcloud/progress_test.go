@@ -0,0 +1,86 @@
+package padlockcloud
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "strings"
+import "testing"
+import "time"
+
+func TestProgress(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	for i := 0; i < 10; i++ {
+		if _, err := CreateAccount(storage, fmt.Sprintf("user%d@padlock.io", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total, err := CountRecords(storage, &Account{}, &DataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 10 {
+		t.Fatalf("Expected 10 records, got %d", total)
+	}
+
+	var out bytes.Buffer
+	clock := NewFakeClock(time.Now())
+	progress := &Progress{
+		Action:   "Processing",
+		Total:    total,
+		Writer:   &out,
+		Format:   ProgressJSON,
+		Interval: 3 * time.Second,
+		Clock:    clock,
+	}
+
+	// Processing each record takes a second, so a report should be printed every third record
+	if err := storage.ListFunc(&Account{}, func(key string) error {
+		clock.Advance(time.Second)
+		progress.Add(1, 0)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	progress.Done()
+
+	var reports []*ProgressReport
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		r := &ProgressReport{}
+		if err := json.Unmarshal([]byte(line), r); err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, r)
+	}
+
+	expected := []*ProgressReport{
+		{Action: "Processing", Records: 4, Total: 10, Elapsed: 3, ETA: 4.5},
+		{Action: "Processing", Records: 7, Total: 10, Elapsed: 6, ETA: 6.0 * 3 / 7},
+		{Action: "Processing", Records: 10, Total: 10, Elapsed: 9},
+		{Action: "Processing", Records: 10, Total: 10, Elapsed: 9, Done: true},
+	}
+	if len(reports) != len(expected) {
+		t.Fatalf("Expected %d reports, got %d:\n%s", len(expected), len(reports), out.String())
+	}
+	for i, r := range reports {
+		e := expected[i]
+		if r.Records != e.Records || r.Total != e.Total || r.Elapsed != e.Elapsed || r.Done != e.Done ||
+			r.ETA < e.ETA-0.001 || r.ETA > e.ETA+0.001 {
+			t.Errorf("Report %d: Expected %+v, got %+v", i, e, r)
+		}
+	}
+
+	out.Reset()
+	p := &Progress{Action: "Backing up", Writer: &out, Clock: clock}
+	p.Add(0, 2048)
+	clock.Advance(time.Second)
+	p.Done()
+	if s := out.String(); s != "Backing up: "+formatBytes(2048)+", done in 1s\n" {
+		t.Errorf("Unexpected text report: %q", s)
+	}
+}
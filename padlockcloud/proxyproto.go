@@ -0,0 +1,178 @@
+package padlockcloud
+
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "errors"
+import "io"
+import "net"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Maximum time a client may take to send the PROXY protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
+// Maximum length of a PROXY protocol v1 header, including the trailing CRLF
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrInvalidProxyHeader = errors.New("padlock: invalid PROXY protocol header")
+
+// Wraps a listener to parse PROXY protocol (v1 and v2) headers sent by a load balancer in front
+// of the server. The client address announced in the header is reported as the connection's
+// remote address. Connections without a valid header are rejected
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, rd: bufio.NewReader(conn)}, nil
+}
+
+// Connection accepted by a `proxyListener`. The header is read lazily on the first call to
+// `Read` or `RemoteAddr` so a slow client can't block the accept loop
+type proxyConn struct {
+	net.Conn
+	rd     *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.rd)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.rd.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Reads a PROXY protocol header. Returns a nil address if the header is valid but doesn't
+// carry a client address, e.g. for health checks sent by the proxy itself
+func readProxyHeader(rd *bufio.Reader) (net.Addr, error) {
+	b, err := rd.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b[0] {
+	case 'P':
+		return readProxyHeaderV1(rd)
+	case proxyV2Signature[0]:
+		return readProxyHeaderV2(rd)
+	}
+
+	return nil, ErrInvalidProxyHeader
+}
+
+func readProxyHeaderV1(rd *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, ErrInvalidProxyHeader
+		}
+		c, err := rd.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	if len(fields) != 6 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || net.ParseIP(fields[3]) == nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(rd *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(rd, header); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(rd, body); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0xf {
+	case 0x0:
+		// LOCAL command; connection was established by the proxy itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	switch header[13] {
+	case 0x11:
+		// TCP over IPv4
+		if len(body) < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21:
+		// TCP over IPv6
+		if len(body) < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+
+	// Other address families (UDP, unix sockets, unspecified) don't carry a usable client address
+	return nil, nil
+}
@@ -0,0 +1,95 @@
+package padlockcloud
+
+import "testing"
+import "bufio"
+import "bytes"
+import "io/ioutil"
+import "net"
+import "strings"
+
+func TestProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &proxyListener{ln}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\nhello"))
+		conn.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if addr := conn.RemoteAddr().String(); addr != "203.0.113.7:56324" {
+		t.Errorf("Expected remote address to be 203.0.113.7:56324, is %s", addr)
+	}
+
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("Expected payload following the header to be preserved, got %q", data)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd byte, fam byte, body []byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|cmd, fam, byte(len(body)>>8), byte(len(body)))
+		return string(append(header, body...))
+	}
+	ipv4Body := []byte{192, 0, 2, 1, 10, 0, 0, 1, 0x1f, 0x90, 0x01, 0xbb}
+	ipv6Body := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("::1").To16()...), 0x1f, 0x90, 0x01, 0xbb)
+
+	for _, c := range []struct {
+		name   string
+		header string
+		addr   string
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 10.0.0.1 8080 443\r\n", "192.0.2.1:8080", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 ::1 8080 443\r\n", "[2001:db8::1]:8080", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 ::1 8080 443\r\n", "", true},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.1 10.0.0.1 99999 443\r\n", "", true},
+		{"v1 missing fields", "PROXY TCP4 192.0.2.1\r\n", "", true},
+		{"v1 missing crlf", "PROXY TCP4 192.0.2.1 10.0.0.1 8080 443\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", true},
+		{"v2 tcp4", v2(1, 0x11, ipv4Body), "192.0.2.1:8080", false},
+		{"v2 tcp6", v2(1, 0x21, ipv6Body), "[2001:db8::1]:8080", false},
+		{"v2 local", v2(0, 0x00, nil), "", false},
+		{"v2 truncated address", v2(1, 0x11, ipv4Body[:6]), "", true},
+		{"v2 invalid command", v2(2, 0x11, ipv4Body), "", true},
+		{"no header", "GET / HTTP/1.1\r\n\r\n", "", true},
+	} {
+		addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader([]byte(c.header))))
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: Expected error, got address %v", c.name, addr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %v", c.name, err)
+			continue
+		}
+
+		if c.addr == "" && addr != nil {
+			t.Errorf("%s: Expected no address, got %v", c.name, addr)
+		} else if c.addr != "" && (addr == nil || addr.String() != c.addr) {
+			t.Errorf("%s: Expected address %s, got %v", c.name, c.addr, addr)
+		}
+	}
+}
@@ -1,42 +1,384 @@
 package padlockcloud
 
+import "fmt"
 import "log"
+import "time"
+import "net"
+import "strings"
+import "strconv"
+import "sync"
+import "sync/atomic"
 import "net/http"
 import "gopkg.in/throttled/throttled.v2"
 import "gopkg.in/throttled/throttled.v2/store/memstore"
 
 type RateQuota throttled.RateQuota
 
+// Rate limiting configuration
+type RateLimitConfig struct {
+	// Where rate limiting state is kept. Either "memory" (the default) or "redis". State kept in
+	// memory is local to each server instance, so instances running behind a load balancer should
+	// share their state via redis
+	Store string `yaml:"store"`
+	// Address of the redis server, e.g. "localhost:6379"
+	RedisAddr string `yaml:"redis_addr"`
+	// Password for authenticating with the redis server, if any
+	RedisPassword string `yaml:"redis_password"`
+	// File to read `RedisPassword` from instead
+	RedisPasswordFile string `yaml:"redis_password_file"`
+	// Redis database to use
+	RedisDB int `yaml:"redis_db"`
+}
+
+// Storage for rate limiting state. All rate limiters sharing a store share their state
+type RateLimitStore interface {
+	throttled.GCRAStore
+}
+
+// Creates the rate limit store selected in `config`
+func NewRateLimitStore(config *RateLimitConfig) (RateLimitStore, error) {
+	switch config.Store {
+	case "", "memory":
+		return memstore.New(65536)
+	case "redis":
+		if config.RedisAddr == "" {
+			return nil, fmt.Errorf("padlock: no redis address provided for rate limit store")
+		}
+		return NewRedisRateLimitStore(config.RedisAddr, config.RedisPassword, config.RedisDB), nil
+	default:
+		return nil, fmt.Errorf("padlock: unknown rate limit store '%s'", config.Store)
+	}
+}
+
+// Prefix for all keys written to redis by `RedisRateLimitStore`
+const redisRateLimitPrefix = "padlock:ratelimit:"
+
+// Returns the current value of a key (or -1) along with the redis server time
+const redisGetWithTimeScript = `
+local v = redis.call('GET', KEYS[1])
+local t = redis.call('TIME')
+if not v then v = '-1' end
+return {v, t[1], t[2]}`
+
+// Atomically replaces the value of a key if it matches the expected value
+const redisCompareAndSwapScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+	return 1
+end
+return 0`
+
+// `RateLimitStore` implementation backed by redis, allowing multiple server instances to
+// share rate limits. The redis server's clock is used for all instances
+type RedisRateLimitStore struct {
+	client *redisClient
+}
+
+func NewRedisRateLimitStore(addr string, password string, db int) *RedisRateLimitStore {
+	return &RedisRateLimitStore{&redisClient{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+		Timeout:  5 * time.Second,
+	}}
+}
+
+func redisTTL(ttl time.Duration) string {
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+// Implementation of the `throttled.GCRAStore.GetWithTime` interface method
+func (s *RedisRateLimitStore) GetWithTime(key string) (int64, time.Time, error) {
+	reply, err := s.client.Do("EVAL", redisGetWithTimeScript, "1", redisRateLimitPrefix+key)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 3 {
+		return 0, time.Time{}, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+
+	var values [3]int64
+	for i, item := range items {
+		b, ok := item.([]byte)
+		if !ok {
+			return 0, time.Time{}, fmt.Errorf("redis: unexpected reply %v", reply)
+		}
+		if values[i], err = strconv.ParseInt(string(b), 10, 64); err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+
+	return values[0], time.Unix(values[1], values[2]*int64(time.Microsecond)), nil
+}
+
+// Implementation of the `throttled.GCRAStore.SetIfNotExistsWithTTL` interface method
+func (s *RedisRateLimitStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	reply, err := s.client.Do("SET", redisRateLimitPrefix+key, strconv.FormatInt(value, 10), "PX", redisTTL(ttl), "NX")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// Implementation of the `throttled.GCRAStore.CompareAndSwapWithTTL` interface method
+func (s *RedisRateLimitStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	reply, err := s.client.Do(
+		"EVAL", redisCompareAndSwapScript, "1", redisRateLimitPrefix+key,
+		strconv.FormatInt(old, 10), strconv.FormatInt(new, 10), redisTTL(ttl),
+	)
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+// Implementation of the `rateLimitDeleter` interface
+func (s *RedisRateLimitStore) Delete(key string) error {
+	_, err := s.client.Do("DEL", redisRateLimitPrefix+key)
+	return err
+}
+
+// Rate limit stores implementing this interface can remove the state of a key directly
+type rateLimitDeleter interface {
+	Delete(key string) error
+}
+
+// Clears the rate limiting state kept for `key` in `store`, giving it its full quota again.
+// Stores that can't delete keys (like the in-memory store) have the key's theoretical arrival
+// time set to zero instead, which has the same effect
+func ResetRateLimit(store RateLimitStore, key string) error {
+	if d, ok := store.(rateLimitDeleter); ok {
+		return d.Delete(key)
+	}
+
+	for {
+		v, _, err := store.GetWithTime(key)
+		if err != nil || v == -1 {
+			return err
+		}
+		if swapped, err := store.CompareAndSwapWithTTL(key, v, 0, time.Second); err != nil || swapped {
+			return err
+		}
+	}
+}
+
 var PerSec = throttled.PerSec
 var PerMin = throttled.PerMin
 
+// A list of networks whose requests are exempt from rate limiting
+type IPAllowlist []*net.IPNet
+
+// Parses a list of CIDRs like "10.0.0.0/8". Single IP addresses are accepted as well
+func ParseIPAllowlist(cidrs []string) (IPAllowlist, error) {
+	var list IPAllowlist
+	for _, entry := range cidrs {
+		cidr := strings.TrimSpace(entry)
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr = cidr + "/32"
+			} else {
+				cidr = cidr + "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("padlock: invalid rate limit allowlist entry '%s'", entry)
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+// Whether `addr` is part of any of the allowed networks. `addr` may include a port
+func (l IPAllowlist) Contains(addr string) bool {
+	if len(l) == 0 {
+		return false
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
 type Route struct {
 	Url    string
 	Method string
 }
 
+func (r Route) String() string {
+	return r.Method + " " + r.Url
+}
+
 type VaryBy struct{}
 
 func (v *VaryBy) Key(r *http.Request) string {
 	return FormatRequest(r)
 }
 
-// Limits the rate of a given handler to a certain number of requests per minute
-func RateLimit(handler http.Handler, quotas map[Route]RateQuota, deniedHandler http.Handler) http.Handler {
+// Fraction of a quota consumed above which requests are counted as near the limit by
+// `RateLimitStats`, unless configured otherwise
+const defaultNearLimitThreshold = 0.8
+
+// Number of requests per route for which a single bucket fill level is logged by
+// `RateLimitStats`, unless configured otherwise
+const defaultRateLimitSampleRate = 100
+
+// Request counts of a single rate-limited route
+type RouteRateLimitStats struct {
+	// Number of requests checked against the route's quota
+	Requests int64 `json:"requests"`
+	// Number of allowed requests that consumed at least the near-limit threshold of the quota
+	NearLimit int64 `json:"nearLimit"`
+	// Number of requests that exceeded the quota
+	Limited int64 `json:"limited"`
+}
+
+// Collects how close clients get to their rate limits, per route. Counting is done with atomic
+// operations only, so it doesn't add noticeable latency to requests
+type RateLimitStats struct {
+	// Fraction of the quota, between 0 and 1, above which requests are counted as near the limit.
+	// Defaults to `defaultNearLimitThreshold` if zero
+	NearLimitThreshold float64
+	// Logger for sampled bucket fill levels. Nothing is logged if nil
+	Log *log.Logger
+	// Log the fill level of every nth request per route. Defaults to `defaultRateLimitSampleRate`
+	// if zero
+	SampleRate int
+
+	mutex  sync.Mutex
+	routes map[Route]*RouteRateLimitStats
+}
+
+// Returns the counters for `route`, creating them if necessary
+func (s *RateLimitStats) route(route Route) *RouteRateLimitStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.routes == nil {
+		s.routes = make(map[Route]*RouteRateLimitStats)
+	}
+	if s.routes[route] == nil {
+		s.routes[route] = &RouteRateLimitStats{}
+	}
+	return s.routes[route]
+}
+
+// Records the result of checking a request to `route` against its quota
+func (s *RateLimitStats) observe(route Route, counts *RouteRateLimitStats, limited bool, res throttled.RateLimitResult) {
+	n := atomic.AddInt64(&counts.Requests, 1)
+
+	if limited {
+		atomic.AddInt64(&counts.Limited, 1)
+	}
+
+	if res.Limit <= 0 {
+		return
+	}
+	fill := rateLimitFill(res)
+
+	threshold := s.NearLimitThreshold
+	if threshold == 0 {
+		threshold = defaultNearLimitThreshold
+	}
+	if !limited && fill >= threshold {
+		atomic.AddInt64(&counts.NearLimit, 1)
+	}
+
+	rate := s.SampleRate
+	if rate <= 0 {
+		rate = defaultRateLimitSampleRate
+	}
+	if s.Log != nil && n%int64(rate) == 0 {
+		s.Log.Printf("Rate limit bucket for %s at %.0f%% (%d/%d consumed)\n", route, fill*100, res.Limit-res.Remaining, res.Limit)
+	}
+}
+
+// Current counts of all rate-limited routes, keyed by method and path, e.g. "POST /auth/".
+// Returns nil if `s` is nil
+func (s *RateLimitStats) Snapshot() map[string]RouteRateLimitStats {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	snapshot := make(map[string]RouteRateLimitStats, len(s.routes))
+	for route, counts := range s.routes {
+		snapshot[route.String()] = RouteRateLimitStats{
+			Requests:  atomic.LoadInt64(&counts.Requests),
+			NearLimit: atomic.LoadInt64(&counts.NearLimit),
+			Limited:   atomic.LoadInt64(&counts.Limited),
+		}
+	}
+	return snapshot
+}
+
+// Wraps a rate limiter, reporting the result of each check to a `RateLimitStats`
+type observedRateLimiter struct {
+	throttled.RateLimiter
+	route  Route
+	stats  *RateLimitStats
+	counts *RouteRateLimitStats
+}
+
+func (rl *observedRateLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	limited, res, err := rl.RateLimiter.RateLimit(key, quantity)
+	if err == nil {
+		rl.stats.observe(rl.route, rl.counts, limited, res)
+	}
+	return limited, res, err
+}
+
+// Limits the rate of a given handler to a certain number of requests per minute. Uses an
+// in-memory store if `store` is nil. Requests from networks in `allowlist` are not limited
+func RateLimit(handler http.Handler, store RateLimitStore, allowlist IPAllowlist, quotas map[Route]RateQuota, deniedHandler http.Handler) http.Handler {
+	return RateLimitWithStats(handler, store, allowlist, quotas, deniedHandler, nil)
+}
+
+// Like `RateLimit`, additionally recording how close requests get to their quotas in `stats`.
+// Nothing is recorded if `stats` is nil
+func RateLimitWithStats(handler http.Handler, store RateLimitStore, allowlist IPAllowlist, quotas map[Route]RateQuota, deniedHandler http.Handler, stats *RateLimitStats) http.Handler {
 	var varyBy *VaryBy
 
-	store, err := memstore.New(65536)
-	if err != nil {
-		log.Fatal(err)
+	if store == nil {
+		var err error
+		if store, err = memstore.New(65536); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	rateLimiters := make(map[Route]http.Handler)
 
 	for route, quota := range quotas {
+		var rateLimiter throttled.RateLimiter
 		rateLimiter, err := throttled.NewGCRARateLimiter(store, throttled.RateQuota(quota))
 		if err != nil {
 			log.Fatal(err)
 		}
+		if stats != nil {
+			rateLimiter = &observedRateLimiter{rateLimiter, route, stats, stats.route(route)}
+		}
 		rateLimiters[route] = (&throttled.HTTPRateLimiter{
 			RateLimiter:   rateLimiter,
 			VaryBy:        varyBy,
@@ -45,10 +387,10 @@ func RateLimit(handler http.Handler, quotas map[Route]RateQuota, deniedHandler h
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		route := Route{r.Method, r.URL.Path}
+		route := Route{Method: r.Method, Url: r.URL.Path}
 		rateLimiter := rateLimiters[route]
 
-		if rateLimiter != nil {
+		if rateLimiter != nil && !allowlist.Contains(getIp(r)) {
 			rateLimiter.ServeHTTP(w, r)
 		} else {
 			handler.ServeHTTP(w, r)
@@ -56,26 +398,184 @@ func RateLimit(handler http.Handler, quotas map[Route]RateQuota, deniedHandler h
 	})
 }
 
+// Implemented by handlers that consult the `EmailRateLimiter` before sending emails, so the routes
+// they serve can be told apart, e.g. when logging them at startup. Requests from clients using a
+// deprecated api version are limited as well, regardless of the handler
+type emailRateLimitedHandler interface {
+	emailRateLimited()
+}
+
+// Requests per minute and burst size allowed for each ip address and each email by the
+// `EmailRateLimiter` guarding routes that send emails
+const (
+	emailRateLimitPerMin = 1
+	emailRateLimitBurst  = 5
+)
+
+// Time per-account rate limits are cached for by `EmailRateLimiter`
+const accountRateLimitCacheTTL = time.Minute
+
+// Maximum number of per-account rate limits cached by `EmailRateLimiter`
+const accountRateLimitCacheSize = 10000
+
+type cachedAccountRateLimit struct {
+	perMin  int
+	expires time.Time
+}
+
 type EmailRateLimiter struct {
+	// Requests from these networks are never limited
+	Allowlist IPAllowlist
+	// If set, accounts are looked up to apply their `RateLimit` overrides
+	Storage Storage
+	// Source for the expiry of cached account overrides. Defaults to the system clock
+	Clock Clock
+	// If set, requests checked via `RateLimitRequest` are counted per route
+	Stats *RateLimitStats
+
+	store            RateLimitStore
 	ipRateLimiter    throttled.RateLimiter
 	emailRateLimiter throttled.RateLimiter
+
+	mutex               sync.Mutex
+	accountRateLimits   map[string]cachedAccountRateLimit
+	accountRateLimiters map[int]throttled.RateLimiter
 }
 
-func (erl *EmailRateLimiter) RateLimit(ip string, email string) bool {
-	if erl == nil {
-		return false
+// Returns the rate limit override of the account with the given email or 0 if there is none.
+// Results are cached to avoid hitting the storage on every request
+func (erl *EmailRateLimiter) accountRateLimit(email string) int {
+	if erl.Storage == nil {
+		return 0
+	}
+
+	erl.mutex.Lock()
+	cached, ok := erl.accountRateLimits[email]
+	erl.mutex.Unlock()
+
+	if ok && clockNow(erl.Clock).Before(cached.expires) {
+		return cached.perMin
+	}
+
+	perMin := 0
+	if acc, err := GetAccount(erl.Storage, email); err == nil {
+		perMin = acc.RateLimit
+	}
+
+	erl.mutex.Lock()
+	if erl.accountRateLimits == nil || len(erl.accountRateLimits) >= accountRateLimitCacheSize {
+		erl.accountRateLimits = make(map[string]cachedAccountRateLimit)
 	}
-	ipLimited, _, _ := erl.ipRateLimiter.RateLimit(ip, 1)
-	emailLimited, _, _ := erl.ipRateLimiter.RateLimit(email, 1)
-	return ipLimited || emailLimited
+	erl.accountRateLimits[email] = cachedAccountRateLimit{perMin, clockNow(erl.Clock).Add(accountRateLimitCacheTTL)}
+	erl.mutex.Unlock()
+
+	return perMin
 }
 
-func NewEmailRateLimiter(ipQuota RateQuota, emailQuota RateQuota) (*EmailRateLimiter, error) {
-	store, err := memstore.New(65536)
+// Returns a rate limiter allowing `perMin` requests per minute
+func (erl *EmailRateLimiter) accountRateLimiter(perMin int) (throttled.RateLimiter, error) {
+	erl.mutex.Lock()
+	defer erl.mutex.Unlock()
+
+	if rl := erl.accountRateLimiters[perMin]; rl != nil {
+		return rl, nil
+	}
+
+	rl, err := throttled.NewGCRARateLimiter(erl.store, throttled.RateQuota{MaxRate: PerMin(perMin), MaxBurst: perMin})
 	if err != nil {
 		return nil, err
 	}
 
+	if erl.accountRateLimiters == nil {
+		erl.accountRateLimiters = make(map[int]throttled.RateLimiter)
+	}
+	erl.accountRateLimiters[perMin] = rl
+
+	return rl, nil
+}
+
+func (erl *EmailRateLimiter) RateLimit(ip string, email string) bool {
+	limited, _, _ := erl.rateLimit(ip, email)
+	return limited
+}
+
+// Like `RateLimit`, using the ip address of `r` and recording the result for its route in
+// `Stats`
+func (erl *EmailRateLimiter) RateLimitRequest(r *http.Request, email string) bool {
+	limited, res, checked := erl.rateLimit(getIp(r), email)
+	if checked && erl.Stats != nil {
+		route := Route{Method: r.Method, Url: r.URL.Path}
+		erl.Stats.observe(route, erl.Stats.route(route), limited, res)
+	}
+	return limited
+}
+
+// Checks both the ip and the email quota. Also returns the result of whichever quota is closer
+// to being exhausted and whether any quota was checked at all
+func (erl *EmailRateLimiter) rateLimit(ip string, email string) (bool, throttled.RateLimitResult, bool) {
+	if erl == nil || erl.Allowlist.Contains(ip) {
+		return false, throttled.RateLimitResult{}, false
+	}
+
+	// The ip quota always applies, so a known email can't be used to send unlimited emails from
+	// many addresses. Accounts with a custom rate limit only replace the per-email quota
+	emailRateLimiter := erl.emailRateLimiter
+	if perMin := erl.accountRateLimit(email); perMin > 0 {
+		if rl, err := erl.accountRateLimiter(perMin); err == nil {
+			emailRateLimiter = rl
+		}
+	}
+
+	ipLimited, ipRes, _ := erl.ipRateLimiter.RateLimit(ip, 1)
+	emailLimited, emailRes, _ := emailRateLimiter.RateLimit(email, 1)
+
+	res := ipRes
+	if emailLimited && !ipLimited || rateLimitFill(emailRes) > rateLimitFill(ipRes) {
+		res = emailRes
+	}
+
+	return ipLimited || emailLimited, res, true
+}
+
+// Fraction of the quota consumed according to `res`
+func rateLimitFill(res throttled.RateLimitResult) float64 {
+	if res.Limit <= 0 {
+		return 0
+	}
+	return float64(res.Limit-res.Remaining) / float64(res.Limit)
+}
+
+// Counts of all routes checked via `RateLimitRequest`. Returns nil if no stats are recorded
+func (erl *EmailRateLimiter) StatsSnapshot() map[string]RouteRateLimitStats {
+	if erl == nil {
+		return nil
+	}
+	return erl.Stats.Snapshot()
+}
+
+// Clears the rate limits of the given ip address or email, e.g. to unblock a client after fixing
+// it. Also drops the cached per-account rate limit so changes to it take effect immediately
+func (erl *EmailRateLimiter) Reset(key string) error {
+	if erl == nil {
+		return nil
+	}
+
+	erl.mutex.Lock()
+	delete(erl.accountRateLimits, key)
+	erl.mutex.Unlock()
+
+	return ResetRateLimit(erl.store, key)
+}
+
+// Creates a new `EmailRateLimiter`. Uses an in-memory store if `store` is nil
+func NewEmailRateLimiter(store RateLimitStore, ipQuota RateQuota, emailQuota RateQuota) (*EmailRateLimiter, error) {
+	if store == nil {
+		var err error
+		if store, err = memstore.New(65536); err != nil {
+			return nil, err
+		}
+	}
+
 	ipRateLimiter, err := throttled.NewGCRARateLimiter(store, throttled.RateQuota(ipQuota))
 	if err != nil {
 		return nil, err
@@ -87,7 +587,8 @@ func NewEmailRateLimiter(ipQuota RateQuota, emailQuota RateQuota) (*EmailRateLim
 	}
 
 	return &EmailRateLimiter{
-		ipRateLimiter,
-		emailRateLimiter,
+		store:            store,
+		ipRateLimiter:    ipRateLimiter,
+		emailRateLimiter: emailRateLimiter,
 	}, nil
 }
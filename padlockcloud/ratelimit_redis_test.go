@@ -0,0 +1,18 @@
+package padlockcloud
+
+import "os"
+import "testing"
+
+// Runs against a live redis instance at the address given via PC_TEST_REDIS, e.g.
+// `PC_TEST_REDIS=localhost:6379 go test`. Skipped if it isn't set
+func TestRedisRateLimitStore(t *testing.T) {
+	addr := os.Getenv("PC_TEST_REDIS")
+	if addr == "" {
+		t.Skip("PC_TEST_REDIS not set")
+	}
+
+	store := NewRedisRateLimitStore(addr, os.Getenv("PC_TEST_REDIS_PASSWORD"), 0)
+	defer store.client.Close()
+
+	testRateLimitStore(t, store)
+}
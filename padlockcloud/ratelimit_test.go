@@ -4,6 +4,12 @@ import "net/http"
 import "net/http/httptest"
 import "testing"
 import "time"
+import "fmt"
+import "bufio"
+import "strings"
+import "reflect"
+import "bytes"
+import "log"
 
 func TestRateLimit(t *testing.T) {
 	if testing.Short() {
@@ -14,8 +20,8 @@ func TestRateLimit(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	rl := RateLimit(handler, map[Route]RateQuota{
-		Route{"GET", "/test/"}: RateQuota{PerSec(1), 0},
+	rl := RateLimit(handler, nil, nil, map[Route]RateQuota{
+		Route{Method: "GET", Url: "/test/"}: RateQuota{PerSec(1), 0},
 	}, nil)
 
 	testServer := httptest.NewServer(rl)
@@ -67,3 +73,241 @@ func TestRateLimit(t *testing.T) {
 		t.Fatalf("Expected OK as status, got %s", res.Status)
 	}
 }
+
+// Checks that `store` correctly implements the `RateLimitStore` interface
+func testRateLimitStore(t *testing.T, store RateLimitStore) {
+	key := fmt.Sprintf("test-%d", time.Now().UnixNano())
+
+	if v, ts, err := store.GetWithTime(key); err != nil || v != -1 || ts.IsZero() {
+		t.Fatalf("Expected -1 and current time for missing key, got %d, %v, %v", v, ts, err)
+	}
+
+	if ok, err := store.CompareAndSwapWithTTL(key, 1, 2, time.Minute); err != nil || ok {
+		t.Fatalf("Expected compare-and-swap on missing key to fail, got %v, %v", ok, err)
+	}
+
+	if ok, err := store.SetIfNotExistsWithTTL(key, 1, time.Minute); err != nil || !ok {
+		t.Fatalf("Expected value to be set, got %v, %v", ok, err)
+	}
+
+	if ok, err := store.SetIfNotExistsWithTTL(key, 5, time.Minute); err != nil || ok {
+		t.Fatalf("Expected existing value not to be overwritten, got %v, %v", ok, err)
+	}
+
+	if v, _, err := store.GetWithTime(key); err != nil || v != 1 {
+		t.Fatalf("Expected value to be 1, got %d, %v", v, err)
+	}
+
+	if ok, err := store.CompareAndSwapWithTTL(key, 3, 4, time.Minute); err != nil || ok {
+		t.Fatalf("Expected compare-and-swap with wrong old value to fail, got %v, %v", ok, err)
+	}
+
+	if ok, err := store.CompareAndSwapWithTTL(key, 1, 2, time.Minute); err != nil || !ok {
+		t.Fatalf("Expected compare-and-swap to succeed, got %v, %v", ok, err)
+	}
+
+	if v, _, err := store.GetWithTime(key); err != nil || v != 2 {
+		t.Fatalf("Expected value to be 2, got %d, %v", v, err)
+	}
+
+	// Rate limiters sharing a store should share their limits
+	rl1, err := NewEmailRateLimiter(store, RateQuota{PerMin(1), 1}, RateQuota{PerMin(1), 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl2, err := NewEmailRateLimiter(store, RateQuota{PerMin(1), 1}, RateQuota{PerMin(1), 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rl1.RateLimit(key+"-ip", key+"-email") {
+		t.Fatal("Expected first request to be allowed")
+	}
+	if rl2.RateLimit(key+"-ip", key+"-email") {
+		t.Fatal("Expected second request to be allowed")
+	}
+	if !rl1.RateLimit(key+"-ip", key+"-email") || !rl2.RateLimit(key+"-ip", key+"-email") {
+		t.Fatal("Expected further requests to be limited")
+	}
+
+	// Resetting both keys should lift the limits for all rate limiters sharing the store
+	for _, k := range []string{key + "-ip", key + "-email", key + "-unknown"} {
+		if err := rl1.Reset(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rl2.RateLimit(key+"-ip", key+"-email") {
+		t.Fatal("Expected request to be allowed after reset")
+	}
+}
+
+func TestRateLimitStats(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var logs bytes.Buffer
+	stats := &RateLimitStats{Log: log.New(&logs, "", 0), SampleRate: 5}
+	rl := RateLimitWithStats(handler, nil, nil, map[Route]RateQuota{
+		Route{Method: "GET", Url: "/test/"}: RateQuota{PerMin(1), 9},
+	}, nil, stats)
+
+	request := func() int {
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, httptest.NewRequest("GET", "/test/", nil))
+		return w.Code
+	}
+
+	// The bucket allows 10 requests, so the 8th one is the first to consume 80% of it
+	for i := 1; i <= 10; i++ {
+		if code := request(); code != http.StatusOK {
+			t.Fatalf("Expected request %d to be allowed, got %d", i, code)
+		}
+
+		expected := int64(0)
+		if i >= 8 {
+			expected = int64(i - 7)
+		}
+		if s := stats.Snapshot()["GET /test/"]; s.Requests != int64(i) || s.NearLimit != expected {
+			t.Fatalf("Expected %d near-limit requests after %d requests, got %+v", expected, i, s)
+		}
+	}
+
+	// Exceeding the quota should be counted separately
+	if code := request(); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected request to be limited, got %d", code)
+	}
+	if s := stats.Snapshot()["GET /test/"]; s.Requests != 11 || s.NearLimit != 3 || s.Limited != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+
+	expectedLogs := "Rate limit bucket for GET /test/ at 50% (5/10 consumed)\n" +
+		"Rate limit bucket for GET /test/ at 100% (10/10 consumed)\n"
+	if logs.String() != expectedLogs {
+		t.Errorf("Expected logs %q, got %q", expectedLogs, logs.String())
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store, err := NewRateLimitStore(&RateLimitConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRateLimitStore(t, store)
+}
+
+func TestNewRateLimitStore(t *testing.T) {
+	if store, err := NewRateLimitStore(&RateLimitConfig{Store: "redis", RedisAddr: "localhost:6379"}); err != nil {
+		t.Fatal(err)
+	} else if _, ok := store.(*RedisRateLimitStore); !ok {
+		t.Fatalf("Expected redis store, got %T", store)
+	}
+
+	if _, err := NewRateLimitStore(&RateLimitConfig{Store: "redis"}); err == nil {
+		t.Fatal("Expected error for missing redis address")
+	}
+
+	if _, err := NewRateLimitStore(&RateLimitConfig{Store: "memcached"}); err == nil {
+		t.Fatal("Expected error for unknown store")
+	}
+}
+
+func TestRedisProtocol(t *testing.T) {
+	if cmd := string(encodeRedisCommand([]string{"SET", "key", "value"})); cmd != "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n" {
+		t.Fatalf("Unexpected command encoding: %q", cmd)
+	}
+
+	rd := bufio.NewReader(strings.NewReader(
+		"+OK\r\n:42\r\n$5\r\nhello\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n-ERR wrong\r\n",
+	))
+
+	expected := []interface{}{
+		"OK",
+		int64(42),
+		[]byte("hello"),
+		nil,
+		[]interface{}{[]byte("a"), int64(1)},
+	}
+
+	for _, exp := range expected {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(reply, exp) {
+			t.Fatalf("Expected %#v, got %#v", exp, reply)
+		}
+	}
+
+	if _, err := readRedisReply(rd); err != redisError("ERR wrong") {
+		t.Fatalf("Expected error reply, got %v", err)
+	}
+}
+
+func TestIPAllowlist(t *testing.T) {
+	list, err := ParseIPAllowlist([]string{"10.0.0.0/8", "192.168.1.5", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []string{"10.1.2.3", "10.1.2.3:1234", "192.168.1.5", "[fd00::1]:80"} {
+		if !list.Contains(addr) {
+			t.Fatalf("Expected %s to be allowed", addr)
+		}
+	}
+
+	for _, addr := range []string{"11.0.0.1", "192.168.1.6", "fe80::1", "", "invalid"} {
+		if list.Contains(addr) {
+			t.Fatalf("Expected %s not to be allowed", addr)
+		}
+	}
+
+	if _, err := ParseIPAllowlist([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("Expected error for invalid CIDR")
+	}
+
+	if _, err := ParseIPAllowlist([]string{"not an ip"}); err == nil {
+		t.Fatal("Expected error for invalid ip")
+	}
+}
+
+func TestEmailRateLimitStats(t *testing.T) {
+	rl, err := NewEmailRateLimiter(nil, RateQuota{PerMin(1), 9}, RateQuota{PerMin(1), 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.Stats = &RateLimitStats{}
+
+	request := func(email string) bool {
+		r := httptest.NewRequest("POST", "/auth/", nil)
+		r.RemoteAddr = "10.0.0.1"
+		return rl.RateLimitRequest(r, email)
+	}
+
+	// The email quota allows 5 requests and is closer to being exhausted than the ip quota, so
+	// the 4th request is the first near the limit
+	for i := 1; i <= 5; i++ {
+		if request(testEmail) {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+	}
+	if !request(testEmail) {
+		t.Fatal("Expected request to be limited")
+	}
+
+	stats := rl.StatsSnapshot()
+	if s := stats["POST /auth/"]; s.Requests != 6 || s.NearLimit != 2 || s.Limited != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	// Requests checked without a route are not counted
+	rl.RateLimit("10.0.0.2", "other@padlock.io")
+	if s := rl.StatsSnapshot()["POST /auth/"]; s.Requests != 6 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+
+	var nilRl *EmailRateLimiter
+	if nilRl.StatsSnapshot() != nil {
+		t.Error("Expected no stats for nil rate limiter")
+	}
+}
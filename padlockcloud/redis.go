@@ -0,0 +1,175 @@
+package padlockcloud
+
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+import "net"
+import "strconv"
+import "sync"
+import "time"
+
+// Error reply returned by a redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Minimal redis client supporting the subset of commands needed for storing rate limiting state.
+// Connections are established lazily and re-established after network errors
+type redisClient struct {
+	Addr     string
+	Password string
+	DB       int
+	Timeout  time.Duration
+
+	mutex sync.Mutex
+	conn  net.Conn
+	rd    *bufio.Reader
+}
+
+func (c *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.rd = bufio.NewReader(conn)
+
+	if c.Password != "" {
+		if _, err := c.do("AUTH", c.Password); err != nil {
+			c.close()
+			return err
+		}
+	}
+
+	if c.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(c.DB)); err != nil {
+			c.close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = nil
+	c.rd = nil
+}
+
+// Sends a command and returns the reply. Replies are returned as `string` (status), `int64`,
+// `[]byte` (bulk strings, nil if absent) or `[]interface{}` (arrays). Error replies are
+// returned as `redisError`
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		// The connection is in an unknown state after a network or protocol error
+		c.close()
+	}
+
+	return reply, err
+}
+
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	if c.Timeout != 0 {
+		c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	if _, err := c.conn.Write(encodeRedisCommand(args)); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.rd)
+}
+
+func (c *redisClient) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.close()
+	return nil
+}
+
+// Encodes a command as an array of bulk strings
+func encodeRedisCommand(args []string) []byte {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	return buf
+}
+
+func readRedisLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("redis: malformed reply")
+	}
+	return line[:len(line)-2], nil
+}
+
+// Reads a single reply
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := readRedisLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("redis: malformed reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+}
@@ -0,0 +1,88 @@
+package padlockcloud
+
+import "context"
+import "errors"
+import "fmt"
+import "math"
+import "math/rand"
+import "time"
+
+// Multiplier used by `BackoffPolicy` if none is configured
+const defaultBackoffMultiplier = 2
+
+// Describes how often and in which intervals failed operations are retried. The zero value
+// makes a single attempt without any retries
+type BackoffPolicy struct {
+	// Time to wait before the first retry
+	BaseDelay time.Duration `yaml:"base_delay"`
+	// Upper bound for the time between two attempts. Unbounded if zero
+	MaxDelay time.Duration `yaml:"max_delay"`
+	// Factor by which the delay grows with each retry. Defaults to `defaultBackoffMultiplier`
+	// if zero
+	Multiplier float64 `yaml:"multiplier"`
+	// Total number of attempts, including the first one. A single attempt is made if zero
+	MaxAttempts int `yaml:"max_attempts"`
+	// Fraction by which delays are randomly varied in either direction, e.g. 0.1 for +/- 10%, so
+	// retries of many failed operations don't all happen at the same time
+	Jitter float64 `yaml:"jitter"`
+}
+
+// Validates the policy, returning an error describing the first invalid setting
+func (p *BackoffPolicy) Validate() error {
+	if p.BaseDelay < 0 || p.MaxDelay < 0 || p.MaxAttempts < 0 {
+		return errors.New("padlock: retry delays and attempts must not be negative")
+	}
+	if p.Multiplier != 0 && p.Multiplier < 1 {
+		return fmt.Errorf("padlock: retry multiplier must be at least 1, got %v", p.Multiplier)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("padlock: retry jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+	return nil
+}
+
+// Returns the time to wait before the given retry, counting from zero
+func (p *BackoffPolicy) Delay(retry int) time.Duration {
+	m := p.Multiplier
+	if m == 0 {
+		m = defaultBackoffMultiplier
+	}
+
+	d := float64(p.BaseDelay) * math.Pow(m, float64(retry))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+
+	return time.Duration(d)
+}
+
+// Calls `fn` until it succeeds or the maximum number of attempts of `policy` is reached, waiting
+// between attempts as described by the policy. Returns the error of the last attempt. If `ctx`
+// is cancelled while waiting, the context's error is returned instead, wrapping the last error's
+// message. A nil policy makes a single attempt
+func Retry(ctx context.Context, policy *BackoffPolicy, fn func() error) error {
+	if policy == nil {
+		policy = &BackoffPolicy{}
+	}
+
+	var err error
+	for i := 0; i == 0 || i < policy.MaxAttempts; i++ {
+		if i > 0 {
+			t := time.NewTimer(policy.Delay(i - 1))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+			}
+		}
+
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package padlockcloud
+
+import "context"
+import "errors"
+import "io/ioutil"
+import "testing"
+import "time"
+
+func TestRetry(t *testing.T) {
+	failure := errors.New("failure")
+	policy := &BackoffPolicy{BaseDelay: time.Millisecond, MaxAttempts: 3}
+
+	// Succeeds after two failures
+	attempts := 0
+	if err := Retry(context.Background(), policy, func() error {
+		attempts++
+		if attempts < 3 {
+			return failure
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("Expected to succeed, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+
+	// Gives up after the maximum number of attempts, returning the last error
+	attempts = 0
+	if err := Retry(context.Background(), policy, func() error {
+		attempts++
+		return failure
+	}); err != failure {
+		t.Errorf("Expected %v, got %v", failure, err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+
+	// A nil policy makes a single attempt
+	attempts = 0
+	Retry(context.Background(), nil, func() error {
+		attempts++
+		return failure
+	})
+	if attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d", attempts)
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := &BackoffPolicy{BaseDelay: time.Hour, MaxAttempts: 3}
+
+	attempts := 0
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := Retry(ctx, policy, func() error {
+		attempts++
+		return errors.New("failure")
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d", attempts)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected cancellation to interrupt the backoff")
+	}
+}
+
+func TestBackoffPolicyDelay(t *testing.T) {
+	policy := &BackoffPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second, Multiplier: 2}
+	for retry, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		if d := policy.Delay(retry); d != expected {
+			t.Errorf("Retry %d: Expected delay of %v, got %v", retry, expected, d)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := policy.Delay(0); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("Expected delay to be within 50%% of 1s, got %v", d)
+		}
+	}
+
+	for _, p := range []*BackoffPolicy{
+		{BaseDelay: -time.Second},
+		{Multiplier: 0.5},
+		{Jitter: 2},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", p)
+		}
+	}
+}
+
+func TestEmailRetryValidation(t *testing.T) {
+	logger := &Log{Config: &LogConfig{}}
+	logger.Init()
+	logger.Info.SetOutput(ioutil.Discard)
+	logger.Error.SetOutput(ioutil.Discard)
+
+	// The retry policy of the email sender is validated along with the server config
+	sender := &EmailSender{Config: &EmailConfig{Retry: BackoffPolicy{MaxAttempts: -1}}}
+	server := NewServer(logger, &MemoryStorage{}, sender, &ServerConfig{})
+	if err := server.Init(); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected invalid config error, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package padlockcloud
+
+import "fmt"
+import "os"
+import "sync"
+
+// File writer that rotates the file once it exceeds a given size. Rotated files are renamed to
+// `{Path}.1`, `{Path}.2` and so on, with `{Path}.1` being the most recent one
+type RotatingFile struct {
+	Path string
+	// Size in bytes after which the file is rotated. The file is never rotated if zero
+	MaxSize int64
+	// Number of rotated files to keep. Older files are removed
+	MaxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// Opens the file at `path` for appending, creating it if necessary
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Implementation of the `io.Writer` interface. Rotates the file first if writing `p` would
+// exceed `MaxSize`
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Shifts all rotated files by one, moves the current file to `{Path}.1` and opens a new one
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	if f.MaxBackups > 0 {
+		for i := f.MaxBackups - 1; i > 0; i-- {
+			if err := os.Rename(f.backupPath(i), f.backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(f.Path, f.backupPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *RotatingFile) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", f.Path, i)
+}
+
+// Closes and reopens the file, e.g. after it has been moved by an external tool like logrotate
+func (f *RotatingFile) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+
+	return f.open()
+}
+
+// Closes the underlying file
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
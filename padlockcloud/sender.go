@@ -1,7 +1,21 @@
 package padlockcloud
 
+import "context"
 import "fmt"
+import "net"
 import "net/smtp"
+import "crypto/tls"
+import "errors"
+import "sync"
+import "bytes"
+import "html"
+import "mime"
+import "mime/multipart"
+import "mime/quotedprintable"
+import "net/textproto"
+import "regexp"
+import "strings"
+import "time"
 
 // Sender is a interface that exposes the `Send` method for sending messages with a subject to a given
 // recipient.
@@ -9,6 +23,21 @@ type Sender interface {
 	Send(recipient string, subject string, message string) error
 }
 
+// Senders implementing this interface can stop waiting for a message to be sent once a context
+// is cancelled, e.g. because the request it was sent for has ended
+type ContextSender interface {
+	Sender
+	SendCtx(ctx context.Context, recipient string, subject string, message string) error
+}
+
+// Sends a message via `s`, using `ContextSender.SendCtx` if supported
+func sendCtx(ctx context.Context, s Sender, recipient string, subject string, message string) error {
+	if cs, ok := s.(ContextSender); ok {
+		return cs.SendCtx(ctx, recipient, subject, message)
+	}
+	return s.Send(recipient, subject, message)
+}
+
 type EmailConfig struct {
 	// User name used for authentication with the mail server
 	User string `yaml:"user"`
@@ -18,47 +47,472 @@ type EmailConfig struct {
 	Port string `yaml:"port"`
 	// Password used for authentication with the mail server
 	Password string `yaml:"password"`
+	// File to read `Password` from instead, e.g. a mounted docker or kubernetes secret
+	PasswordFile string `yaml:"password_file"`
+	// Maximum number of concurrent connections to the mail server. Defaults to
+	// `defaultEmailConcurrency` if zero
+	Concurrency int `yaml:"concurrency"`
+	// Time to wait for a connection to the mail server. Defaults to `defaultEmailDialTimeout`
+	// if zero
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	// Time to wait for the mail server during each step of sending an email. Defaults to
+	// `defaultEmailSendTimeout` if zero
+	SendTimeout time.Duration `yaml:"send_timeout"`
+	// Subjects of the different types of emails. These are templates that may refer to the fields
+	// of `EmailSubjectData`, e.g. "Log in to {{.HostName}}". Defaults are used if empty
+	ActivationSubject        string `yaml:"activation_subject"`
+	LoginSubject             string `yaml:"login_subject"`
+	DeleteRequestSubject     string `yaml:"delete_request_subject"`
+	DeprecatedVersionSubject string `yaml:"deprecated_version_subject"`
+	AccountSuspendedSubject  string `yaml:"account_suspended_subject"`
+	NotificationSubject      string `yaml:"notification_subject"`
+	// How emails that couldn't be sent are retried. Emails are only attempted once by default
+	Retry BackoffPolicy `yaml:"retry"`
+}
+
+// Default maximum number of concurrent connections to the mail server
+const defaultEmailConcurrency = 5
+
+// Maximum number of emails waiting to be sent
+const emailQueueSize = 1000
+
+var ErrEmailQueueFull = errors.New("padlock: email queue is full")
+var ErrSenderClosed = errors.New("padlock: email sender has been closed")
+
+// Senders implementing this interface can send messages in the background
+type QueueSender interface {
+	Sender
+	// Queues a message for sending without waiting for it to be sent. `done` is called with the
+	// result once the message has been sent
+	Queue(recipient string, subject string, message string, done func(error)) error
+}
+
+// Health states of the mail server as reported by `EmailSender.Health`
+const (
+	EmailHealthUnknown   = "unknown"
+	EmailHealthHealthy   = "healthy"
+	EmailHealthUnhealthy = "unhealthy"
+)
+
+// Outcome of the most recent attempt to reach the mail server
+type EmailHealth struct {
+	// One of `EmailHealthUnknown`, `EmailHealthHealthy` and `EmailHealthUnhealthy`. Unknown until
+	// the mail server is contacted for the first time
+	Status string `json:"status"`
+	// Error of the last attempt, if it failed
+	Error string `json:"error,omitempty"`
+	// Time of the last attempt
+	Checked *time.Time `json:"checked,omitempty"`
 }
 
-// EmailSender implements the `Sender` interface for emails
+// Implemented by senders keeping track of whether they can reach their server
+type EmailHealthReporter interface {
+	Health() *EmailHealth
+}
+
+type emailJob struct {
+	ctx       context.Context
+	recipient string
+	subject   string
+	message   string
+	done      func(error)
+}
+
+// EmailSender implements the `Sender` interface for emails. Emails are sent by a fixed number of
+// workers so bursts of emails don't exhaust connections to the mail server
 type EmailSender struct {
 	Config *EmailConfig
+	// Source for the `Date` header. Defaults to the system clock
+	Clock Clock
+
+	// Sends a single email. Defaults to `sendMail`; replaced in tests
+	send    func(rec string, subject string, body string) error
+	once    sync.Once
+	mutex   sync.RWMutex
+	queue   chan *emailJob
+	ctx     context.Context
+	cancel  context.CancelFunc
+	closed  bool
+	workers sync.WaitGroup
+
+	healthMutex sync.Mutex
+	health      EmailHealth
+}
+
+// Records the outcome of an attempt to reach the mail server
+func (sender *EmailSender) recordHealth(err error) {
+	sender.healthMutex.Lock()
+	defer sender.healthMutex.Unlock()
+
+	checked := clockNow(sender.Clock)
+	sender.health = EmailHealth{Status: EmailHealthHealthy, Checked: &checked}
+	if err != nil {
+		sender.health.Status = EmailHealthUnhealthy
+		sender.health.Error = err.Error()
+	}
+}
+
+// Implementation of the `EmailHealthReporter` interface. The mail server is not contacted for this;
+// the health is derived from the last email sent or connection check
+func (sender *EmailSender) Health() *EmailHealth {
+	sender.healthMutex.Lock()
+	defer sender.healthMutex.Unlock()
+
+	h := sender.health
+	if h.Status == "" {
+		h.Status = EmailHealthUnknown
+	}
+	return &h
 }
 
-// Attempts to send an email to a given recipient. Through `smpt.SendMail`
+func (sender *EmailSender) start() {
+	sender.once.Do(func() {
+		n := sender.Config.Concurrency
+		if n <= 0 {
+			n = defaultEmailConcurrency
+		}
+		if sender.send == nil {
+			sender.send = sender.sendMail
+		}
+
+		sender.queue = make(chan *emailJob, emailQueueSize)
+		sender.ctx, sender.cancel = context.WithCancel(context.Background())
+		for i := 0; i < n; i++ {
+			sender.workers.Add(1)
+			go func() {
+				defer sender.workers.Done()
+				for job := range sender.queue {
+					err := sender.process(job)
+					if job.done != nil {
+						job.done(err)
+					}
+				}
+			}()
+		}
+	})
+}
+
+// Sends a queued email, retrying according to the configured policy. Retries stop once the
+// job's context is cancelled or the sender is closed. Emails whose context has already been
+// cancelled aren't sent at all
+func (sender *EmailSender) process(job *emailJob) error {
+	if err := job.ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(job.ctx)
+	defer cancel()
+	stop := context.AfterFunc(sender.ctx, cancel)
+	defer stop()
+
+	return Retry(ctx, &sender.Config.Retry, func() error {
+		err := sender.send(job.recipient, job.subject, job.message)
+		sender.recordHealth(err)
+		return err
+	})
+}
+
+// Implementation of the `QueueSender.Queue` method. Returns `ErrEmailQueueFull` if too many emails
+// are waiting to be sent
+func (sender *EmailSender) Queue(rec string, subject string, body string, done func(error)) error {
+	return sender.queueCtx(context.Background(), rec, subject, body, done)
+}
+
+func (sender *EmailSender) queueCtx(ctx context.Context, rec string, subject string, body string, done func(error)) error {
+	sender.start()
+
+	sender.mutex.RLock()
+	defer sender.mutex.RUnlock()
+
+	if sender.closed {
+		return ErrSenderClosed
+	}
+
+	select {
+	case sender.queue <- &emailJob{ctx, rec, subject, body, done}:
+		return nil
+	default:
+		return ErrEmailQueueFull
+	}
+}
+
+// Sends an email to a given recipient, waiting for it to be sent
 func (sender *EmailSender) Send(rec string, subject string, body string) error {
-	auth := smtp.PlainAuth(
-		"",
-		sender.Config.User,
-		sender.Config.Password,
-		sender.Config.Server,
-	)
-
-	message := fmt.Sprintf("Subject: %s\r\nFrom: Padlock Cloud <%s>\r\n\r\n%s", subject, sender.Config.User, body)
-	return smtp.SendMail(
-		sender.Config.Server+":"+sender.Config.Port,
-		auth,
-		sender.Config.User,
-		[]string{rec},
-		[]byte(message),
-	)
-}
-
-// Mock implementation of the `Sender` interface. Simply records arguments passed to the `Send` method
+	return sender.SendCtx(context.Background(), rec, subject, body)
+}
+
+// Implementation of the `ContextSender.SendCtx` method. Stops waiting and retrying once `ctx` is
+// cancelled, returning the context's error
+func (sender *EmailSender) SendCtx(ctx context.Context, rec string, subject string, body string) error {
+	result := make(chan error, 1)
+	if err := sender.queueCtx(ctx, rec, subject, body, func(err error) {
+		result <- err
+	}); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stops accepting new emails and waits for queued emails to be sent. Failed emails aren't
+// retried anymore once the sender is closed
+func (sender *EmailSender) Close() error {
+	sender.start()
+
+	sender.mutex.Lock()
+	if !sender.closed {
+		sender.closed = true
+		close(sender.queue)
+		sender.cancel()
+	}
+	sender.mutex.Unlock()
+
+	sender.workers.Wait()
+	return nil
+}
+
+// Default time to wait for a connection to the mail server to be established
+const defaultEmailDialTimeout = 10 * time.Second
+
+// Default time to wait for a single read or write during the conversation with the mail server
+const defaultEmailSendTimeout = 30 * time.Second
+
+// Wraps a connection, extending its deadline before each read and write so a mail server that
+// stops responding results in a timeout error instead of blocking forever
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// Connects to the mail server, upgrading the connection to TLS if supported and authenticating
+// if a user is configured
+func (sender *EmailSender) dial() (*smtp.Client, error) {
+	dialTimeout := sender.Config.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultEmailDialTimeout
+	}
+	sendTimeout := sender.Config.SendTimeout
+	if sendTimeout == 0 {
+		sendTimeout = defaultEmailSendTimeout
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(sender.Config.Server, sender.Config.Port), dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(&deadlineConn{conn, sendTimeout}, sender.Config.Server)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: sender.Config.Server}); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if sender.Config.User != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", sender.Config.User, sender.Config.Password, sender.Config.Server)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Attempts to send an email to a given recipient
+func (sender *EmailSender) sendMail(rec string, subject string, body string) error {
+	message, err := sender.message(rec, subject, body)
+	if err != nil {
+		return err
+	}
+
+	c, err := sender.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Mail(sender.Config.User); err != nil {
+		return err
+	}
+	if err := c.Rcpt(rec); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// Connects and authenticates with the mail server without sending an email
+func (sender *EmailSender) CheckConnection() error {
+	err := sender.checkConnection()
+	sender.recordHealth(err)
+	return err
+}
+
+func (sender *EmailSender) checkConnection() error {
+	c, err := sender.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Noop(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+var htmlBreakPattern = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</h[1-6]>|</li>|</tr>`)
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// Loosely checks whether `body` is an html document or fragment
+func isHTML(body string) bool {
+	return strings.HasPrefix(strings.TrimSpace(body), "<")
+}
+
+// Creates a plain text version of an html body by stripping all tags
+func htmlToText(body string) string {
+	text := htmlBreakPattern.ReplaceAllString(body, "$0\n")
+	text = htmlTagPattern.ReplaceAllString(text, "")
+	return strings.TrimSpace(html.UnescapeString(text))
+}
+
+// Creates an html version of a plain text body, preserving line breaks and turning urls into links
+func textToHTML(body string) string {
+	escaped := html.EscapeString(body)
+	linked := urlPattern.ReplaceAllStringFunc(escaped, func(url string) string {
+		return fmt.Sprintf(`<a href="%s">%s</a>`, url, url)
+	})
+	return "<html><body><p>" + strings.Replace(linked, "\n", "<br>\n", -1) + "</p></body></html>"
+}
+
+// Builds a `multipart/alternative` message with both a plain text and an html part. `body` may be
+// either; the other format is generated from it
+func (sender *EmailSender) message(rec string, subject string, body string) ([]byte, error) {
+	var text, htmlBody string
+	if isHTML(body) {
+		text, htmlBody = htmlToText(body), body
+	} else {
+		text, htmlBody = body, textToHTML(body)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "From: Padlock Cloud <%s>\r\n", sender.Config.User)
+	fmt.Fprintf(&buf, "To: %s\r\n", rec)
+	fmt.Fprintf(&buf, "Date: %s\r\n", clockNow(sender.Clock).Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	// Parts are ordered by increasing preference
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", htmlBody},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qw := quotedprintable.NewWriter(w)
+		if _, err := qw.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Mock implementation of the `Sender` interface. Simply records arguments passed to the `Send` method.
+// Use `Last` for reading them while emails may be sent in the background
 type RecordSender struct {
 	Recipient string
 	Subject   string
 	Message   string
+	mu        sync.Mutex
 }
 
 func (s *RecordSender) Send(rec string, subj string, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Recipient = rec
 	s.Subject = subj
 	s.Message = message
 	return nil
 }
 
+// Implementation of the `QueueSender.Queue` method. Records the email right away so it can be
+// inspected as soon as the request queueing it has been answered
+func (s *RecordSender) Queue(rec string, subj string, message string, done func(error)) error {
+	err := s.Send(rec, subj, message)
+	if done != nil {
+		done(err)
+	}
+	return nil
+}
+
+// Returns the recipient, subject and message of the last email sent
+func (s *RecordSender) Last() (string, string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Recipient, s.Subject, s.Message
+}
+
 func (s *RecordSender) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Recipient = ""
 	s.Subject = ""
 	s.Message = ""
@@ -0,0 +1,299 @@
+package padlockcloud
+
+import "context"
+import "errors"
+import "testing"
+import "sync"
+import "sync/atomic"
+import "time"
+import "bufio"
+import "bytes"
+import "net"
+import "io"
+import "io/ioutil"
+import "mime"
+import "mime/multipart"
+import "net/mail"
+import "strings"
+
+func TestEmailSenderConcurrency(t *testing.T) {
+	var current, max, sent int64
+
+	sender := &EmailSender{Config: &EmailConfig{Concurrency: 3}}
+	sender.send = func(rec string, subject string, body string) error {
+		n := atomic.AddInt64(&current, 1)
+		for {
+			m := atomic.LoadInt64(&max)
+			if n <= m || atomic.CompareAndSwapInt64(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt64(&current, -1)
+		atomic.AddInt64(&sent, 1)
+		return nil
+	}
+
+	// Flood the sender with both blocking and queued sends
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sender.Send(testEmail, "subject", "message"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for i := 0; i < 30; i++ {
+		if err := sender.Queue(testEmail, "subject", "message", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	// Closing the sender should wait for queued emails to be sent
+	if err := sender.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != 60 {
+		t.Errorf("Expected 60 emails to be sent, got %d", sent)
+	}
+	if max > 3 {
+		t.Errorf("Expected at most 3 concurrent sends, got %d", max)
+	}
+
+	if err := sender.Send(testEmail, "subject", "message"); err != ErrSenderClosed {
+		t.Errorf("Expected %v after closing, got %v", ErrSenderClosed, err)
+	}
+}
+
+func TestEmailSenderCancel(t *testing.T) {
+	var attempts int64
+
+	sender := &EmailSender{Config: &EmailConfig{Retry: BackoffPolicy{MaxAttempts: 5, BaseDelay: time.Hour}}}
+	sender.send = func(rec string, subject string, body string) error {
+		if subject == "queued" {
+			atomic.AddInt64(&attempts, 1)
+		}
+		return errors.New("unreachable")
+	}
+
+	// Cancelling the context should stop waiting for the email without sending further retries
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sender.SendCtx(ctx, testEmail, "subject", "message"); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// Emails whose context is already done aren't sent at all
+	if err := sender.SendCtx(ctx, testEmail, "subject", "message"); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// Closing the sender should cancel pending retries instead of waiting for them
+	done := make(chan error, 1)
+	if err := sender.Queue(testEmail, "queued", "message", func(err error) {
+		done <- err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for atomic.LoadInt64(&attempts) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		sender.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected closing the sender not to wait for retries")
+	}
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected queued email to be cancelled, got %v", err)
+	}
+	if n := atomic.LoadInt64(&attempts); n != 1 {
+		t.Errorf("Expected a single attempt, got %d", n)
+	}
+}
+
+func parseEmailMessage(t *testing.T, msg []byte) (*mail.Message, map[string]string) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Expected content type to be multipart/alternative, is %s", mediaType)
+	}
+
+	parts := make(map[string]string)
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// `NextPart` transparently decodes quoted-printable content. Line breaks are sent as CRLF
+		content, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[p.Header.Get("Content-Type")] = strings.Replace(string(content), "\r\n", "\n", -1)
+	}
+
+	return m, parts
+}
+
+func TestEmailMessage(t *testing.T) {
+	sender := &EmailSender{Config: &EmailConfig{User: "cloud@padlock.io"}}
+
+	text := "Hi there!\n\nActivation link: https://cloud.padlock.io/activate/?t=abc&v=1\n\nBest, Ünicode"
+	msg, err := sender.message("user@example.com", "Connect to Padlock Cloud", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, parts := parseEmailMessage(t, msg)
+	if m.Header.Get("MIME-Version") != "1.0" || m.Header.Get("To") != "user@example.com" {
+		t.Errorf("Unexpected headers: %v", m.Header)
+	}
+
+	if len(parts) != 2 {
+		t.Fatalf("Expected 2 parts, got %d", len(parts))
+	}
+	if parts["text/plain; charset=utf-8"] != text {
+		t.Errorf("Expected text part to equal the original body, got %q", parts["text/plain; charset=utf-8"])
+	}
+	htmlPart := parts["text/html; charset=utf-8"]
+	if !strings.Contains(htmlPart, `<a href="https://cloud.padlock.io/activate/?t=abc&amp;v=1">`) ||
+		!strings.Contains(htmlPart, "Ünicode") {
+		t.Errorf("Expected html part to contain the linkified body, got %q", htmlPart)
+	}
+
+	// Text part should be generated by stripping html if the body is html
+	msg, err = sender.message("user@example.com", "Test", "<p>Hello &amp; welcome!</p><p><b>Bye</b></p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, parts = parseEmailMessage(t, msg); parts["text/plain; charset=utf-8"] != "Hello & welcome!\nBye" {
+		t.Errorf("Expected stripped text part, got %q", parts["text/plain; charset=utf-8"])
+	}
+}
+
+// Starts a minimal smtp server that stops responding once it receives a command starting with
+// `hangOn` (or right away if `hangOn` is "CONNECT"). Received messages are sent to `messages`
+func mockSMTPServer(t *testing.T, hangOn string, messages chan<- string) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if hangOn == "CONNECT" {
+					io.Copy(ioutil.Discard, conn)
+					return
+				}
+
+				r := bufio.NewReader(conn)
+				conn.Write([]byte("220 localhost ready\r\n"))
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(strings.TrimSpace(line))
+					if hangOn != "" && strings.HasPrefix(cmd, hangOn) {
+						io.Copy(ioutil.Discard, conn)
+						return
+					}
+
+					switch {
+					case strings.HasPrefix(cmd, "EHLO"):
+						conn.Write([]byte("250 localhost\r\n"))
+					case strings.HasPrefix(cmd, "DATA"):
+						conn.Write([]byte("354 go ahead\r\n"))
+						var msg bytes.Buffer
+						for {
+							l, err := r.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if l == ".\r\n" {
+								break
+							}
+							msg.WriteString(l)
+						}
+						messages <- msg.String()
+						conn.Write([]byte("250 ok\r\n"))
+					case strings.HasPrefix(cmd, "QUIT"):
+						conn.Write([]byte("221 bye\r\n"))
+						return
+					default:
+						conn.Write([]byte("250 ok\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func TestEmailSenderTimeout(t *testing.T) {
+	for _, hangOn := range []string{"", "CONNECT", "EHLO", "MAIL", "DATA"} {
+		messages := make(chan string, 1)
+		addr, stop := mockSMTPServer(t, hangOn, messages)
+		host, port, _ := net.SplitHostPort(addr)
+
+		sender := &EmailSender{Config: &EmailConfig{
+			Server:      host,
+			Port:        port,
+			DialTimeout: time.Second,
+			SendTimeout: 100 * time.Millisecond,
+		}}
+
+		start := time.Now()
+		err := sender.Send(testEmail, "subject", "message")
+		elapsed := time.Since(start)
+		sender.Close()
+		stop()
+
+		if hangOn == "" {
+			if err != nil {
+				t.Fatalf("Expected email to be sent, got %v", err)
+			}
+			if msg := <-messages; !strings.Contains(msg, "message") {
+				t.Errorf("Expected message to be received, got %q", msg)
+			}
+			continue
+		}
+
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			t.Errorf("%s: Expected timeout error, got %v", hangOn, err)
+		}
+		if elapsed > time.Second {
+			t.Errorf("%s: Expected send to time out quickly, took %v", hangOn, elapsed)
+		}
+	}
+}
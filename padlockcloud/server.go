@@ -1,21 +1,52 @@
 package padlockcloud
 
+import "context"
 import "net/http"
+import "net/url"
 import "net/http/httputil"
 import "fmt"
+import "errors"
 import "encoding/base64"
 import "regexp"
 import "bytes"
+import "reflect"
 import "strings"
 import "time"
 import "strconv"
-import "path/filepath"
+import "sync"
+import "sync/atomic"
+import "net"
+import "io"
+import "io/fs"
+import "io/ioutil"
+import "crypto/tls"
+import "crypto/x509"
 import "gopkg.in/tylerb/graceful.v1"
 
 const (
 	ApiVersion = 1
 )
 
+// Value of the Retry-After header sent with requests rejected during read-only mode
+const readOnlyRetryAfter = 5 * time.Minute
+
+// Minimum time between notifications about the storage being full
+const storageFullNotifyInterval = time.Hour
+
+// Value of the Retry-After header sent with requests rejected while the server is starting up
+const startingRetryAfter = 10 * time.Second
+
+// Minimum time between connection checks of the mail server triggered by the health check
+const emailReadinessInterval = 30 * time.Second
+
+// Policies for handling new auth tokens exceeding `ServerConfig.MaxTokensPerAccount`
+const (
+	// Reject the new token
+	TokenLimitReject = "reject"
+	// Remove the least recently used tokens to make room for the new one
+	TokenLimitEvict = "evict"
+)
+
 func versionFromRequest(r *http.Request) int {
 	var vString string
 	accept := r.Header.Get("Accept")
@@ -43,6 +74,15 @@ func getIp(r *http.Request) string {
 	return ip
 }
 
+// Same as `getIp` but with the port stripped
+func getHost(r *http.Request) string {
+	ip := getIp(r)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+	return ip
+}
+
 func FormatRequest(r *http.Request) string {
 	return fmt.Sprintf("%s %s %s", getIp(r), r.Method, r.URL)
 }
@@ -78,8 +118,12 @@ func (d *DataStore) Serialize() ([]byte, error) {
 type ServerConfig struct {
 	// Path to assets directory; used for loading templates and such
 	AssetsPath string `yaml:"assets_path"`
+	// Use assets embedded into the binary instead of loading them from `AssetsPath`
+	AssetsFromEmbed bool `yaml:"assets_from_embed"`
 	// Port to listen on
 	Port int `yaml:"port"`
+	// Address to bind to, e.g. "127.0.0.1" or "::1". Listens on all interfaces if empty
+	BindHost string `yaml:"bind_host"`
 	// Path to TLS certificate
 	TLSCert string `yaml:"tls_cert"`
 	// Path to TLS key file
@@ -88,8 +132,105 @@ type ServerConfig struct {
 	BaseUrl string `yaml:"base_url"`
 	// Secret used for authenticating cookies
 	Secret string `yaml:"secret"`
+	// File to read `Secret` from instead
+	SecretFile string `yaml:"secret_file"`
+	// Number of random bytes used for generating auth and activation tokens. Has to be at least
+	// 16. Defaults to `DefaultTokenBytes` if zero
+	TokenBytes int `yaml:"token_bytes"`
 	// Enable Cross-Origin Resource Sharing
 	Cors bool `yaml:"cors"`
+	// How long browsers may cache the results of CORS preflight requests. Browser default if zero
+	CorsMaxAge time.Duration `yaml:"cors_max_age"`
+	// Allow browsers to include credentials like cookies in cross-origin requests. Requires
+	// `CorsAllowedOrigins` to be set
+	CorsAllowCredentials bool `yaml:"cors_allow_credentials"`
+	// Origins allowed to make cross-origin requests, e.g. "https://app.padlock.io". Any origin is
+	// allowed if empty
+	CorsAllowedOrigins []string `yaml:"cors_allowed_origins,omitempty"`
+	// Policies overriding the CORS settings above for paths starting with the given prefixes, e.g.
+	// "/admin/". The longest matching prefix wins
+	CorsPolicies map[string]*CorsPolicy `yaml:"cors_policies,omitempty"`
+	// Address to serve runtime profiling data on, e.g. "localhost:6060". Disabled if empty. Must
+	// not be reachable publicly
+	PprofAddr string `yaml:"pprof_addr"`
+	// Address for a separate listener carrying all operational endpoints (metrics, health check,
+	// profiling data and the admin api), e.g. "localhost:9090". Disabled if empty. Must not be
+	// reachable publicly
+	InternalBindAddr string `yaml:"internal_bind_addr"`
+	// Path to the audit log file. Security-relevant events are not recorded if empty
+	AuditLog string `yaml:"audit_log"`
+	// Settings for automatic backups
+	Backup BackupConfig `yaml:"backup"`
+	// Reject any requests that would modify data
+	ReadOnly bool `yaml:"read_only"`
+	// Settings for the admin api
+	Admin AdminConfig `yaml:"admin"`
+	// Maximum size of request bodies in bytes. Unlimited if zero
+	MaxRequestBodyBytes int64 `yaml:"max_request_body_bytes"`
+	// Path to a PEM file with CA certificates. If provided, client certificates signed by one of
+	// these CAs are accepted for authentication. Requires `TLSCert` and `TLSKey` to be set
+	ClientCAFile string `yaml:"client_ca_file"`
+	// If set, deleted accounts are moved to the trash and only purged after this period
+	TrashRetention time.Duration `yaml:"trash_retention"`
+	// Number of previous versions of each account's data to keep for rolling back. Disabled if zero
+	DataVersions int `yaml:"data_versions"`
+	// Wait for activation emails to be sent, answering auth requests with an error and discarding
+	// them if sending fails. Otherwise activation emails are sent in the background
+	FailSignupOnEmailError bool `yaml:"fail_signup_on_email_error"`
+	// Reject auth requests for email addresses without an account, so new accounts can only be
+	// created through the cli or the admin api
+	DisableSignup bool `yaml:"disable_signup"`
+	// Don't send any emails. Routes depending on emails, like requesting auth tokens, are rejected
+	// and no mail server needs to be configured. Requires `DisableSignup`
+	DisableEmail bool `yaml:"disable_email"`
+	// Fail to start if the mail server can't be reached. Otherwise the server starts regardless and
+	// the mail server's health is reported via the metrics and health check endpoints
+	RequireEmailAtStartup bool `yaml:"require_email_at_startup"`
+	// Report the server as unavailable via the health check endpoint while the mail server can't be
+	// reached, e.g. so load balancers stop sending signups to it. The mail server is checked at most
+	// every `emailReadinessInterval`
+	RequireEmailForReadiness bool `yaml:"require_email_for_readiness"`
+	// Maximum number of named vaults per account. Unlimited if zero
+	MaxVaultsPerAccount int `yaml:"max_vaults_per_account"`
+	// Maximum combined size in bytes of all named vaults of an account. Unlimited if zero
+	MaxVaultBytesPerAccount int64 `yaml:"max_vault_bytes_per_account"`
+	// Maximum number of auth tokens per account. Unlimited if zero
+	MaxTokensPerAccount int `yaml:"max_tokens_per_account"`
+	// What to do when a new auth token would exceed `MaxTokensPerAccount`. One of
+	// `TokenLimitReject` (the default) and `TokenLimitEvict`
+	TokenLimitPolicy string `yaml:"token_limit_policy"`
+	// Settings for rate limiting
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	// Requests from these networks (in CIDR notation) are exempt from rate limiting
+	RateLimitAllowlist []string `yaml:"rate_limit_allowlist,omitempty"`
+	// Addresses to listen on. If empty, the server listens on `Port`, using TLS if `TLSCert`
+	// and `TLSKey` are provided
+	Listeners []ListenerConfig `yaml:"listeners,omitempty"`
+	// Requests taking longer than this are cancelled and answered with a 503. Unlimited if zero
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// Expect connections to start with a PROXY protocol header and use the client address
+	// provided therein. Only enable this when running behind a proxy that sends these headers
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// Answer requests received over plain http with `426 Upgrade Required`, pointing clients to
+	// the https url instead. Don't enable this if TLS is terminated by a proxy in front of the server
+	RequireTLS bool `yaml:"require_tls"`
+	// Accept cleartext HTTP/2 (h2c) with prior knowledge on listeners without TLS, in addition to
+	// HTTP/1.1. Only useful when TLS is terminated by a proxy that talks HTTP/2 to the server.
+	// HTTP/2 is always available on TLS listeners
+	H2C bool `yaml:"h2c"`
+	// Value of the `Server` response header. No such header is sent if empty
+	ServerHeader string `yaml:"server_header"`
+	// Send the server version in an `X-Padlock-Version` response header
+	VersionHeader bool `yaml:"version_header"`
+	// Export request traces to an OpenTelemetry collector
+	Tracing TracingConfig `yaml:"tracing"`
+	// Post audit events to external services
+	Webhooks WebhookConfig `yaml:"webhooks"`
+	// Settings applied to accounts created via signup, the cli or the admin api. Changing these
+	// doesn't affect existing accounts
+	DefaultAccount DefaultAccountConfig `yaml:"default_account"`
+	// Restrictions on the email addresses auth tokens can be requested for
+	AuthPolicy AuthPolicyConfig `yaml:"auth_policy"`
 }
 
 // The Server type holds all the contextual data and logic used for running a Padlock Cloud instances
@@ -100,12 +241,77 @@ type Server struct {
 	Storage           Storage
 	Sender            Sender
 	Templates         *Templates
+	Assets            fs.FS
 	Config            *ServerConfig
 	Secure            bool
 	Endpoints         map[string]*Endpoint
 	secret            []byte
+	Backuper          *Backuper
 	emailRateLimiter  *EmailRateLimiter
 	cleanAuthRequests *Job
+	backups           *Job
+	purgeTrash        *Job
+	listeners         []*graceful.Server
+	listenersMutex    sync.Mutex
+	addrs             []net.Addr
+	stopped           bool
+	admin             *http.Server
+	pprof             *http.Server
+	internal          *http.Server
+	internalAddr      net.Addr
+	readOnly          int32
+	starting          int32
+	storageFullAt     int64
+	started           time.Time
+	Metrics           *Metrics
+	Audit             *AuditLog
+	GeoLookup         GeoLookupFunc
+	Tracer            *Tracer
+	Clock             Clock
+	EmailSubjects     *EmailSubjects
+	Webhooks          *Webhooks
+	emailCheckMutex   sync.Mutex
+}
+
+// Looks up a coarse, human-readable location (e.g. "Berlin, Germany") for an ip address.
+// Should return an empty string if the location is unknown
+type GeoLookupFunc func(ip string) string
+
+// Records where a request for the auth token `t` came from
+func (server *Server) recordClient(t *AuthToken, r *http.Request) {
+	t.IP = getHost(r)
+	t.UserAgent = r.UserAgent()
+	t.DeviceName = deviceName(r.PostFormValue("device_name"), t.UserAgent)
+	if server.GeoLookup != nil {
+		t.Location = server.GeoLookup(t.IP)
+	}
+}
+
+// Returns true if the server is in read-only mode
+func (server *Server) ReadOnly() bool {
+	return atomic.LoadInt32(&server.readOnly) == 1
+}
+
+// Enables or disables read-only mode. While in read-only mode, any requests that would
+// modify data are rejected
+func (server *Server) SetReadOnly(readOnly bool) {
+	var val int32
+	if readOnly {
+		val = 1
+	}
+
+	if atomic.SwapInt32(&server.readOnly, val) != val {
+		if readOnly {
+			server.Info.Println("Entering read-only mode")
+		} else {
+			server.Info.Println("Leaving read-only mode")
+		}
+	}
+}
+
+// Returns true if the server is accepting connections but hasn't finished initializing yet
+func (server *Server) Starting() bool {
+	return atomic.LoadInt32(&server.starting) == 1
 }
 
 func (server *Server) BaseUrl(r *http.Request) string {
@@ -133,13 +339,17 @@ func (server *Server) Authenticate(r *http.Request) (*AuthToken, error) {
 	}
 
 	invalidErr := &InvalidAuthToken{authToken.Email, authToken.Token}
+	fail := func(err ErrorResponse) (*AuthToken, error) {
+		server.audit(r, "auth:failed", authToken.Email, err.Code())
+		return nil, err
+	}
 
 	acc := &Account{Email: authToken.Email}
 
 	// Fetch account for the given email address
-	if err := server.Storage.Get(acc); err != nil {
+	if err := server.Storage.GetCtx(r.Context(), acc); err != nil {
 		if err == ErrNotFound {
-			return nil, invalidErr
+			return fail(invalidErr)
 		} else {
 			return nil, err
 		}
@@ -148,57 +358,120 @@ func (server *Server) Authenticate(r *http.Request) (*AuthToken, error) {
 	// Find the fully populated auth token struct on account. If not found, the value will be nil
 	// and we know that the provided token is not valid
 	if !authToken.Validate(acc) {
-		return nil, invalidErr
+		return fail(invalidErr)
 	}
 
 	// Check if the token is expired
-	if authToken.Expired() {
-		return nil, &ExpiredAuthToken{authToken.Email, authToken.Token}
+	if authToken.ExpiredAt(server.now()) {
+		return fail(&ExpiredAuthToken{authToken.Email, authToken.Token})
+	}
+
+	if acc.Suspended {
+		return fail(&AccountSuspended{acc.Email, acc.SuspendedReason})
 	}
 
 	// If everything checks out, update the `LastUsed` field with the current time
-	authToken.LastUsed = time.Now()
+	authToken.LastUsed = server.now()
+	authToken.LastIP = getHost(r)
 	// Update client version
 	authToken.ClientVersion = r.Header.Get("X-Client-Version")
 	authToken.ClientPlatform = r.Header.Get("X-Client-Platform")
 
 	acc.UpdateAuthToken(authToken)
 
-	// Save account info to persist last used data for auth tokens
-	if err := server.Storage.Put(acc); err != nil {
-		return nil, err
+	// Save account info to persist last used data for auth tokens. Skipped in read-only mode
+	// since this is not essential
+	if !server.ReadOnly() {
+		if err := server.Storage.PutCtx(r.Context(), acc); err != nil {
+			return nil, err
+		}
 	}
 
 	return authToken, nil
 }
 
+// Authenticates a request via its verified client certificate. The account is identified by the
+// certificate's first email address or, if it has none, its common name. The returned auth token
+// has the type "cert", uses the certificate's serial number as id and isn't stored on the account
+func (server *Server) AuthenticateClientCert(r *http.Request) (*AuthToken, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, &InvalidAuthToken{}
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	email := cert.Subject.CommonName
+	if len(cert.EmailAddresses) > 0 {
+		email = cert.EmailAddresses[0]
+	}
+
+	acc := &Account{Email: email}
+	if err := server.Storage.GetCtx(r.Context(), acc); err == ErrNotFound {
+		err := &InvalidAuthToken{email, ""}
+		server.audit(r, "auth:failed", email, err.Code())
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	if acc.Suspended {
+		err := &AccountSuspended{acc.Email, acc.SuspendedReason}
+		server.audit(r, "auth:failed", email, err.Code())
+		return nil, err
+	}
+
+	return &AuthToken{
+		Email:   email,
+		Type:    "cert",
+		Id:      cert.SerialNumber.String(),
+		LastIP:  getHost(r),
+		account: acc,
+	}, nil
+}
+
 func (server *Server) LogError(err error, r *http.Request) {
 	switch e := err.(type) {
-	case *ServerError, *InvalidCsrfToken:
+	case *ServerError, *StorageUnavailable, *InvalidCsrfToken, *EmailDeliveryFailed:
 		server.Error.Printf("%s - %v\nRequest:\n%s\n", FormatRequest(r), e, formatRequestVerbose(r))
+	case *InsufficientStorage:
+		server.Info.Printf("%s - %v", FormatRequest(r), e)
+		server.notifyStorageFull()
 	default:
 		server.Info.Printf("%s - %v", FormatRequest(r), e)
 	}
 }
 
+// Logs an error about the storage being full, at most once per `storageFullNotifyInterval` so
+// retrying clients don't flood the error notifications
+func (server *Server) notifyStorageFull() {
+	t := server.now().UnixNano()
+	last := atomic.LoadInt64(&server.storageFullAt)
+	if t-last < int64(storageFullNotifyInterval) || !atomic.CompareAndSwapInt64(&server.storageFullAt, last, t) {
+		return
+	}
+	server.Error.Println("Rejecting writes since there is no space left on the storage device")
+}
+
 // Global error handler. Writes a appropriate response to the provided `http.ResponseWriter` object and
 // logs / notifies of internal server errors
 func (server *Server) HandleError(e error, w http.ResponseWriter, r *http.Request) {
-	err, ok := e.(ErrorResponse)
-
-	if !ok {
-		err = &ServerError{e}
-	}
+	err := toErrorResponse(e)
 
 	server.LogError(err, r)
 
+	server.writeError(w, r, err)
+}
+
+// Writes an error response in the format negotiated via the request's `Accept` header: A
+// `{"error": ..., "message": ...}` object for api clients, the error page for browsers and the
+// plain error message otherwise
+func (server *Server) writeError(w http.ResponseWriter, r *http.Request, err ErrorResponse) {
 	var response []byte
-	accept := r.Header.Get("Accept")
 
-	if accept == "application/json" || strings.HasPrefix(accept, "application/vnd.padlock") {
+	switch negotiateErrorFormat(r.Header.Get("Accept")) {
+	case errorFormatJSON:
 		w.Header().Set("Content-Type", "application/json")
 		response = JsonifyErrorResponse(err)
-	} else if strings.Contains(accept, "text/html") {
+	case errorFormatHTML:
 		w.Header().Set("Content-Type", "text/html")
 		var buff bytes.Buffer
 		if err := server.Templates.ErrorPage.Execute(&buff, map[string]string{
@@ -211,6 +484,7 @@ func (server *Server) HandleError(e error, w http.ResponseWriter, r *http.Reques
 	}
 
 	if response == nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		response = []byte(err.Message())
 	}
 
@@ -218,29 +492,107 @@ func (server *Server) HandleError(e error, w http.ResponseWriter, r *http.Reques
 	w.Write(response)
 }
 
+// Responds to requests for unknown routes with a 404 error in the format preferred by the client
+func (server *Server) NotFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.HandleError(&UnsupportedEndpoint{r.URL.Path}, w, r)
+	})
+}
+
 // Registers handlers mapped by method for a given path
 func (server *Server) WrapEndpoint(endpoint *Endpoint) Handler {
+	h, _ := server.wrapEndpoint(endpoint)
+	return h
+}
+
+// Like `WrapEndpoint`, additionally returning the names of the applied middleware, outermost first
+func (server *Server) wrapEndpoint(endpoint *Endpoint) (Handler, []string) {
 	var h Handler = endpoint
+	var names []string
+
+	wrap := func(m MiddleWare) {
+		h = m.Wrap(h)
+		names = append([]string{reflect.TypeOf(m).Elem().Name()}, names...)
+	}
 
 	// If auth type is "web", wrap handler in csrf middleware
 	if endpoint.AuthType != "" {
-		h = (&CSRF{server}).Wrap(h)
+		wrap(&CSRF{server})
 	}
 
 	// Check for correct endpoint version
-	h = (&CheckEndpointVersion{server, endpoint.Version}).Wrap(h)
+	wrap(&CheckEndpointVersion{server, endpoint.Version})
 
 	// Wrap handler in auth middleware
-	h = (&Authenticate{server, endpoint.AuthType}).Wrap(h)
+	wrap(&Authenticate{server, endpoint.AuthType, endpoint.ClientCert})
+
+	// Reject modifying requests in read-only mode
+	wrap(&CheckReadOnly{server, endpoint.Writes})
+
+	// Reject requests until the server is fully initialized
+	wrap(&CheckStarting{server})
+
+	// Limit size of request body
+	maxBody := server.Config.MaxRequestBodyBytes
+	if endpoint.MaxBodyBytes != 0 {
+		maxBody = endpoint.MaxBodyBytes
+	}
+	wrap(&LimitRequestBody{maxBody})
 
 	// Check if Method is supported
-	h = (&CheckMethod{endpoint.Handlers}).Wrap(h)
+	wrap(&CheckMethod{endpoint.Handlers})
 
-	h = (&HandlePanic{}).Wrap(h)
+	// Make client certificate available to handlers
+	wrap(&ClientCertificate{})
 
-	h = (&HandleError{server}).Wrap(h)
+	// Reject plaintext requests if TLS is required
+	if server.Config.RequireTLS {
+		wrap(&RequireTLS{server})
+	}
 
-	return h
+	wrap(&HandlePanic{})
+
+	// Cancel requests exceeding the configured timeout. Wraps `HandlePanic` since the handler
+	// runs in a separate goroutine
+	if !endpoint.NoTimeout {
+		wrap(&RequestTimeout{server.Config.RequestTimeout})
+	}
+
+	wrap(&HandleError{server})
+
+	wrap(&CountInFlight{server.Metrics})
+
+	return h, names
+}
+
+// Wraps the endpoint registered under `path` in its middleware and, if tracing is enabled, in a
+// span named after the path. Also returns the names of the applied middleware, outermost first
+func (server *Server) routeHandler(path string, endpoint *Endpoint) (Handler, []string) {
+	h, names := server.wrapEndpoint(endpoint)
+	if server.Tracer != nil {
+		h = (&Trace{server.Tracer, path}).Wrap(h)
+		names = append([]string{"Trace"}, names...)
+	}
+	return h, names
+}
+
+// Creates a tls config that verifies client certificates against the CAs in `caFile`. Certificates
+// are optional on the connection level and only required by routes authenticating with them
+func clientCertTLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("padlock: no valid certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
 }
 
 // Registeres http handlers for various routes
@@ -256,6 +608,7 @@ func (server *Server) InitEndpoints() {
 			"POST": &RequestAuthToken{server},
 		},
 		Version: ApiVersion,
+		Writes:  []string{"PUT", "POST"},
 	}
 
 	// Endpoint for logging in / requesting api keys
@@ -264,6 +617,15 @@ func (server *Server) InitEndpoints() {
 			"GET":  &LoginPage{server},
 			"POST": &RequestAuthToken{server},
 		},
+		Writes: []string{"POST"},
+	}
+
+	// Endpoint for resending activation emails
+	server.Endpoints["/auth/resend/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"POST": &ResendActivation{server},
+		},
+		Writes: []string{"POST"},
 	}
 
 	// Endpoint for activating auth tokens
@@ -271,6 +633,7 @@ func (server *Server) InitEndpoints() {
 		Handlers: map[string]Handler{
 			"GET": &ActivateAuthToken{server},
 		},
+		Writes: []string{"GET"},
 	}
 
 	// Endpoint for reading / writing and deleting a store
@@ -283,6 +646,37 @@ func (server *Server) InitEndpoints() {
 		},
 		Version:  ApiVersion,
 		AuthType: "api",
+		// Devices syncing without user interaction may authenticate via client certificates
+		ClientCert: true,
+		Writes:     []string{"PUT", "DELETE"},
+	}
+
+	// Endpoint for retrieving the number of bytes stored for an account. Takes precedence over
+	// the vault of the same name, which is why "usage" is a reserved vault name
+	server.Endpoints["/store/usage"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET": &StoreUsage{server},
+		},
+		Version:  ApiVersion,
+		AuthType: "api",
+	}
+
+	// Endpoints for listing and revoking the auth tokens of the authenticated account
+	server.Endpoints["/auth/sessions"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET": &ListSessions{server},
+		},
+		Version:  ApiVersion,
+		AuthType: "api",
+	}
+
+	server.Endpoints["/auth/sessions/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"DELETE": &RevokeSession{server},
+		},
+		Version:  ApiVersion,
+		AuthType: "api",
+		Writes:   []string{"DELETE"},
 	}
 
 	server.Endpoints["/deletestore/"] = &Endpoint{
@@ -290,6 +684,7 @@ func (server *Server) InitEndpoints() {
 			"POST": &DeleteStore{server},
 		},
 		AuthType: "web",
+		Writes:   []string{"POST"},
 	}
 
 	// Dashboard for managing data, auth tokens etc.
@@ -306,6 +701,7 @@ func (server *Server) InitEndpoints() {
 			"GET": &Logout{server},
 		},
 		AuthType: "web",
+		Writes:   []string{"GET"},
 	}
 
 	// Endpoint for revoking auth tokens
@@ -314,14 +710,20 @@ func (server *Server) InitEndpoints() {
 			"POST": &Revoke{server},
 		},
 		AuthType: "web",
+		Writes:   []string{"POST"},
+	}
+
+	// Endpoint for retrieving version and build information
+	server.Endpoints["/version/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET": &VersionHandler{server},
+		},
 	}
 
+	static, _ := fs.Sub(server.Assets, "static")
 	server.Endpoints["/static/"] = &Endpoint{
 		Handlers: map[string]Handler{
-			"GET": NewStaticHandler(
-				filepath.Join(server.Config.AssetsPath, "static"),
-				"/static/",
-			),
+			"GET": NewStaticHandlerFS(static, "/static/"),
 		},
 	}
 
@@ -340,14 +742,90 @@ func (server *Server) InitHandler() {
 	mux := http.NewServeMux()
 
 	for key, endpoint := range server.Endpoints {
-		mux.Handle(key, HttpHandler(server.WrapEndpoint(endpoint)))
+		h, _ := server.routeHandler(key, endpoint)
+		mux.Handle(key, HttpHandler(h))
 	}
 
+	var h http.Handler = mux
 	if server.Config.Cors {
-		server.Handler = Cors(mux)
-	} else {
-		server.Handler = mux
+		h = server.Cors(h)
 	}
+	server.Handler = ServerHeaders(h, server.Config.ServerHeader, server.Config.VersionHeader)
+}
+
+// Applies the configured CORS policies to `handler`, along with the `DefaultCorsPolicies` not
+// overridden by them
+func (server *Server) Cors(handler http.Handler) http.Handler {
+	def, policies := server.corsPolicies()
+	return CorsWithPolicies(handler, def, policies)
+}
+
+// Returns the default CORS policy along with the policies in effect for specific path prefixes
+func (server *Server) corsPolicies() (*CorsPolicy, map[string]*CorsPolicy) {
+	policies := make(map[string]*CorsPolicy)
+	for prefix, p := range DefaultCorsPolicies {
+		policies[prefix] = p
+	}
+	for prefix, p := range server.Config.CorsPolicies {
+		policies[prefix] = p
+	}
+
+	origins := server.Config.CorsAllowedOrigins
+	if len(origins) == 0 {
+		origins = []string{"*"}
+	}
+
+	return &CorsPolicy{
+		AllowedOrigins:   origins,
+		MaxAge:           server.Config.CorsMaxAge,
+		AllowCredentials: server.Config.CorsAllowCredentials,
+	}, policies
+}
+
+// Records a security-relevant event in the audit log and notifies webhooks, if enabled
+func (server *Server) audit(r *http.Request, event string, email string, details string) {
+	if err := server.Audit.LogRequest(r, event, email, details); err != nil {
+		server.LogError(&ServerError{err}, r)
+	}
+	if err := server.Webhooks.Notify(&WebhookEvent{
+		Time:    server.now(),
+		Event:   event,
+		Email:   email,
+		Details: details,
+	}); err != nil {
+		server.LogError(&ServerError{err}, r)
+	}
+}
+
+// Sends an email in the background, logging any errors. Uses the sender's queue if it has one, in
+// which case an error is returned if the email couldn't be queued. Does nothing if email is disabled
+func (server *Server) sendEmail(r *http.Request, rec string, subject string, body string) error {
+	sender := server.Sender
+	if sender == nil {
+		return nil
+	}
+
+	_, span := startSpan(r.Context(), "email.send")
+	done := func(err error) {
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			server.LogError(&ServerError{err}, r)
+		}
+	}
+
+	if q, ok := sender.(QueueSender); ok {
+		if err := q.Queue(rec, subject, body, done); err != nil {
+			done(err)
+			return err
+		}
+		return nil
+	}
+
+	go func() {
+		done(sender.Send(rec, subject, body))
+	}()
+	return nil
 }
 
 func (server *Server) SendDeprecatedVersionEmail(r *http.Request) error {
@@ -368,33 +846,119 @@ func (server *Server) SendDeprecatedVersionEmail(r *http.Request) error {
 		email = r.PostFormValue("email")
 	}
 
-	if email != "" && !server.emailRateLimiter.RateLimit(getIp(r), email) {
+	if email != "" && !server.emailRateLimiter.RateLimitRequest(r, email) {
 		var buff bytes.Buffer
 		if err := server.Templates.DeprecatedVersionEmail.Execute(&buff, nil); err != nil {
 			return err
 		}
 		body := buff.String()
 
+		subject, err := server.emailSubject(server.EmailSubjects.DeprecatedVersion, r, email)
+		if err != nil {
+			return err
+		}
+
 		// Send email about deprecated api version
-		go func() {
-			if err := server.Sender.Send(email, "Please update your version of Padlock", body); err != nil {
-				server.LogError(&ServerError{err}, r)
-			}
-		}()
+		server.sendEmail(r, email, subject, body)
 	}
 
 	return nil
 }
 
+// Initializes the server. Needs to be called before `Start`
 func (server *Server) Init() error {
+	if err := server.initConfig(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	if err := server.checkEmail(); err != nil {
+		return err
+	}
+
+	return server.initStorage()
+}
+
+// Checks the connection to the mail server if `RequireEmailAtStartup` is set. Otherwise the mail
+// server is only contacted when the first email is sent
+func (server *Server) checkEmail() error {
+	if !server.Config.RequireEmailAtStartup {
+		return nil
+	}
+
+	if c, ok := server.Sender.(ConnectionChecker); ok {
+		if err := c.CheckConnection(); err != nil {
+			return fmt.Errorf("padlock: failed to connect to the mail server: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Health of the mail server as reported by the sender. Nil if the sender doesn't keep track of it
+// or email is disabled
+func (server *Server) EmailHealth() *EmailHealth {
+	if h, ok := server.Sender.(EmailHealthReporter); ok {
+		return h.Health()
+	}
+	return nil
+}
+
+// Checks whether the mail server can be reached. The health recorded by the sender is reused if it
+// was determined less than `emailReadinessInterval` ago, either by sending an email or by a previous
+// check. Returns nil if the sender doesn't support connection checks or email is disabled
+func (server *Server) checkEmailReadiness() *EmailHealth {
+	c, ok := server.Sender.(ConnectionChecker)
+	if !ok {
+		return nil
+	}
+
+	// Concurrent probes wait for a running check instead of contacting the mail server themselves
+	server.emailCheckMutex.Lock()
+	defer server.emailCheckMutex.Unlock()
+
+	h := server.EmailHealth()
+	if h != nil && h.Checked != nil && server.now().Sub(*h.Checked) < emailReadinessInterval {
+		return h
+	}
+
+	c.CheckConnection()
+	return server.EmailHealth()
+}
+
+// Current values of all operational gauges, including the mail server's health and the outcome
+// of the last backup
+func (server *Server) MetricsSnapshot() *MetricsSnapshot {
+	s := server.Metrics.Snapshot()
+	s.Email = server.EmailHealth()
+	s.Webhooks = server.Webhooks.Stats()
+	s.RateLimits = server.emailRateLimiter.StatsSnapshot()
+	s.Backup = server.Backuper.Stats()
+	return s
+}
+
+// Returns the current time from the server's clock or, if none is set, the system clock
+func (server *Server) now() time.Time {
+	return clockNow(server.Clock)
+}
+
+// Number of random bytes used for generating tokens, as configured via `ServerConfig.TokenBytes`
+func (server *Server) tokenBytes() int {
+	if n := server.Config.TokenBytes; n > 0 {
+		return n
+	}
+	return DefaultTokenBytes
+}
+
+// Validates the configuration and sets up everything not depending on the storage
+func (server *Server) initConfig() error {
 	var err error
 
 	if server.Config.Secret != "" {
-		if s, err := base64.StdEncoding.DecodeString(server.Config.Secret); err != nil {
-			server.secret = s
-		} else {
-			return err
+		s, err := base64.StdEncoding.DecodeString(server.Config.Secret)
+		if err != nil {
+			return fmt.Errorf("padlock: secret must be base64 encoded: %w", err)
 		}
+		server.secret = s
 	} else {
 		if key, err := randomBytes(32); err != nil {
 			return err
@@ -403,27 +967,162 @@ func (server *Server) Init() error {
 		}
 	}
 
+	if server.Config.ClientCAFile != "" {
+		if server.Config.TLSCert == "" || server.Config.TLSKey == "" {
+			return errors.New("padlock: client certificate authentication requires a tls certificate and key")
+		}
+
+		tlsConfig, err := clientCertTLSConfig(server.Config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	if server.Config.BaseUrl != "" {
+		if u, err := url.Parse(server.Config.BaseUrl); err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("padlock: base url must be an absolute url like 'https://example.com', got '%s'", server.Config.BaseUrl)
+		}
+	}
+
+	if n := server.Config.TokenBytes; n != 0 && n < DefaultTokenBytes {
+		return fmt.Errorf("padlock: token bytes must be at least %d, got %d", DefaultTokenBytes, n)
+	}
+
+	switch server.Config.TokenLimitPolicy {
+	case "", TokenLimitReject, TokenLimitEvict:
+	default:
+		return fmt.Errorf("padlock: token limit policy must be '%s' or '%s', got '%s'", TokenLimitReject, TokenLimitEvict, server.Config.TokenLimitPolicy)
+	}
+
+	for _, w := range server.Config.Webhooks.migrateDeprecated() {
+		server.Info.Printf("WARNING: %s\n", w)
+	}
+	if err := server.Config.Webhooks.Validate(); err != nil {
+		return err
+	}
+
+	if err := server.Config.Backup.Retry.Validate(); err != nil {
+		return err
+	}
+
+	// The email config isn't part of the server config, so it's reached through the sender
+	if s, ok := server.Sender.(*EmailSender); ok && s.Config != nil {
+		if err := s.Config.Retry.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := server.Config.AuthPolicy.Validate(); err != nil {
+		return err
+	}
+
+	if def, _ := server.corsPolicies(); def.Validate() != nil {
+		return def.Validate()
+	}
+	if err := validateCorsPolicies(server.Config.CorsPolicies); err != nil {
+		return err
+	}
+
+	if server.Config.DefaultAccount.RateLimit < 0 {
+		return fmt.Errorf("padlock: default account rate limit must not be negative, got %d", server.Config.DefaultAccount.RateLimit)
+	}
+
+	if server.Config.DefaultAccount.DataQuota < 0 {
+		return fmt.Errorf("padlock: default account data quota must not be negative, got %d", server.Config.DefaultAccount.DataQuota)
+	}
+
+	if server.Config.DisableEmail {
+		if !server.Config.DisableSignup {
+			return errors.New("padlock: disabling email requires disabling signup as well, since new accounts are activated via email")
+		}
+		server.Sender = nil
+	}
+
+	if server.Config.Admin.Addr != "" && server.Config.Admin.Key == "" {
+		return errors.New("padlock: an admin key is required for enabling the admin api")
+	}
+
+	server.SetReadOnly(server.Config.ReadOnly)
+
+	server.started = server.now()
+
+	if server.Config.AuditLog != "" {
+		server.Audit = &AuditLog{Path: server.Config.AuditLog, Clock: server.Clock}
+		if err := server.Audit.Open(); err != nil {
+			return err
+		}
+	}
+
+	if server.Assets == nil {
+		if server.Assets, err = OpenAssets(server.Config.AssetsPath, server.Config.AssetsFromEmbed); err != nil {
+			return err
+		}
+	}
+
+	if server.Webhooks == nil && len(server.Config.Webhooks.URLs) != 0 {
+		server.Webhooks = &Webhooks{Config: &server.Config.Webhooks, Error: server.Error}
+	}
+
+	if server.Tracer == nil && server.Config.Tracing.Enabled {
+		server.Tracer = NewTracer(NewOTLPExporter(&server.Config.Tracing), tracingExportInterval)
+		server.Tracer.Clock = server.Clock
+		server.Tracer.OnError = func(err error) {
+			server.Error.Printf("Failed to export traces: %v\n", err)
+		}
+	}
+	if server.Tracer != nil {
+		server.Storage = &TracedStorage{server.Storage}
+	}
+
 	server.InitEndpoints()
 
 	if server.Templates == nil {
+		templates, err := fs.Sub(server.Assets, "templates")
+		if err != nil {
+			return err
+		}
 		server.Templates = &Templates{}
 		// Load templates from assets directory
-		if err := LoadTemplates(server.Templates, filepath.Join(server.Config.AssetsPath, "templates")); err != nil {
+		if err := LoadTemplatesFS(server.Templates, templates); err != nil {
 			return err
 		}
 	}
 
+	return nil
+}
+
+// Opens the storage and sets up everything depending on it, which may take a while, e.g. when
+// recovering a large database
+func (server *Server) initStorage() error {
+	var err error
+
 	// Open storage
 	if err = server.Storage.Open(); err != nil {
 		return err
 	}
 
+	store, err := NewRateLimitStore(&server.Config.RateLimit)
+	if err != nil {
+		return err
+	}
+
+	allowlist, err := ParseIPAllowlist(server.Config.RateLimitAllowlist)
+	if err != nil {
+		return err
+	}
+
 	if rl, err := NewEmailRateLimiter(
-		RateQuota{PerMin(1), 5},
-		RateQuota{PerMin(1), 5},
+		store,
+		RateQuota{PerMin(emailRateLimitPerMin), emailRateLimitBurst},
+		RateQuota{PerMin(emailRateLimitPerMin), emailRateLimitBurst},
 	); err != nil {
 		return err
 	} else {
+		rl.Allowlist = allowlist
+		rl.Storage = server.Storage
+		rl.Clock = server.Clock
+		rl.Stats = &RateLimitStats{Log: server.Log.Debug}
 		server.emailRateLimiter = rl
 	}
 
@@ -442,8 +1141,8 @@ func (server *Server) Init() error {
 				if err := iter.Get(ar); err != nil {
 					server.Log.Error.Println("Error while cleaning auth requests:", err)
 				}
-				if ar.Created.Before(time.Now().Add(-24 * time.Hour)) {
-					if err := server.Storage.Delete(ar); err != nil {
+				if ar.Created.Before(server.now().Add(-authRequestMaxAge)) {
+					if err := server.Storage.Batch(deleteAuthRequestOps(ar)); err != nil {
 						server.Log.Error.Println("Error while cleaning auth requests:", err)
 					}
 					n = n + 1
@@ -458,6 +1157,57 @@ func (server *Server) Init() error {
 
 	server.cleanAuthRequests.Start(24 * time.Hour)
 
+	if err := server.InitBackups(); err != nil {
+		return err
+	}
+
+	server.InitTrash()
+
+	return nil
+}
+
+// Sets up backups if a backup destination or interval is configured. Backups are only created
+// periodically if an interval is provided; otherwise they can be triggered via the admin api
+func (server *Server) InitBackups() error {
+	config := server.Config.Backup
+	if config.Interval == 0 && config.Destination == "" {
+		return nil
+	}
+
+	storage, ok := unwrapStorage(server.Storage).(Backupable)
+	if !ok {
+		return errors.New("padlock: storage does not support backups")
+	}
+
+	dest, err := NewBackupDestination(config.Destination)
+	if err != nil {
+		return err
+	}
+
+	server.Backuper = &Backuper{
+		Storage:     storage,
+		Destination: dest,
+		Retention:   config.Retention,
+		Retry:       &server.Config.Backup.Retry,
+		Clock:       server.Clock,
+	}
+
+	if config.Interval == 0 {
+		return nil
+	}
+
+	server.backups = &Job{
+		Action: func() {
+			if name, err := server.Backuper.Run(); err != nil {
+				server.Log.Error.Println("Error while creating backup:", err)
+			} else {
+				server.Log.Info.Printf("Created backup %s", name)
+			}
+		},
+	}
+
+	server.backups.Start(config.Interval)
+
 	return nil
 }
 
@@ -465,33 +1215,130 @@ func (server *Server) CleanUp() error {
 	if server.cleanAuthRequests != nil {
 		server.cleanAuthRequests.Stop()
 	}
+	// Stop retrying a failed backup so a running backup job doesn't delay shutting down
+	if server.Backuper != nil {
+		server.Backuper.Close()
+	}
+	if server.backups != nil {
+		server.backups.Stop()
+	}
+	if server.purgeTrash != nil {
+		server.purgeTrash.Stop()
+	}
+	if server.admin != nil {
+		server.admin.Close()
+	}
+	if server.pprof != nil {
+		server.pprof.Close()
+	}
+	if server.internal != nil {
+		server.internal.Close()
+	}
+	if server.Audit != nil {
+		server.Audit.Close()
+	}
+	// Wait for queued webhook deliveries to be attempted
+	if server.Webhooks != nil {
+		server.Webhooks.Close()
+	}
+	if err := server.Tracer.Close(); err != nil {
+		server.Error.Printf("Failed to export traces: %v\n", err)
+	}
+	// Wait for queued emails to be sent
+	if c, ok := server.Sender.(io.Closer); ok {
+		c.Close()
+	}
 	return server.Storage.Close()
 }
 
 func (server *Server) Start() error {
 	defer server.CleanUp()
 
+	return server.serve()
+}
+
+// Like calling `Init` and `Start`, but starts accepting connections before the storage has been
+// opened. Until then, requests are answered with `503 Service Unavailable` and a `Retry-After`
+// header, giving load balancers a clean signal to wait
+func (server *Server) InitAndStart() error {
+	if err := server.initConfig(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	defer server.CleanUp()
+
+	if err := server.checkEmail(); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&server.starting, 1)
+
+	initErr := make(chan error, 1)
+	go func() {
+		err := server.initStorage()
+		if err != nil {
+			server.Stop(server.Timeout)
+		} else {
+			atomic.StoreInt32(&server.starting, 0)
+			server.Info.Println("Server initialized, now accepting requests")
+		}
+		initErr <- err
+	}()
+
+	err := server.serve()
+
+	// Make sure initialization is complete before cleaning up
+	if ierr := <-initErr; ierr != nil {
+		return ierr
+	}
+
+	return err
+}
+
+// Initializes the server and serves requests until `ctx` is cancelled, then shuts down gracefully,
+// waiting up to `Timeout` for active requests to finish. Unlike `InitAndStart`, no signals are
+// handled, making this suitable for embedding the server into other programs. Returns nil if
+// the server was stopped by cancelling `ctx`
+func (server *Server) Run(ctx context.Context) error {
+	server.NoSignalHandling = true
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			server.Stop(server.Timeout)
+		case <-done:
+		}
+	}()
+
+	return server.InitAndStart()
+}
+
+func (server *Server) serve() error {
 	server.InitHandler()
+	server.logStartupDetails()
 
-	port := server.Config.Port
-	tlsCert := server.Config.TLSCert
-	tlsKey := server.Config.TLSKey
+	if err := server.StartAdmin(); err != nil {
+		return err
+	}
 
-	server.Addr = fmt.Sprintf(":%d", port)
+	if err := server.StartPprof(); err != nil {
+		return err
+	}
 
-	// Start server
-	if tlsCert != "" && tlsKey != "" {
-		server.Info.Printf("Starting server with TLS on port %v", port)
-		server.Secure = true
-		return server.ListenAndServeTLS(tlsCert, tlsKey)
-	} else {
-		server.Info.Printf("Starting server on port %v", port)
-		return server.ListenAndServe()
+	if err := server.StartInternal(); err != nil {
+		return err
 	}
+
+	return server.serveListeners()
 }
 
 // Instantiates and initializes a new Server and returns a reference to it
 func NewServer(log *Log, storage Storage, sender Sender, config *ServerConfig) *Server {
+	// Default subjects always parse
+	subjects, _ := NewEmailSubjects(&EmailConfig{})
+
 	server := &Server{
 		Server: &graceful.Server{
 			Server:  &http.Server{},
@@ -501,6 +1348,10 @@ func NewServer(log *Log, storage Storage, sender Sender, config *ServerConfig) *
 		Storage: storage,
 		Sender:  sender,
 		Config:  config,
+		Metrics: &Metrics{},
+		Clock:   SystemClock{},
+
+		EmailSubjects: subjects,
 	}
 
 	// Hook up logger for http.Server
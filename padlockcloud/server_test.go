@@ -1,9 +1,11 @@
 package padlockcloud
 
 import "testing"
+import "encoding/base64"
 import "fmt"
 import "html/template"
 import "net/http"
+import "net"
 import "net/http/cookiejar"
 import "net/http/httptest"
 import "net/url"
@@ -14,6 +16,18 @@ import "bytes"
 import "encoding/json"
 import "errors"
 import "time"
+import "os"
+import "strings"
+import "path/filepath"
+import "context"
+import "math/big"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "encoding/pem"
 import "github.com/gorilla/csrf"
 
 const (
@@ -180,19 +194,21 @@ func (ctx serverTestContext) getCsrfToken() string {
 }
 
 func (ctx *serverTestContext) extractActivationLink() (string, error) {
+	recipient, _, message := ctx.sender.Last()
+
 	// Activation message should be sent to the correct email
-	if ctx.sender.Recipient != testEmail {
-		return "", fmt.Errorf("Expected activation message to be sent to %s, instead got %s", testEmail, ctx.sender.Recipient)
+	if recipient != testEmail {
+		return "", fmt.Errorf("Expected activation message to be sent to %s, instead got %s", testEmail, recipient)
 	}
 
 	// Activation message should contain a valid activation link
 	linkPattern := fmt.Sprintf("%s/activate/\\?t=%s", ctx.host, tokenPattern)
 	msgPattern := fmt.Sprintf("%s, %s", testEmail, linkPattern)
-	match, _ := regexp.MatchString(msgPattern, ctx.sender.Message)
+	match, _ := regexp.MatchString(msgPattern, message)
 	if !match {
-		return "", fmt.Errorf("Expected activation message to match \"%s\", got \"%s\"", msgPattern, ctx.sender.Message)
+		return "", fmt.Errorf("Expected activation message to match \"%s\", got \"%s\"", msgPattern, message)
 	}
-	link := regexp.MustCompile(linkPattern).FindString(ctx.sender.Message)
+	link := regexp.MustCompile(linkPattern).FindString(message)
 
 	return link, nil
 }
@@ -212,6 +228,7 @@ func newServerTestContext() *serverTestContext {
 		template.New(""),
 		template.Must(template.New("").Parse("{{ .token.Email }}, {{ .activation_link }}")),
 		template.Must(template.New("").Parse("")),
+		template.Must(template.New("").Parse("{{ .email }} is suspended. Reason: {{ .reason }}")),
 		template.Must(template.New("").Parse("<html>{{ .message }}</html>")),
 		template.Must(template.New("").Parse("login,{{ .email }},{{ .submitted }}")),
 		template.Must(template.New("").Parse("dashboard")),
@@ -742,9 +759,24 @@ func TestRevokeAuthToken(t *testing.T) {
 func TestMethodNotAllowed(t *testing.T) {
 	ctx := newServerTestContext()
 	// Requests with unsupported HTTP methods should return with 405 - method not allowed
-	if res, err := ctx.request("POST", ctx.host+"/store/", "", ApiVersion); err != nil {
-		t.Fatal(err)
-	} else {
+	// and list the supported methods in the `Allow` header
+	for _, c := range []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{"POST", "/store/", "DELETE, GET, HEAD, PUT"},
+		{"GET", "/auth/", "POST, PUT"},
+		{"DELETE", "/login/", "GET, POST"},
+		{"GET", "/revoke/", "POST"},
+	} {
+		res, err := ctx.request(c.method, ctx.host+c.path, "", ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allow := res.Header.Get("Allow"); allow != c.allow {
+			t.Errorf("%s %s: Expected Allow header '%s', got '%s'", c.method, c.path, c.allow, allow)
+		}
 		testError(t, res, &MethodNotAllowed{})
 	}
 }
@@ -764,7 +796,7 @@ func TestOutdatedVersion(t *testing.T) {
 
 	// The root path is a special case in that the only way to figure out if the client is using
 	// and older api version is if the Authorization header is using the 'ApiKey' authentication scheme
-	token, _ := token()
+	token, _ := token(DefaultTokenBytes)
 	req, _ := http.NewRequest("GET", ctx.host+"/", nil)
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s:%s", testEmail, token))
@@ -832,13 +864,77 @@ func TestErrorFormat(t *testing.T) {
 	testErr("", []byte(e.Message()))
 }
 
+func TestErrorFormatNegotiation(t *testing.T) {
+	for accept, format := range map[string]string{
+		"application/json":                          errorFormatJSON,
+		"application/vnd.padlock;version=1":         errorFormatJSON,
+		"application/json, text/plain, */*":         errorFormatJSON,
+		"text/html,application/xhtml+xml,*/*;q=0.8": errorFormatHTML,
+		"text/html;q=0.5, application/json;q=0.9":   errorFormatJSON,
+		"application/json;q=0.1, text/html":         errorFormatHTML,
+		"*/*":                                       errorFormatText,
+		"":                                          errorFormatText,
+	} {
+		if f := negotiateErrorFormat(accept); f != format {
+			t.Errorf("%s: Expected format %s, got %s", accept, format, f)
+		}
+	}
+
+	ctx := newServerTestContext()
+	ctx.server.Endpoints["/ratelimited/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET": HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+				return &RateLimitExceeded{}
+			}),
+		},
+	}
+	ctx.server.InitHandler()
+
+	ts := httptest.NewServer(ctx.server.Handler)
+	defer ts.Close()
+
+	request := func(method string, path string, accept string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		req.Header.Set("Accept", accept)
+		res, err := ctx.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for _, c := range []struct {
+		method string
+		path   string
+		err    ErrorResponse
+	}{
+		{"GET", "/unknown/route", &UnsupportedEndpoint{}},
+		{"GET", "/static/missing.css", &UnsupportedEndpoint{}},
+		{"DELETE", "/version/", &MethodNotAllowed{}},
+		{"GET", "/panic/", &ServerError{}},
+		{"GET", "/ratelimited/", &RateLimitExceeded{}},
+	} {
+		res := request(c.method, c.path, "application/json")
+		if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Expected json response, got %s", c.method, c.path, ct)
+		}
+		testError(t, res, c.err)
+
+		res = request(c.method, c.path, "text/html,application/xhtml+xml,*/*;q=0.8")
+		if ct := res.Header.Get("Content-Type"); ct != "text/html" {
+			t.Errorf("%s %s: Expected html response, got %s", c.method, c.path, ct)
+		}
+		testResponse(t, res, c.err.Status(), "^<html>"+regexp.QuoteMeta(c.err.Message())+"</html>$")
+	}
+}
+
 func TestEmailRateLimit(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode.")
 	}
 
 	initRL := func(ctx *serverTestContext) {
-		rl, _ := NewEmailRateLimiter(RateQuota{PerSec(1), 1}, RateQuota{PerSec(1), 1})
+		rl, _ := NewEmailRateLimiter(nil, RateQuota{PerSec(1), 1}, RateQuota{PerSec(1), 1})
 		ctx.server.emailRateLimiter = rl
 	}
 
@@ -903,6 +999,123 @@ func TestEmailRateLimit(t *testing.T) {
 		testResponse(t, res, http.StatusAccepted, "")
 	})
 
+	t.Run("allowlist", func(t *testing.T) {
+		var res *http.Response
+		var err error
+
+		t.Parallel()
+
+		ctx := newServerTestContext()
+		initRL(ctx)
+		ctx.server.emailRateLimiter.Allowlist, _ = ParseIPAllowlist([]string{"10.0.0.0/8"})
+
+		// Requests from allowlisted networks should never be limited
+		for i := 0; i < 5; i++ {
+			if res, err = request(ctx, "10.1.2.3", fmt.Sprintf("allowed%d", i)); err != nil {
+				t.Fatal(err)
+			}
+			testResponse(t, res, http.StatusAccepted, "")
+		}
+
+		// Other ips should still be limited
+		for i := 0; i < 2; i++ {
+			if res, err = request(ctx, "11.1.2.3", fmt.Sprintf("limited%d", i)); err != nil {
+				t.Fatal(err)
+			}
+			testResponse(t, res, http.StatusAccepted, "")
+		}
+		if res, err = request(ctx, "11.1.2.3", "limited2"); err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &RateLimitExceeded{})
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		var res *http.Response
+		var err error
+
+		t.Parallel()
+
+		ctx := newServerTestContext()
+		initRL(ctx)
+		ctx.server.Config.Admin.Key = testAdminKey
+		admin := httptest.NewServer(ctx.server.AdminHandler())
+		defer admin.Close()
+
+		for i := 0; i < 2; i++ {
+			if res, err = request(ctx, "12.1.2.3", "reset@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			testResponse(t, res, http.StatusAccepted, "")
+		}
+		if res, err = request(ctx, "12.1.2.3", "reset@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &RateLimitExceeded{})
+
+		// Clearing the limits of both the ip and the email should allow requests again
+		for _, key := range []string{"12.1.2.3", "reset@example.com"} {
+			if res, err = adminRequest(admin.URL, "DELETE", "/admin/ratelimits/"+key, "", testAdminKey); err != nil {
+				t.Fatal(err)
+			}
+			testResponse(t, res, http.StatusNoContent, "")
+		}
+
+		if res, err = request(ctx, "12.1.2.3", "reset@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusAccepted, "")
+	})
+
+	t.Run("account_override", func(t *testing.T) {
+		var res *http.Response
+		var err error
+
+		t.Parallel()
+
+		ctx := newServerTestContext()
+		initRL(ctx)
+		ctx.server.emailRateLimiter.Storage = ctx.server.Storage
+
+		for _, acc := range []*Account{{Email: "raised@example.com", RateLimit: 600}, {Email: "default@example.com"}} {
+			if err := ctx.server.Storage.Put(acc); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// An account with a raised limit should not be throttled where the default would
+		for i := 0; i < 5; i++ {
+			if res, err = request(ctx, fmt.Sprintf("1.2.3.%d", 10+i), "raised@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			testResponse(t, res, http.StatusAccepted, "")
+		}
+
+		// The override must not lift the ip quota
+		for i := 0; i < 2; i++ {
+			if res, err = request(ctx, "1.2.3.4", "raised@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			testResponse(t, res, http.StatusAccepted, "")
+		}
+		if res, err = request(ctx, "1.2.3.4", "raised@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &RateLimitExceeded{})
+
+		// Accounts without an override should still be subject to the default quota
+		for i := 0; i < 2; i++ {
+			if res, err = request(ctx, "1.2.3.5", "default@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			testResponse(t, res, http.StatusAccepted, "")
+		}
+		if res, err = request(ctx, "1.2.3.5", "default@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &RateLimitExceeded{})
+	})
+
 	t.Run("const_email", func(t *testing.T) {
 		var res *http.Response
 		var err error
@@ -943,3 +1156,1820 @@ func TestEmailRateLimit(t *testing.T) {
 	})
 
 }
+
+func TestReadOnlyMode(t *testing.T) {
+	var res *http.Response
+	var err error
+
+	ctx := newServerTestContext()
+
+	if _, err = ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, err = ctx.request("PUT", ctx.host+"/store/", testData, ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	ctx.server.SetReadOnly(true)
+
+	// Writes should be rejected
+	if res, err = ctx.request("PUT", ctx.host+"/store/", "other data", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &ServiceUnavailable{"The server is in read-only mode. Please try again later"})
+	if res.Header.Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header to be set")
+	}
+
+	if res, err = ctx.request("DELETE", ctx.host+"/store/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusServiceUnavailable, "")
+
+	if res, err = ctx.request("POST", ctx.host+"/auth/", url.Values{
+		"email": {testEmail},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusServiceUnavailable, "")
+
+	// Reads should still work
+	if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, fmt.Sprintf("^%s$", testData))
+
+	ctx.server.SetReadOnly(false)
+
+	// Writes should go through again after leaving read-only mode
+	if res, err = ctx.request("PUT", ctx.host+"/store/", testData, ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+}
+
+func TestReadOnlyModeGetWrites(t *testing.T) {
+	ctx := newServerTestContext()
+
+	if _, err := ctx.loginWeb(testEmail, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Request another auth token, activating it only once the server is read-only
+	res, err := ctx.request("POST", ctx.host+"/auth/", url.Values{
+		"email": {testEmail},
+		"type":  {"api"},
+	}.Encode(), ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusAccepted, "")
+	link, err := ctx.extractActivationLink()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.server.SetReadOnly(true)
+
+	// Activating and logging out modify data even though they are GET requests
+	for _, u := range []string{link, ctx.host + "/logout/"} {
+		if res, err = ctx.request("GET", u, "", 0); err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: Expected status %d in read-only mode, got %d", u, http.StatusServiceUnavailable, res.StatusCode)
+		}
+	}
+
+	acc, err := GetAccount(ctx.server.Storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.AuthTokens) != 1 {
+		t.Errorf("Expected the account to still have only the web token, has %d tokens", len(acc.AuthTokens))
+	}
+
+	// The session should still be valid
+	if res, err = ctx.request("GET", ctx.host+"/dashboard/", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "^dashboard$")
+}
+
+// Creates a self-signed CA certificate and a client certificate signed by it
+func newTestCertificates() (caPEM []byte, clientCert tls.Certificate, err error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	clientTemplate := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "device1"},
+		EmailAddresses: []string{testEmail},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caCert, &clientKey.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	clientCert = tls.Certificate{
+		Certificate: [][]byte{clientDER},
+		PrivateKey:  clientKey,
+	}
+	return
+}
+
+func TestClientCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caPEM, clientCert, err := newTestCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newServerTestContext()
+	ctx.server.Secure = true
+	ctx.server.Endpoints["/authtestcert/"] = &Endpoint{
+		AuthType: "cert",
+		Handlers: map[string]Handler{
+			"GET": HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+				fmt.Fprintf(w, "%s %s", ClientCertSubject(r), auth.Account().Email)
+				return nil
+			}),
+		},
+	}
+	ctx.server.InitHandler()
+
+	tlsConfig, err := clientCertTLSConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(ctx.server.Handler)
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+	ctx.host = ts.URL
+	ctx.client = ts.Client()
+
+	// Clients without a certificate can still connect and use auth tokens...
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ctx.request("GET", ctx.host+"/authtestapi/", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "")
+
+	// ...but are rejected by routes requiring a certificate
+	if res, err = ctx.request("GET", ctx.host+"/authtestcert/", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &InvalidAuthToken{})
+
+	client := ts.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+	// Make sure the certificate is presented on a new connection
+	transport.CloseIdleConnections()
+	ctx.client = client
+	ctx.authToken = nil
+
+	// The certificate identifies the account by its email address
+	if res, err = ctx.request("GET", ctx.host+"/authtestcert/", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "^CN=device1 "+regexp.QuoteMeta(testEmail)+"$")
+
+	// Routes accepting client certificates as well as auth tokens
+	if res, err = ctx.request("PUT", ctx.host+"/store/", testData, ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+	if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "^"+regexp.QuoteMeta(testData)+"$")
+
+	// Token-authenticated routes should still require an auth token
+	if res, err = ctx.request("GET", ctx.host+"/authtestapi/", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &InvalidAuthToken{})
+
+	// Certificates for unknown accounts should be rejected
+	if err := ctx.storage.Delete(&Account{Email: testEmail}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &InvalidAuthToken{})
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.MaxRequestBodyBytes = 100
+	ctx.server.InitHandler()
+	ts := httptest.NewServer(ctx.server.Handler)
+	defer ts.Close()
+	ctx.host = ts.URL
+
+	// Oversized request to auth endpoint should be rejected
+	res, err := ctx.request("POST", ctx.host+"/auth/", url.Values{
+		"email": {testEmail},
+		"pad":   {strings.Repeat("a", 200)},
+	}.Encode(), ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &RequestEntityTooLarge{})
+
+	// Requests within the limit should go through
+	if res, err = ctx.request("POST", ctx.host+"/auth/", url.Values{
+		"email": {testEmail},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusAccepted, "")
+
+	// Per-endpoint limits override the global limit
+	ctx.server.Endpoints["/store/"].MaxBodyBytes = 1000
+	ctx.server.InitHandler()
+	ts2 := httptest.NewServer(ctx.server.Handler)
+	defer ts2.Close()
+	ctx.host = ts2.URL
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = ctx.request("PUT", ctx.host+"/store/", strings.Repeat("a", 500), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+	if res, err = ctx.request("PUT", ctx.host+"/store/", strings.Repeat("a", 1500), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &RequestEntityTooLarge{})
+}
+
+func TestMultipleListeners(t *testing.T) {
+	ctx := newServerTestContext()
+
+	// Without explicit listeners, the legacy options should be translated into a single listener
+	ctx.server.Config.Port = 3000
+	if configs := ctx.server.listenerConfigs(); len(configs) != 1 || configs[0].Addr != ":3000" || configs[0].TLS {
+		t.Fatalf("Unexpected listeners: %+v", configs)
+	}
+
+	// Startup errors should be reported for all failing listeners
+	ctx.server.Config.Listeners = []ListenerConfig{{Addr: "invalid:addr:1"}, {Addr: "127.0.0.1:0", TLS: true}}
+	if _, err := ctx.server.openListeners(ctx.server.Config.Listeners); err == nil ||
+		!strings.Contains(err.Error(), "invalid:addr:1") || !strings.Contains(err.Error(), "TLS") {
+		t.Fatalf("Expected errors for both listeners, got %v", err)
+	}
+
+	ctx.server.Config.Listeners = []ListenerConfig{{Addr: "127.0.0.1:0"}, {Addr: "127.0.0.1:0"}}
+
+	done := make(chan error)
+	go func() {
+		done <- ctx.server.Start()
+	}()
+
+	var addrs []net.Addr
+	for i := 0; i < 100 && len(addrs) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		addrs = ctx.server.Addrs()
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("Expected 2 listeners, got %v", addrs)
+	}
+
+	for _, addr := range addrs {
+		res, err := http.Get(fmt.Sprintf("http://%s/authtestnoauth/", addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusOK, "")
+	}
+
+	ctx.server.Stop(time.Second)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not shut down")
+	}
+
+	for _, addr := range addrs {
+		if _, err := http.Get(fmt.Sprintf("http://%s/authtestnoauth/", addr)); err == nil {
+			t.Fatalf("Expected listener on %s to be closed", addr)
+		}
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, err := writeTestServerCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := func(h2c bool) (*serverTestContext, []net.Addr) {
+		ctx := newServerTestContext()
+		ctx.server.Config.TLSCert = certFile
+		ctx.server.Config.TLSKey = keyFile
+		ctx.server.Config.H2C = h2c
+		ctx.server.Config.Listeners = []ListenerConfig{{Addr: "127.0.0.1:0", TLS: true}, {Addr: "127.0.0.1:0"}}
+
+		go ctx.server.Start()
+
+		var addrs []net.Addr
+		for i := 0; i < 100 && len(addrs) < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+			addrs = ctx.server.Addrs()
+		}
+		if len(addrs) != 2 {
+			t.Fatalf("Expected 2 listeners, got %v", addrs)
+		}
+		return ctx, addrs
+	}
+
+	tlsClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	h2cProtocols := &http.Protocols{}
+	h2cProtocols.SetUnencryptedHTTP2(true)
+	h2cClient := &http.Client{Transport: &http.Transport{Protocols: h2cProtocols}}
+
+	ctx, addrs := start(false)
+
+	// HTTP/2 should be negotiated on TLS listeners
+	res, err := tlsClient.Get(fmt.Sprintf("https://%s/authtestnoauth/", addrs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 over TLS, got %s", res.Proto)
+	}
+	testResponse(t, res, http.StatusOK, "")
+
+	// Plain listeners shouldn't accept h2c unless enabled
+	if _, err := h2cClient.Get(fmt.Sprintf("http://%s/authtestnoauth/", addrs[1])); err == nil {
+		t.Error("Expected h2c request to fail while h2c is disabled")
+	}
+	ctx.server.Stop(time.Second)
+
+	ctx, addrs = start(true)
+	defer ctx.server.Stop(time.Second)
+
+	res, err = h2cClient.Get(fmt.Sprintf("http://%s/authtestnoauth/", addrs[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ProtoMajor != 2 {
+		t.Errorf("Expected h2c, got %s", res.Proto)
+	}
+	testResponse(t, res, http.StatusOK, "")
+
+	// HTTP/1.1 clients should still be served
+	if res, err = http.Get(fmt.Sprintf("http://%s/authtestnoauth/", addrs[1])); err != nil {
+		t.Fatal(err)
+	}
+	if res.ProtoMajor != 1 {
+		t.Errorf("Expected HTTP/1.1, got %s", res.Proto)
+	}
+	testResponse(t, res, http.StatusOK, "")
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.RequestTimeout = 50 * time.Millisecond
+
+	cancelled := make(chan struct{})
+	slow := HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+			return r.Context().Err()
+		case <-time.After(time.Second):
+			w.Write([]byte("too late"))
+			return nil
+		}
+	})
+	ctx.server.Endpoints["/slow/"] = &Endpoint{
+		Handlers: map[string]Handler{"GET": slow},
+	}
+	ctx.server.Endpoints["/fast/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET": HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+				w.Header().Set("X-Test", "fast")
+				w.WriteHeader(http.StatusAccepted)
+				w.Write([]byte("done"))
+				return nil
+			}),
+		},
+	}
+	ctx.server.Endpoints["/longpoll/"] = &Endpoint{
+		NoTimeout: true,
+		Handlers: map[string]Handler{
+			"GET": HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+				time.Sleep(100 * time.Millisecond)
+				w.Write([]byte("done"))
+				return nil
+			}),
+		},
+	}
+	ctx.server.InitHandler()
+
+	ts := httptest.NewServer(ctx.server.Handler)
+	defer ts.Close()
+
+	get := func(path string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Set("Accept", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	start := time.Now()
+	res := get("/slow/")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected request to time out after 50ms, took %v", elapsed)
+	}
+	testError(t, res, &ServiceUnavailable{"Request timed out"})
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Expected request context to be cancelled")
+	}
+
+	// Responses of handlers finishing in time should be passed through unchanged
+	res = get("/fast/")
+	if h := res.Header.Get("X-Test"); h != "fast" {
+		t.Errorf("Expected X-Test header to be passed through, got %q", h)
+	}
+	testResponse(t, res, http.StatusAccepted, "^done$")
+
+	// Exempted endpoints should not be affected
+	testResponse(t, get("/longpoll/"), http.StatusOK, "^done$")
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	ctx := newServerTestContext()
+
+	getInfo := func() *VersionInfo {
+		res, err := ctx.request("GET", ctx.host+"/version/", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := validateResponse(res, http.StatusOK, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected content type to be application/json, is %s", ct)
+		}
+		info := &VersionInfo{}
+		if err := json.Unmarshal(body, info); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	first := getInfo()
+	if first.Version != Version {
+		t.Errorf("Expected version to be %s, is %s", Version, first.Version)
+	}
+	if first.GoVersion == "" {
+		t.Error("Expected go version to be set")
+	}
+	if first.Started.IsZero() {
+		t.Error("Expected start time to be set")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	second := getInfo()
+	if second.Uptime <= first.Uptime {
+		t.Errorf("Expected uptime to increase, went from %v to %v", first.Uptime, second.Uptime)
+	}
+	if !second.Started.Equal(first.Started) {
+		t.Errorf("Expected start time to stay the same, went from %v to %v", first.Started, second.Started)
+	}
+}
+
+func TestAccountSuspension(t *testing.T) {
+	ctx := newServerTestContext()
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ctx.request("PUT", ctx.host+"/store/", testData, ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	if err := SetAccountSuspended(ctx.server.Storage, testEmail, true, "abuse"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Suspended accounts should neither be able to access their data...
+	suspended := &AccountSuspended{testEmail, "abuse"}
+	if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, suspended)
+
+	if res, err = ctx.request("PUT", ctx.host+"/store/", "new data", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, suspended)
+
+	// ...nor request new auth tokens. The response should look the same as for any other account
+	// while the owner is told about the suspension via email
+	ctx.sender.Reset()
+	if res, err = ctx.request("POST", ctx.host+"/auth/", url.Values{
+		"email": {testEmail},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusAccepted, "")
+	if ctx.sender.Recipient != testEmail || !strings.Contains(ctx.sender.Message, "Reason: abuse") ||
+		strings.Contains(ctx.sender.Message, "/activate/") {
+		t.Errorf("Expected the suspension reason to be emailed instead of an activation link, got %q", ctx.sender.Message)
+	}
+	var authRequests int
+	ctx.server.Storage.ListFunc(&AuthRequest{}, func(key string) error {
+		authRequests++
+		return nil
+	})
+	if authRequests != 0 {
+		t.Errorf("Expected no auth request to be stored for a suspended account, found %d", authRequests)
+	}
+
+	// Reinstated accounts should regain access to their untouched data
+	if err := SetAccountSuspended(ctx.server.Storage, testEmail, false, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "^"+testData+"$")
+}
+
+func TestDeletedAccountLogin(t *testing.T) {
+	ctx := newServerTestContext()
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ctx.request("PUT", ctx.host+"/store/", testData, ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	if err := ctx.server.DeleteAccount(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctx.server.Storage.Get(&DataStore{Account: &Account{Email: testEmail}}); err != ErrNotFound {
+		t.Errorf("Expected data to be deleted along with the account, got %v", err)
+	}
+
+	// Leftover data must not let the account log in again as a legacy account
+	if res, err = ctx.request("PUT", ctx.host+"/auth/", url.Values{
+		"email": {testEmail},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &AccountNotFound{testEmail})
+}
+
+func TestAuthTokenClientInfo(t *testing.T) {
+	ctx := newServerTestContext()
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err := GetAccount(ctx.server.Storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := acc.AuthTokens[0]
+
+	if at.IP != "127.0.0.1" {
+		t.Errorf("Expected ip to be 127.0.0.1, is %s", at.IP)
+	}
+	if !strings.HasPrefix(at.UserAgent, "Go-http-client") {
+		t.Errorf("Expected user agent to be recorded, got %q", at.UserAgent)
+	}
+	if at.Location != "" {
+		t.Errorf("Expected no location without a geo lookup, got %s", at.Location)
+	}
+
+	// Location should be populated if a geo lookup function is provided
+	ctx.server.GeoLookup = func(ip string) string {
+		return "Somewhere near " + ip
+	}
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	if acc, err = GetAccount(ctx.server.Storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+	for _, at := range acc.AuthTokens[2:] {
+		if at.Location != "Somewhere near 127.0.0.1" {
+			t.Errorf("Expected location to be populated for %s token, got %q", at.Type, at.Location)
+		}
+	}
+}
+
+func TestAuthTokenDeviceName(t *testing.T) {
+	ctx := newServerTestContext()
+
+	requestToken := func(email string, name string, ua string) *AuthToken {
+		req, err := http.NewRequest("POST", ctx.host+"/auth/", strings.NewReader(url.Values{
+			"email":       {email},
+			"device_name": {name},
+		}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", fmt.Sprintf("application/vnd.padlock;version=%d", ApiVersion))
+		req.Header.Set("User-Agent", ua)
+
+		res, err := ctx.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusAccepted, "")
+
+		ar, err := LatestAuthRequest(ctx.storage, email, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ar.AuthToken
+	}
+
+	// Supplied names should be stored, with whitespace cleaned up
+	if at := requestToken("a@padlock.io", "  Alice's\tiPhone\x00 ", "Padlock/2.0"); at.DeviceName != "Alice's iPhone" {
+		t.Errorf("Expected supplied device name to be stored, got %q", at.DeviceName)
+	}
+
+	// Overly long names should be cut off
+	if at := requestToken("b@padlock.io", strings.Repeat("x", 1000), ""); len(at.DeviceName) != maxDeviceNameLength {
+		t.Errorf("Expected device name to be limited to %d characters, got %d", maxDeviceNameLength, len(at.DeviceName))
+	}
+
+	// Without a name, one should be derived from the user agent
+	ua := "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/115.0"
+	if at := requestToken("c@padlock.io", "", ua); at.DeviceName != "Firefox on Windows" {
+		t.Errorf("Expected device name to be derived from user agent, got %q", at.DeviceName)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	ctx := newServerTestContext()
+	// Web tokens expire after a few milliseconds in tests, so time must stand still for the web
+	// sessions created along with the api tokens to stay listed. Storing an account prunes expired
+	// tokens as well, so the storage needs the same clock
+	clock := NewFakeClock(time.Now())
+	ctx.server.Clock = clock
+	ctx.storage.Clock = clock
+	defer func() {
+		ctx.server.Clock = SystemClock{}
+		ctx.storage.Clock = nil
+	}()
+
+	// Another account's token, which should neither be listed nor revokable
+	other, err := CreateAccount(ctx.storage, "other@padlock.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := NewAuthToken(other.Email, "api", DefaultTokenBytes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.AddAuthToken(otherToken)
+	if err := ctx.storage.Put(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// Log in from two devices
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	first := ctx.authToken
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method string, path string) *http.Response {
+		res, err := ctx.request(method, ctx.host+path, "", ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	listSessions := func() []*session {
+		res := request("GET", "/auth/sessions")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %s", res.Status)
+		}
+		var sessions []*session
+		if err := json.NewDecoder(res.Body).Decode(&sessions); err != nil {
+			t.Fatal(err)
+		}
+		return sessions
+	}
+
+	// Activating an api token logs the device into the dashboard as well
+	sessions := listSessions()
+	if len(sessions) != 4 {
+		t.Fatalf("Expected the caller's 4 sessions, got %d", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Id == otherToken.Id {
+			t.Errorf("Expected sessions of other accounts not to be listed")
+		}
+		if s.Current != (s.Id == ctx.authToken.Id) {
+			t.Errorf("Expected only the token used for the request to be marked as current, got %+v", s)
+		}
+		if s.Id == ctx.authToken.Id && (s.LastIP != "127.0.0.1" || s.LastUsed.IsZero() || s.Created.IsZero()) {
+			t.Errorf("Expected last used time and ip to be recorded, got %+v", s)
+		}
+	}
+
+	// Revoking another account's token must be rejected and leave it intact
+	testError(t, request("DELETE", "/auth/sessions/"+otherToken.Id), &NotFound{})
+	if acc, err := GetAccount(ctx.storage, other.Email); err != nil || len(acc.AuthTokens) != 1 {
+		t.Errorf("Expected other account's token to be kept, got %v", err)
+	}
+
+	// Revoking one of the caller's own sessions should log out that device only
+	testResponse(t, request("DELETE", "/auth/sessions/"+first.Id), http.StatusNoContent, "")
+	sessions = listSessions()
+	if len(sessions) != 3 {
+		t.Errorf("Expected 3 sessions to be left, got %d", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Id == first.Id {
+			t.Errorf("Expected session %s to be revoked", first.Id)
+		}
+	}
+
+	ctx.authToken = first
+	testError(t, request("GET", "/auth/sessions"), &InvalidAuthToken{})
+}
+
+func TestServerHeaders(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Endpoints["/leaky/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET": HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+				w.Header().Set("Server", "Go/1.0 (Linux)")
+				return nil
+			}),
+		},
+	}
+
+	get := func(serverHeader string, version bool, path string) http.Header {
+		ctx.server.Config.ServerHeader = serverHeader
+		ctx.server.Config.VersionHeader = version
+		ctx.server.InitHandler()
+		ts := httptest.NewServer(ctx.server.Handler)
+		defer ts.Close()
+
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.Header
+	}
+
+	// By default, neither handlers nor unknown routes should reveal anything about the server
+	for _, path := range []string{"/leaky/", "/unknown/"} {
+		if h := get("", false, path); h.Get("Server") != "" || h.Get("X-Padlock-Version") != "" {
+			t.Errorf("Expected identification headers to be suppressed for %s, got %v", path, h)
+		}
+	}
+
+	if h := get("Padlock Cloud", false, "/leaky/"); h.Get("Server") != "Padlock Cloud" || h.Get("X-Padlock-Version") != "" {
+		t.Errorf("Expected custom server header, got %v", h)
+	}
+
+	if h := get("", true, "/unknown/"); h.Get("X-Padlock-Version") != Version || h.Get("Server") != "" {
+		t.Errorf("Expected version header to be %s, got %v", Version, h)
+	}
+}
+
+func TestBaseUrl(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.BaseUrl = "https://cloud.example.com/"
+
+	if _, err := ctx.request("POST", ctx.host+"/auth/", url.Values{
+		"email": {testEmail},
+		"type":  {"api"},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	// Activation links should use the configured base url instead of the request host
+	if !strings.Contains(ctx.sender.Message, "https://cloud.example.com/activate/?t=") {
+		t.Errorf("Expected activation link to use the configured base url, got %q", ctx.sender.Message)
+	}
+
+	for _, baseUrl := range []string{"cloud.example.com", "/padlock", "https://"} {
+		ctx.server.Config.BaseUrl = baseUrl
+		if err := ctx.server.Init(); err == nil {
+			t.Errorf("Expected an error for base url %q", baseUrl)
+		}
+	}
+
+	// Configuring a secret shouldn't skip the remaining checks
+	ctx.server.Config.Secret = base64.StdEncoding.EncodeToString([]byte("secret"))
+	ctx.server.Config.BaseUrl = "cloud.example.com"
+	if err := ctx.server.Init(); err == nil {
+		t.Error("Expected an error for an invalid base url along with a secret")
+	}
+
+	ctx.server.Config.BaseUrl = ""
+	ctx.server.Config.Secret = "not base64!"
+	if err := ctx.server.Init(); err == nil {
+		t.Error("Expected an error for a secret that isn't base64 encoded")
+	}
+}
+
+// Storage that blocks in `Open` until `open` is closed
+type slowStorage struct {
+	*MemoryStorage
+	open chan struct{}
+}
+
+func (s *slowStorage) Open() error {
+	<-s.open
+	return s.MemoryStorage.Open()
+}
+
+func TestStartingState(t *testing.T) {
+	ctx := newServerTestContext()
+
+	storage := &slowStorage{&MemoryStorage{}, make(chan struct{})}
+	server := NewServer(ctx.server.Log, storage, &RecordSender{}, &ServerConfig{
+		Listeners: []ListenerConfig{{Addr: "127.0.0.1:0"}},
+	})
+	server.Templates = ctx.server.Templates
+	server.Assets = ctx.server.Assets
+
+	done := make(chan error)
+	go func() {
+		done <- server.InitAndStart()
+	}()
+	defer func() {
+		server.Stop(time.Second)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	var addrs []net.Addr
+	for i := 0; i < 100 && len(addrs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		addrs = server.Addrs()
+	}
+	if len(addrs) == 0 {
+		t.Fatal("Server did not start")
+	}
+	url := "http://" + addrs[0].String() + "/version/"
+
+	// Requests should be rejected while the storage is still being opened...
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code to be %d, is %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+	if ra := res.Header.Get("Retry-After"); ra != "10" {
+		t.Errorf("Expected Retry-After header to be 10, is %q", ra)
+	}
+
+	// ...and served normally once initialization is complete
+	close(storage.open)
+	for i := 0; i < 100 && server.Starting(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if res, err = http.Get(url); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code to be %d, is %d", http.StatusOK, res.StatusCode)
+	}
+}
+
+func TestServerRun(t *testing.T) {
+	ctx := newServerTestContext()
+
+	server := NewServer(ctx.server.Log, &MemoryStorage{}, &RecordSender{}, &ServerConfig{
+		Listeners: []ListenerConfig{{Addr: "127.0.0.1:0"}},
+	})
+	server.Templates = ctx.server.Templates
+	server.Assets = ctx.server.Assets
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- server.Run(runCtx)
+	}()
+
+	var addrs []net.Addr
+	for i := 0; i < 100 && (len(addrs) == 0 || server.Starting()); i++ {
+		time.Sleep(10 * time.Millisecond)
+		addrs = server.Addrs()
+	}
+	if len(addrs) == 0 {
+		t.Fatal("Server did not start")
+	}
+
+	res, err := http.Get("http://" + addrs[0].String() + "/version/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code to be %d, is %d", http.StatusOK, res.StatusCode)
+	}
+
+	// Cancelling the context should stop the server
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected Run to return cleanly, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancelling the context")
+	}
+
+	if _, err := http.Get("http://" + addrs[0].String() + "/version/"); err == nil {
+		t.Error("Expected server to stop accepting connections")
+	}
+}
+
+func TestBindHost(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.Port = 3000
+
+	for host, addr := range map[string]string{
+		"":          ":3000",
+		"127.0.0.1": "127.0.0.1:3000",
+		"::1":       "[::1]:3000",
+		"[::1]":     "[::1]:3000",
+		"fe80::1%2": "[fe80::1%2]:3000",
+	} {
+		ctx.server.Config.BindHost = host
+		if configs := ctx.server.listenerConfigs(); len(configs) != 1 || configs[0].Addr != addr {
+			t.Errorf("%q: Expected listener address %s, got %+v", host, addr, configs)
+		}
+	}
+
+	// The configured host should actually be bound to
+	ctx.server.Config.Port = 0
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		ctx.server.Config.BindHost = host
+		listeners, err := ctx.server.openListeners(ctx.server.listenerConfigs())
+		if err != nil {
+			if host == "::1" {
+				t.Logf("Skipping IPv6: %v", err)
+				continue
+			}
+			t.Fatal(err)
+		}
+		if ip := listeners[0].Addr().(*net.TCPAddr).IP; !ip.Equal(net.ParseIP(host)) {
+			t.Errorf("Expected listener to be bound to %s, is bound to %s", host, ip)
+		}
+		listeners[0].Close()
+	}
+}
+
+// Storage rejecting all writes as if the disk was full
+type fullStorage struct {
+	*MemoryStorage
+}
+
+func (s *fullStorage) Put(t Storable) error {
+	return ErrStorageFull
+}
+
+func (s *fullStorage) PutCtx(ctx context.Context, t Storable) error {
+	return ErrStorageFull
+}
+
+func (s *fullStorage) Batch(ops []BatchOp) error {
+	return ErrStorageFull
+}
+
+func (s *fullStorage) BatchCtx(ctx context.Context, ops []BatchOp) error {
+	return ErrStorageFull
+}
+
+func TestStorageFull(t *testing.T) {
+	ctx := newServerTestContext()
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	var errOut bytes.Buffer
+	ctx.server.Error.SetOutput(&errOut)
+	ctx.server.Storage = &fullStorage{ctx.server.Storage.(*MemoryStorage)}
+
+	// Writes should be rejected with a 507, which should only be reported once
+	for i := 0; i < 3; i++ {
+		res, err := ctx.request("PUT", ctx.host+"/store/", testData, ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &InsufficientStorage{})
+	}
+
+	if n := strings.Count(errOut.String(), "no space left"); n != 1 {
+		t.Errorf("Expected exactly one error notification, got %d: %s", n, errOut.String())
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		status int
+	}{
+		{ErrNotFound, http.StatusNotFound},
+		{ErrAccountExists, http.StatusConflict},
+		{ErrStorageClosed, http.StatusServiceUnavailable},
+		{ErrStorageLocked, http.StatusServiceUnavailable},
+		{ErrStorageFull, http.StatusInsufficientStorage},
+		{&AccountNotFound{testEmail}, http.StatusNotFound},
+		{errors.New("something else"), http.StatusInternalServerError},
+	} {
+		if status := toErrorResponse(c.err).Status(); status != c.status {
+			t.Errorf("%v: Expected status %d, got %d", c.err, c.status, status)
+		}
+	}
+
+	// Storage errors returned by handlers should be mapped centrally
+	ctx := newServerTestContext()
+	ctx.server.Endpoints["/closed/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET": HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+				return ErrStorageClosed
+			}),
+		},
+	}
+	ctx.server.InitHandler()
+
+	ts := httptest.NewServer(ctx.server.Handler)
+	defer ts.Close()
+
+	res, err := ctx.request("GET", ts.URL+"/closed/", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &StorageUnavailable{ErrStorageClosed})
+}
+
+func TestResendActivation(t *testing.T) {
+	ctx := newServerTestContext()
+	clock := NewFakeClock(time.Now())
+	ctx.server.Clock = clock
+	defer func() {
+		ctx.server.Clock = SystemClock{}
+	}()
+
+	resend := func(email string) {
+		res, err := ctx.request("POST", ctx.host+"/auth/resend/", url.Values{"email": {email}}.Encode(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusOK, "^$")
+	}
+
+	waitForEmail := func() {
+		for i := 0; i < 100; i++ {
+			if rec, _, _ := ctx.sender.Last(); rec != "" {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	expectNoEmail := func(msg string) {
+		time.Sleep(50 * time.Millisecond)
+		if rec, _, message := ctx.sender.Last(); rec != "" {
+			t.Fatalf("%s: Expected no email to be sent, got %q", msg, message)
+		}
+	}
+
+	// Missing email
+	res, err := ctx.request("POST", ctx.host+"/auth/resend/", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusBadRequest, "")
+
+	// Unknown emails should get the same response as known ones
+	resend("unknown@padlock.io")
+	expectNoEmail("unknown email")
+
+	if res, err = ctx.request("POST", ctx.host+"/auth/", url.Values{
+		"email": {testEmail},
+		"type":  {"api"},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusAccepted, "")
+	waitForEmail()
+	link1, err := ctx.extractActivationLink()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Resending right after the initial request should be prevented by the cooldown
+	ctx.sender.Reset()
+	resend(testEmail)
+	expectNoEmail("cooldown")
+
+	start := clock.Now()
+	clock.Advance(resendActivationCooldown)
+	resend(testEmail)
+	waitForEmail()
+	link2, err := ctx.extractActivationLink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link2 == link1 {
+		t.Fatal("Expected a new activation link to be generated")
+	}
+
+	// Resending shouldn't extend the lifetime of the request
+	ar, err := LatestAuthRequest(ctx.storage, testEmail, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ar.Created.Equal(start) || !ar.LastSent().Equal(clock.Now()) {
+		t.Errorf("Expected creation time to be kept, got created %v, last sent %v", ar.Created, ar.LastSent())
+	}
+
+	// The cooldown starts over with each resent email
+	ctx.sender.Reset()
+	resend(testEmail)
+	expectNoEmail("cooldown after resend")
+
+	// The old link should be invalidated, while the new one activates the original auth token
+	ctx.followRedirects(false)
+	if res, err = ctx.request("GET", link1, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusBadRequest, "")
+
+	if res, err = ctx.request("GET", link2, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusFound, "")
+
+	acc, err := GetAccount(ctx.storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.AuthTokensByType("api")) != 1 {
+		t.Errorf("Expected api token to be activated, got %+v", acc.AuthTokens)
+	}
+}
+
+func TestTokenBytes(t *testing.T) {
+	ctx := newServerTestContext()
+	defer func() {
+		ctx.server.Config.TokenBytes = 0
+	}()
+
+	pattern := regexp.MustCompile("^" + tokenPattern + "$")
+	for _, c := range []struct {
+		bytes  int
+		length int
+	}{
+		{0, 22},
+		{16, 22},
+		{32, 43},
+		{64, 86},
+	} {
+		ctx.server.Config.TokenBytes = c.bytes
+		if err := ctx.server.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		seen := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			at, err := NewAuthToken(testEmail, "api", ctx.server.tokenBytes(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(at.Token) != c.length || !pattern.MatchString(at.Token) {
+				t.Fatalf("Expected url-safe token of length %d for %d bytes, got %q", c.length, c.bytes, at.Token)
+			}
+			if seen[at.Token] {
+				t.Fatalf("Token %q was generated twice", at.Token)
+			}
+			seen[at.Token] = true
+		}
+	}
+
+	ctx.server.Config.TokenBytes = 8
+	if err := ctx.server.Init(); err == nil {
+		t.Error("Expected an error for less than 16 token bytes")
+	}
+}
+
+// Mock sender that fails to send any messages
+type failingSender struct{}
+
+func (s *failingSender) Send(rec string, subj string, message string) error {
+	return errors.New("mail server unreachable")
+}
+
+// Mock sender whose queue is always full
+type fullQueueSender struct{}
+
+func (s *fullQueueSender) Send(rec string, subj string, message string) error {
+	return ErrEmailQueueFull
+}
+
+func (s *fullQueueSender) Queue(rec string, subj string, message string, done func(error)) error {
+	return ErrEmailQueueFull
+}
+
+// Mock sender that doesn't finish sending until `release` is closed
+type blockingSender struct {
+	release chan struct{}
+}
+
+func (s *blockingSender) Send(rec string, subj string, message string) error {
+	<-s.release
+	return nil
+}
+
+func (s *blockingSender) SendCtx(ctx context.Context, rec string, subj string, message string) error {
+	select {
+	case <-s.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestEmailDeliveryFailure(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Sender = &failingSender{}
+
+	request := func(email string) *http.Response {
+		res, err := ctx.request("POST", ctx.host+"/auth/", url.Values{
+			"email":  {email},
+			"create": {"true"},
+		}.Encode(), ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	t.Run("keep", func(t *testing.T) {
+		// Delivery errors are only logged, the email is sent in the background
+		res := request("keep@padlock.io")
+		if body, err := validateResponse(res, http.StatusAccepted, ""); err != nil {
+			t.Error(err)
+		} else if bytes.Contains(body, []byte("emailError")) {
+			t.Errorf("Expected no email error, got %s", body)
+		}
+
+		if _, err := LatestAuthRequest(ctx.storage, "keep@padlock.io", nil); err != nil {
+			t.Errorf("Expected auth request to be kept, got %v", err)
+		}
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		// The auth request should be kept and the client told that the email wasn't sent
+		ctx.server.Sender = &fullQueueSender{}
+		defer func() {
+			ctx.server.Sender = &failingSender{}
+		}()
+
+		res := request("queue@padlock.io")
+		testResponse(t, res, http.StatusAccepted, "\"emailError\"")
+
+		if _, err := LatestAuthRequest(ctx.storage, "queue@padlock.io", nil); err != nil {
+			t.Errorf("Expected auth request to be kept, got %v", err)
+		}
+	})
+
+	t.Run("no wait", func(t *testing.T) {
+		// Requests shouldn't wait for the email to be delivered
+		sender := &blockingSender{make(chan struct{})}
+		ctx.server.Sender = sender
+		defer func() {
+			close(sender.release)
+			ctx.server.Sender = &failingSender{}
+		}()
+
+		res := request("nowait@padlock.io")
+		testResponse(t, res, http.StatusAccepted, "")
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		ctx.server.Config.FailSignupOnEmailError = true
+		defer func() {
+			ctx.server.Config.FailSignupOnEmailError = false
+		}()
+
+		res := request("fail@padlock.io")
+		testError(t, res, &EmailDeliveryFailed{})
+
+		if _, err := LatestAuthRequest(ctx.storage, "fail@padlock.io", nil); err != ErrNotFound {
+			t.Errorf("Expected auth request to be discarded, got %v", err)
+		}
+	})
+
+	t.Run("fail timeout", func(t *testing.T) {
+		// Waiting for the email is bounded by `signupEmailTimeout`
+		ctx.server.Config.FailSignupOnEmailError = true
+		sender := &blockingSender{make(chan struct{})}
+		ctx.server.Sender = sender
+		timeout := signupEmailTimeout
+		signupEmailTimeout = 20 * time.Millisecond
+		defer func() {
+			signupEmailTimeout = timeout
+			close(sender.release)
+			ctx.server.Sender = &failingSender{}
+			ctx.server.Config.FailSignupOnEmailError = false
+		}()
+
+		res := request("timeout@padlock.io")
+		testError(t, res, &EmailDeliveryFailed{})
+	})
+}
+
+func TestDisabledFeatures(t *testing.T) {
+	ctx := newServerTestContext()
+
+	request := func(path string, email string) *http.Response {
+		res, err := ctx.request("POST", ctx.host+path, url.Values{
+			"email": {email},
+		}.Encode(), ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if _, err := CreateAccount(ctx.storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("signup", func(t *testing.T) {
+		ctx.server.Config.DisableSignup = true
+		defer func() {
+			ctx.server.Config.DisableSignup = false
+		}()
+
+		testError(t, request("/auth/", "new@padlock.io"), &FeatureDisabled{"Signup"})
+		if _, err := LatestAuthRequest(ctx.storage, "new@padlock.io", nil); err != ErrNotFound {
+			t.Errorf("Expected no auth request to be created, got %v", err)
+		}
+
+		// Existing accounts should still be able to log in
+		testResponse(t, request("/auth/", testEmail), http.StatusAccepted, "")
+	})
+
+	t.Run("email", func(t *testing.T) {
+		ctx.server.Config.DisableSignup = true
+		ctx.server.Config.DisableEmail = true
+		defer func() {
+			ctx.server.Config.DisableSignup = false
+			ctx.server.Config.DisableEmail = false
+		}()
+
+		ctx.sender.Reset()
+		testError(t, request("/auth/", testEmail), &FeatureDisabled{"Email"})
+		testError(t, request("/auth/resend/", testEmail), &FeatureDisabled{"Email"})
+		if ctx.sender.Recipient != "" {
+			t.Errorf("Expected no email to be sent, got one for %s", ctx.sender.Recipient)
+		}
+	})
+
+	t.Run("config", func(t *testing.T) {
+		logger := &Log{Config: &LogConfig{}}
+		logger.Init()
+		logger.Info.SetOutput(ioutil.Discard)
+		logger.Error.SetOutput(ioutil.Discard)
+
+		// Disabling email requires disabling signup
+		server := NewServer(logger, &MemoryStorage{}, nil, &ServerConfig{DisableEmail: true})
+		if err := server.Init(); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("Expected invalid config error, got %v", err)
+		}
+
+		// The server should start without a sender if email is disabled
+		server = NewServer(logger, &MemoryStorage{}, nil, &ServerConfig{DisableEmail: true, DisableSignup: true})
+		server.Templates = ctx.server.Templates
+		if err := server.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer server.CleanUp()
+		server.InitHandler()
+
+		ts := httptest.NewServer(server.Handler)
+		defer ts.Close()
+
+		res, err := ctx.request("POST", ts.URL+"/auth/", url.Values{"email": {testEmail}}.Encode(), ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &FeatureDisabled{"Email"})
+	})
+}
+
+func TestEmailHealth(t *testing.T) {
+	// Get an address nothing is listening on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	logger := &Log{Config: &LogConfig{}}
+	logger.Init()
+	logger.Info.SetOutput(ioutil.Discard)
+	logger.Error.SetOutput(ioutil.Discard)
+
+	newServer := func(config *ServerConfig) *Server {
+		sender := &EmailSender{Config: &EmailConfig{Server: host, Port: port, DialTimeout: time.Second}}
+		server := NewServer(logger, &MemoryStorage{}, sender, config)
+		server.Templates = newServerTestContext().server.Templates
+		return server
+	}
+
+	// Requiring email at startup should fail with an unreachable mail server
+	server := newServer(&ServerConfig{RequireEmailAtStartup: true})
+	if err := server.Init(); err == nil {
+		t.Error("Expected init to fail with an unreachable mail server")
+	}
+	server.CleanUp()
+
+	// By default, the server should start anyway and report the mail server as unhealthy once
+	// sending an email failed
+	server = newServer(&ServerConfig{})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.CleanUp()
+
+	if h := server.EmailHealth(); h.Status != EmailHealthUnknown {
+		t.Errorf("Expected email health to be unknown before the first email, got %s", h.Status)
+	}
+
+	if err := server.Sender.Send(testEmail, "subject", "message"); err == nil {
+		t.Fatal("Expected sending to fail")
+	}
+
+	ts := httptest.NewServer(server.InternalHandler())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, `"email":\{"status":"unhealthy","error":"[^"]+"`)
+
+	res, err = http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "^ok\nemail unhealthy: ")
+}
+
+func TestEmailReadiness(t *testing.T) {
+	// Get an address nothing is listening on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx := newServerTestContext()
+	sender := &EmailSender{Config: &EmailConfig{Server: host, Port: port, DialTimeout: time.Second}, Clock: clock}
+	ctx.server.Sender = sender
+	ctx.server.Clock = clock
+
+	ts := httptest.NewServer(ctx.server.InternalHandler())
+	defer ts.Close()
+
+	healthz := func() *http.Response {
+		res, err := http.Get(ts.URL + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Without the gate, the mail server isn't checked
+	testResponse(t, healthz(), http.StatusOK, "^ok$")
+	if h := sender.Health(); h.Status != EmailHealthUnknown {
+		t.Errorf("Expected mail server not to be checked, got %s", h.Status)
+	}
+
+	ctx.server.Config.RequireEmailForReadiness = true
+	defer func() {
+		ctx.server.Config.RequireEmailForReadiness = false
+	}()
+
+	testResponse(t, healthz(), http.StatusServiceUnavailable, "email unhealthy: ")
+	checked := *sender.Health().Checked
+
+	// The result should be cached for a while
+	clock.Advance(emailReadinessInterval / 2)
+	testResponse(t, healthz(), http.StatusServiceUnavailable, "email unhealthy: ")
+	if c := *sender.Health().Checked; !c.Equal(checked) {
+		t.Errorf("Expected cached result to be used, but mail server was checked again at %v", c)
+	}
+
+	clock.Advance(emailReadinessInterval)
+	testResponse(t, healthz(), http.StatusServiceUnavailable, "email unhealthy: ")
+	if c := *sender.Health().Checked; !c.After(checked) {
+		t.Error("Expected mail server to be checked again once the cached result expired")
+	}
+}
+
+func TestMaxTokensPerAccount(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.MaxTokensPerAccount = 2
+	defer func() {
+		ctx.server.Config.MaxTokensPerAccount = 0
+		ctx.server.Config.TokenLimitPolicy = ""
+	}()
+
+	acc := &Account{Email: testEmail}
+	old, _ := NewAuthToken(testEmail, "api", DefaultTokenBytes, nil)
+	old.LastUsed = time.Now().Add(-time.Hour)
+	recent, _ := NewAuthToken(testEmail, "api", DefaultTokenBytes, nil)
+	acc.AddAuthToken(old)
+	acc.AddAuthToken(recent)
+	if err := ctx.storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	tokenIds := func() map[string]bool {
+		acc := &Account{Email: testEmail}
+		if err := ctx.storage.Get(acc); err != nil {
+			t.Fatal(err)
+		}
+		ids := map[string]bool{}
+		for _, t := range acc.AuthTokens {
+			ids[t.Id] = true
+		}
+		return ids
+	}
+
+	activate := func() (*AuthRequest, error) {
+		authRequest, _ := NewAuthRequest(testEmail, "api", DefaultTokenBytes, nil)
+		if err := ctx.storage.Put(authRequest); err != nil {
+			t.Fatal(err)
+		}
+		h := &ActivateAuthToken{ctx.server}
+		return authRequest, h.Activate(authRequest, httptest.NewRequest("GET", "/activate/", nil))
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		ctx.server.Config.TokenLimitPolicy = TokenLimitReject
+
+		if _, err := activate(); err == nil {
+			t.Fatal("Expected new token to be rejected")
+		} else if _, ok := err.(*TooManyAuthTokens); !ok {
+			t.Fatalf("Expected TooManyAuthTokens error, got %v", err)
+		}
+
+		if ids := tokenIds(); len(ids) != 2 {
+			t.Errorf("Expected account to still have 2 auth tokens, has %d", len(ids))
+		}
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		ctx.server.Config.TokenLimitPolicy = TokenLimitEvict
+
+		authRequest, err := activate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := tokenIds()
+		if len(ids) != 2 {
+			t.Errorf("Expected account to have 2 auth tokens, has %d", len(ids))
+		}
+		if ids[old.Id] {
+			t.Error("Expected least recently used token to be evicted")
+		}
+		if !ids[recent.Id] {
+			t.Error("Expected recently used token to be kept")
+		}
+		if !ids[authRequest.AuthToken.Id] {
+			t.Error("Expected new token to be added")
+		}
+	})
+}
+
+func TestRequireTLS(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.RequireTLS = true
+	ctx.server.Config.BaseUrl = "https://padlock.example.com"
+	ctx.server.InitHandler()
+
+	plain := httptest.NewServer(ctx.server.Handler)
+	defer plain.Close()
+
+	req, _ := http.NewRequest("GET", plain.URL+"/store/?foo=bar", nil)
+	req.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &TLSRequired{"https://padlock.example.com/store/?foo=bar"})
+	if res.StatusCode != http.StatusUpgradeRequired || res.Header.Get("Upgrade") == "" {
+		t.Errorf("Expected 426 response with Upgrade header, got %d, %v", res.StatusCode, res.Header)
+	}
+
+	// Requests over TLS should be handled as usual
+	secure := httptest.NewTLSServer(ctx.server.Handler)
+	defer secure.Close()
+
+	res, err = secure.Client().Get(secure.URL + "/version/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected requests over TLS to be accepted, got %d", res.StatusCode)
+	}
+
+	// Without a https base url, the request's host should be used
+	ctx.server.Config.BaseUrl = ""
+	ctx.server.Config.Listeners = []ListenerConfig{{Addr: ":80"}, {Addr: ":8443", TLS: true}}
+	r := httptest.NewRequest("GET", "http://padlock.example.com/auth/", nil)
+	if u := (&RequireTLS{ctx.server}).httpsUrl(r); u != "https://padlock.example.com:8443/auth/" {
+		t.Errorf("Expected https url with port of TLS listener, got %s", u)
+	}
+}
+
+func TestRequestAuthTokenContentTypes(t *testing.T) {
+	ctx := newServerTestContext()
+
+	post := func(contentType string, body string) *http.Response {
+		req, _ := http.NewRequest("POST", ctx.host+"/auth/", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Accept", fmt.Sprintf("application/vnd.padlock;version=%d", ApiVersion))
+		res, err := ctx.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for _, c := range []struct {
+		contentType string
+		body        string
+	}{
+		{"application/x-www-form-urlencoded", url.Values{
+			"email":       {testEmail},
+			"type":        {"web"},
+			"device_name": {"Alice's iPhone"},
+		}.Encode()},
+		{"application/json; charset=utf-8", `{"email":"` + testEmail + `","type":"web","device_name":"Alice's iPhone"}`},
+	} {
+		testResponse(t, post(c.contentType, c.body), http.StatusAccepted, "")
+
+		authRequest, err := LatestAuthRequest(ctx.storage, testEmail, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if at := authRequest.AuthToken; at.Type != "web" || at.DeviceName != "Alice's iPhone" {
+			t.Errorf("Expected %s body to be handled like the others, got type '%s' and device name '%s'",
+				c.contentType, at.Type, at.DeviceName)
+		}
+		if err := ctx.storage.Delete(authRequest); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testError(t, post("application/json", `{"email":`), &BadRequest{"invalid json body"})
+	testError(t, post("text/plain", testEmail), &UnsupportedMediaType{"text/plain"})
+}
+
+func TestDefaultAccount(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.DefaultAccount = DefaultAccountConfig{RateLimit: 30, DataQuota: 1000, Tags: map[string]string{"plan": "free"}}
+	defer func() {
+		ctx.server.Config.DefaultAccount = DefaultAccountConfig{}
+	}()
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err := GetAccount(ctx.storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.RateLimit != 30 || acc.DataQuota != 1000 || acc.Tags["plan"] != "free" {
+		t.Errorf("Expected new account to inherit defaults, got rate limit %d, data quota %d and tags %v", acc.RateLimit, acc.DataQuota, acc.Tags)
+	}
+
+	// Defaults should only be applied when the account is created
+	if err := SetAccountRateLimit(ctx.storage, testEmail, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if acc, err = GetAccount(ctx.storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if acc.RateLimit != 0 {
+		t.Errorf("Expected existing account to be left untouched, got rate limit %d", acc.RateLimit)
+	}
+}
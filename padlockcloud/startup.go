@@ -0,0 +1,111 @@
+package padlockcloud
+
+import "fmt"
+import "sort"
+import "strings"
+
+// Formats a CORS policy for logging
+func formatCorsPolicy(p *CorsPolicy) string {
+	if p == nil || len(p.AllowedOrigins) == 0 {
+		return "no origins allowed"
+	}
+	return fmt.Sprintf("origins=%s max_age=%s credentials=%t",
+		strings.Join(p.AllowedOrigins, ","), p.MaxAge, p.AllowCredentials)
+}
+
+// Logs the middleware chain, routes, rate limits, CORS policies and feature toggles in effect, so
+// it's clear how requests are going to be handled. Only logs anything at the debug level
+func (server *Server) logStartupDetails() {
+	if !server.Log.DebugEnabled() {
+		return
+	}
+
+	outer := []string{"ServerHeaders"}
+	if server.Config.Cors {
+		outer = append(outer, "Cors")
+	}
+	server.Debug.Printf("Middleware chain (outermost first): %s, followed by the route middleware below",
+		strings.Join(outer, ", "))
+
+	var paths []string
+	for path := range server.Endpoints {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		endpoint := server.Endpoints[path]
+
+		var methods, limited []string
+		for method, h := range endpoint.Handlers {
+			methods = append(methods, method)
+			if _, ok := h.(emailRateLimitedHandler); ok {
+				limited = append(limited, method)
+			}
+		}
+		sort.Strings(methods)
+		sort.Strings(limited)
+
+		auth := endpoint.AuthType
+		if auth == "" {
+			auth = "none"
+		}
+		rateLimited := "none"
+		if len(limited) != 0 {
+			rateLimited = strings.Join(limited, ",")
+		}
+
+		_, middleware := server.routeHandler(path, endpoint)
+		server.Debug.Printf("Route %s: methods=%s auth=%s rate_limited=%s middleware=%s", path,
+			strings.Join(methods, ","), auth, rateLimited, strings.Join(middleware, ","))
+	}
+
+	server.Debug.Printf("Email rate limit: %d/min per ip address and per email, burst %d",
+		emailRateLimitPerMin, emailRateLimitBurst)
+	if perMin := server.Config.DefaultAccount.RateLimit; perMin > 0 {
+		server.Debug.Printf("Default account rate limit: %d/min", perMin)
+	}
+	if len(server.Config.RateLimitAllowlist) != 0 {
+		server.Debug.Printf("Rate limit allowlist: %s", strings.Join(server.Config.RateLimitAllowlist, ", "))
+	}
+
+	if !server.Config.Cors {
+		server.Debug.Printf("CORS: disabled")
+	} else {
+		def, policies := server.corsPolicies()
+		server.Debug.Printf("CORS default policy: %s", formatCorsPolicy(def))
+
+		var prefixes []string
+		for prefix := range policies {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			server.Debug.Printf("CORS policy for %s: %s", prefix, formatCorsPolicy(policies[prefix]))
+		}
+	}
+
+	features := map[string]bool{
+		"admin_api":          server.Config.Admin.Addr != "",
+		"audit_log":          server.Config.AuditLog != "",
+		"client_certificate": server.Config.ClientCAFile != "",
+		"data_versions":      server.Config.DataVersions > 0,
+		"disable_email":      server.Config.DisableEmail,
+		"disable_signup":     server.Config.DisableSignup,
+		"h2c":                server.Config.H2C,
+		"internal_listener":  server.Config.InternalBindAddr != "",
+		"pprof":              server.Config.PprofAddr != "",
+		"proxy_protocol":     server.Config.ProxyProtocol,
+		"read_only":          server.ReadOnly(),
+		"require_tls":        server.Config.RequireTLS,
+		"tracing":            server.Tracer != nil,
+		"trash":              server.Config.TrashRetention > 0,
+		"webhooks":           len(server.Config.Webhooks.URLs) != 0,
+	}
+	var toggles []string
+	for name, enabled := range features {
+		toggles = append(toggles, fmt.Sprintf("%s=%t", name, enabled))
+	}
+	sort.Strings(toggles)
+	server.Debug.Printf("Features: %s", strings.Join(toggles, " "))
+}
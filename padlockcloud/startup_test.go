@@ -0,0 +1,80 @@
+package padlockcloud
+
+import "bytes"
+import "log"
+import "strings"
+import "testing"
+
+func TestLogStartupDetails(t *testing.T) {
+	ctx := newServerTestContext()
+
+	var out bytes.Buffer
+	ctx.server.Debug = log.New(&out, "DEBUG: ", 0)
+
+	ctx.server.Config.Cors = true
+	ctx.server.Config.CorsPolicies = map[string]*CorsPolicy{
+		"/auth/": &CorsPolicy{AllowedOrigins: []string{"https://app.padlock.io"}},
+	}
+	ctx.server.Config.DefaultAccount.RateLimit = 30
+	ctx.server.Config.RateLimitAllowlist = []string{"10.0.0.0/8"}
+	ctx.server.Config.ReadOnly = true
+	ctx.server.SetReadOnly(true)
+
+	// Nothing should be logged unless the log level is debug
+	ctx.server.logStartupDetails()
+	if out.Len() != 0 {
+		t.Fatalf("Expected nothing to be logged at info level, got:\n%s", out.String())
+	}
+
+	ctx.server.Log.Config.Level = LogLevelDebug
+	defer func() { ctx.server.Log.Config.Level = "" }()
+	ctx.server.logStartupDetails()
+
+	for _, line := range []string{
+		"DEBUG: Middleware chain (outermost first): ServerHeaders, Cors, followed by the route middleware below",
+		"DEBUG: Route /auth/: methods=POST,PUT auth=none rate_limited=POST,PUT middleware=CountInFlight,HandleError,RequestTimeout,",
+		"DEBUG: Route /login/: methods=GET,POST auth=none rate_limited=POST middleware=",
+		"DEBUG: Route /store/: methods=DELETE,GET,HEAD,PUT auth=api rate_limited=DELETE middleware=",
+		"DEBUG: Default account rate limit: 30/min",
+		"DEBUG: Rate limit allowlist: 10.0.0.0/8",
+		"DEBUG: CORS default policy: origins=*",
+		"DEBUG: CORS policy for /admin/: no origins allowed",
+		"DEBUG: CORS policy for /auth/: origins=https://app.padlock.io",
+		"read_only=true",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected startup log to contain %q, got:\n%s", line, out.String())
+		}
+	}
+
+	// Tracing is applied per route, outside of the endpoint middleware
+	ctx.server.Tracer = NewTracer(&memorySpanExporter{}, 0)
+	defer func() { ctx.server.Tracer = nil }()
+	out.Reset()
+	ctx.server.logStartupDetails()
+
+	for _, line := range []string{
+		"DEBUG: Middleware chain (outermost first): ServerHeaders, Cors, followed by the route middleware below",
+		"DEBUG: Route /auth/: methods=POST,PUT auth=none rate_limited=POST,PUT middleware=Trace,CountInFlight,HandleError,",
+		",CheckEndpointVersion\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected startup log to contain %q, got:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	if err := (&LogConfig{Level: "verbose"}).ValidateLevel(); err == nil {
+		t.Error("Expected unknown log level to be rejected")
+	}
+
+	l := NewLog(&LogConfig{}, nil)
+	if l.DebugEnabled() {
+		t.Error("Expected debug messages to be disabled by default")
+	}
+	l = NewLog(&LogConfig{Level: LogLevelDebug}, nil)
+	if !l.DebugEnabled() || l.Debug == nil {
+		t.Error("Expected debug messages to be enabled")
+	}
+}
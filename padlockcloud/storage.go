@@ -2,10 +2,28 @@ package padlockcloud
 
 import "reflect"
 import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path"
+import "archive/tar"
+import "compress/gzip"
+import "encoding/hex"
+import "syscall"
+import "time"
+import "context"
+import "sort"
+import "strings"
 import "encoding/json"
 import "path/filepath"
 import "github.com/syndtr/goleveldb/leveldb"
 import "github.com/syndtr/goleveldb/leveldb/iterator"
+import lderrors "github.com/syndtr/goleveldb/leveldb/errors"
+import "github.com/syndtr/goleveldb/leveldb/opt"
+import "github.com/syndtr/goleveldb/leveldb/filter"
+import "github.com/syndtr/goleveldb/leveldb/storage"
+import "github.com/syndtr/goleveldb/leveldb/util"
 
 // Error singletons
 var (
@@ -13,10 +31,43 @@ var (
 	ErrUnregisteredStorable = errors.New("padlock: unregistered storable type")
 	// An object was not found
 	ErrNotFound = errors.New("padlock: not found")
+	// An object conflicts with an existing one
+	ErrConflict = errors.New("padlock: conflict")
+	// The storage can't be accessed at the moment
+	ErrStorageUnavailable = errors.New("padlock: storage unavailable")
 	// A query was attempted on a closed storage
-	ErrStorageClosed = errors.New("padlock: storage closed")
+	ErrStorageClosed = &kindError{"padlock: storage closed", ErrStorageUnavailable}
+	// An operation requiring an empty storage was attempted on a non-empty one
+	ErrStorageNotEmpty = errors.New("padlock: storage not empty")
+	// The storage is currently held open by another process
+	ErrStorageLocked = &kindError{"padlock: storage locked by another process", ErrStorageUnavailable}
+	// A write failed because there is no space left on the device
+	ErrStorageFull = errors.New("padlock: no space left on device")
 )
 
+// Error with a specific message that is still recognized as one of the generic errors above (e.g.
+// `ErrNotFound` or `ErrStorageUnavailable`) by `errors.Is`
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// Translates write errors caused by a full disk into `ErrStorageFull`
+func writeError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return ErrStorageFull
+	}
+	return err
+}
+
 func typeFromStorable(t Storable) reflect.Type {
 	return reflect.TypeOf(t).Elem()
 }
@@ -33,6 +84,30 @@ type Storable interface {
 	Deserialize([]byte) error
 }
 
+// Storable types implementing this interface have their timestamps updated
+// with the current time whenever they are written to the store
+type Timestamped interface {
+	Touch(time.Time)
+}
+
+const preserveTimestampsContextKey contextKey = "preserveTimestamps"
+
+// Returns a context under which `PutCtx` writes objects as is, without updating their timestamps
+func PreserveTimestamps(ctx context.Context) context.Context {
+	return context.WithValue(ctx, preserveTimestampsContextKey, true)
+}
+
+// Updates the timestamps of `t` with the time from `clock` if it implements the `Timestamped`
+// interface, unless `ctx` was created with `PreserveTimestamps`
+func touch(ctx context.Context, t Storable, clock Clock) {
+	if preserve, _ := ctx.Value(preserveTimestampsContextKey).(bool); preserve {
+		return
+	}
+	if ts, ok := t.(Timestamped); ok {
+		ts.Touch(clockNow(clock))
+	}
+}
+
 type StorageIterator interface {
 	Next() bool
 	Get(Storable) error
@@ -57,6 +132,34 @@ type Storage interface {
 	Delete(Storable) error
 	// Lists all keys for a given `Storable` type
 	Iterator(Storable) (StorageIterator, error)
+	// Calls a function with the key of each stored object of a given `Storable` type. Iteration
+	// stops at the first error returned by the function, which is then returned
+	ListFunc(Storable, func(key string) error) error
+	// Returns the keys of all stored objects of a given `Storable` type
+	List(Storable) ([]string, error)
+	// Like `ListFunc`, but only visits keys starting with `prefix`, in sorted order. `fn` also
+	// receives the size in bytes of the stored value, which is determined without decoding it
+	ListPrefixFunc(t Storable, prefix string, fn func(key string, size int) error) error
+	// Variants of the above methods that abort with the context's error once it is cancelled
+	GetCtx(context.Context, Storable) error
+	PutCtx(context.Context, Storable) error
+	DeleteCtx(context.Context, Storable) error
+	ListFuncCtx(context.Context, Storable, func(key string) error) error
+	ListPrefixFuncCtx(ctx context.Context, t Storable, prefix string, fn func(key string, size int) error) error
+	ListCtx(context.Context, Storable) ([]string, error)
+	// Performs all given writes atomically, i.e. either all of them are applied or none
+	Batch([]BatchOp) error
+	BatchCtx(context.Context, []BatchOp) error
+}
+
+// Collects all keys passed to the `ListFuncCtx` callback of `s`
+func listKeys(ctx context.Context, s Storage, t Storable) ([]string, error) {
+	var keys []string
+	err := s.ListFuncCtx(ctx, t, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
 }
 
 // Map of supported `Storable` implementations along with identifier strings that can be used for
@@ -69,15 +172,67 @@ func RegisterStorable(t Storable, loc string) {
 
 type LevelDBIterator struct {
 	iterator.Iterator
+	encryptor *Encryptor
+	namespace []byte
 }
 
 func (iter *LevelDBIterator) Get(t Storable) error {
-	return t.Deserialize(iter.Value())
+	data, err := decodeValue(iter.encryptor, iter.Value(), iter.Key()[len(iter.namespace):])
+	if err != nil {
+		return err
+	}
+	return t.Deserialize(data)
 }
 
 type LevelDBConfig struct {
 	// Path to directory on disc where database files should be stored
 	Path string `yaml:"path"`
+	// Base64-encoded key used for encrypting stored values. Values are stored unencrypted if empty
+	EncryptionKey string `yaml:"encryption_key"`
+	// Path to a file containing the base64-encoded encryption key. Takes precedence over `EncryptionKey`
+	EncryptionKeyFile string `yaml:"encryption_key_file"`
+	// Version of the encryption key. Should be increased whenever the key is changed
+	EncryptionKeyVersion int `yaml:"encryption_key_version"`
+	// Size of the block cache in megabytes. Defaults to 8 if zero
+	CacheSizeMB int `yaml:"cache_size_mb"`
+	// Size of the write buffer in megabytes. Larger buffers speed up bulk writes at the cost
+	// of memory and recovery time. Defaults to 4 if zero
+	WriteBufferMB int `yaml:"write_buffer_mb"`
+	// Bits per key used for bloom filters, which reduce disk reads for lookups of missing keys.
+	// A value of 10 is a good choice. Bloom filters are disabled if zero
+	BloomFilterBits int `yaml:"bloom_filter_bits"`
+	// Attempt to recover databases with a corrupted manifest instead of failing to open them
+	Recover bool `yaml:"recover"`
+	// Name of the codec used for encoding newly written values, e.g. "gzip". Values are stored as
+	// is if empty. Existing values are always decoded with the codec they were written with
+	Codec string `yaml:"codec"`
+	// Prefix for all keys, allowing multiple isolated data sets to share the same database files.
+	// The default, empty namespace covers the whole database and should not be mixed with others
+	Namespace string `yaml:"namespace"`
+	// Octal mode newly created database directories get, e.g. "0700". Defaults to "0755"
+	DirMode string `yaml:"dir_mode"`
+	// Octal mode applied to existing database files when opening the database, e.g. "0600"
+	FileMode string `yaml:"file_mode"`
+	// Refuse to open the database if any of its directories or files are writable by group or others
+	StrictPerms bool `yaml:"strict_perms"`
+}
+
+// Creates the options used for opening each database. Zero values use the LevelDB defaults
+func (c *LevelDBConfig) options() (*opt.Options, error) {
+	if c.CacheSizeMB < 0 || c.WriteBufferMB < 0 || c.BloomFilterBits < 0 {
+		return nil, errors.New("padlock: leveldb cache size, write buffer size and bloom filter bits must not be negative")
+	}
+
+	o := &opt.Options{
+		BlockCacheCapacity: c.CacheSizeMB * opt.MiB,
+		WriteBuffer:        c.WriteBufferMB * opt.MiB,
+	}
+
+	if c.BloomFilterBits > 0 {
+		o.Filter = filter.NewBloomFilter(c.BloomFilterBits)
+	}
+
+	return o, nil
 }
 
 // LevelDB implementation of the `Storage` interface
@@ -85,25 +240,177 @@ type LevelDBStorage struct {
 	Config *LevelDBConfig
 	// Map of `leveldb.DB` instances associated with different `Storable` types
 	stores map[reflect.Type]*leveldb.DB
+	// Used for encrypting values if an encryption key is configured
+	encryptor *Encryptor
+	// Used for encoding values before they are written
+	codec Codec
+	// Prefix of all keys, derived from `Config.Namespace`
+	namespace []byte
+	// Used for logging recoveries, if provided
+	Log *Log
+	// Source for the timestamps of stored objects and backups. Defaults to the system clock
+	Clock Clock
+	// Holds batches spanning multiple stores until they have been applied
+	journal *leveldb.DB
+	// Sequence number of the last journal entry
+	journalSeq uint64
+	// Called after a batch has been written to one of its stores. Used for simulating failures
+	// in tests
+	afterBatchWrite func(loc string) error
+}
+
+// Decrypts a stored value if an encryptor is provided and the value is encrypted
+func decryptValue(e *Encryptor, data []byte, key []byte) ([]byte, error) {
+	if e == nil {
+		if isEncrypted(data) {
+			return nil, ErrNoEncryptionKey
+		}
+		return data, nil
+	}
+	return e.Decrypt(data, key)
+}
+
+// Decrypts a stored value, verifies its checksum and decodes it
+func decodeValue(e *Encryptor, data []byte, key []byte) ([]byte, error) {
+	data, err := decryptValue(e, data, key)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = verifyChecksum(data); err != nil {
+		return nil, err
+	}
+	return decodeCodec(data)
+}
+
+// Initializes the encryptor if an encryption key is configured
+func (s *LevelDBStorage) initEncryption() error {
+	s.encryptor = nil
+
+	if s.Config.EncryptionKey == "" && s.Config.EncryptionKeyFile == "" {
+		return nil
+	}
+
+	key, err := loadEncryptionKey(s.Config.EncryptionKey, s.Config.EncryptionKeyFile)
+	if err != nil {
+		return err
+	}
+
+	if s.Config.EncryptionKeyVersion < 0 || s.Config.EncryptionKeyVersion > 255 {
+		return errors.New("padlock: encryption key version has to be between 0 and 255")
+	}
+
+	s.encryptor, err = NewEncryptor(key, byte(s.Config.EncryptionKeyVersion))
+	return err
 }
 
 // Implementation of the `Storage.Open` interface method
 func (s *LevelDBStorage) Open() error {
+	if err := s.initEncryption(); err != nil {
+		return err
+	}
+
+	codec, err := CodecByName(s.Config.Codec)
+	if err != nil {
+		return err
+	}
+	s.codec = codec
+
+	if strings.Contains(s.Config.Namespace, ":") {
+		return errors.New("padlock: leveldb namespace must not contain ':'")
+	}
+	s.namespace = nil
+	if s.Config.Namespace != "" {
+		s.namespace = []byte(s.Config.Namespace + ":")
+	}
+
+	options, err := s.Config.options()
+	if err != nil {
+		return err
+	}
+
+	if err := s.preparePath(); err != nil {
+		return err
+	}
+
 	// Instantiate stores map
 	s.stores = make(map[reflect.Type]*leveldb.DB)
 
 	// Create `leveldb.DB` instance for each supported `Storable` type
 	for t, loc := range StorableTypes {
-		db, err := leveldb.OpenFile(filepath.Join(s.Config.Path, loc), nil)
+		db, err := s.openDB(filepath.Join(s.Config.Path, loc), options)
 		if err != nil {
+			s.Close()
 			return err
 		}
 		s.stores[t] = db
 	}
 
+	if s.journal, err = s.openDB(filepath.Join(s.Config.Path, journalLoc), options); err != nil {
+		s.Close()
+		return err
+	}
+
+	if err := s.chmodFiles(); err != nil {
+		s.Close()
+		return err
+	}
+
+	// Complete batches interrupted by a crash
+	if err := s.replayJournal(); err != nil {
+		s.Close()
+		return err
+	}
+
 	return nil
 }
 
+// Opens the database at `p`, recovering it if it's corrupted and recovery is enabled
+func (s *LevelDBStorage) openDB(p string, options *opt.Options) (*leveldb.DB, error) {
+	db, err := leveldb.OpenFile(p, options)
+	if lderrors.IsCorrupted(err) {
+		if !s.Config.Recover {
+			return nil, fmt.Errorf("padlock: database at %s is corrupted (%v). Use the --recover-db flag or "+
+				"the 'recover' config option to attempt an automatic recovery", p, err)
+		}
+		db, err = s.recover(p, options, err)
+	}
+	if err == storage.ErrLocked || err == syscall.EWOULDBLOCK {
+		return nil, ErrStorageLocked
+	} else if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Recovers a corrupted database by rebuilding its manifest from the existing table files
+func (s *LevelDBStorage) recover(p string, options *opt.Options, cause error) (*leveldb.DB, error) {
+	if s.Log != nil {
+		s.Log.Error.Printf("Database at %s is corrupted (%v). Attempting recovery", p, cause)
+	}
+
+	db, err := leveldb.RecoverFile(p, options)
+	if err != nil {
+		return nil, err
+	}
+
+	records := 0
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		records++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if s.Log != nil {
+		s.Log.Info.Printf("Recovered database at %s; %d records survived", p, records)
+	}
+
+	return db, nil
+}
+
 // Implementation of the `Storage.Close` interface method
 func (s *LevelDBStorage) Close() error {
 	// Close all existing `leveldb.DB` instances
@@ -115,6 +422,13 @@ func (s *LevelDBStorage) Close() error {
 
 	s.stores = nil
 
+	if s.journal != nil {
+		if err := s.journal.Close(); err != nil {
+			return err
+		}
+		s.journal = nil
+	}
+
 	return nil
 }
 
@@ -138,8 +452,29 @@ func (s *LevelDBStorage) getDB(t Storable) (*leveldb.DB, error) {
 	return db, nil
 }
 
-// Implementation of the `Storage.Get` interface method
-func (s *LevelDBStorage) Get(t Storable) error {
+// Key under which `key` is stored in the configured namespace
+func (s *LevelDBStorage) dbKey(key []byte) []byte {
+	if s.namespace == nil {
+		return key
+	}
+	return append(append([]byte{}, s.namespace...), key...)
+}
+
+// Strips the namespace from a key read from the database
+func (s *LevelDBStorage) userKey(dbKey []byte) []byte {
+	return dbKey[len(s.namespace):]
+}
+
+// Creates an iterator over all entries of `db` within the configured namespace
+func (s *LevelDBStorage) newIterator(db leveldb.Reader) iterator.Iterator {
+	if s.namespace == nil {
+		return db.NewIterator(nil, nil)
+	}
+	return db.NewIterator(util.BytesPrefix(s.namespace), nil)
+}
+
+// Implementation of the `Storage.GetCtx` interface method
+func (s *LevelDBStorage) GetCtx(ctx context.Context, t Storable) error {
 	if s.stores == nil {
 		return ErrStorageClosed
 	}
@@ -148,23 +483,37 @@ func (s *LevelDBStorage) Get(t Storable) error {
 		return ErrUnregisteredStorable
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	db, err := s.getDB(t)
 	if err != nil {
 		return err
 	}
 
-	data, err := db.Get(t.Key(), nil)
+	key := t.Key()
+	data, err := db.Get(s.dbKey(key), nil)
 	if err == leveldb.ErrNotFound {
 		return ErrNotFound
 	} else if err != nil {
 		return err
 	}
 
+	if data, err = decodeValue(s.encryptor, data, key); err != nil {
+		return err
+	}
+
 	return t.Deserialize(data)
 }
 
-// Implementation of the `Storage.Put` interface method
-func (s *LevelDBStorage) Put(t Storable) error {
+// Implementation of the `Storage.Get` interface method
+func (s *LevelDBStorage) Get(t Storable) error {
+	return s.GetCtx(context.Background(), t)
+}
+
+// Implementation of the `Storage.PutCtx` interface method
+func (s *LevelDBStorage) PutCtx(ctx context.Context, t Storable) error {
 	if s.stores == nil {
 		return ErrStorageClosed
 	}
@@ -173,21 +522,92 @@ func (s *LevelDBStorage) Put(t Storable) error {
 		return ErrUnregisteredStorable
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	db, err := s.getDB(t)
 	if err != nil {
 		return err
 	}
 
+	touch(ctx, t, s.Clock)
+
+	key := t.Key()
+	data, err := s.encode(t, key)
+	if err != nil {
+		return err
+	}
+
+	return writeError(db.Put(s.dbKey(key), data, nil))
+}
+
+// Serializes, encodes, checksums and (if configured) encrypts `t` for storing it under `key`
+func (s *LevelDBStorage) encode(t Storable, key []byte) ([]byte, error) {
 	data, err := t.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err = encodeValue(s.codec, data); err != nil {
+		return nil, err
+	}
+
+	data = addChecksum(data)
+
+	if s.encryptor != nil {
+		if data, err = s.encryptor.Encrypt(data, key); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// Implementation of the `Storage.Put` interface method
+func (s *LevelDBStorage) Put(t Storable) error {
+	return s.PutCtx(context.Background(), t)
+}
+
+// Implementation of the `Storage.DeleteCtx` interface method
+func (s *LevelDBStorage) DeleteCtx(ctx context.Context, t Storable) error {
+	if s.stores == nil {
+		return ErrStorageClosed
+	}
+
+	if t == nil {
+		return ErrUnregisteredStorable
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db, err := s.getDB(t)
 	if err != nil {
 		return err
 	}
 
-	return db.Put(t.Key(), data, nil)
+	return writeError(db.Delete(s.dbKey(t.Key()), nil))
 }
 
 // Implementation of the `Storage.Delete` interface method
 func (s *LevelDBStorage) Delete(t Storable) error {
+	return s.DeleteCtx(context.Background(), t)
+}
+
+func (s *LevelDBStorage) Iterator(t Storable) (StorageIterator, error) {
+	db, err := s.getDB(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LevelDBIterator{s.newIterator(db), s.encryptor, s.namespace}, nil
+}
+
+// Implementation of the `Storage.ListFuncCtx` interface method. Keys are read from a consistent
+// snapshot in sorted order, so `fn` may safely modify the storage
+func (s *LevelDBStorage) ListFuncCtx(ctx context.Context, t Storable, fn func(key string) error) error {
 	if s.stores == nil {
 		return ErrStorageClosed
 	}
@@ -201,17 +621,513 @@ func (s *LevelDBStorage) Delete(t Storable) error {
 		return err
 	}
 
-	return db.Delete(t.Key(), nil)
+	iter := s.newIterator(db)
+	defer iter.Release()
+
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(string(s.userKey(iter.Key()))); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
 }
 
-func (s *LevelDBStorage) Iterator(t Storable) (StorageIterator, error) {
+// Implementation of the `Storage.ListPrefixFuncCtx` interface method. Sizes are those of the
+// values as written to disk, i.e. after compression and encryption
+func (s *LevelDBStorage) ListPrefixFuncCtx(ctx context.Context, t Storable, prefix string, fn func(key string, size int) error) error {
+	if s.stores == nil {
+		return ErrStorageClosed
+	}
+
+	if t == nil {
+		return ErrUnregisteredStorable
+	}
+
 	db, err := s.getDB(t)
+	if err != nil {
+		return err
+	}
+
+	iter := db.NewIterator(util.BytesPrefix(s.dbKey([]byte(prefix))), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(string(s.userKey(iter.Key())), len(iter.Value())); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// Implementation of the `Storage.ListPrefixFunc` interface method
+func (s *LevelDBStorage) ListPrefixFunc(t Storable, prefix string, fn func(key string, size int) error) error {
+	return s.ListPrefixFuncCtx(context.Background(), t, prefix, fn)
+}
+
+// Implementation of the `Storage.ListFunc` interface method
+func (s *LevelDBStorage) ListFunc(t Storable, fn func(key string) error) error {
+	return s.ListFuncCtx(context.Background(), t, fn)
+}
+
+// Implementation of the `Storage.List` interface method
+func (s *LevelDBStorage) List(t Storable) ([]string, error) {
+	return listKeys(context.Background(), s, t)
+}
+
+// Implementation of the `Storage.ListCtx` interface method
+func (s *LevelDBStorage) ListCtx(ctx context.Context, t Storable) ([]string, error) {
+	return listKeys(ctx, s, t)
+}
+
+// Approximate size on disk of all entries in `db` within the configured namespace
+func (s *LevelDBStorage) dbSize(db *leveldb.DB) (int64, error) {
+	iter := s.newIterator(db)
+	defer iter.Release()
+
+	if !iter.Last() {
+		return 0, iter.Error()
+	}
+
+	// Use a limit just past the last key so the whole key range is covered
+	limit := append(append([]byte{}, iter.Key()...), 0xff)
+	sizes, err := db.SizeOf([]util.Range{{Start: s.namespace, Limit: limit}})
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(sizes.Sum()), nil
+}
+
+// Statistics about the contents of a `LevelDBStorage`
+type LevelDBStats struct {
+	// Number of accounts
+	Accounts int `json:"accounts"`
+	// Number of data stores
+	DataStores int `json:"data_stores"`
+	// Aggregate size of all data stores in bytes
+	DataBytes int64 `json:"data_bytes"`
+	// Approximate size on disk of all stores in bytes
+	DiskSize int64 `json:"disk_size"`
+}
+
+// Collects statistics about the number of entries and size of the database
+func (s *LevelDBStorage) Stats() (*LevelDBStats, error) {
+	if s.stores == nil {
+		return nil, ErrStorageClosed
+	}
+
+	stats := &LevelDBStats{}
+
+	for _, db := range s.stores {
+		size, err := s.dbSize(db)
+		if err != nil {
+			return nil, err
+		}
+		stats.DiskSize += size
+	}
+
+	accDB, err := s.getDB(&Account{})
 	if err != nil {
 		return nil, err
 	}
 
-	iter := db.NewIterator(nil, nil)
-	return &LevelDBIterator{iter}, nil
+	iter := s.newIterator(accDB)
+	for iter.Next() {
+		stats.Accounts++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	dataDB, err := s.getDB(&DataStore{})
+	if err != nil {
+		return nil, err
+	}
+
+	iter = s.newIterator(dataDB)
+	for iter.Next() {
+		stats.DataStores++
+		size := len(iter.Value())
+		if hasChecksum(iter.Value()) {
+			size -= checksumOverhead
+		}
+		stats.DataBytes += int64(size)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Compacts the underlying databases, discarding deleted and overwritten entries
+func (s *LevelDBStorage) Compact() error {
+	if s.stores == nil {
+		return ErrStorageClosed
+	}
+
+	for _, db := range s.stores {
+		if err := db.CompactRange(util.Range{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A stored entry that failed verification
+type CorruptEntry struct {
+	// Name of the store the entry was found in
+	Store string `json:"store"`
+	// Key of the entry
+	Key string `json:"key"`
+	// Reason the entry is considered corrupt
+	Err error `json:"-"`
+}
+
+// Result of verifying the contents of a `LevelDBStorage`
+type LevelDBVerifyResult struct {
+	// Number of entries checked
+	Checked int `json:"checked"`
+	// Number of entries stored without a checksum
+	Unchecksummed int `json:"unchecksummed"`
+	// Entries that failed verification
+	Corrupt []*CorruptEntry `json:"corrupt"`
+}
+
+// Checks all stored entries for corruption by verifying their checksums and making sure they can
+// be decoded. Corrupt entries are reported but left untouched
+func (s *LevelDBStorage) Verify() (*LevelDBVerifyResult, error) {
+	if s.stores == nil {
+		return nil, ErrStorageClosed
+	}
+
+	result := &LevelDBVerifyResult{Corrupt: []*CorruptEntry{}}
+
+	for t, db := range s.stores {
+		iter := s.newIterator(db)
+
+		for iter.Next() {
+			result.Checked++
+
+			checksummed, err := s.checkValue(t, s.userKey(iter.Key()), iter.Value())
+			if err == nil && !checksummed {
+				result.Unchecksummed++
+			}
+
+			if err != nil {
+				result.Corrupt = append(result.Corrupt, &CorruptEntry{
+					Store: StorableTypes[t],
+					Key:   string(s.userKey(iter.Key())),
+					Err:   err,
+				})
+			}
+		}
+
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Makes sure the stored `value` of an entry of type `t` can be decrypted, verified and decoded.
+// Returns whether the value carries a checksum
+func (s *LevelDBStorage) checkValue(t reflect.Type, key []byte, value []byte) (bool, error) {
+	data, err := decryptValue(s.encryptor, value, key)
+	if err != nil {
+		return false, err
+	}
+	checksummed := hasChecksum(data)
+	if data, err = verifyChecksum(data); err != nil {
+		return checksummed, err
+	}
+	if data, err = decodeCodec(data); err != nil {
+		return checksummed, err
+	}
+	return checksummed, reflect.New(t).Interface().(Storable).Deserialize(data)
+}
+
+// Removes all entries within the configured namespace from the underlying databases
+func (s *LevelDBStorage) Clear() error {
+	if s.stores == nil {
+		return ErrStorageClosed
+	}
+
+	for _, db := range s.stores {
+		iter := s.newIterator(db)
+		batch := new(leveldb.Batch)
+		for iter.Next() {
+			batch.Delete(iter.Key())
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+		if err := db.Write(batch, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns true if none of the underlying databases contain any entries within the configured namespace
+func (s *LevelDBStorage) Empty() (bool, error) {
+	if s.stores == nil {
+		return false, ErrStorageClosed
+	}
+
+	for _, db := range s.stores {
+		iter := s.newIterator(db)
+		found := iter.Next()
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return false, err
+		}
+		if found {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Writes a gzipped tarball with the contents of all underlying databases to `w`. Each database is read
+// from a snapshot so the backup is consistent even if writes happen concurrently. Entries are stored
+// as files of the form `{location}/{hex-encoded key}`. Only entries within the configured namespace
+// are included and their keys are stored without it, so they can be restored into any namespace
+func (s *LevelDBStorage) Backup(w io.Writer) error {
+	if s.stores == nil {
+		return ErrStorageClosed
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	for t, db := range s.stores {
+		loc := StorableTypes[t]
+
+		snap, err := db.GetSnapshot()
+		if err != nil {
+			return err
+		}
+
+		iter := s.newIterator(snap)
+		for iter.Next() {
+			value := iter.Value()
+			if err = tw.WriteHeader(&tar.Header{
+				Name:    path.Join(loc, hex.EncodeToString(s.userKey(iter.Key()))),
+				Mode:    0600,
+				Size:    int64(len(value)),
+				ModTime: clockNow(s.Clock),
+			}); err != nil {
+				break
+			}
+			if _, err = tw.Write(value); err != nil {
+				break
+			}
+		}
+		iter.Release()
+		snap.Release()
+
+		if err == nil {
+			err = iter.Error()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+// Restores entries from a tarball created with `Backup`. Returns `ErrStorageNotEmpty` if the storage
+// already contains any entries. The backup is read and validated completely before anything is
+// written, so an invalid backup leaves the storage untouched
+func (s *LevelDBStorage) Restore(r io.Reader) error {
+	return s.restore(r, false)
+}
+
+// Same as `Restore`, but replaces any existing entries. Existing entries are only removed once the
+// whole backup has been read and validated
+func (s *LevelDBStorage) Replace(r io.Reader) error {
+	return s.restore(r, true)
+}
+
+func (s *LevelDBStorage) restore(r io.Reader, replace bool) error {
+	if !replace {
+		empty, err := s.Empty()
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return ErrStorageNotEmpty
+		}
+	} else if s.stores == nil {
+		return ErrStorageClosed
+	}
+
+	// Spool the backup to a temporary file so it can be read twice: once for validating it and
+	// once for actually writing the entries
+	tmp, err := ioutil.TempFile("", "padlock-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return err
+	}
+
+	if err := s.readBackup(tmp, func(t reflect.Type, db *leveldb.DB, key []byte, value []byte) error {
+		if _, err := s.checkValue(t, key, value); err != nil {
+			return fmt.Errorf("padlock: invalid entry %s/%s in backup: %w", StorableTypes[t], key, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if replace {
+		if err := s.Clear(); err != nil {
+			return err
+		}
+	}
+
+	return s.readBackup(tmp, func(t reflect.Type, db *leveldb.DB, key []byte, value []byte) error {
+		return db.Put(s.dbKey(key), value, nil)
+	})
+}
+
+// Reads the backup in `f` from the start, calling `fn` with each entry along with its type and
+// the database it belongs in
+func (s *LevelDBStorage) readBackup(f io.ReadSeeker, fn func(reflect.Type, *leveldb.DB, []byte, []byte) error) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	types := make(map[string]reflect.Type)
+	for t := range s.stores {
+		types[StorableTypes[t]] = t
+	}
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		loc, name := path.Split(hdr.Name)
+		t, ok := types[path.Clean(loc)]
+		if !ok {
+			return fmt.Errorf("padlock: unknown store in backup: %s", loc)
+		}
+
+		key, err := hex.DecodeString(name)
+		if err != nil {
+			return err
+		}
+
+		value, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(t, s.stores[t], key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Re-encrypts all values with the encryptor `to`. Values are decrypted using the currently configured
+// encryption key (unencrypted values are simply encrypted). Values that are already encrypted with `to`
+// are skipped, so an interrupted run can safely be repeated. `progress` (if not nil) is called
+// after each processed value with the number of values processed so far. Returns the number of
+// values that were re-encrypted
+func (s *LevelDBStorage) Rekey(to *Encryptor, progress func(int)) (int, error) {
+	if s.stores == nil {
+		return 0, ErrStorageClosed
+	}
+
+	processed := 0
+	rekeyed := 0
+
+	for _, db := range s.stores {
+		iter := s.newIterator(db)
+
+		for iter.Next() {
+			key := s.userKey(iter.Key())
+			value := iter.Value()
+
+			processed++
+			if progress != nil {
+				progress(processed)
+			}
+
+			// Skip values that have already been encrypted with the new key
+			if v, ok := encryptionKeyVersion(value); ok && v == to.Version {
+				if _, err := to.Decrypt(value, key); err == nil {
+					continue
+				}
+			}
+
+			data, err := decryptValue(s.encryptor, value, key)
+			if err != nil {
+				iter.Release()
+				return rekeyed, err
+			}
+
+			if data, err = to.Encrypt(data, key); err != nil {
+				iter.Release()
+				return rekeyed, err
+			}
+
+			if err := db.Put(s.dbKey(key), data, nil); err != nil {
+				iter.Release()
+				return rekeyed, err
+			}
+
+			rekeyed++
+		}
+
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return rekeyed, err
+		}
+	}
+
+	s.encryptor = to
+
+	return rekeyed, nil
 }
 
 type SliceIterator struct {
@@ -238,6 +1154,9 @@ func (iter *SliceIterator) Release() {
 
 // In-memory implemenation of the `Storage` interface Mainly used for testing
 type MemoryStorage struct {
+	// Source for the timestamps of stored objects. Defaults to the system clock
+	Clock Clock
+
 	store map[reflect.Type](map[string][]byte)
 }
 
@@ -250,7 +1169,7 @@ func (s *MemoryStorage) Close() error {
 	return nil
 }
 
-func (s *MemoryStorage) Get(t Storable) error {
+func (s *MemoryStorage) GetCtx(ctx context.Context, t Storable) error {
 	if s.store == nil {
 		return ErrStorageClosed
 	}
@@ -259,6 +1178,10 @@ func (s *MemoryStorage) Get(t Storable) error {
 		return ErrUnregisteredStorable
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	tm := s.store[reflect.TypeOf(t)]
 	if tm == nil {
 		return ErrNotFound
@@ -270,7 +1193,11 @@ func (s *MemoryStorage) Get(t Storable) error {
 	return json.Unmarshal(data, t)
 }
 
-func (s *MemoryStorage) Put(t Storable) error {
+func (s *MemoryStorage) Get(t Storable) error {
+	return s.GetCtx(context.Background(), t)
+}
+
+func (s *MemoryStorage) PutCtx(ctx context.Context, t Storable) error {
 	if s.store == nil {
 		return ErrStorageClosed
 	}
@@ -279,6 +1206,12 @@ func (s *MemoryStorage) Put(t Storable) error {
 		return ErrUnregisteredStorable
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	touch(ctx, t, s.Clock)
+
 	data, err := json.Marshal(t)
 	if err != nil {
 		return err
@@ -292,7 +1225,11 @@ func (s *MemoryStorage) Put(t Storable) error {
 	return nil
 }
 
-func (s *MemoryStorage) Delete(t Storable) error {
+func (s *MemoryStorage) Put(t Storable) error {
+	return s.PutCtx(context.Background(), t)
+}
+
+func (s *MemoryStorage) DeleteCtx(ctx context.Context, t Storable) error {
 	if s.store == nil {
 		return ErrStorageClosed
 	}
@@ -301,6 +1238,10 @@ func (s *MemoryStorage) Delete(t Storable) error {
 		return ErrUnregisteredStorable
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	ts := s.store[reflect.TypeOf(t)]
 	if ts != nil {
 		delete(ts, string(t.Key()))
@@ -308,6 +1249,10 @@ func (s *MemoryStorage) Delete(t Storable) error {
 	return nil
 }
 
+func (s *MemoryStorage) Delete(t Storable) error {
+	return s.DeleteCtx(context.Background(), t)
+}
+
 func (s *MemoryStorage) Ready() bool {
 	return s.store != nil
 }
@@ -337,5 +1282,98 @@ func (s *MemoryStorage) Iterator(t Storable) (StorageIterator, error) {
 
 	return &SliceIterator{
 		s: sl,
+		i: -1,
 	}, nil
 }
+
+// Implementation of the `Storage.ListFuncCtx` interface method. Keys are copied before `fn` is called
+// for the first time, so `fn` may safely modify the storage
+func (s *MemoryStorage) ListFuncCtx(ctx context.Context, t Storable, fn func(key string) error) error {
+	if s.store == nil {
+		return ErrStorageClosed
+	}
+
+	if t == nil {
+		return ErrUnregisteredStorable
+	}
+
+	var keys []string
+	for key := range s.store[reflect.TypeOf(t)] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Implementation of the `Storage.ListPrefixFuncCtx` interface method. Sizes are those of the
+// serialized objects
+func (s *MemoryStorage) ListPrefixFuncCtx(ctx context.Context, t Storable, prefix string, fn func(key string, size int) error) error {
+	if s.store == nil {
+		return ErrStorageClosed
+	}
+
+	if t == nil {
+		return ErrUnregisteredStorable
+	}
+
+	typ := reflect.TypeOf(t)
+	sizes := make(map[string]int)
+	var keys []string
+	for key, data := range s.store[typ] {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		obj := reflect.New(typ.Elem()).Interface().(Storable)
+		if err := json.Unmarshal(data, obj); err != nil {
+			return err
+		}
+		ser, err := obj.Serialize()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		sizes[key] = len(ser)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(key, sizes[key]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Implementation of the `Storage.ListPrefixFunc` interface method
+func (s *MemoryStorage) ListPrefixFunc(t Storable, prefix string, fn func(key string, size int) error) error {
+	return s.ListPrefixFuncCtx(context.Background(), t, prefix, fn)
+}
+
+// Implementation of the `Storage.ListFunc` interface method
+func (s *MemoryStorage) ListFunc(t Storable, fn func(key string) error) error {
+	return s.ListFuncCtx(context.Background(), t, fn)
+}
+
+// Implementation of the `Storage.List` interface method
+func (s *MemoryStorage) List(t Storable) ([]string, error) {
+	return listKeys(context.Background(), s, t)
+}
+
+// Implementation of the `Storage.ListCtx` interface method
+func (s *MemoryStorage) ListCtx(ctx context.Context, t Storable) ([]string, error) {
+	return listKeys(ctx, s, t)
+}
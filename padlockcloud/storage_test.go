@@ -3,6 +3,16 @@ package padlockcloud
 import "testing"
 import "io/ioutil"
 import "os"
+import "fmt"
+import "bytes"
+import "encoding/base64"
+import "path/filepath"
+import "strings"
+import "context"
+import "time"
+import "errors"
+import "syscall"
+import "reflect"
 
 type testStrbl string
 
@@ -87,3 +97,954 @@ func TestLevelDBStorage(t *testing.T) {
 	}
 
 }
+
+func TestListFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storages := map[string]Storage{
+		"leveldb": &LevelDBStorage{Config: &LevelDBConfig{Path: dir}},
+		"memory":  &MemoryStorage{},
+	}
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			if err := storage.ListFunc(&Account{}, func(string) error { return nil }); err != ErrStorageClosed {
+				t.Fatalf("Should return error for closed storage, got %v", err)
+			}
+
+			if err := storage.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+
+			n := 1000
+			for i := 0; i < n; i++ {
+				if err := storage.Put(&Account{Email: fmt.Sprintf("%04d@padlock.io", i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// All keys should be visited in order
+			visited := 0
+			if err := storage.ListFunc(&Account{}, func(email string) error {
+				if expected := fmt.Sprintf("%04d@padlock.io", visited); email != expected {
+					return fmt.Errorf("expected %s, got %s", expected, email)
+				}
+				visited++
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if visited != n {
+				t.Fatalf("Expected %d keys to be visited, got %d", n, visited)
+			}
+
+			// Returning an error should stop the iteration
+			stop := fmt.Errorf("stop")
+			visited = 0
+			if err := storage.ListFunc(&Account{}, func(email string) error {
+				visited++
+				if visited == 10 {
+					return stop
+				}
+				return nil
+			}); err != stop {
+				t.Fatalf("Expected iteration to be stopped, got %v", err)
+			}
+			if visited != 10 {
+				t.Fatalf("Expected 10 keys to be visited, got %d", visited)
+			}
+
+			// The callback should be able to modify the storage
+			if err := storage.ListFunc(&Account{}, func(email string) error {
+				return storage.Delete(&Account{Email: email})
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if keys, err := storage.List(&Account{}); err != nil || len(keys) != 0 {
+				t.Fatalf("Expected all accounts to be deleted, got %d, %v", len(keys), err)
+			}
+		})
+	}
+}
+
+func TestListPrefixFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storages := map[string]Storage{
+		"leveldb": &LevelDBStorage{Config: &LevelDBConfig{Path: dir, Namespace: "ns"}},
+		"memory":  &MemoryStorage{},
+	}
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			if err := storage.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+
+			// Nothing stored yet
+			if err := storage.ListPrefixFunc(&Vault{}, testEmail+"/", func(string, int) error {
+				return fmt.Errorf("unexpected key")
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, v := range []*Vault{
+				{Email: testEmail, Name: "b", Content: []byte("bb")},
+				{Email: testEmail, Name: "a", Content: []byte("a")},
+				{Email: "other" + testEmail, Name: "c", Content: []byte("ccc")},
+			} {
+				if err := storage.Put(v); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Only keys with the prefix should be visited, in order
+			var keys []string
+			var sizes []int
+			if err := storage.ListPrefixFunc(&Vault{}, testEmail+"/", func(key string, size int) error {
+				keys = append(keys, key)
+				sizes = append(sizes, size)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if expected := []string{testEmail + "/a", testEmail + "/b"}; !reflect.DeepEqual(keys, expected) {
+				t.Fatalf("Expected keys %v, got %v", expected, keys)
+			}
+			if len(sizes) != 2 || sizes[0] < 1 || sizes[1] <= sizes[0] {
+				t.Fatalf("Expected sizes to reflect the stored values, got %v", sizes)
+			}
+		})
+	}
+}
+
+func TestStorageContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storages := map[string]Storage{
+		"leveldb": &LevelDBStorage{Config: &LevelDBConfig{Path: dir}},
+		"memory":  &MemoryStorage{},
+	}
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			if err := storage.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+
+			for i := 0; i < 1000; i++ {
+				if err := storage.Put(&Account{Email: fmt.Sprintf("%04d@padlock.io", i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Cancelling the context should abort a running list
+			ctx, cancel := context.WithCancel(context.Background())
+			visited := 0
+			if err := storage.ListFuncCtx(ctx, &Account{}, func(email string) error {
+				visited++
+				if visited == 10 {
+					cancel()
+				}
+				return nil
+			}); err != context.Canceled {
+				t.Fatalf("Expected list to be cancelled, got %v", err)
+			}
+			if visited != 10 {
+				t.Fatalf("Expected 10 keys to be visited, got %d", visited)
+			}
+
+			if _, err := storage.ListCtx(ctx, &Account{}); err != context.Canceled {
+				t.Fatalf("Expected list to be cancelled, got %v", err)
+			}
+
+			// Other operations should fail with cancelled contexts as well
+			acc := &Account{Email: "0000@padlock.io"}
+			if err := storage.GetCtx(ctx, acc); err != context.Canceled {
+				t.Fatalf("Expected get to be cancelled, got %v", err)
+			}
+			if err := storage.PutCtx(ctx, acc); err != context.Canceled {
+				t.Fatalf("Expected put to be cancelled, got %v", err)
+			}
+			if err := storage.DeleteCtx(ctx, acc); err != context.Canceled {
+				t.Fatalf("Expected delete to be cancelled, got %v", err)
+			}
+
+			ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+			defer cancel()
+			if err := storage.GetCtx(ctx, acc); err != context.DeadlineExceeded {
+				t.Fatalf("Expected deadline to be exceeded, got %v", err)
+			}
+
+			// Operations with a live context should work normally
+			if err := storage.GetCtx(context.Background(), acc); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLevelDBStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &LevelDBStorage{
+		Config: &LevelDBConfig{
+			Path: dir,
+		},
+	}
+
+	if _, err := storage.Stats(); err != ErrStorageClosed {
+		t.Fatalf("Should return error for closed storage, got %v", err)
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	for _, email := range []string{"a@padlock.io", "b@padlock.io", "c@padlock.io"} {
+		acc := &Account{Email: email}
+		if err := storage.Put(acc); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(&DataStore{Account: acc, Content: []byte(testData)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := storage.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Accounts != 3 {
+		t.Errorf("Expected 3 accounts, got %d", stats.Accounts)
+	}
+	if stats.DataStores != 3 {
+		t.Errorf("Expected 3 data stores, got %d", stats.DataStores)
+	}
+	if stats.DataBytes != int64(3*len(testData)) {
+		t.Errorf("Expected %d data bytes, got %d", 3*len(testData), stats.DataBytes)
+	}
+}
+
+func TestLevelDBCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &LevelDBStorage{
+		Config: &LevelDBConfig{
+			Path: dir,
+		},
+	}
+
+	if err := storage.Compact(); err != ErrStorageClosed {
+		t.Fatalf("Should return error for closed storage, got %v", err)
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	// A second instance should not be able to open the same database
+	if err := (&LevelDBStorage{Config: storage.Config}).Open(); err != ErrStorageLocked {
+		t.Fatalf("Should return error for locked storage, got %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := storage.Put(&Account{Email: fmt.Sprintf("%d@padlock.io", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := storage.Delete(&Account{Email: fmt.Sprintf("%d@padlock.io", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := storage.Compact(); err != nil {
+		t.Fatalf("Should return no error, got %v", err)
+	}
+
+	stats, err := storage.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Accounts != 50 {
+		t.Fatalf("Expected 50 accounts after compaction, got %d", stats.Accounts)
+	}
+
+	if err := storage.Get(&Account{Email: "99@padlock.io"}); err != nil {
+		t.Fatalf("Should return no error, got %v", err)
+	}
+}
+
+func TestLevelDBBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &LevelDBStorage{Config: &LevelDBConfig{Path: filepath.Join(dir, "db1")}}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	acc := &Account{Email: testEmail}
+	if err := storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&DataStore{Account: acc, Content: []byte(testData)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buff bytes.Buffer
+	if err := storage.Backup(&buff); err != nil {
+		t.Fatalf("Should return no error, got %v", err)
+	}
+	backup := buff.Bytes()
+
+	storage2 := &LevelDBStorage{Config: &LevelDBConfig{Path: filepath.Join(dir, "db2")}}
+	if err := storage2.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage2.Close()
+
+	if err := storage2.Restore(bytes.NewReader(backup)); err != nil {
+		t.Fatalf("Should return no error, got %v", err)
+	}
+
+	acc2 := &Account{Email: testEmail}
+	if err := storage2.Get(acc2); err != nil {
+		t.Fatalf("Should return no error, got %v", err)
+	}
+	if !acc2.Created.Equal(acc.Created) {
+		t.Errorf("Expected restored account to be created at %v, got %v", acc.Created, acc2.Created)
+	}
+
+	data := &DataStore{Account: acc2}
+	if err := storage2.Get(data); err != nil {
+		t.Fatalf("Should return no error, got %v", err)
+	}
+	if string(data.Content) != testData {
+		t.Errorf("Expected restored data to be '%s', got '%s'", testData, data.Content)
+	}
+
+	// Restoring into a non-empty database should fail
+	if err := storage2.Restore(bytes.NewReader(backup)); err != ErrStorageNotEmpty {
+		t.Fatalf("Should return error for non-empty storage, got %v", err)
+	}
+
+	// After clearing the database, restoring should work again
+	if err := storage2.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage2.Restore(bytes.NewReader(backup)); err != nil {
+		t.Fatalf("Should return no error, got %v", err)
+	}
+}
+
+func TestLevelDBEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := genSecret()
+	storage := &LevelDBStorage{Config: &LevelDBConfig{Path: dir}}
+
+	// Write some data without encryption first
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&Account{Email: "legacy@padlock.io"}); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	storage.Config.EncryptionKey = key
+	storage.Config.EncryptionKeyVersion = 1
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	acc := &Account{Email: testEmail}
+	if err := storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	// Values should be encrypted on disk
+	db, _ := storage.getDB(acc)
+	if raw, _ := db.Get(acc.Key(), nil); !isEncrypted(raw) || bytes.Contains(raw, []byte(testEmail)) {
+		t.Fatalf("Expected value to be stored encrypted, got %s", raw)
+	}
+
+	// Encrypted values should be decrypted transparently
+	acc2 := &Account{Email: testEmail}
+	if err := storage.Get(acc2); err != nil || acc2.Created.IsZero() {
+		t.Fatalf("Expected encrypted account to be read correctly, got %v", err)
+	}
+
+	// Legacy plaintext entries should still be readable
+	legacy := &Account{Email: "legacy@padlock.io"}
+	if err := storage.Get(legacy); err != nil || legacy.Created.IsZero() {
+		t.Fatalf("Expected legacy account to be read correctly, got %v", err)
+	}
+
+	// Iterating should decrypt values as well
+	iter, err := storage.Iterator(&Account{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for iter.Next() {
+		a := &Account{}
+		if err := iter.Get(a); err != nil || a.Email == "" {
+			t.Fatalf("Expected account to be read correctly, got %v", err)
+		}
+		n++
+	}
+	iter.Release()
+	if n != 2 {
+		t.Fatalf("Expected 2 accounts, got %d", n)
+	}
+
+	storage.Close()
+
+	// Encrypted values can't be read without the key
+	storage.Config.EncryptionKey = ""
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if err := storage.Get(&Account{Email: testEmail}); err != ErrNoEncryptionKey {
+		t.Fatalf("Expected missing key error, got %v", err)
+	}
+}
+
+func TestLevelDBOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &LevelDBStorage{
+		Config: &LevelDBConfig{
+			Path:          dir,
+			CacheSizeMB:   -1,
+			WriteBufferMB: 1,
+		},
+	}
+
+	if err := storage.Open(); err == nil {
+		storage.Close()
+		t.Fatal("Expected error for negative cache size")
+	}
+
+	storage.Config.CacheSizeMB = 16
+	storage.Config.BloomFilterBits = 10
+
+	options, err := storage.Config.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.BlockCacheCapacity != 16*1024*1024 || options.WriteBuffer != 1024*1024 || options.Filter == nil {
+		t.Fatalf("Options not applied correctly: %+v", options)
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if err := storage.Put(&Account{Email: testEmail}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetAccount(storage, testEmail); err != nil {
+		t.Fatalf("Expected account to be read back, got %v", err)
+	}
+	if _, err := GetAccount(storage, "unknown@padlock.io"); err != ErrNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestLevelDBNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Opens the database at `dir` in the given namespace and passes it to `fn`
+	withNamespace := func(ns string, fn func(storage *LevelDBStorage)) {
+		storage := &LevelDBStorage{Config: &LevelDBConfig{Path: dir, Namespace: ns}}
+		if err := storage.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+		fn(storage)
+	}
+
+	for _, ns := range []string{"a", "b"} {
+		withNamespace(ns, func(storage *LevelDBStorage) {
+			for _, email := range []string{testEmail, ns + "@padlock.io"} {
+				acc := &Account{Email: email}
+				if err := storage.Put(acc); err != nil {
+					t.Fatal(err)
+				}
+				if err := storage.Put(&DataStore{Account: acc, Content: []byte(ns)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+
+	withNamespace("b", func(storage *LevelDBStorage) {
+		if err := storage.Delete(&Account{Email: testEmail}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	withNamespace("a", func(storage *LevelDBStorage) {
+		keys, err := storage.List(&Account{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 2 || keys[0] != "a@padlock.io" || keys[1] != testEmail {
+			t.Errorf("Expected only accounts in namespace to be listed, got %v", keys)
+		}
+
+		if _, err := GetAccount(storage, "b@padlock.io"); err != ErrNotFound {
+			t.Errorf("Expected account from other namespace not to be found, got %v", err)
+		}
+
+		// Deleting an account in another namespace should not affect this one
+		data := &DataStore{Account: &Account{Email: testEmail}}
+		if err := storage.Get(data); err != nil || string(data.Content) != "a" {
+			t.Errorf("Expected data of namespace to be read, got %q, %v", data.Content, err)
+		}
+
+		if stats, err := storage.Stats(); err != nil || stats.Accounts != 2 || stats.DataStores != 2 {
+			t.Errorf("Expected stats to only cover namespace, got %+v, %v", stats, err)
+		}
+	})
+
+	withNamespace("b", func(storage *LevelDBStorage) {
+		if err := storage.Clear(); err != nil {
+			t.Fatal(err)
+		}
+		if empty, err := storage.Empty(); err != nil || !empty {
+			t.Errorf("Expected namespace to be empty after clearing, got %v, %v", empty, err)
+		}
+	})
+
+	withNamespace("a", func(storage *LevelDBStorage) {
+		if empty, err := storage.Empty(); err != nil || empty {
+			t.Errorf("Expected clearing another namespace to leave this one alone, got %v, %v", empty, err)
+		}
+	})
+
+	storage := &LevelDBStorage{Config: &LevelDBConfig{Path: dir, Namespace: "a:b"}}
+	if err := storage.Open(); err == nil {
+		storage.Close()
+		t.Error("Expected error for namespace containing ':'")
+	}
+}
+
+func TestLevelDBPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data", "db")
+	storage := &LevelDBStorage{Config: &LevelDBConfig{
+		Path:        path,
+		DirMode:     "0750",
+		FileMode:    "0600",
+		StrictPerms: true,
+	}}
+
+	// Directories should be created with the configured mode on first open
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&Account{Email: testEmail}); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	accPath := filepath.Join(path, StorableTypes[typeFromStorable(&Account{})])
+	for _, p := range []string{path, accPath} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0750 {
+			t.Errorf("Expected %s to be created with mode 0750, got %v", p, info.Mode())
+		}
+	}
+
+	// Existing files should get the configured file mode when reopening
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	files, err := ioutil.ReadDir(accPath)
+	if err != nil || len(files) == 0 {
+		t.Fatalf("Expected database files, got %v, %v", files, err)
+	}
+	for _, f := range files {
+		if f.Mode().IsRegular() && f.Mode().Perm() != 0600 {
+			t.Errorf("Expected %s to have mode 0600, got %v", f.Name(), f.Mode())
+		}
+	}
+
+	// World-writable directories should be rejected in strict mode
+	if err := os.Chmod(path, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Open(); err == nil || !strings.Contains(err.Error(), "writable by other users") {
+		storage.Close()
+		t.Fatalf("Expected error for world-writable directory, got %v", err)
+	}
+
+	storage.Config.StrictPerms = false
+	if err := storage.Open(); err != nil {
+		t.Fatalf("Expected database to open without strict permissions, got %v", err)
+	}
+	storage.Close()
+
+	storage.Config.DirMode = "rwx"
+	if err := storage.Open(); err == nil {
+		storage.Close()
+		t.Error("Expected error for invalid mode")
+	}
+}
+
+func TestLevelDBRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &LevelDBStorage{
+		Config: &LevelDBConfig{
+			Path: dir,
+		},
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := storage.Put(&Account{Email: fmt.Sprintf("%d@padlock.io", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage.Close()
+
+	// Corrupt the manifest of the accounts database
+	manifests, err := filepath.Glob(filepath.Join(dir, "auth-accounts", "MANIFEST-*"))
+	if err != nil || len(manifests) == 0 {
+		t.Fatalf("Failed to find manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(manifests[0], []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the recover option, opening should fail with an explanation
+	if err := storage.Open(); err == nil || !strings.Contains(err.Error(), "--recover-db") {
+		storage.Close()
+		t.Fatalf("Expected corruption error, got %v", err)
+	}
+
+	storage.Config.Recover = true
+	if err := storage.Open(); err != nil {
+		t.Fatalf("Expected database to be recovered, got %v", err)
+	}
+	defer storage.Close()
+
+	accounts, err := ListAccounts(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 20 {
+		t.Fatalf("Expected 20 accounts to survive, got %d", len(accounts))
+	}
+}
+
+func TestLevelDBVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &LevelDBStorage{
+		Config: &LevelDBConfig{
+			Path: dir,
+		},
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	for i := 0; i < 5; i++ {
+		email := fmt.Sprintf("%d@padlock.io", i)
+		if err := storage.Put(&Account{Email: email}); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(&DataStore{Account: &Account{Email: email}, Content: []byte("data")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A clean store should pass verification
+	result, err := storage.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 10 || len(result.Corrupt) != 0 || result.Unchecksummed != 0 {
+		t.Fatalf("Expected 10 clean entries, got %+v", result)
+	}
+
+	// Deliberately corrupt a stored data store
+	corrupted := &DataStore{Account: &Account{Email: "3@padlock.io"}}
+	db, _ := storage.getDB(corrupted)
+	raw, err := db.Get(corrupted.Key(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 0xff
+	if err := db.Put(corrupted.Key(), raw, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if result, err = storage.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 10 || len(result.Corrupt) != 1 {
+		t.Fatalf("Expected 1 corrupt entry, got %+v", result)
+	}
+	if entry := result.Corrupt[0]; entry.Store != "data-stores" || entry.Key != string(corrupted.Key()) || entry.Err != ErrChecksumMismatch {
+		t.Fatalf("Unexpected corrupt entry: %+v", entry)
+	}
+
+	// Verification should not modify the corrupt entry
+	if after, _ := db.Get(corrupted.Key(), nil); !bytes.Equal(after, raw) {
+		t.Fatal("Expected corrupt entry to be left untouched")
+	}
+
+	// Reading the corrupt entry should fail
+	if err := storage.Get(corrupted); err != ErrChecksumMismatch {
+		t.Fatalf("Expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestLevelDBRekey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey, _ := genSecret()
+	storage := &LevelDBStorage{Config: &LevelDBConfig{
+		Path:                 dir,
+		EncryptionKey:        oldKey,
+		EncryptionKeyVersion: 1,
+	}}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	var emails []string
+	for i := 0; i < 10; i++ {
+		acc := &Account{Email: fmt.Sprintf("%d@padlock.io", i)}
+		emails = append(emails, acc.Email)
+		if err := storage.Put(acc); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(&DataStore{Account: acc, Content: []byte(testData)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newKey, _ := randomBytes(32)
+	to, _ := NewEncryptor(newKey, 2)
+
+	processed := 0
+	n, err := storage.Rekey(to, func(i int) { processed = i })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 || processed != 20 {
+		t.Fatalf("Expected 20 records to be processed and rekeyed, got %d and %d", processed, n)
+	}
+
+	// Running the rekey again should not touch any records
+	if n, err := storage.Rekey(to, nil); err != nil || n != 0 {
+		t.Fatalf("Expected no records to be rekeyed, got %d, %v", n, err)
+	}
+
+	storage.Close()
+
+	// All values should be readable with the new key now
+	storage.Config.EncryptionKey = base64.StdEncoding.EncodeToString(newKey)
+	storage.Config.EncryptionKeyVersion = 2
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	for _, email := range emails {
+		acc := &Account{Email: email}
+		if err := storage.Get(acc); err != nil {
+			t.Fatalf("Expected account to be decrypted with new key, got %v", err)
+		}
+		data := &DataStore{Account: acc}
+		if err := storage.Get(data); err != nil || string(data.Content) != testData {
+			t.Fatalf("Expected data store to be decrypted with new key, got %v", err)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	err := &os.PathError{Op: "write", Path: "000001.log", Err: syscall.ENOSPC}
+	if writeError(err) != ErrStorageFull {
+		t.Errorf("Expected ENOSPC to be translated to ErrStorageFull, got %v", writeError(err))
+	}
+	if other := errors.New("other"); writeError(other) != other {
+		t.Error("Expected other errors to be passed through")
+	}
+}
+
+func TestLevelDBBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &LevelDBStorage{Config: &LevelDBConfig{Path: dir}}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	acc := &Account{Email: testEmail}
+	data := &DataStore{Account: acc, Content: []byte(testData)}
+
+	// Simulate the process dying after the first of the two stores has been written
+	failure := errors.New("simulated crash")
+	storage.afterBatchWrite = func(loc string) error {
+		return failure
+	}
+
+	if err := storage.Batch([]BatchOp{PutOp(acc), PutOp(data)}); err != failure {
+		t.Fatalf("Expected simulated failure, got %v", err)
+	}
+
+	found := 0
+	if err := storage.Get(&Account{Email: testEmail}); err == nil {
+		found++
+	}
+	if err := storage.Get(&DataStore{Account: acc}); err == nil {
+		found++
+	}
+	if found != 1 {
+		t.Fatalf("Expected exactly one record to be written before the failure, found %d", found)
+	}
+
+	storage.Close()
+
+	// Reopening the storage should complete the interrupted batch
+	storage.afterBatchWrite = nil
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if err := storage.Get(&Account{Email: testEmail}); err != nil {
+		t.Errorf("Expected account to be written, got %v", err)
+	}
+	data2 := &DataStore{Account: acc}
+	if err := storage.Get(data2); err != nil || string(data2.Content) != testData {
+		t.Errorf("Expected data store to be written, got %v", err)
+	}
+
+	iter := storage.newIterator(storage.journal)
+	defer iter.Release()
+	if iter.Next() {
+		t.Error("Expected journal to be empty after replay")
+	}
+
+	// Deletes spanning multiple stores should be applied all together as well
+	if err := storage.Batch([]BatchOp{DeleteOp(acc), DeleteOp(data)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Get(&Account{Email: testEmail}); err != ErrNotFound {
+		t.Errorf("Expected account to be deleted, got %v", err)
+	}
+	if err := storage.Get(&DataStore{Account: acc}); err != ErrNotFound {
+		t.Errorf("Expected data store to be deleted, got %v", err)
+	}
+}
+
+func TestMemoryStorageBatch(t *testing.T) {
+	storage := &MemoryStorage{}
+	storage.Open()
+	defer storage.Close()
+
+	acc := &Account{Email: testEmail}
+	data := &DataStore{Account: acc, Content: []byte(testData)}
+
+	if err := storage.Batch([]BatchOp{PutOp(acc), PutOp(data)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Get(&DataStore{Account: acc}); err != nil {
+		t.Errorf("Expected data store to be written, got %v", err)
+	}
+
+	if err := storage.Batch([]BatchOp{DeleteOp(data), {}}); err != ErrUnregisteredStorable {
+		t.Fatalf("Expected invalid batch to be rejected, got %v", err)
+	}
+	if err := storage.Get(&DataStore{Account: acc}); err != nil {
+		t.Errorf("Expected rejected batch to leave storage untouched, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package padlockcloud
+
+import "bytes"
+import "fmt"
+import "net/http"
+import "net/url"
+import "os"
+import "text/template"
+
+// Default subjects of the different types of emails
+const (
+	DefaultActivationSubject        = "Connect to Padlock Cloud"
+	DefaultLoginSubject             = "Log in to Padlock Cloud"
+	DefaultDeleteRequestSubject     = "Padlock Cloud Delete Request"
+	DefaultDeprecatedVersionSubject = "Please update your version of Padlock"
+	DefaultAccountSuspendedSubject  = "Your Padlock Cloud account is suspended"
+	DefaultNotificationSubject      = "Padlock Cloud Error Notification"
+)
+
+// Values available in email subject templates
+type EmailSubjectData struct {
+	// Host of the server as seen by the client, e.g. "cloud.padlock.io". For error notifications,
+	// which aren't tied to a request, this is the name of the machine the server is running on
+	HostName string
+	// Recipient of the email
+	Email string
+}
+
+// Subject templates for the different types of emails
+type EmailSubjects struct {
+	// Sent for connecting a new device (auth tokens of type "api")
+	Activation *template.Template
+	// Sent for logging in to the dashboard (auth tokens of type "web")
+	Login *template.Template
+	// Sent for confirming the deletion of an account's data
+	DeleteRequest *template.Template
+	// Sent to clients using an outdated api version
+	DeprecatedVersion *template.Template
+	// Sent instead of an activation email when the account is suspended
+	AccountSuspended *template.Template
+	// Sent to the configured recipients when an error is logged
+	Notification *template.Template
+}
+
+// Parses the subject templates configured in `config`, using the defaults for subjects that aren't
+// configured
+func NewEmailSubjects(config *EmailConfig) (*EmailSubjects, error) {
+	s := &EmailSubjects{}
+	for _, subj := range []struct {
+		name  string
+		value string
+		def   string
+		tmpl  **template.Template
+	}{
+		{"activation", config.ActivationSubject, DefaultActivationSubject, &s.Activation},
+		{"login", config.LoginSubject, DefaultLoginSubject, &s.Login},
+		{"delete request", config.DeleteRequestSubject, DefaultDeleteRequestSubject, &s.DeleteRequest},
+		{"deprecated version", config.DeprecatedVersionSubject, DefaultDeprecatedVersionSubject, &s.DeprecatedVersion},
+		{"account suspended", config.AccountSuspendedSubject, DefaultAccountSuspendedSubject, &s.AccountSuspended},
+		{"notification", config.NotificationSubject, DefaultNotificationSubject, &s.Notification},
+	} {
+		value := subj.value
+		if value == "" {
+			value = subj.def
+		}
+
+		tmpl, err := template.New(subj.name).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("padlock: invalid %s email subject: %w", subj.name, err)
+		}
+
+		// Render with sample data to catch references to unknown fields early
+		if err := tmpl.Execute(&bytes.Buffer{}, &EmailSubjectData{}); err != nil {
+			return nil, fmt.Errorf("padlock: invalid %s email subject: %w", subj.name, err)
+		}
+
+		*subj.tmpl = tmpl
+	}
+	return s, nil
+}
+
+// Returns the subject template for activation emails of the given auth token type
+func (s *EmailSubjects) ForAuthType(authType string) *template.Template {
+	if authType == "web" {
+		return s.Login
+	}
+	return s.Activation
+}
+
+// Renders the subject template `tmpl` with the given data
+func renderSubject(tmpl *template.Template, data *EmailSubjectData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Renders the subject of error notifications, using the name of the machine as `HostName`
+func (s *EmailSubjects) RenderNotification() (string, error) {
+	host, _ := os.Hostname()
+	return renderSubject(s.Notification, &EmailSubjectData{HostName: host})
+}
+
+// Renders an email subject for a request to `r`, using the host of the server's base url
+func (server *Server) emailSubject(tmpl *template.Template, r *http.Request, email string) (string, error) {
+	host := r.Host
+	if u, err := url.Parse(server.BaseUrl(r)); err == nil {
+		host = u.Host
+	}
+	return renderSubject(tmpl, &EmailSubjectData{HostName: host, Email: email})
+}
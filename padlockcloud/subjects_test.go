@@ -0,0 +1,93 @@
+package padlockcloud
+
+import "net/http"
+import "net/url"
+import "os"
+import "testing"
+import "text/template"
+
+func TestEmailSubjects(t *testing.T) {
+	subjects, err := NewEmailSubjects(&EmailConfig{
+		ActivationSubject:        "Connect to {{.HostName}}",
+		LoginSubject:             "Log in to {{.HostName}} as {{.Email}}",
+		DeleteRequestSubject:     "Delete data on {{.HostName}}",
+		DeprecatedVersionSubject: "Update for {{.Email}}",
+		AccountSuspendedSubject:  "{{.Email}} is suspended",
+		NotificationSubject:      "Error on {{.HostName}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := &EmailSubjectData{HostName: "cloud.padlock.io", Email: testEmail}
+	for _, c := range []struct {
+		name     string
+		subject  string
+		expected string
+	}{
+		{"activation", render(t, subjects.ForAuthType("api"), data), "Connect to cloud.padlock.io"},
+		{"login", render(t, subjects.ForAuthType("web"), data), "Log in to cloud.padlock.io as " + testEmail},
+		{"delete request", render(t, subjects.DeleteRequest, data), "Delete data on cloud.padlock.io"},
+		{"deprecated version", render(t, subjects.DeprecatedVersion, data), "Update for " + testEmail},
+		{"account suspended", render(t, subjects.AccountSuspended, data), testEmail + " is suspended"},
+	} {
+		if c.subject != c.expected {
+			t.Errorf("Expected %s subject to be '%s', got '%s'", c.name, c.expected, c.subject)
+		}
+	}
+
+	host, _ := os.Hostname()
+	if subj, err := subjects.RenderNotification(); err != nil || subj != "Error on "+host {
+		t.Errorf("Expected notification subject 'Error on %s', got '%s', %v", host, subj, err)
+	}
+
+	// Defaults should be used if no subjects are configured
+	defaults, err := NewEmailSubjects(&EmailConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subj := render(t, defaults.Login, data); subj != DefaultLoginSubject {
+		t.Errorf("Expected default login subject, got '%s'", subj)
+	}
+
+	// Invalid templates should be rejected up front
+	for _, subj := range []string{"Log in to {{.HostName", "Log in to {{.Unknown}}"} {
+		if _, err := NewEmailSubjects(&EmailConfig{LoginSubject: subj}); err == nil {
+			t.Errorf("Expected error for invalid subject '%s'", subj)
+		}
+	}
+}
+
+func render(t *testing.T, tmpl *template.Template, data *EmailSubjectData) string {
+	subj, err := renderSubject(tmpl, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subj
+}
+
+func TestEmailSubjectFromRequest(t *testing.T) {
+	ctx := newServerTestContext()
+	subjects, err := NewEmailSubjects(&EmailConfig{LoginSubject: "Log in to {{.HostName}} as {{.Email}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.server.EmailSubjects = subjects
+	ctx.server.Config.BaseUrl = "https://cloud.padlock.io"
+	defer func() {
+		ctx.server.Config.BaseUrl = ""
+	}()
+
+	res, err := ctx.request("POST", ctx.host+"/auth/", url.Values{
+		"email": {testEmail},
+		"type":  {"web"},
+	}.Encode(), ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusAccepted, "")
+
+	if expected := "Log in to cloud.padlock.io as " + testEmail; ctx.sender.Subject != expected {
+		t.Errorf("Expected subject '%s', got '%s'", expected, ctx.sender.Subject)
+	}
+}
@@ -1,6 +1,7 @@
 package padlockcloud
 
-import fp "path/filepath"
+import "os"
+import "io/fs"
 import t "html/template"
 import "errors"
 
@@ -12,9 +13,11 @@ type Templates struct {
 	ActivateAuthTokenEmail *t.Template
 	// Email template for clients using an outdated api version
 	DeprecatedVersionEmail *t.Template
-	ErrorPage              *t.Template
-	LoginPage              *t.Template
-	Dashboard              *t.Template
+	// Email template for telling the owner of a suspended account why they can't log in
+	AccountSuspendedEmail *t.Template
+	ErrorPage             *t.Template
+	LoginPage             *t.Template
+	Dashboard             *t.Template
 }
 
 func ExtendTemplate(base *t.Template, path string) (*t.Template, error) {
@@ -30,29 +33,51 @@ func ExtendTemplate(base *t.Template, path string) (*t.Template, error) {
 	return b.ParseFiles(path)
 }
 
+// Same as `ExtendTemplate` but reads the template from the file system `fsys`
+func ExtendTemplateFS(base *t.Template, fsys fs.FS, path string) (*t.Template, error) {
+	if base == nil {
+		return nil, errors.New("Base page is nil")
+	}
+
+	b, err := base.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	return b.ParseFS(fsys, path)
+}
+
 // Loads templates from given directory
 func LoadTemplates(tt *Templates, p string) error {
+	return LoadTemplatesFS(tt, os.DirFS(p))
+}
+
+// Loads templates from the file system `fsys`
+func LoadTemplatesFS(tt *Templates, fsys fs.FS) error {
 	var err error
 
-	if tt.BaseEmail, err = t.ParseFiles(fp.Join(p, "email/base.txt")); err != nil {
+	if tt.BaseEmail, err = t.ParseFS(fsys, "email/base.txt"); err != nil {
+		return err
+	}
+	if tt.BasePage, err = t.ParseFS(fsys, "page/base.html"); err != nil {
 		return err
 	}
-	if tt.BasePage, err = t.ParseFiles(fp.Join(p, "page/base.html")); err != nil {
+	if tt.ActivateAuthTokenEmail, err = ExtendTemplateFS(tt.BaseEmail, fsys, "email/activate-auth-token.txt"); err != nil {
 		return err
 	}
-	if tt.ActivateAuthTokenEmail, err = ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/activate-auth-token.txt")); err != nil {
+	if tt.DeprecatedVersionEmail, err = ExtendTemplateFS(tt.BaseEmail, fsys, "email/deprecated-version.txt"); err != nil {
 		return err
 	}
-	if tt.DeprecatedVersionEmail, err = ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/deprecated-version.txt")); err != nil {
+	if tt.AccountSuspendedEmail, err = ExtendTemplateFS(tt.BaseEmail, fsys, "email/account-suspended.txt"); err != nil {
 		return err
 	}
-	if tt.ErrorPage, err = ExtendTemplate(tt.BasePage, fp.Join(p, "page/error.html")); err != nil {
+	if tt.ErrorPage, err = ExtendTemplateFS(tt.BasePage, fsys, "page/error.html"); err != nil {
 		return err
 	}
-	if tt.LoginPage, err = ExtendTemplate(tt.BasePage, fp.Join(p, "page/login.html")); err != nil {
+	if tt.LoginPage, err = ExtendTemplateFS(tt.BasePage, fsys, "page/login.html"); err != nil {
 		return err
 	}
-	if tt.Dashboard, err = ExtendTemplate(tt.BasePage, fp.Join(p, "page/dashboard.html")); err != nil {
+	if tt.Dashboard, err = ExtendTemplateFS(tt.BasePage, fsys, "page/dashboard.html"); err != nil {
 		return err
 	}
 
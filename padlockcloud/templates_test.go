@@ -26,6 +26,7 @@ func TestLoadTemplates(t *testing.T) {
 		templates.BaseEmail == nil ||
 		templates.ActivateAuthTokenEmail == nil ||
 		templates.DeprecatedVersionEmail == nil ||
+		templates.AccountSuspendedEmail == nil ||
 		templates.ErrorPage == nil ||
 		templates.LoginPage == nil ||
 		templates.Dashboard == nil {
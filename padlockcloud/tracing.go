@@ -0,0 +1,526 @@
+package padlockcloud
+
+import "bytes"
+import "context"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Minimal request tracing compatible with OpenTelemetry. The official Go SDK and otelhttp pull in
+// a large dependency tree requiring Go modules, which this vendored GOPATH build doesn't support.
+// Only what the server needs is implemented here: spans with W3C trace context propagation and
+// export to an OTLP/HTTP receiver in the JSON encoding
+
+// Default url of the OTLP/HTTP trace receiver of a local OpenTelemetry collector
+const DefaultTracingEndpoint = "http://localhost:4318/v1/traces"
+
+// Maximum number of finished spans buffered between exports. Further spans are dropped
+const maxPendingSpans = 2048
+
+// Interval in which finished spans are exported
+const tracingExportInterval = 5 * time.Second
+
+// Configuration for exporting request traces to an OpenTelemetry collector
+type TracingConfig struct {
+	// Record and export traces. Tracing is a no-op if disabled
+	Enabled bool `yaml:"enabled"`
+	// Url of an OTLP/HTTP trace receiver accepting JSON-encoded spans
+	Endpoint string `yaml:"endpoint"`
+	// Reported as the `service.name` resource attribute. Defaults to "padlock-cloud"
+	ServiceName string `yaml:"service_name"`
+}
+
+// Kind of a span as defined by OpenTelemetry
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// A single timed operation within a trace. All methods are safe to call on a nil span, which
+// is what `Tracer.Start` and `startSpan` return if tracing is disabled
+type Span struct {
+	TraceId    [16]byte
+	SpanId     [8]byte
+	ParentId   [8]byte
+	Name       string
+	Kind       SpanKind
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]interface{}
+	// Error message if the operation failed
+	Err string
+
+	tracer *Tracer
+	mutex  sync.Mutex
+}
+
+// Sets an attribute. Values should be strings, integers or booleans
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Attributes[key] = value
+}
+
+// Marks the span as failed if `err` is not nil
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Err = err.Error()
+}
+
+// Records the end time and hands the span to its tracer for exporting. Calling `End` more than
+// once has no effect
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if !s.EndTime.IsZero() {
+		s.mutex.Unlock()
+		return
+	}
+	s.EndTime = clockNow(s.tracer.Clock)
+	s.mutex.Unlock()
+
+	s.tracer.finish(s)
+}
+
+// Exports finished spans, e.g. to an OpenTelemetry collector
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Creates spans and periodically exports finished ones. A nil tracer creates no spans
+type Tracer struct {
+	Exporter SpanExporter
+	// Called with errors occurring during background exports
+	OnError func(error)
+	// Source for the start and end times of spans. Defaults to the system clock
+	Clock Clock
+
+	mutex   sync.Mutex
+	pending []*Span
+	dropped int
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Creates a new tracer exporting finished spans every `interval`. Spans are only exported when
+// calling `Flush` or `Close` if `interval` is zero
+func NewTracer(exporter SpanExporter, interval time.Duration) *Tracer {
+	t := &Tracer{Exporter: exporter}
+	if interval > 0 {
+		t.stop = make(chan struct{})
+		t.done = make(chan struct{})
+		go t.loop(interval)
+	}
+	return t
+}
+
+func (t *Tracer) loop(interval time.Duration) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.Flush(); err != nil && t.OnError != nil {
+				t.OnError(err)
+			}
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+type spanContextKey struct{}
+type remoteParentContextKey struct{}
+
+// Span context of a remote parent, extracted from a `traceparent` header
+type remoteParent struct {
+	traceId [16]byte
+	spanId  [8]byte
+}
+
+// Returns the span stored in `ctx`, if any
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+// Starts a new span. The span becomes a child of the span in `ctx` or, if there is none, of the
+// remote parent set by `withRemoteParent`. Otherwise a new trace is started
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  clockNow(t.Clock),
+		Attributes: make(map[string]interface{}),
+		tracer:     t,
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.TraceId = parent.TraceId
+		s.ParentId = parent.SpanId
+	} else if remote, ok := ctx.Value(remoteParentContextKey{}).(*remoteParent); ok {
+		s.TraceId = remote.traceId
+		s.ParentId = remote.spanId
+	} else if b, err := randomBytes(len(s.TraceId)); err == nil {
+		copy(s.TraceId[:], b)
+	}
+
+	if b, err := randomBytes(len(s.SpanId)); err == nil {
+		copy(s.SpanId[:], b)
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// Starts a child of the span in `ctx`. Does nothing if `ctx` has no span, so instrumented code
+// only records spans as part of a traced request
+func startSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, SpanKindInternal)
+}
+
+// Parses a W3C `traceparent` header and stores it in the context so spans started from it
+// continue the caller's trace
+func withRemoteParent(ctx context.Context, header string) context.Context {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return ctx
+	}
+
+	var p remoteParent
+	traceId, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceId) != len(p.traceId) {
+		return ctx
+	}
+	spanId, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanId) != len(p.spanId) {
+		return ctx
+	}
+	copy(p.traceId[:], traceId)
+	copy(p.spanId[:], spanId)
+
+	if p.traceId == [16]byte{} || p.spanId == [8]byte{} {
+		return ctx
+	}
+
+	return context.WithValue(ctx, remoteParentContextKey{}, &p)
+}
+
+func (t *Tracer) finish(s *Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.pending) >= maxPendingSpans {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, s)
+}
+
+// Exports all finished spans
+func (t *Tracer) Flush() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	spans := t.pending
+	dropped := t.dropped
+	t.pending = nil
+	t.dropped = 0
+	t.mutex.Unlock()
+
+	if len(spans) != 0 {
+		if err := t.Exporter.ExportSpans(spans); err != nil {
+			return err
+		}
+	}
+
+	if dropped != 0 {
+		return fmt.Errorf("padlock: dropped %d spans since the export buffer was full", dropped)
+	}
+
+	return nil
+}
+
+// Stops exporting in the background and exports all remaining spans
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	if t.stop != nil {
+		close(t.stop)
+		<-t.done
+		t.stop = nil
+	}
+	return t.Flush()
+}
+
+// Exports spans to an OpenTelemetry collector using the JSON encoding of OTLP/HTTP
+type OTLPExporter struct {
+	Url         string
+	ServiceName string
+	Client      *http.Client
+}
+
+func NewOTLPExporter(config *TracingConfig) *OTLPExporter {
+	e := &OTLPExporter{
+		Url:         config.Endpoint,
+		ServiceName: config.ServiceName,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	if e.Url == "" {
+		e.Url = DefaultTracingEndpoint
+	}
+	if e.ServiceName == "" {
+		e.ServiceName = "padlock-cloud"
+	}
+	return e
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	var res []otlpAttribute
+	for key, value := range attrs {
+		var v otlpValue
+		switch value := value.(type) {
+		case bool:
+			v.BoolValue = &value
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		res = append(res, otlpAttribute{key, v})
+	}
+	return res
+}
+
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	var otlpSpans []otlpSpan
+	for _, s := range spans {
+		s.mutex.Lock()
+		o := otlpSpan{
+			TraceId:           hex.EncodeToString(s.TraceId[:]),
+			SpanId:            hex.EncodeToString(s.SpanId[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.ParentId != [8]byte{} {
+			o.ParentSpanId = hex.EncodeToString(s.ParentId[:])
+		}
+		if s.Err != "" {
+			o.Status = otlpStatus{2, s.Err}
+		}
+		s.mutex.Unlock()
+		otlpSpans = append(otlpSpans, o)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": e.ServiceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "padlock-cloud", "version": Version},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := e.Client.Post(e.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("padlock: exporting spans to %s failed with status %d", e.Url, res.StatusCode)
+	}
+
+	return nil
+}
+
+// Records the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Records a span for each request, continuing the caller's trace if the request has a
+// `traceparent` header. Handlers further down add attributes like the authenticated account
+// and start child spans through the request context
+type Trace struct {
+	*Tracer
+	Route string
+}
+
+func (m *Trace) Wrap(h Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, a *AuthToken) error {
+		ctx := withRemoteParent(r.Context(), r.Header.Get("traceparent"))
+		ctx, span := m.Start(ctx, r.Method+" "+m.Route, SpanKindServer)
+		defer span.End()
+
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("http.route", m.Route)
+		span.SetAttribute("url.path", r.URL.Path)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		err := h.Handle(rec, r.WithContext(ctx), a)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttribute("http.response.status_code", status)
+		if status >= 500 {
+			span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+		}
+
+		return err
+	})
+}
+
+// Records a child span for each storage operation performed as part of a traced request
+type TracedStorage struct {
+	Storage
+}
+
+func (s *TracedStorage) trace(ctx context.Context, op string, t Storable, fn func(context.Context) error) error {
+	ctx, span := startSpan(ctx, "storage."+op)
+	defer span.End()
+
+	span.SetAttribute("padlock.storage.type", StorableTypes[typeFromStorable(t)])
+	err := fn(ctx)
+	if err != ErrNotFound {
+		span.SetError(err)
+	}
+	return err
+}
+
+func (s *TracedStorage) GetCtx(ctx context.Context, t Storable) error {
+	return s.trace(ctx, "get", t, func(ctx context.Context) error {
+		return s.Storage.GetCtx(ctx, t)
+	})
+}
+
+func (s *TracedStorage) PutCtx(ctx context.Context, t Storable) error {
+	return s.trace(ctx, "put", t, func(ctx context.Context) error {
+		return s.Storage.PutCtx(ctx, t)
+	})
+}
+
+func (s *TracedStorage) DeleteCtx(ctx context.Context, t Storable) error {
+	return s.trace(ctx, "delete", t, func(ctx context.Context) error {
+		return s.Storage.DeleteCtx(ctx, t)
+	})
+}
+
+func (s *TracedStorage) ListFuncCtx(ctx context.Context, t Storable, fn func(key string) error) error {
+	return s.trace(ctx, "list", t, func(ctx context.Context) error {
+		return s.Storage.ListFuncCtx(ctx, t, fn)
+	})
+}
+
+func (s *TracedStorage) ListPrefixFuncCtx(ctx context.Context, t Storable, prefix string, fn func(key string, size int) error) error {
+	return s.trace(ctx, "list", t, func(ctx context.Context) error {
+		return s.Storage.ListPrefixFuncCtx(ctx, t, prefix, fn)
+	})
+}
+
+func (s *TracedStorage) ListCtx(ctx context.Context, t Storable) ([]string, error) {
+	var keys []string
+	err := s.trace(ctx, "list", t, func(ctx context.Context) error {
+		var err error
+		keys, err = s.Storage.ListCtx(ctx, t)
+		return err
+	})
+	return keys, err
+}
+
+// Returns the storage wrapped by `TracedStorage`, for checking which optional interfaces it
+// implements
+func unwrapStorage(s Storage) Storage {
+	if t, ok := s.(*TracedStorage); ok {
+		return t.Storage
+	}
+	return s
+}
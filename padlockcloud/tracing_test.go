@@ -0,0 +1,148 @@
+package padlockcloud
+
+import "context"
+import "encoding/hex"
+import "encoding/json"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "sync"
+import "testing"
+
+// Keeps exported spans in memory
+type memorySpanExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func (e *memorySpanExporter) ExportSpans(spans []*Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	ctx := newServerTestContext()
+	exporter := &memorySpanExporter{}
+	ctx.server.Tracer = NewTracer(exporter, 0)
+	ctx.server.Storage = &TracedStorage{ctx.server.Storage}
+	ctx.server.InitHandler()
+	testServer := httptest.NewServer(ctx.server.Handler)
+	defer testServer.Close()
+	ctx.host = testServer.URL
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	ctx.server.Tracer.Flush()
+	exporter.spans = nil
+
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentId := "00f067aa0ba902b7"
+	req, _ := http.NewRequest("GET", ctx.host+"/store/", nil)
+	req.Header.Set("Accept", "application/vnd.padlock;version=1")
+	req.Header.Set("Authorization", ctx.authToken.String())
+	req.Header.Set("traceparent", "00-"+traceId+"-"+parentId+"-01")
+	res, err := ctx.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if err := ctx.server.Tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var root *Span
+	for _, s := range exporter.spans {
+		if s.Kind == SpanKindServer {
+			root = s
+		}
+	}
+	if root == nil {
+		t.Fatalf("Expected a span for the request, got %d spans", len(exporter.spans))
+	}
+
+	if root.Name != "GET /store/" {
+		t.Errorf("Expected span name 'GET /store/', got '%s'", root.Name)
+	}
+	if hex.EncodeToString(root.TraceId[:]) != traceId || hex.EncodeToString(root.ParentId[:]) != parentId {
+		t.Errorf("Expected request span to continue the caller's trace, got trace %x, parent %x", root.TraceId, root.ParentId)
+	}
+	for _, value := range root.Attributes {
+		if value == testEmail {
+			t.Error("Expected span not to contain the account's email")
+		}
+	}
+	for key, value := range map[string]interface{}{
+		"http.route":                "/store/",
+		"http.response.status_code": http.StatusOK,
+		"padlock.auth_token":        ctx.authToken.Id,
+	} {
+		if root.Attributes[key] != value {
+			t.Errorf("Expected attribute %s to be %v, got %v", key, value, root.Attributes[key])
+		}
+	}
+
+	children := map[string]bool{}
+	for _, s := range exporter.spans {
+		if s.ParentId == root.SpanId && s.TraceId == root.TraceId {
+			children[s.Name] = true
+		}
+	}
+	if !children["storage.get"] || !children["storage.put"] {
+		t.Errorf("Expected storage child spans, got %v", children)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "test", SpanKindServer)
+	span.SetAttribute("key", "value")
+	span.End()
+
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Error("Expected no span to be recorded if tracing is disabled")
+	}
+
+	if _, span := startSpan(ctx, "child"); span != nil {
+		t.Error("Expected no child span without a parent")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &body)
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(NewOTLPExporter(&TracingConfig{Endpoint: collector.URL}), 0)
+	ctx, span := tracer.Start(context.Background(), "GET /store/", SpanKindServer)
+	_, child := startSpan(ctx, "storage.get")
+	child.End()
+	span.SetAttribute("http.response.status_code", 200)
+	span.End()
+
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	resourceSpans, _ := body["resourceSpans"].([]interface{})
+	if len(resourceSpans) != 1 {
+		t.Fatalf("Expected one resource, got %v", body)
+	}
+	scopeSpans := resourceSpans[0].(map[string]interface{})["scopeSpans"].([]interface{})
+	spans := scopeSpans[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+
+	exported := spans[0].(map[string]interface{})
+	if exported["traceId"] != hex.EncodeToString(child.TraceId[:]) ||
+		exported["parentSpanId"] != hex.EncodeToString(span.SpanId[:]) {
+		t.Errorf("Expected child span to reference its parent, got %v", exported)
+	}
+}
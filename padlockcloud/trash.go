@@ -0,0 +1,199 @@
+package padlockcloud
+
+import "sort"
+import "time"
+import "encoding/json"
+
+// An account with the same email already exists
+var ErrAccountExists = &kindError{"padlock: account already exists", ErrConflict}
+
+// Interval in which expired accounts are purged from the trash
+const trashPurgeInterval = time.Hour
+
+// A deleted account along with its data. Trashed accounts can be restored until they are purged
+type TrashedAccount struct {
+	Account *Account
+	// Contents of the data store associated with the account, if any
+	Data []byte
+	// Contents of the account's named vaults, if any
+	Vaults map[string][]byte `json:",omitempty"`
+	// Stored versions of the account's data, oldest first
+	Versions []*DataVersion `json:",omitempty"`
+	// Time the account was deleted
+	Deleted time.Time
+}
+
+// Implementation of the `Storable.Key` interface method
+func (ta *TrashedAccount) Key() []byte {
+	return []byte(ta.Account.Email)
+}
+
+// Implementation of the `Storable.Deserialize` interface method
+func (ta *TrashedAccount) Deserialize(data []byte) error {
+	return json.Unmarshal(data, ta)
+}
+
+// Implementation of the `Storable.Serialize` interface method
+func (ta *TrashedAccount) Serialize() ([]byte, error) {
+	return json.Marshal(ta)
+}
+
+// Moves the account with the given email and its data to the trash, recording the deletion time
+// from `clock` (or the system clock if nil)
+func TrashAccount(storage Storage, email string, clock Clock) error {
+	acc, err := GetAccount(storage, email)
+	if err != nil {
+		return err
+	}
+
+	ta := &TrashedAccount{Account: acc, Deleted: clockNow(clock)}
+
+	data := &DataStore{Account: acc}
+	if err := storage.Get(data); err == nil {
+		ta.Data = data.Content
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	if ta.Vaults, err = GetVaults(storage, email); err != nil {
+		return err
+	}
+
+	if ta.Versions, err = ListDataVersions(storage, email); err != nil {
+		return err
+	}
+
+	ops, err := deleteAccountOps(storage, email)
+	if err != nil {
+		return err
+	}
+
+	return storage.Batch(append(ops, PutOp(ta)))
+}
+
+// Restores a trashed account along with its data. Returns `ErrAccountExists` if a new account
+// with the same email has been created in the meantime
+func RestoreAccount(storage Storage, email string) error {
+	ta := &TrashedAccount{Account: &Account{Email: email}}
+	if err := storage.Get(ta); err != nil {
+		return err
+	}
+
+	if _, err := GetAccount(storage, email); err == nil {
+		return ErrAccountExists
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	ops := append(putVaultOps(email, ta.Vaults), PutOp(ta.Account), DeleteOp(ta))
+	if ta.Data != nil {
+		ops = append(ops, PutOp(&DataStore{Account: ta.Account, Content: ta.Data}))
+	}
+	if len(ta.Versions) > 0 {
+		ops = append(ops, PutOp(&DataHistory{Email: email, Versions: ta.Versions}))
+	}
+
+	return storage.Batch(ops)
+}
+
+// Fetches all trashed accounts, sorted by email
+func ListTrash(storage Storage) ([]*TrashedAccount, error) {
+	iter, err := storage.Iterator(&TrashedAccount{})
+	if err == ErrUnregisteredStorable {
+		// The memory storage returns this error if nothing has been trashed yet
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	var trashed []*TrashedAccount
+	for iter.Next() {
+		ta := &TrashedAccount{}
+		if err := iter.Get(ta); err != nil {
+			return nil, err
+		}
+		trashed = append(trashed, ta)
+	}
+
+	sort.Slice(trashed, func(i, j int) bool {
+		return trashed[i].Account.Email < trashed[j].Account.Email
+	})
+
+	return trashed, nil
+}
+
+// Permanently removes all accounts that have been in the trash for longer than `retention`
+// according to `clock`. Nothing is purged if `retention` isn't positive, since the trash is
+// disabled then. Returns the number of purged accounts
+func PurgeTrash(storage Storage, retention time.Duration, clock Clock) (int, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+	now := clockNow(clock)
+	return purgeTrash(storage, func(ta *TrashedAccount) bool {
+		return now.Sub(ta.Deleted) >= retention
+	})
+}
+
+// Permanently removes all accounts from the trash, regardless of when they were deleted. Returns
+// the number of purged accounts
+func EmptyTrash(storage Storage) (int, error) {
+	return purgeTrash(storage, func(*TrashedAccount) bool {
+		return true
+	})
+}
+
+// Permanently removes all trashed accounts for which `expired` returns true. Data versions are
+// kept in the trashed account, so they are removed along with it
+func purgeTrash(storage Storage, expired func(*TrashedAccount) bool) (int, error) {
+	trashed, err := ListTrash(storage)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, ta := range trashed {
+		if !expired(ta) {
+			continue
+		}
+		if err := storage.Delete(ta); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// Deletes an account, moving it to the trash if a trash retention period is configured
+func (server *Server) DeleteAccount(email string) error {
+	if server.Config.TrashRetention > 0 {
+		return TrashAccount(server.Storage, email, server.Clock)
+	}
+	return DeleteAccount(server.Storage, email)
+}
+
+// Sets up periodic purging of the trash if a trash retention period is configured
+func (server *Server) InitTrash() {
+	retention := server.Config.TrashRetention
+	if retention == 0 {
+		return
+	}
+
+	server.purgeTrash = &Job{
+		Action: func() {
+			if n, err := PurgeTrash(server.Storage, retention, server.Clock); err != nil {
+				server.Log.Error.Println("Error while purging trash:", err)
+			} else if n > 0 {
+				server.Log.Info.Printf("Purged %d accounts from trash", n)
+			}
+		},
+	}
+
+	server.purgeTrash.Start(trashPurgeInterval)
+}
+
+func init() {
+	RegisterStorable(&TrashedAccount{}, "auth-accounts-trash")
+}
@@ -0,0 +1,127 @@
+package padlockcloud
+
+import "testing"
+import "time"
+
+func TestTrash(t *testing.T) {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	storage := &MemoryStorage{Clock: clock}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	trash := func(email string) {
+		if _, err := CreateAccount(storage, email); err != nil && err != ErrAccountExists {
+			t.Fatal(err)
+		}
+		if err := storage.Put(&DataStore{Account: &Account{Email: email}, Content: []byte("data")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := RecordDataVersion(storage, email, []byte("old data"), 5, clock); err != nil {
+			t.Fatal(err)
+		}
+		if err := TrashAccount(storage, email, clock); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("delete and restore", func(t *testing.T) {
+		trash(testEmail)
+
+		// Trashed accounts should be excluded from normal lookups
+		if _, err := GetAccount(storage, testEmail); err != ErrNotFound {
+			t.Fatalf("Expected trashed account not to be found, got %v", err)
+		}
+		if accounts, _ := ListAccounts(storage); len(accounts) != 0 {
+			t.Fatalf("Expected no accounts, got %d", len(accounts))
+		}
+		if trashed, _ := ListTrash(storage); len(trashed) != 1 || !trashed[0].Deleted.Equal(start) {
+			t.Fatalf("Expected account to be in trash, got %v", trashed)
+		}
+		if versions, _ := ListDataVersions(storage, testEmail); len(versions) != 0 {
+			t.Fatalf("Expected data versions to be moved to the trash, got %d", len(versions))
+		}
+
+		if err := RestoreAccount(storage, testEmail); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := GetAccount(storage, testEmail); err != nil {
+			t.Fatalf("Expected account to be restored, got %v", err)
+		}
+		data := &DataStore{Account: &Account{Email: testEmail}}
+		if err := storage.Get(data); err != nil || string(data.Content) != "data" {
+			t.Fatalf("Expected data to be restored, got %v", err)
+		}
+		if versions, _ := ListDataVersions(storage, testEmail); len(versions) != 1 || string(versions[0].Content) != "old data" {
+			t.Fatalf("Expected data versions to be restored, got %v", versions)
+		}
+		if trashed, _ := ListTrash(storage); len(trashed) != 0 {
+			t.Fatalf("Expected trash to be empty, got %d", len(trashed))
+		}
+
+		if err := RestoreAccount(storage, testEmail); err != ErrNotFound {
+			t.Fatalf("Expected not found error, got %v", err)
+		}
+	})
+
+	t.Run("restore existing", func(t *testing.T) {
+		trash(testEmail)
+
+		if _, err := CreateAccount(storage, testEmail); err != nil {
+			t.Fatal(err)
+		}
+		if err := RestoreAccount(storage, testEmail); err != ErrAccountExists {
+			t.Fatalf("Expected account exists error, got %v", err)
+		}
+
+		if err := DeleteAccount(storage, testEmail); err != nil {
+			t.Fatal(err)
+		}
+		if err := RestoreAccount(storage, testEmail); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("delete and purge", func(t *testing.T) {
+		trash(testEmail)
+		clock.Set(start.Add(12 * time.Hour))
+		trash("other@padlock.io")
+
+		// Neither account has been in the trash for the full retention period
+		clock.Set(start.Add(23 * time.Hour))
+		if n, err := PurgeTrash(storage, 24*time.Hour, clock); err != nil || n != 0 {
+			t.Fatalf("Expected no accounts to be purged, got %d, %v", n, err)
+		}
+
+		clock.Set(start.Add(24 * time.Hour))
+		if n, err := PurgeTrash(storage, 24*time.Hour, clock); err != nil || n != 1 {
+			t.Fatalf("Expected 1 account to be purged, got %d, %v", n, err)
+		}
+
+		if err := RestoreAccount(storage, testEmail); err != ErrNotFound {
+			t.Fatalf("Expected purged account to be gone, got %v", err)
+		}
+		if versions, _ := ListDataVersions(storage, testEmail); len(versions) != 0 {
+			t.Fatalf("Expected data versions to be purged along with the account, got %d", len(versions))
+		}
+		if trashed, _ := ListTrash(storage); len(trashed) != 1 || trashed[0].Account.Email != "other@padlock.io" {
+			t.Fatalf("Expected other account to remain in trash, got %v", trashed)
+		}
+
+		// Without a retention period, the trash is disabled rather than purged completely
+		if n, err := PurgeTrash(storage, 0, clock); err != nil || n != 0 {
+			t.Fatalf("Expected no accounts to be purged without retention, got %d, %v", n, err)
+		}
+
+		if n, err := EmptyTrash(storage); err != nil || n != 1 {
+			t.Fatalf("Expected 1 account to be purged, got %d, %v", n, err)
+		}
+		if trashed, _ := ListTrash(storage); len(trashed) != 0 {
+			t.Fatalf("Expected trash to be empty, got %v", trashed)
+		}
+	})
+}
@@ -1,11 +1,13 @@
 package padlockcloud
 
+import "fmt"
+import "io"
 import "encoding/base64"
 import "crypto/rand"
 import "os"
 import "path/filepath"
 
-const tokenPattern = `[a-zA-Z0-9\-_]{22}`
+const tokenPattern = `[a-zA-Z0-9\-_]{22,}`
 
 var gopath = os.Getenv("GOPATH")
 var DefaultAssetsPath = filepath.Join(gopath, "src/github.com/maklesoft/padlock-cloud/assets")
@@ -28,6 +30,36 @@ func randomBase64(nBytes int) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func token() (string, error) {
-	return randomBase64(16)
+// Default number of random bytes used for generating tokens
+const DefaultTokenBytes = 16
+
+// Generates a random, url-safe token from `n` random bytes
+func token(n int) (string, error) {
+	return randomBase64(n)
+}
+
+// Formats a number of bytes as a human-readable string, e.g. "1.5 MB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Wraps an `io.Writer` and counts the number of bytes written to it
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
 }
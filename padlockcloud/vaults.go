@@ -0,0 +1,125 @@
+package padlockcloud
+
+import "regexp"
+import "strings"
+
+// Names of vaults may only contain letters, digits, dashes and underscores
+var vaultNamePattern = regexp.MustCompile("^[a-zA-Z0-9_-]{1,64}$")
+
+// Names taken by other endpoints under /store/
+var reservedVaultNames = map[string]bool{
+	"usage": true,
+}
+
+// Returns true if `name` can be used as the name of a vault
+func ValidVaultName(name string) bool {
+	return vaultNamePattern.MatchString(name) && !reservedVaultNames[name]
+}
+
+// Data of a named vault. Accounts can store any number of named vaults in addition to the data
+// store used by clients that don't specify a vault name
+type Vault struct {
+	Email   string
+	Name    string
+	Content []byte
+}
+
+// Implementation of the `Storable.Key` interface method. Vault names can't contain slashes, so
+// keys can always be split into the email and the name at the last slash
+func (v *Vault) Key() []byte {
+	return []byte(v.Email + "/" + v.Name)
+}
+
+// Creates an empty vault with the given key, as returned by `Vault.Key`
+func vaultFromKey(key string) *Vault {
+	i := strings.LastIndex(key, "/")
+	if i == -1 {
+		return &Vault{Email: key}
+	}
+	return &Vault{Email: key[:i], Name: key[i+1:]}
+}
+
+// Implementation of the `Storable.Deserialize` interface method
+func (v *Vault) Deserialize(data []byte) error {
+	v.Content = data
+	return nil
+}
+
+// Implementation of the `Storable.Serialize` interface method
+func (v *Vault) Serialize() ([]byte, error) {
+	return v.Content, nil
+}
+
+// Returns the names of all vaults of the account with the given email, sorted alphabetically
+func ListVaults(storage Storage, email string) ([]string, error) {
+	var names []string
+	prefix := email + "/"
+	err := storage.ListPrefixFunc(&Vault{}, prefix, func(key string, size int) error {
+		if name := strings.TrimPrefix(key, prefix); ValidVaultName(name) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Fetches the contents of all vaults of the account with the given email, mapped by name
+func GetVaults(storage Storage, email string) (map[string][]byte, error) {
+	names, err := ListVaults(storage, email)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	vaults := make(map[string][]byte, len(names))
+	for _, name := range names {
+		v := &Vault{Email: email, Name: name}
+		if err := storage.Get(v); err != nil {
+			return nil, err
+		}
+		vaults[name] = v.Content
+	}
+	return vaults, nil
+}
+
+// Stores the given vaults for the account with the given email
+func PutVaults(storage Storage, email string, vaults map[string][]byte) error {
+	return storage.Batch(putVaultOps(email, vaults))
+}
+
+// Writes for storing the given vaults
+func putVaultOps(email string, vaults map[string][]byte) []BatchOp {
+	var ops []BatchOp
+	for name, content := range vaults {
+		ops = append(ops, PutOp(&Vault{Email: email, Name: name, Content: content}))
+	}
+	return ops
+}
+
+// Removes all vaults of the account with the given email
+func DeleteVaults(storage Storage, email string) error {
+	ops, err := deleteVaultOps(storage, email)
+	if err != nil {
+		return err
+	}
+	return storage.Batch(ops)
+}
+
+// Writes for removing all vaults of the account with the given email
+func deleteVaultOps(storage Storage, email string) ([]BatchOp, error) {
+	names, err := ListVaults(storage, email)
+	if err != nil {
+		return nil, err
+	}
+	var ops []BatchOp
+	for _, name := range names {
+		ops = append(ops, DeleteOp(&Vault{Email: email, Name: name}))
+	}
+	return ops, nil
+}
+
+func init() {
+	RegisterStorable(&Vault{}, "vaults")
+}
@@ -0,0 +1,221 @@
+package padlockcloud
+
+import "net/http"
+import "reflect"
+import "testing"
+
+func TestVaults(t *testing.T) {
+	ctx := newServerTestContext()
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method string, path string, body string) *http.Response {
+		res, err := ctx.request(method, ctx.host+path, body, ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	testResponse(t, request("PUT", "/store/", testData), http.StatusNoContent, "")
+	testResponse(t, request("PUT", "/store/work", "work data"), http.StatusNoContent, "")
+	testResponse(t, request("PUT", "/store/personal", "personal data"), http.StatusNoContent, "")
+
+	// Each vault should be stored separately from the default data store
+	testResponse(t, request("GET", "/store/", ""), http.StatusOK, testData)
+	testResponse(t, request("GET", "/store/work", ""), http.StatusOK, "work data")
+	testResponse(t, request("GET", "/store/personal", ""), http.StatusOK, "personal data")
+	testResponse(t, request("GET", "/store/unknown", ""), http.StatusOK, "")
+
+	if names, err := ListVaults(ctx.storage, testEmail); err != nil || !reflect.DeepEqual(names, []string{"personal", "work"}) {
+		t.Errorf("Expected vaults personal and work, got %v, %v", names, err)
+	}
+
+	testError(t, request("PUT", "/store/a/b", "data"), &BadRequest{"invalid vault name"})
+
+	// Deleting a named vault shouldn't affect any other data
+	testResponse(t, request("DELETE", "/store/work", ""), http.StatusNoContent, "")
+	testResponse(t, request("GET", "/store/work", ""), http.StatusOK, "")
+	testResponse(t, request("GET", "/store/personal", ""), http.StatusOK, "personal data")
+	testResponse(t, request("GET", "/store/", ""), http.StatusOK, testData)
+
+	// Resetting the account's data should remove all vaults
+	if err := ResetAccountData(ctx.storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := ListVaults(ctx.storage, testEmail); err != nil || len(names) != 0 {
+		t.Errorf("Expected all vaults to be deleted, got %v, %v", names, err)
+	}
+}
+
+func TestVaultsFollowAccount(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	newEmail := "new@padlock.io"
+	if _, err := CreateAccount(storage, testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&Vault{Email: testEmail, Name: "work", Content: []byte("work data")}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]byte{"work": []byte("work data")}
+
+	// Vaults should be moved when renaming an account
+	if err := RenameAccount(storage, testEmail, newEmail); err != nil {
+		t.Fatal(err)
+	}
+	if vaults, err := GetVaults(storage, newEmail); err != nil || !reflect.DeepEqual(vaults, expected) {
+		t.Errorf("Expected vaults to be moved to the new email, got %v, %v", vaults, err)
+	}
+	if names, _ := ListVaults(storage, testEmail); len(names) != 0 {
+		t.Errorf("Expected no vaults to be left for the old email, got %v", names)
+	}
+
+	// ...and kept in the trash when deleting it
+	if err := TrashAccount(storage, newEmail, nil); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := ListVaults(storage, newEmail); len(names) != 0 {
+		t.Errorf("Expected vaults to be moved to the trash, got %v", names)
+	}
+	if err := RestoreAccount(storage, newEmail); err != nil {
+		t.Fatal(err)
+	}
+	if vaults, err := GetVaults(storage, newEmail); err != nil || !reflect.DeepEqual(vaults, expected) {
+		t.Errorf("Expected vaults to be restored, got %v, %v", vaults, err)
+	}
+}
+
+func TestVaultLimits(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.MaxVaultsPerAccount = 2
+	ctx.server.Config.MaxVaultBytesPerAccount = 10
+	defer func() {
+		ctx.server.Config.MaxVaultsPerAccount = 0
+		ctx.server.Config.MaxVaultBytesPerAccount = 0
+	}()
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method string, path string, body string) *http.Response {
+		res, err := ctx.request(method, ctx.host+path, body, ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	testResponse(t, request("PUT", "/store/a", "0123"), http.StatusNoContent, "")
+	testResponse(t, request("PUT", "/store/b", "0123"), http.StatusNoContent, "")
+
+	// Creating a third vault should fail, but existing ones can still be replaced
+	testError(t, request("PUT", "/store/c", "0"), &TooManyVaults{2})
+	testResponse(t, request("PUT", "/store/b", "012345"), http.StatusNoContent, "")
+
+	// The combined size of all vaults is limited
+	testError(t, request("PUT", "/store/b", "0123456"), &VaultStorageExceeded{10})
+
+	// The data store doesn't count towards the vault limits
+	testResponse(t, request("PUT", "/store/", "0123456789abc"), http.StatusNoContent, "")
+
+	// Deleting a vault makes room for a new one
+	testResponse(t, request("DELETE", "/store/a", ""), http.StatusNoContent, "")
+	testResponse(t, request("PUT", "/store/c", "0123"), http.StatusNoContent, "")
+}
+
+func TestDataQuota(t *testing.T) {
+	ctx := newServerTestContext()
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err := GetAccount(ctx.storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc.DataQuota = 10
+	if err := ctx.storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method string, path string, body string) *http.Response {
+		res, err := ctx.request(method, ctx.host+path, body, ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	testResponse(t, request("PUT", "/store/", "0123"), http.StatusNoContent, "")
+	testResponse(t, request("PUT", "/store/a", "0123"), http.StatusNoContent, "")
+
+	// The data store and vaults count towards the same quota
+	testError(t, request("PUT", "/store/b", "0123"), &DataQuotaExceeded{10})
+	testError(t, request("PUT", "/store/", "0123456"), &DataQuotaExceeded{10})
+
+	// Replaced data doesn't count
+	testResponse(t, request("PUT", "/store/", "012345"), http.StatusNoContent, "")
+	testResponse(t, request("PUT", "/store/a", "01"), http.StatusNoContent, "")
+	testResponse(t, request("PUT", "/store/b", "01"), http.StatusNoContent, "")
+}
+
+func TestStoreUsage(t *testing.T) {
+	ctx := newServerTestContext()
+
+	// Usage is only available to authenticated accounts
+	res, err := ctx.request("GET", ctx.host+"/store/usage", "", ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &InvalidAuthToken{})
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method string, path string, body string) *http.Response {
+		res, err := ctx.request(method, ctx.host+path, body, ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	testResponse(t, request("GET", "/store/usage", ""), http.StatusOK, `{"bytes":0}`)
+
+	// Usage should reflect recent writes to the data store and vaults
+	testResponse(t, request("PUT", "/store/", "0123456789"), http.StatusNoContent, "")
+	testResponse(t, request("PUT", "/store/work", "01234"), http.StatusNoContent, "")
+	testResponse(t, request("GET", "/store/usage", ""), http.StatusOK, `{"bytes":15,"vaults":{"work":5}}`)
+
+	// Data of other accounts shouldn't be counted
+	if err := ctx.storage.Put(&Vault{Email: "other@padlock.io", Name: "work", Content: []byte("other data")}); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, request("GET", "/store/usage", ""), http.StatusOK, `{"bytes":15,"vaults":{"work":5}}`)
+
+	// The quota is reported along with the percentage used, if the account has one
+	acc, err := GetAccount(ctx.storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc.DataQuota = 40
+	if err := ctx.storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, request("GET", "/store/usage", ""), http.StatusOK,
+		`{"bytes":15,"vaults":{"work":5},"quota":{"limit":40,"percentUsed":37.5}}`)
+
+	// "usage" can't be used as a vault name
+	testError(t, request("PUT", "/store/usage", "data"), &MethodNotAllowed{})
+	testError(t, request("DELETE", "/store/usage", ""), &MethodNotAllowed{})
+}
@@ -1,3 +1,7 @@
 package padlockcloud
 
 const Version = "1.0.0"
+
+// Git commit the binary was built from. Set at build time via
+// `-ldflags "-X github.com/maklesoft/padlock-cloud/padlockcloud.Commit=<commit>"`
+var Commit = ""
@@ -0,0 +1,116 @@
+package padlockcloud
+
+import "time"
+import "encoding/json"
+
+// A previously written version of an account's data
+type DataVersion struct {
+	// Sequential version number, starting at 1
+	Version int
+	// Time the data was written
+	Created time.Time
+	Content []byte
+}
+
+// The most recently written versions of an account's data, oldest first
+type DataHistory struct {
+	Email    string
+	Versions []*DataVersion
+}
+
+// Implementation of the `Storable.Key` interface method
+func (h *DataHistory) Key() []byte {
+	return []byte(h.Email)
+}
+
+// Implementation of the `Storable.Deserialize` interface method
+func (h *DataHistory) Deserialize(data []byte) error {
+	return json.Unmarshal(data, h)
+}
+
+// Implementation of the `Storable.Serialize` interface method
+func (h *DataHistory) Serialize() ([]byte, error) {
+	return json.Marshal(h)
+}
+
+// Fetches the stored versions of the data of the account with the given email, oldest first
+func ListDataVersions(storage Storage, email string) ([]*DataVersion, error) {
+	h := &DataHistory{Email: email}
+	if err := storage.Get(h); err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return h.Versions, nil
+}
+
+// Records `content` as the newest version of the data of the account with the given email,
+// pruning all but the last `keep` versions. The version is timestamped using `clock`, or the
+// system clock if nil. Does nothing if `keep` is not positive
+func RecordDataVersion(storage Storage, email string, content []byte, keep int, clock Clock) error {
+	ops, err := recordDataVersionOps(storage, email, content, keep, clock)
+	if err != nil {
+		return err
+	}
+	return storage.Batch(ops)
+}
+
+// Writes for recording `content` as the newest version, as described in `RecordDataVersion`
+func recordDataVersionOps(storage Storage, email string, content []byte, keep int, clock Clock) ([]BatchOp, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+
+	h := &DataHistory{Email: email}
+	if err := storage.Get(h); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	version := 1
+	if n := len(h.Versions); n > 0 {
+		version = h.Versions[n-1].Version + 1
+	}
+	h.Versions = append(h.Versions, &DataVersion{version, clockNow(clock), content})
+
+	if len(h.Versions) > keep {
+		h.Versions = h.Versions[len(h.Versions)-keep:]
+	}
+
+	return []BatchOp{PutOp(h)}, nil
+}
+
+// Restores the given version of the data of the account with the given email. The restored data
+// is recorded as a new version so the rollback itself can be undone. Returns `ErrNotFound` if
+// no such account or version exists
+func RollbackData(storage Storage, email string, version int, keep int, clock Clock) error {
+	acc, err := GetAccount(storage, email)
+	if err != nil {
+		return err
+	}
+
+	versions, err := ListDataVersions(storage, email)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		if v.Version == version {
+			ops, err := recordDataVersionOps(storage, email, v.Content, keep, clock)
+			if err != nil {
+				return err
+			}
+			return storage.Batch(append(ops, PutOp(&DataStore{Account: acc, Content: v.Content})))
+		}
+	}
+
+	return ErrNotFound
+}
+
+// Removes all stored versions of the data of the account with the given email
+func DeleteDataVersions(storage Storage, email string) error {
+	return storage.Delete(&DataHistory{Email: email})
+}
+
+func init() {
+	RegisterStorable(&DataHistory{}, "data-versions")
+}
@@ -0,0 +1,110 @@
+package padlockcloud
+
+import "testing"
+import "fmt"
+import "net/http"
+
+func TestDataVersions(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	acc, err := CreateAccount(storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Recording versions should be a no-op if versioning is disabled
+	if err := RecordDataVersion(storage, testEmail, []byte("data0"), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := ListDataVersions(storage, testEmail); err != nil || len(versions) != 0 {
+		t.Fatalf("Expected no versions, got %v, %v", versions, err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		content := []byte(fmt.Sprintf("data%d", i))
+		if err := storage.Put(&DataStore{Account: acc, Content: content}); err != nil {
+			t.Fatal(err)
+		}
+		if err := RecordDataVersion(storage, testEmail, content, 3, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the last 3 versions should be kept
+	versions, err := ListDataVersions(storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("Expected 3 versions, got %d", len(versions))
+	}
+	for i, v := range versions {
+		if v.Version != i+3 || string(v.Content) != fmt.Sprintf("data%d", i+3) {
+			t.Errorf("Unexpected version %d: %+v", i, v)
+		}
+	}
+
+	if err := RollbackData(storage, testEmail, 1, 3, nil); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for pruned version, got %v", err)
+	}
+
+	if err := RollbackData(storage, testEmail, 4, 3, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data := &DataStore{Account: acc}
+	if err := storage.Get(data); err != nil || string(data.Content) != "data4" {
+		t.Fatalf("Expected data to be rolled back to version 4, got %q, %v", data.Content, err)
+	}
+
+	// The rollback should itself be recorded as a new version
+	versions, _ = ListDataVersions(storage, testEmail)
+	if last := versions[len(versions)-1]; len(versions) != 3 || last.Version != 6 || string(last.Content) != "data4" {
+		t.Errorf("Expected rollback to be recorded as version 6, got %+v", last)
+	}
+
+	// Renaming the account should carry over its versions...
+	if err := RenameAccount(storage, testEmail, "renamed@padlock.io"); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := ListDataVersions(storage, "renamed@padlock.io"); len(versions) != 3 {
+		t.Errorf("Expected versions to be moved to the new email, got %d", len(versions))
+	}
+
+	// ...and resetting its data should remove them
+	if err := ResetAccountData(storage, "renamed@padlock.io"); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := ListDataVersions(storage, "renamed@padlock.io"); len(versions) != 0 {
+		t.Errorf("Expected versions to be removed, got %d", len(versions))
+	}
+}
+
+func TestDataVersionsServer(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.server.Config.DataVersions = 2
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, content := range []string{"one", "two", "three"} {
+		res, err := ctx.request("PUT", ctx.host+"/store/", content, ApiVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusNoContent, "")
+	}
+
+	versions, err := ListDataVersions(ctx.storage, testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || string(versions[0].Content) != "two" || string(versions[1].Content) != "three" {
+		t.Errorf("Expected the last two writes to be kept, got %+v", versions)
+	}
+}
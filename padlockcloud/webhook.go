@@ -0,0 +1,299 @@
+package padlockcloud
+
+import "bytes"
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "log"
+import "net/http"
+import "net/url"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// Policies for handling webhook deliveries while the queue is full
+const (
+	// Drop the delivery and log it
+	WebhookOverflowDrop = "drop"
+	// Wait until there is room in the queue, slowing down the request triggering the event
+	WebhookOverflowBlock = "block"
+)
+
+// Defaults for the corresponding `WebhookConfig` fields
+const (
+	defaultWebhookConcurrency  = 2
+	defaultWebhookQueueSize    = 100
+	defaultWebhookTimeout      = 10 * time.Second
+	defaultWebhookMaxAttempts  = 3
+	defaultWebhookRetryBackoff = time.Second
+)
+
+var ErrWebhooksClosed = errors.New("padlock: webhooks closed")
+
+// Configuration for notifying external services of events via http callbacks
+type WebhookConfig struct {
+	// Urls to post events to. Webhooks are disabled if empty
+	URLs []string `yaml:"urls,omitempty"`
+	// Number of deliveries made concurrently. Defaults to `defaultWebhookConcurrency` if zero
+	Concurrency int `yaml:"concurrency"`
+	// Maximum number of deliveries waiting to be made. Defaults to `defaultWebhookQueueSize` if zero
+	QueueSize int `yaml:"queue_size"`
+	// What to do when the queue is full. One of `WebhookOverflowDrop` (the default) and
+	// `WebhookOverflowBlock`
+	OverflowPolicy string `yaml:"overflow_policy"`
+	// Time to wait for a receiver to answer a single attempt. Defaults to `defaultWebhookTimeout`
+	// if zero
+	Timeout time.Duration `yaml:"timeout"`
+	// How failed deliveries are retried. The number of attempts and the delay before the first
+	// retry default to `defaultWebhookMaxAttempts` and `defaultWebhookRetryBackoff` if zero
+	Retry BackoffPolicy `yaml:"retry"`
+	// Deprecated: use `Retry.MaxAttempts` instead. Moved there by `migrateDeprecated`
+	MaxAttempts int `yaml:"max_attempts,omitempty"`
+	// Deprecated: use `Retry.BaseDelay` instead. Moved there by `migrateDeprecated`
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"`
+}
+
+// Moves the settings of the deprecated `max_attempts` and `retry_backoff` options into `Retry`,
+// unless they are set there already. Returns a warning for each deprecated option in use
+func (c *WebhookConfig) migrateDeprecated() []string {
+	var warnings []string
+
+	if c.MaxAttempts != 0 {
+		if c.Retry.MaxAttempts == 0 {
+			c.Retry.MaxAttempts = c.MaxAttempts
+		}
+		c.MaxAttempts = 0
+		warnings = append(warnings, "webhooks.max_attempts is deprecated, use webhooks.retry.max_attempts instead")
+	}
+
+	if c.RetryBackoff != 0 {
+		if c.Retry.BaseDelay == 0 {
+			c.Retry.BaseDelay = c.RetryBackoff
+		}
+		c.RetryBackoff = 0
+		warnings = append(warnings, "webhooks.retry_backoff is deprecated, use webhooks.retry.base_delay instead")
+	}
+
+	return warnings
+}
+
+// Validates the config, returning an error describing the first invalid setting
+func (c *WebhookConfig) Validate() error {
+	for _, u := range c.URLs {
+		if parsed, err := url.Parse(u); err != nil || !parsed.IsAbs() || parsed.Host == "" {
+			return fmt.Errorf("padlock: invalid webhook url '%s'", u)
+		}
+	}
+
+	switch c.OverflowPolicy {
+	case "", WebhookOverflowDrop, WebhookOverflowBlock:
+	default:
+		return fmt.Errorf("padlock: webhook overflow policy must be '%s' or '%s', got '%s'", WebhookOverflowDrop, WebhookOverflowBlock, c.OverflowPolicy)
+	}
+
+	if c.Concurrency < 0 || c.QueueSize < 0 || c.Timeout < 0 {
+		return errors.New("padlock: webhook settings must not be negative")
+	}
+
+	return c.Retry.Validate()
+}
+
+// Payload posted to webhook receivers
+type WebhookEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Email   string    `json:"email,omitempty"`
+	Details string    `json:"details,omitempty"`
+}
+
+// Delivery counts as reported via the metrics endpoints
+type WebhookStats struct {
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"`
+	Queued    int   `json:"queued"`
+}
+
+type webhookJob struct {
+	url  string
+	body []byte
+}
+
+// Delivers events to the configured webhook urls. Deliveries are made by a fixed number of
+// workers from a bounded queue, so slow or unreachable receivers can't tie up the server
+type Webhooks struct {
+	Config *WebhookConfig
+	// Client used for deliveries. Defaults to `http.DefaultClient`
+	Client *http.Client
+	// Logger for dropped and failed deliveries. Nothing is logged if nil
+	Error *log.Logger
+
+	once    sync.Once
+	mutex   sync.RWMutex
+	queue   chan *webhookJob
+	ctx     context.Context
+	cancel  context.CancelFunc
+	closed  bool
+	workers sync.WaitGroup
+
+	delivered int64
+	failed    int64
+	dropped   int64
+}
+
+func (w *Webhooks) start() {
+	w.once.Do(func() {
+		n := w.Config.Concurrency
+		if n <= 0 {
+			n = defaultWebhookConcurrency
+		}
+		size := w.Config.QueueSize
+		if size <= 0 {
+			size = defaultWebhookQueueSize
+		}
+
+		w.queue = make(chan *webhookJob, size)
+		w.ctx, w.cancel = context.WithCancel(context.Background())
+		for i := 0; i < n; i++ {
+			w.workers.Add(1)
+			go func() {
+				defer w.workers.Done()
+				for job := range w.queue {
+					if err := w.deliver(job); err != nil {
+						atomic.AddInt64(&w.failed, 1)
+						w.logf("Failed to deliver webhook to %s: %v\n", job.url, err)
+					} else {
+						atomic.AddInt64(&w.delivered, 1)
+					}
+				}
+			}()
+		}
+	})
+}
+
+func (w *Webhooks) logf(format string, args ...interface{}) {
+	if w.Error != nil {
+		w.Error.Printf(format, args...)
+	}
+}
+
+// Posts a job to its receiver, retrying according to the configured policy until it succeeds or
+// the maximum number of attempts is reached. Retries are skipped once the webhooks are closed
+func (w *Webhooks) deliver(job *webhookJob) error {
+	policy := w.Config.Retry
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = defaultWebhookRetryBackoff
+	}
+
+	return Retry(w.ctx, &policy, func() error {
+		return w.attempt(job)
+	})
+}
+
+// Makes a single delivery attempt, failing if the receiver doesn't answer with a 2xx status
+// within the configured timeout
+func (w *Webhooks) attempt(job *webhookJob) error {
+	timeout := w.Config.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", job.url, bytes.NewReader(job.body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("receiver responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Queues the event for delivery to all configured urls without waiting for it to be delivered.
+// Depending on the overflow policy, deliveries are dropped or the call blocks while the queue is
+// full. Does nothing if `w` is nil
+func (w *Webhooks) Notify(event *WebhookEvent) error {
+	if w == nil || len(w.Config.URLs) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	w.start()
+
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	if w.closed {
+		return ErrWebhooksClosed
+	}
+
+	for _, u := range w.Config.URLs {
+		job := &webhookJob{u, body}
+		if w.Config.OverflowPolicy == WebhookOverflowBlock {
+			w.queue <- job
+			continue
+		}
+
+		select {
+		case w.queue <- job:
+		default:
+			atomic.AddInt64(&w.dropped, 1)
+			w.logf("Webhook queue is full, dropping %s event for %s\n", event.Event, u)
+		}
+	}
+
+	return nil
+}
+
+// Current delivery counts. Returns nil if `w` is nil
+func (w *Webhooks) Stats() *WebhookStats {
+	if w == nil {
+		return nil
+	}
+	return &WebhookStats{
+		Delivered: atomic.LoadInt64(&w.delivered),
+		Failed:    atomic.LoadInt64(&w.failed),
+		Dropped:   atomic.LoadInt64(&w.dropped),
+		Queued:    len(w.queue),
+	}
+}
+
+// Stops accepting new events and waits for queued deliveries to be attempted. Failed deliveries
+// are not retried anymore
+func (w *Webhooks) Close() error {
+	w.start()
+
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+		w.cancel()
+	}
+	w.mutex.Unlock()
+
+	w.workers.Wait()
+	return nil
+}
@@ -0,0 +1,162 @@
+package padlockcloud
+
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "runtime"
+import "sync"
+import "testing"
+import "time"
+import "gopkg.in/yaml.v2"
+
+func TestWebhooksDelivery(t *testing.T) {
+	var mutex sync.Mutex
+	var events []*WebhookEvent
+	attempts := 0
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		// Fail the first attempt so the delivery has to be retried
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		event := &WebhookEvent{}
+		if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+			t.Error(err)
+		}
+		events = append(events, event)
+	}))
+	defer receiver.Close()
+
+	webhooks := &Webhooks{Config: &WebhookConfig{
+		URLs:  []string{receiver.URL},
+		Retry: BackoffPolicy{BaseDelay: time.Millisecond},
+	}}
+
+	if err := webhooks.Notify(&WebhookEvent{Event: "account:create", Email: testEmail}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retries are skipped once closed, so wait for the delivery first
+	for i := 0; i < 100 && webhooks.Stats().Delivered == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	webhooks.Close()
+
+	if len(events) != 1 || events[0].Event != "account:create" || events[0].Email != testEmail {
+		t.Errorf("Expected account:create event for %s, got %+v", testEmail, events)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts)
+	}
+	if stats := webhooks.Stats(); stats.Delivered != 1 || stats.Failed != 0 || stats.Dropped != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	if err := webhooks.Notify(&WebhookEvent{Event: "account:delete"}); err != ErrWebhooksClosed {
+		t.Errorf("Expected %v, got %v", ErrWebhooksClosed, err)
+	}
+}
+
+func TestWebhooksHangingReceiver(t *testing.T) {
+	received := make(chan struct{}, 100)
+	release := make(chan struct{})
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer receiver.Close()
+
+	webhooks := &Webhooks{Config: &WebhookConfig{
+		URLs:        []string{receiver.URL},
+		Concurrency: 2,
+		QueueSize:   3,
+		Retry:       BackoffPolicy{MaxAttempts: 1},
+	}}
+
+	goroutines := runtime.NumGoroutine()
+
+	// Keep both workers busy with the hanging receiver
+	for i := 0; i < 2; i++ {
+		webhooks.Notify(&WebhookEvent{Event: "test"})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for deliveries")
+		}
+	}
+
+	// Only 3 of these fit into the queue, the rest should be dropped
+	for i := 0; i < 50; i++ {
+		if err := webhooks.Notify(&WebhookEvent{Event: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats := webhooks.Stats(); stats.Dropped != 47 || stats.Queued != 3 {
+		t.Errorf("Expected 47 dropped and 3 queued deliveries, got %+v", stats)
+	}
+
+	// A fixed number of workers plus the receiver's connections, regardless of the number of events
+	if n := runtime.NumGoroutine() - goroutines; n > 20 {
+		t.Errorf("Expected goroutines to be bounded, %d were started", n)
+	}
+
+	close(release)
+	webhooks.Close()
+
+	if stats := webhooks.Stats(); stats.Delivered != 5 || stats.Dropped != 47 {
+		t.Errorf("Expected 5 delivered and 47 dropped deliveries, got %+v", stats)
+	}
+}
+
+func TestWebhookConfigValidate(t *testing.T) {
+	for _, c := range []*WebhookConfig{
+		{URLs: []string{"not a url"}},
+		{URLs: []string{"/relative"}},
+		{OverflowPolicy: "ignore"},
+		{Concurrency: -1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", c)
+		}
+	}
+
+	c := &WebhookConfig{URLs: []string{"https://example.com/hook"}, OverflowPolicy: WebhookOverflowBlock}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebhookConfigMigrateDeprecated(t *testing.T) {
+	c := &WebhookConfig{}
+	if err := yaml.Unmarshal([]byte("max_attempts: 5\nretry_backoff: 2s\n"), c); err != nil {
+		t.Fatal(err)
+	}
+
+	if warnings := c.migrateDeprecated(); len(warnings) != 2 {
+		t.Errorf("Expected a warning for each deprecated option, got %v", warnings)
+	}
+	if c.Retry.MaxAttempts != 5 || c.Retry.BaseDelay != 2*time.Second || c.MaxAttempts != 0 || c.RetryBackoff != 0 {
+		t.Errorf("Expected deprecated options to be moved into the retry policy, got %+v", c)
+	}
+
+	// Options of the retry policy take precedence
+	c = &WebhookConfig{MaxAttempts: 5, Retry: BackoffPolicy{MaxAttempts: 2}}
+	c.migrateDeprecated()
+	if c.Retry.MaxAttempts != 2 {
+		t.Errorf("Expected retry policy to be kept, got %+v", c.Retry)
+	}
+
+	if warnings := c.migrateDeprecated(); len(warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", warnings)
+	}
+}